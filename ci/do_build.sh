@@ -24,6 +24,7 @@ cd $GOPATH/src/github.com/venicegeo/pz-logger
 # run unit tests w/ coverage collection
 go test -v -coverprofile=$root/logger.cov -coverpkg github.com/venicegeo/pz-logger/logger github.com/venicegeo/pz-logger/logger
 go tool cover -func=$root/logger.cov -o $root/logger.cov.txt
+go test -v github.com/venicegeo/pz-logger/schema
 
 # lint
 # sh ci/metalinter.sh | tee $root/lint.txt
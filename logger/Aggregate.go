@@ -0,0 +1,561 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// MaxAggregateTerms is the most distinct values GET /syslog/aggregate
+// returns for a single groupBy field, taking the most common. With more
+// fields, each gets fewer, so that there are still at most this many
+// combinations in each interval.
+const MaxAggregateTerms = 1000
+
+// MaxAggregateGroupBy is the most groupBy fields GET /syslog/aggregate
+// takes at once.
+const MaxAggregateGroupBy = 3
+
+// AggregateBucket is one group of messages: those in the same interval,
+// if there is one, with the same values of the groupBy fields.
+type AggregateBucket struct {
+	Time   *time.Time             `json:"time,omitempty"`
+	Key    map[string]interface{} `json:"key,omitempty"`
+	Count  int                    `json:"count"`
+	Metric *MetricStats           `json:"metric,omitempty"`
+}
+
+// MetricStats summarizes the values of a numeric field over a bucket.
+// Percentiles are keyed by the percent asked for, e.g. "99.9".
+type MetricStats struct {
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Avg         float64            `json:"avg"`
+	Sum         float64            `json:"sum"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// AggregateResult is what GET /syslog/aggregate returns. Buckets are in
+// time order, and then with the largest first. Empty buckets are left out.
+type AggregateResult struct {
+	GroupBy  []string          `json:"groupBy,omitempty"`
+	Interval string            `json:"interval,omitempty"`
+	Count    int               `json:"count"` // number of messages matched
+	Buckets  []AggregateBucket `json:"buckets"`
+}
+
+//---------------------------------------------------------------------------
+
+// aggregateInterval is a date_histogram interval: either a calendar unit
+// or a fixed length of time.
+type aggregateInterval struct {
+	name     string
+	calendar string
+	fixed    time.Duration
+}
+
+var aggregateIntervalRegexp = regexp.MustCompile(`^([1-9][0-9]*)([mhd])$`)
+
+// parseAggregateInterval accepts minute, hour, day, week, month and year,
+// or a number of minutes, hours or days such as 15m, 6h or 2d.
+func parseAggregateInterval(s string) (*aggregateInterval, error) {
+	switch s {
+	case "minute", "hour", "day", "week", "month", "year":
+		return &aggregateInterval{name: s, calendar: s}, nil
+	}
+
+	match := aggregateIntervalRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("interval must be minute, hour, day, week, month, year, or a number followed by m, h or d, not %q", s)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+	unit := map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[match[2]]
+	return &aggregateInterval{name: s, fixed: time.Duration(n) * unit}, nil
+}
+
+// start returns the start of the interval t is in, as ES works it out:
+// in UTC, with weeks starting on Monday and fixed intervals counted from
+// the epoch.
+func (interval *aggregateInterval) start(t time.Time) time.Time {
+	t = t.UTC()
+	y, m, d := t.Date()
+
+	switch interval.calendar {
+	case "minute":
+		return t.Truncate(time.Minute)
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case "week":
+		back := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-back, 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	ms := t.UnixNano() / int64(time.Millisecond)
+	size := int64(interval.fixed / time.Millisecond)
+	ms -= ((ms % size) + size) % size
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+type aggregateSpec struct {
+	groupBy  []string
+	interval *aggregateInterval
+
+	// the values of groupBy fields that a message lacks; without one, such
+	// messages are left out
+	missing map[string]interface{}
+
+	// if set, each bucket also gets the MetricStats of this field
+	metricField string
+	percentiles []float64
+
+	// the most values of each groupBy field to return; if 0, it is
+	// aggregateTermsSize of the number of fields
+	termsSize int
+}
+
+// aggregateTermsSize is the most values of each of n nested groupBy
+// fields to ask for: the largest size whose nth power is within
+// MaxAggregateTerms.
+func aggregateTermsSize(n int) int {
+	size := MaxAggregateTerms
+	for n > 1 && size > 1 && math.Pow(float64(size), float64(n)) > MaxAggregateTerms {
+		size--
+	}
+	return size
+}
+
+func percentileKey(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', -1, 64)
+}
+
+//---------------------------------------------------------------------------
+
+// aggregator counts the messages matching a query, grouped as the spec
+// says.
+type aggregator interface {
+	Aggregate(typ string, query interface{}, spec *aggregateSpec) (*AggregateResult, error)
+}
+
+func newAggregator(sys *piazza.SystemConfig, esi elasticsearch.IIndex) (aggregator, error) {
+	if _, ok := esi.(*elasticsearch.Index); !ok {
+		return &searchAggregator{esi: esi}, nil
+	}
+
+	client, err := newElasticClient(sys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticAggregator{client: client, index: esi.IndexName()}, nil
+}
+
+// elasticAggregator uses a date_histogram aggregation, if there is an
+// interval, with a terms aggregation for each groupBy field inside it.
+type elasticAggregator struct {
+	client *elastic.Client
+	index  string
+}
+
+func aggregateTermsName(i int) string {
+	return "groupBy" + strconv.Itoa(i)
+}
+
+func (ag *elasticAggregator) Aggregate(typ string, query interface{}, spec *aggregateSpec) (*AggregateResult, error) {
+	var aggs map[string]interface{}
+	if spec.metricField != "" {
+		aggs = map[string]interface{}{
+			"stats": map[string]interface{}{
+				"stats": map[string]interface{}{"field": spec.metricField},
+			},
+		}
+		if len(spec.percentiles) > 0 {
+			aggs["percentiles"] = map[string]interface{}{
+				"percentiles": map[string]interface{}{
+					"field":    spec.metricField,
+					"percents": spec.percentiles,
+				},
+			}
+		}
+	}
+	size := spec.termsSize
+	if size == 0 {
+		size = aggregateTermsSize(len(spec.groupBy))
+	}
+	for i := len(spec.groupBy) - 1; i >= 0; i-- {
+		terms := map[string]interface{}{
+			"field": spec.groupBy[i],
+			"size":  size,
+		}
+		if missing, ok := spec.missing[spec.groupBy[i]]; ok {
+			terms["missing"] = missing
+		}
+		agg := map[string]interface{}{"terms": terms}
+		if aggs != nil {
+			agg["aggs"] = aggs
+		}
+		aggs = map[string]interface{}{aggregateTermsName(i): agg}
+	}
+	if spec.interval != nil {
+		agg := map[string]interface{}{
+			"date_histogram": map[string]interface{}{
+				"field":         "timeStamp",
+				"interval":      spec.interval.name,
+				"min_doc_count": 1,
+			},
+		}
+		if aggs != nil {
+			agg["aggs"] = aggs
+		}
+		aggs = map[string]interface{}{"time": agg}
+	}
+
+	dsl := map[string]interface{}{
+		"query": query,
+		"size":  0,
+		"aggs":  aggs,
+	}
+
+	searchResult, err := ag.client.Search().Index(ag.index).Type(typ).Source(dsl).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AggregateResult{Buckets: []AggregateBucket{}}
+	if searchResult.Hits != nil {
+		result.Count = int(searchResult.Hits.TotalHits)
+	}
+
+	bucket := AggregateBucket{Key: map[string]interface{}{}}
+	if spec.interval != nil {
+		histogram, ok := searchResult.Aggregations.DateHistogram("time")
+		if !ok {
+			return nil, errors.New("response has no date_histogram")
+		}
+		for _, item := range histogram.Buckets {
+			t := time.Unix(0, item.Key*int64(time.Millisecond)).UTC()
+			bucket.Time = &t
+			if err = ag.addTerms(result, spec, item.Aggregations, 0, bucket, item.DocCount); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		err = ag.addTerms(result, spec, searchResult.Aggregations, 0, bucket, int64(result.Count))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// addTerms adds the buckets under the terms aggregation for groupBy[i],
+// or the bucket itself once there are no more.
+func (ag *elasticAggregator) addTerms(result *AggregateResult, spec *aggregateSpec,
+	aggs elastic.Aggregations, i int, bucket AggregateBucket, count int64) error {
+
+	if i == len(spec.groupBy) {
+		key := map[string]interface{}{}
+		for k, v := range bucket.Key {
+			key[k] = v
+		}
+		bucket.Key = key
+		bucket.Count = int(count)
+		if spec.metricField != "" {
+			metric, err := ag.getMetricStats(spec, aggs)
+			if err != nil {
+				return err
+			}
+			bucket.Metric = metric
+		}
+		result.Buckets = append(result.Buckets, bucket)
+		return nil
+	}
+
+	terms, ok := aggs.Terms(aggregateTermsName(i))
+	if !ok {
+		return fmt.Errorf("response has no terms for %s", spec.groupBy[i])
+	}
+	for _, item := range terms.Buckets {
+		bucket.Key[spec.groupBy[i]] = item.Key
+		if err := ag.addTerms(result, spec, item.Aggregations, i+1, bucket, item.DocCount); err != nil {
+			return err
+		}
+	}
+	delete(bucket.Key, spec.groupBy[i])
+	return nil
+}
+
+// getMetricStats reads the stats and percentiles aggregations, returning
+// nil if the bucket had no values.
+func (ag *elasticAggregator) getMetricStats(spec *aggregateSpec, aggs elastic.Aggregations) (*MetricStats, error) {
+	stats, ok := aggs.Stats("stats")
+	if !ok {
+		return nil, errors.New("response has no stats")
+	}
+	if stats.Count == 0 || stats.Min == nil || stats.Max == nil || stats.Avg == nil || stats.Sum == nil {
+		return nil, nil
+	}
+	metric := &MetricStats{Min: *stats.Min, Max: *stats.Max, Avg: *stats.Avg, Sum: *stats.Sum}
+
+	if len(spec.percentiles) > 0 {
+		percentiles, ok := aggs.Percentiles("percentiles")
+		if !ok {
+			return nil, errors.New("response has no percentiles")
+		}
+		metric.Percentiles = map[string]float64{}
+		for key, value := range percentiles.Values {
+			percent, err := strconv.ParseFloat(key, 64)
+			if err != nil {
+				return nil, err
+			}
+			metric.Percentiles[percentileKey(percent)] = value
+		}
+	}
+
+	return metric, nil
+}
+
+// searchAggregator fetches every matching message and counts them itself.
+// It is used when the index is not a live Elasticsearch index, e.g. under
+// mocking.
+type searchAggregator struct {
+	esi elasticsearch.IIndex
+}
+
+func (ag *searchAggregator) Aggregate(typ string, query interface{}, spec *aggregateSpec) (*AggregateResult, error) {
+	byts, err := json.Marshal(map[string]interface{}{"query": query, "size": math.MaxInt32})
+	if err != nil {
+		return nil, err
+	}
+	searchResult, err := ag.esi.SearchByJSON(typ, string(byts))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AggregateResult{Buckets: []AggregateBucket{}}
+	index := map[string]int{}
+	values := [][]float64{} // of the metric field, by bucket
+
+	for _, hit := range *searchResult.GetHits() {
+		fields := map[string]interface{}{}
+		if hit.Source == nil {
+			continue
+		}
+		if err = json.Unmarshal(*hit.Source, &fields); err != nil {
+			return nil, err
+		}
+		result.Count++
+
+		bucket := AggregateBucket{Key: map[string]interface{}{}}
+		if spec.interval != nil {
+			s, _ := fields["timeStamp"].(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				continue
+			}
+			t = spec.interval.start(t)
+			bucket.Time = &t
+		}
+		missing := false
+		for _, field := range spec.groupBy {
+			value := lookupMemoryField(fields, field)
+			if value == nil {
+				value = spec.missing[field]
+			}
+			if value == nil {
+				missing = true
+				break
+			}
+			bucket.Key[field] = value
+		}
+		if missing {
+			continue
+		}
+
+		id, err := json.Marshal(bucket)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[string(id)]
+		if !ok {
+			i = len(result.Buckets)
+			index[string(id)] = i
+			result.Buckets = append(result.Buckets, bucket)
+			values = append(values, []float64{})
+		}
+		result.Buckets[i].Count++
+
+		if spec.metricField != "" {
+			if value, ok := lookupMemoryField(fields, spec.metricField).(float64); ok {
+				values[i] = append(values[i], value)
+			}
+		}
+	}
+
+	if spec.metricField != "" {
+		for i := range result.Buckets {
+			result.Buckets[i].Metric = computeMetricStats(values[i], spec.percentiles)
+		}
+	}
+
+	return result, nil
+}
+
+// computeMetricStats works out percentiles by interpolating between the
+// nearest values. ES estimates them, so the two may differ a little.
+func computeMetricStats(values []float64, percentiles []float64) *MetricStats {
+	if len(values) == 0 {
+		return nil
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	metric := &MetricStats{Min: sorted[0], Max: sorted[len(sorted)-1]}
+	for _, value := range sorted {
+		metric.Sum += value
+	}
+	metric.Avg = metric.Sum / float64(len(sorted))
+
+	if len(percentiles) > 0 {
+		metric.Percentiles = map[string]float64{}
+		for _, percent := range percentiles {
+			rank := percent / 100 * float64(len(sorted)-1)
+			lo := int(math.Floor(rank))
+			hi := int(math.Ceil(rank))
+			value := sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+			metric.Percentiles[percentileKey(percent)] = value
+		}
+	}
+
+	return metric
+}
+
+// sortAggregateBuckets puts buckets in time order, then largest first, then
+// in order of their keys.
+func sortAggregateBuckets(buckets []AggregateBucket) {
+	keyString := func(b AggregateBucket) string {
+		byts, _ := json.Marshal(b.Key)
+		return string(byts)
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if a.Time != nil && b.Time != nil && !a.Time.Equal(*b.Time) {
+			return a.Time.Before(*b.Time)
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return keyString(a) < keyString(b)
+	})
+}
+
+//---------------------------------------------------------------------------
+
+// isAggregateGroupByField says whether GET /syslog/aggregate can group by
+// a field: any field of LogData but the free text and the times.
+func isAggregateGroupByField(field string) bool {
+	typ, ok := queryFields[field]
+	return ok && typ != queryFieldDate && field != "message"
+}
+
+// Aggregate takes the filters of GET /syslog, plus groupBy, a list of
+// fields, and interval. At least one of those two is needed.
+func (service *Service) Aggregate(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	groupBy, err := getListParam(params, "groupBy")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if len(groupBy) > MaxAggregateGroupBy {
+		return service.newBadRequestResponse(fmt.Errorf("cannot group by more than %d fields", MaxAggregateGroupBy))
+	}
+	for _, field := range groupBy {
+		if !isAggregateGroupByField(field) {
+			return service.newBadRequestResponse(fmt.Errorf("cannot group by %q", field))
+		}
+	}
+
+	spec := &aggregateSpec{groupBy: groupBy}
+
+	interval, err := params.GetAsString("interval", "")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if interval != "" {
+		if spec.interval, err = parseAggregateInterval(interval); err != nil {
+			return service.newBadRequestResponse(err)
+		}
+	}
+
+	if len(spec.groupBy) == 0 && spec.interval == nil {
+		return service.newBadRequestResponse(errors.New("groupBy or interval is required"))
+	}
+
+	pagination := &piazza.JsonPagination{SortBy: "timeStamp", Order: piazza.SortOrderAscending}
+	dsl, err := createQueryDslAsString(pagination, params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	var query interface{} = map[string]interface{}{"match_all": map[string]interface{}{}}
+	if dsl != "" {
+		obj := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(dsl), &obj); err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		query = obj["query"]
+	}
+
+	result, err := service.aggregator.Aggregate(pzsyslog.LoggerType, query, spec)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	result.GroupBy = spec.groupBy
+	result.Interval = interval
+	sortAggregateBuckets(result.Buckets)
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       result,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
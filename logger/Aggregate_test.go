@@ -0,0 +1,204 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+func TestAggregateInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	// a Wednesday
+	when := time.Date(2016, time.July, 27, 13, 47, 12, 0, time.UTC)
+
+	for s, expected := range map[string]time.Time{
+		"minute": time.Date(2016, time.July, 27, 13, 47, 0, 0, time.UTC),
+		"hour":   time.Date(2016, time.July, 27, 13, 0, 0, 0, time.UTC),
+		"day":    time.Date(2016, time.July, 27, 0, 0, 0, 0, time.UTC),
+		"week":   time.Date(2016, time.July, 25, 0, 0, 0, 0, time.UTC),
+		"month":  time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC),
+		"year":   time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC),
+		"15m":    time.Date(2016, time.July, 27, 13, 45, 0, 0, time.UTC),
+		"5h":     time.Date(2016, time.July, 27, 9, 0, 0, 0, time.UTC),
+	} {
+		interval, err := parseAggregateInterval(s)
+		if assert.NoError(err, s) {
+			assert.Equal(expected, interval.start(when), s)
+		}
+	}
+
+	for _, s := range []string{"", "fortnight", "0h", "1s", "h"} {
+		_, err := parseAggregateInterval(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := newMemoryIndexForTest(assert)
+	service := &Service{esIndex: esi, aggregator: &searchAggregator{esi: esi}}
+
+	aggregate := func(query string) *AggregateResult {
+		request, err := http.NewRequest("GET", "/syslog/aggregate?"+query, nil)
+		assert.NoError(err)
+		resp := service.Aggregate(newQueryParams(request))
+		if !assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		assert.Equal("logaggregate", resp.Type)
+		return resp.Data.(*AggregateResult)
+	}
+
+	result := aggregate("groupBy=application")
+	assert.Equal(4, result.Count)
+	if assert.Len(result.Buckets, 3) {
+		assert.Equal(map[string]interface{}{"application": "pz-workflow"}, result.Buckets[0].Key)
+		assert.Equal(2, result.Buckets[0].Count)
+		assert.Equal(map[string]interface{}{"application": "pz-gateway"}, result.Buckets[1].Key)
+	}
+
+	// messages without an auditData.action aren't in any bucket
+	result = aggregate("groupBy=application,auditData.action&interval=2m")
+	assert.Equal(4, result.Count)
+	if assert.Len(result.Buckets, 1) {
+		assert.Equal(time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC), *result.Buckets[0].Time)
+		assert.Equal("login", result.Buckets[0].Key["auditData.action"])
+	}
+
+	result = aggregate("interval=2m&maxSeverity=4")
+	assert.Equal(2, result.Count)
+	if assert.Len(result.Buckets, 1) {
+		assert.Equal(2, result.Buckets[0].Count)
+		assert.Empty(result.Buckets[0].Key)
+	}
+
+	for _, query := range []string{"", "groupBy=message", "groupBy=colour", "interval=fortnight",
+		"groupBy=severity,application,hostName,process"} {
+		request, err := http.NewRequest("GET", "/syslog/aggregate?"+query, nil)
+		assert.NoError(err)
+		resp := service.Aggregate(newQueryParams(request))
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+// newFakeElasticAggregator answers every search with the given response,
+// keeping the last request.
+func newFakeElasticAggregator(assert *assert.Assertions, response string, request *map[string]interface{}) (*elasticAggregator, func()) {
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_search") {
+			byts, err := ioutil.ReadAll(r.Body)
+			assert.NoError(err)
+			assert.NoError(json.Unmarshal(byts, request))
+			_, err = w.Write([]byte(response))
+			assert.NoError(err)
+			return
+		}
+		_, err := w.Write([]byte(`{}`))
+		assert.NoError(err)
+	}))
+
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false))
+	assert.NoError(err)
+	return &elasticAggregator{client: client, index: "pzlogger"}, es.Close
+}
+
+func TestElasticAggregator(t *testing.T) {
+	assert := assert.New(t)
+
+	var request map[string]interface{}
+	ag, closer := newFakeElasticAggregator(assert, `{
+		"hits": {"total": 5, "hits": []},
+		"aggregations": {"time": {"buckets": [
+			{"key": 1469494800000, "doc_count": 5, "groupBy0": {"buckets": [
+				{"key": 3, "doc_count": 4},
+				{"key": 6, "doc_count": 1}
+			]}}
+		]}}
+	}`, &request)
+	defer closer()
+
+	interval, err := parseAggregateInterval("hour")
+	assert.NoError(err)
+	result, err := ag.Aggregate(pzsyslog.LoggerType, map[string]interface{}{"match_all": map[string]interface{}{}},
+		&aggregateSpec{groupBy: []string{"severity"}, interval: interval})
+	if !assert.NoError(err) {
+		return
+	}
+
+	byts, err := json.Marshal(request["aggs"])
+	assert.NoError(err)
+	assert.JSONEq(`{"time":{
+		"date_histogram":{"field":"timeStamp","interval":"hour","min_doc_count":1},
+		"aggs":{"groupBy0":{"terms":{"field":"severity","size":1000}}}
+	}}`, string(byts))
+
+	assert.Equal(5, result.Count)
+	if assert.Len(result.Buckets, 2) {
+		assert.Equal(time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC), *result.Buckets[0].Time)
+		assert.EqualValues(3, result.Buckets[0].Key["severity"])
+		assert.Equal(4, result.Buckets[0].Count)
+	}
+}
+
+func TestElasticAggregatorNested(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(1000, aggregateTermsSize(1))
+	assert.Equal(31, aggregateTermsSize(2))
+	assert.Equal(10, aggregateTermsSize(3))
+
+	var request map[string]interface{}
+	ag, closer := newFakeElasticAggregator(assert, `{
+		"hits": {"total": 3, "hits": []},
+		"aggregations": {"groupBy0": {"buckets": [
+			{"key": "pz-gateway", "doc_count": 3, "groupBy1": {"buckets": [
+				{"key": 3, "doc_count": 2},
+				{"key": 6, "doc_count": 1}
+			]}}
+		]}}
+	}`, &request)
+	defer closer()
+
+	result, err := ag.Aggregate(pzsyslog.LoggerType, map[string]interface{}{"match_all": map[string]interface{}{}},
+		&aggregateSpec{groupBy: []string{"application", "severity"}})
+	if !assert.NoError(err) {
+		return
+	}
+
+	byts, err := json.Marshal(request["aggs"])
+	assert.NoError(err)
+	assert.JSONEq(`{"groupBy0":{
+		"terms":{"field":"application","size":31},
+		"aggs":{"groupBy1":{"terms":{"field":"severity","size":31}}}
+	}}`, string(byts))
+
+	if assert.Len(result.Buckets, 2) {
+		assert.Equal("pz-gateway", result.Buckets[0].Key["application"])
+		assert.EqualValues(3, result.Buckets[0].Key["severity"])
+		assert.Equal(2, result.Buckets[0].Count)
+	}
+}
@@ -0,0 +1,934 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+const (
+	// AlertRuleType and AlertEventType are the types, in an index of their
+	// own (see Kit.AlertIndex), that alert rules and the events they raise
+	// are kept in.
+	AlertRuleType  = "AlertRule"
+	AlertEventType = "AlertEvent"
+
+	// AlertLeaseType is where the instances take turns at raising the
+	// rate events.
+	AlertLeaseType = "AlertLease"
+
+	// MaxAlertRules is the most rules there may be.
+	MaxAlertRules = 1000
+
+	// AlertEventQueueSize is how many events may wait to be stored. Past
+	// that, events are dropped, and logged.
+	AlertEventQueueSize = 10000
+
+	// AlertEventBatchSize is the most events stored in one bulk request.
+	AlertEventBatchSize = 500
+
+	// DefaultAlertRuleReloadInterval is how often the rules, and the
+	// notification channels, are read back from the index, to pick up
+	// changes made through other instances.
+	DefaultAlertRuleReloadInterval = 30 * time.Second
+
+	// alertRuleChangeSlack is how long a rule, or channel, changed through
+	// this instance is kept as it is, whatever a reload finds, since the
+	// index may not be showing the change yet.
+	alertRuleChangeSlack = 30 * time.Second
+)
+
+var (
+	errAlertEventQueueFull = errors.New("alert event queue is full")
+	errAlertEngineClosed   = errors.New("alert engine is closed")
+)
+
+const alertRuleMapping = `{
+	"AlertRule": {
+		"dynamic": "strict",
+		"properties": {
+			"id":        {"type": "string", "index": "not_analyzed"},
+			"name":      {"type": "string", "index": "not_analyzed"},
+			"query":     {"type": "string", "index": "not_analyzed"},
+			"disabled":  {"type": "boolean"},
+			"channels":  {"type": "string", "index": "not_analyzed"},
+			"throttle":  {"type": "string", "index": "not_analyzed"},
+			"rate":      {"type": "object", "enabled": false},
+			"tenant":    {"type": "string", "index": "not_analyzed"},
+			"createdOn": {"type": "date"}
+		}
+	}
+}`
+
+const alertEventMapping = `{
+	"AlertEvent": {
+		"dynamic": "strict",
+		"properties": {
+			"id":        {"type": "string", "index": "not_analyzed"},
+			"ruleId":    {"type": "string", "index": "not_analyzed"},
+			"ruleName":  {"type": "string", "index": "not_analyzed"},
+			"tenant":    {"type": "string", "index": "not_analyzed"},
+			"timeStamp": {"type": "date"},
+			"message":   {"type": "object", "enabled": false},
+			"rate":      {"type": "object", "enabled": false}
+		}
+	}
+}`
+
+const alertLeaseMapping = `{
+	"AlertLease": {
+		"dynamic": "strict",
+		"properties": {
+			"holder": {"type": "string", "index": "not_analyzed"},
+			"start":  {"type": "date"}
+		}
+	}
+}`
+
+// AlertRule raises an AlertEvent for each accepted message that matches
+// its query, which is in the language of GET /syslog?q=, or, if it has a
+// Rate instead, each time the rate of messages trips it. A rule with a
+// tenant sees only that tenant's messages.
+type AlertRule struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Query     string           `json:"query"`
+	Disabled  bool             `json:"disabled,omitempty"`
+	Tenant    string           `json:"tenant,omitempty"`
+	CreatedOn piazza.TimeStamp `json:"createdOn"`
+
+	// the notification channels told of its matches, and, if set, the
+	// least time between notifications, such as "10m"; matches in between
+	// are summarized in the next one
+	Channels []string `json:"channels,omitempty"`
+	Throttle string   `json:"throttle,omitempty"`
+
+	Rate *RateCondition `json:"rate,omitempty"`
+}
+
+// throttle returns the rule's Throttle, which has been checked.
+func (rule *AlertRule) throttle() time.Duration {
+	d, _ := time.ParseDuration(rule.Throttle)
+	return d
+}
+
+// AlertEvent is a message that matched a rule, or why a rate rule
+// tripped, and when.
+type AlertEvent struct {
+	ID        string            `json:"id"`
+	RuleID    string            `json:"ruleId"`
+	RuleName  string            `json:"ruleName"`
+	Tenant    string            `json:"tenant,omitempty"`
+	TimeStamp piazza.TimeStamp  `json:"timeStamp"`
+	Message   *pzsyslog.Message `json:"message,omitempty"`
+	Rate      *RateTrip         `json:"rate,omitempty"`
+}
+
+// alertRuleError is what is wrong with a rule that can't be saved.
+type alertRuleError struct {
+	problem string
+}
+
+func (e *alertRuleError) Error() string {
+	return e.problem
+}
+
+// alertMatcher is a rule with its query, or rate condition, parsed.
+type alertMatcher struct {
+	rule  *AlertRule
+	query map[string]interface{}
+
+	rate    *rateMatcher
+	tripped bool // when the rate was last checked
+}
+
+// sees says whether a rule, or a caller, with the one tenant may see
+// things of the other. Those without a tenant see everything.
+func sees(tenant string, other string) bool {
+	return tenant == "" || tenant == other
+}
+
+//---------------------------------------------------------------------------
+
+// AlertEngine matches accepted messages against the alert rules, in
+// process, as GET /syslog/stream does, and raises an event for each match.
+// The rules are kept in the index and, so that matching costs no round
+// trip, in memory: they are read from the index when the engine is made,
+// and again every so often, for the changes made through other instances.
+// Events are queued, and stored in bulk, off the request path.
+type AlertEngine struct {
+	sync.RWMutex
+	esi      elasticsearch.IIndex
+	matchers map[string]*alertMatcher
+
+	// the rules changed through this engine lately, by ID, nil if deleted,
+	// which a reload leaves alone
+	changes map[string]alertRuleChange
+
+	// if set, called with each event, and the rule that raised it, once
+	// the event is stored
+	onEvent func(AlertRule, *AlertEvent)
+
+	// held for reading while sending to the queue, and for writing to
+	// close it
+	eventsLock   sync.RWMutex
+	events       chan *queuedAlertEvent
+	eventsClosed bool
+	eventsDone   chan struct{} // closed once the queue is written out
+	indexer      bulkIndexer
+
+	// closed to stop checking the rate rules, and reloading the rules
+	stopRates   chan struct{}
+	stopReloads chan struct{}
+
+	// the rate lease this engine last asked for, and whether it got it
+	instance  string
+	leaseLock sync.Mutex
+	leaseSlot int64
+	leaseHeld bool
+
+	now func() time.Time
+}
+
+type alertRuleChange struct {
+	matcher *alertMatcher
+	at      time.Time
+}
+
+// queuedAlertEvent is an event waiting to be stored, or, if flushed is
+// set, a request to be told when everything before it has been.
+type queuedAlertEvent struct {
+	rule    AlertRule
+	event   *AlertEvent
+	flushed chan struct{}
+}
+
+// NewAlertEngine makes sure the index has the alert types, reads the
+// rules, and starts storing events, with the indexer if it isn't nil.
+func NewAlertEngine(esi elasticsearch.IIndex, indexer bulkIndexer) (*AlertEngine, error) {
+	for typ, mapping := range map[string]string{
+		AlertRuleType:  alertRuleMapping,
+		AlertEventType: alertEventMapping,
+		AlertLeaseType: alertLeaseMapping,
+	} {
+		ok, err := esi.TypeExists(typ)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err = esi.SetMapping(typ, piazza.JsonString(mapping)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if indexer == nil {
+		indexer = &postDataBulkIndexer{esi: esi}
+	}
+	engine := &AlertEngine{
+		esi:        esi,
+		changes:    map[string]alertRuleChange{},
+		events:     make(chan *queuedAlertEvent, AlertEventQueueSize),
+		eventsDone: make(chan struct{}),
+		indexer:    indexer,
+		instance:   piazza.NewUuid().String(),
+		now:        time.Now,
+	}
+
+	var err error
+	if engine.matchers, err = engine.readRules(); err != nil {
+		return nil, err
+	}
+
+	go engine.writeEvents()
+
+	return engine, nil
+}
+
+// readRules reads the rules from the index. A rule that is the same as
+// the one in memory keeps its matcher, and so the state of its rate.
+func (engine *AlertEngine) readRules() (map[string]*alertMatcher, error) {
+	dsl := fmt.Sprintf(`{"query":{"match_all":{}},"size":%d}`, MaxAlertRules)
+	searchResult, err := engine.esi.SearchByJSON(AlertRuleType, dsl)
+	if err != nil {
+		return nil, err
+	}
+
+	engine.RLock()
+	old := engine.matchers
+	engine.RUnlock()
+
+	matchers := map[string]*alertMatcher{}
+	for _, hit := range *searchResult.GetHits() {
+		if hit.Source == nil {
+			continue
+		}
+		rule := &AlertRule{}
+		if err = json.Unmarshal(*hit.Source, rule); err != nil {
+			return nil, err
+		}
+		if matcher, ok := old[rule.ID]; ok && reflect.DeepEqual(matcher.rule, rule) {
+			matchers[rule.ID] = matcher
+			continue
+		}
+		matcher, err := newAlertMatcher(rule)
+		if err != nil {
+			// saved by an older version, perhaps; keep it, so it can be fixed
+			log.Printf("alert rule %s: %s", rule.ID, err.Error())
+			matcher = &alertMatcher{rule: rule}
+		}
+		matchers[rule.ID] = matcher
+	}
+	return matchers, nil
+}
+
+// ReloadRules reads the rules back from the index, except for those changed
+// through this engine lately.
+func (engine *AlertEngine) ReloadRules() error {
+	matchers, err := engine.readRules()
+	if err != nil {
+		return err
+	}
+
+	engine.Lock()
+	defer engine.Unlock()
+
+	now := engine.now()
+	for id, change := range engine.changes {
+		if now.Sub(change.at) > alertRuleChangeSlack {
+			delete(engine.changes, id)
+			continue
+		}
+		if change.matcher == nil {
+			delete(matchers, id)
+		} else {
+			matchers[id] = change.matcher
+		}
+	}
+	engine.matchers = matchers
+	return nil
+}
+
+// startRuleReloads reloads the rules every interval until stopRuleReloads.
+func (engine *AlertEngine) startRuleReloads(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultAlertRuleReloadInterval
+	}
+
+	engine.Lock()
+	defer engine.Unlock()
+	if engine.stopReloads != nil {
+		return
+	}
+	stop := make(chan struct{})
+	engine.stopReloads = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := engine.ReloadRules(); err != nil {
+					log.Printf("Unable to reload alert rules: %s", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (engine *AlertEngine) stopRuleReloads() {
+	engine.Lock()
+	defer engine.Unlock()
+	if engine.stopReloads != nil {
+		close(engine.stopReloads)
+		engine.stopReloads = nil
+	}
+}
+
+func newAlertMatcher(rule *AlertRule) (*alertMatcher, error) {
+	if rule.Name == "" {
+		return nil, &alertRuleError{"alert rule has no name"}
+	}
+	if rule.Throttle != "" {
+		if d, err := time.ParseDuration(rule.Throttle); err != nil || d < 0 {
+			return nil, &alertRuleError{fmt.Sprintf("throttle %q is not a duration such as 10m", rule.Throttle)}
+		}
+	}
+
+	if rule.Rate != nil {
+		if rule.Query != "" {
+			return nil, &alertRuleError{"alert rule may not have both a query and a rate"}
+		}
+		rate, err := newRateMatcher(rule.Rate)
+		if err != nil {
+			return nil, err
+		}
+		return &alertMatcher{rule: rule, rate: rate}, nil
+	}
+
+	if rule.Query == "" {
+		return nil, &alertRuleError{"alert rule has no query"}
+	}
+	query, err := ParseQuery(rule.Query)
+	if err != nil {
+		return nil, &alertRuleError{err.Error()}
+	}
+	return &alertMatcher{rule: rule, query: query}, nil
+}
+
+// Rules returns the rules the tenant may see, oldest first.
+func (engine *AlertEngine) Rules(tenant string) []AlertRule {
+	engine.RLock()
+	defer engine.RUnlock()
+
+	rules := []AlertRule{}
+	for _, matcher := range engine.matchers {
+		if sees(tenant, matcher.rule.Tenant) {
+			rules = append(rules, *matcher.rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		ti, tj := time.Time(rules[i].CreatedOn), time.Time(rules[j].CreatedOn)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// Rule returns the rule, or nil if there is none the tenant may see.
+func (engine *AlertEngine) Rule(id string, tenant string) *AlertRule {
+	engine.RLock()
+	defer engine.RUnlock()
+
+	matcher, ok := engine.matchers[id]
+	if !ok || !sees(tenant, matcher.rule.Tenant) {
+		return nil
+	}
+	rule := *matcher.rule
+	return &rule
+}
+
+// Put stores a new or changed rule. A new rule, one without an ID, is
+// given one.
+func (engine *AlertEngine) Put(rule *AlertRule) error {
+	engine.Lock()
+	defer engine.Unlock()
+
+	if rule.ID == "" {
+		if len(engine.matchers) >= MaxAlertRules {
+			return &alertRuleError{fmt.Sprintf("there may be at most %d alert rules", MaxAlertRules)}
+		}
+		rule.ID = piazza.NewUuid().String()
+		rule.CreatedOn = piazza.TimeStamp(engine.now().UTC())
+	}
+
+	matcher, err := newAlertMatcher(rule)
+	if err != nil {
+		return err
+	}
+
+	if _, err = engine.esi.PutData(AlertRuleType, rule.ID, rule); err != nil {
+		return err
+	}
+	engine.matchers[rule.ID] = matcher
+	engine.changes[rule.ID] = alertRuleChange{matcher: matcher, at: engine.now()}
+	return nil
+}
+
+// Delete removes a rule. The events it raised are kept.
+func (engine *AlertEngine) Delete(id string) error {
+	engine.Lock()
+	defer engine.Unlock()
+
+	if _, err := engine.esi.DeleteByID(AlertRuleType, id); err != nil {
+		return err
+	}
+	delete(engine.matchers, id)
+	engine.changes[id] = alertRuleChange{at: engine.now()}
+	return nil
+}
+
+// Match raises an event for each enabled rule that the message, of the
+// given tenant, matches.
+func (engine *AlertEngine) Match(mssg *pzsyslog.Message, tenant string) ([]*AlertEvent, error) {
+	engine.RLock()
+	matchers := make([]*alertMatcher, 0, len(engine.matchers))
+	for _, matcher := range engine.matchers {
+		if matcher.query != nil && !matcher.rule.Disabled && sees(matcher.rule.Tenant, tenant) {
+			matchers = append(matchers, matcher)
+		}
+	}
+	engine.RUnlock()
+
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+
+	byts, err := json.Marshal(&storedMessage{Message: mssg, Tenant: tenant})
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err = json.Unmarshal(byts, &fields); err != nil {
+		return nil, err
+	}
+
+	events := []*AlertEvent{}
+	for _, matcher := range matchers {
+		ok, err := evalMemoryQuery(matcher.query, fields)
+		if err != nil {
+			return events, fmt.Errorf("alert rule %s: %s", matcher.rule.ID, err.Error())
+		}
+		if !ok {
+			continue
+		}
+
+		event := &AlertEvent{
+			ID:        piazza.NewUuid().String(),
+			RuleID:    matcher.rule.ID,
+			RuleName:  matcher.rule.Name,
+			Tenant:    tenant,
+			TimeStamp: piazza.TimeStamp(engine.now().UTC()),
+			Message:   mssg,
+		}
+		if err = engine.raise(*matcher.rule, event); err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// raise queues an event to be stored and passed on.
+func (engine *AlertEngine) raise(rule AlertRule, event *AlertEvent) error {
+	engine.eventsLock.RLock()
+	defer engine.eventsLock.RUnlock()
+
+	if engine.eventsClosed {
+		return errAlertEngineClosed
+	}
+	select {
+	case engine.events <- &queuedAlertEvent{rule: rule, event: event}:
+		return nil
+	default:
+		return errAlertEventQueueFull
+	}
+}
+
+// flushEvents waits for the events raised so far to be stored and passed
+// on.
+func (engine *AlertEngine) flushEvents() {
+	flushed := make(chan struct{})
+
+	engine.eventsLock.RLock()
+	if engine.eventsClosed {
+		engine.eventsLock.RUnlock()
+		return
+	}
+	engine.events <- &queuedAlertEvent{flushed: flushed}
+	engine.eventsLock.RUnlock()
+
+	<-flushed
+}
+
+// Close stops taking events, and waits for those queued to be stored and
+// passed on, or for the context to be done.
+func (engine *AlertEngine) Close(ctx context.Context) error {
+	engine.eventsLock.Lock()
+	if engine.eventsClosed {
+		engine.eventsLock.Unlock()
+		return nil
+	}
+	engine.eventsClosed = true
+	close(engine.events)
+	engine.eventsLock.Unlock()
+
+	select {
+	case <-engine.eventsDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeEvents stores the queued events, as many at a time as are waiting,
+// and passes on those stored.
+func (engine *AlertEngine) writeEvents() {
+	defer close(engine.eventsDone)
+
+	for queued := range engine.events {
+		batch := []*queuedAlertEvent{}
+		flushed := []chan struct{}{}
+		add := func(queued *queuedAlertEvent) {
+			if queued.flushed != nil {
+				flushed = append(flushed, queued.flushed)
+			} else {
+				batch = append(batch, queued)
+			}
+		}
+		add(queued)
+
+	fill:
+		for len(batch) < AlertEventBatchSize {
+			select {
+			case queued, ok := <-engine.events:
+				if !ok {
+					break fill
+				}
+				add(queued)
+			default:
+				break fill
+			}
+		}
+
+		engine.storeEvents(batch)
+		for _, ch := range flushed {
+			close(ch)
+		}
+	}
+}
+
+func (engine *AlertEngine) storeEvents(batch []*queuedAlertEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, len(batch))
+	for i, queued := range batch {
+		docs[i] = queued.event
+	}
+	errs, err := engine.indexer.Bulk(AlertEventType, docs)
+	if err != nil {
+		log.Printf("Unable to store %d alert events: %s", len(batch), err.Error())
+		return
+	}
+
+	engine.RLock()
+	onEvent := engine.onEvent
+	engine.RUnlock()
+
+	for i, queued := range batch {
+		if errs[i] != nil {
+			log.Printf("Unable to store alert event of rule %s: %s", queued.rule.ID, errs[i].Error())
+			continue
+		}
+		if onEvent != nil {
+			onEvent(queued.rule, queued.event)
+		}
+	}
+}
+
+func extractAlertEvents(searchResult *elasticsearch.SearchResult) ([]AlertEvent, error) {
+	events := make([]AlertEvent, 0, len(*searchResult.GetHits()))
+	for _, hit := range *searchResult.GetHits() {
+		if hit.Source == nil {
+			continue
+		}
+		var event AlertEvent
+		if err := json.Unmarshal(*hit.Source, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+//---------------------------------------------------------------------------
+
+func (service *Service) setAlertEngine(alerts *AlertEngine) {
+	service.Lock()
+	service.alerts = alerts
+	service.Unlock()
+}
+
+func (service *Service) getAlertEngine() *AlertEngine {
+	service.Lock()
+	defer service.Unlock()
+	return service.alerts
+}
+
+// matchAlerts runs an accepted message past the alert rules. The message
+// is already stored, so a failure here is only logged.
+func (service *Service) matchAlerts(mssg *pzsyslog.Message, tenant string) {
+	alerts := service.getAlertEngine()
+	if alerts == nil {
+		return
+	}
+	if _, err := alerts.Match(mssg, tenant); err != nil {
+		log.Printf("Unable to raise alerts for message [%s]: %s", mssg.String(), err.Error())
+	}
+}
+
+func (service *Service) newAlertResponse(statusCode int, data interface{}) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{
+		StatusCode: statusCode,
+		Data:       data,
+	}
+
+	err := resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
+
+func (service *Service) getAlertEngineOrError() (*AlertEngine, *piazza.JsonResponse) {
+	alerts := service.getAlertEngine()
+	if alerts == nil {
+		return nil, service.newServiceUnavailableResponse(errors.New("alerts are not set up"))
+	}
+	return alerts, nil
+}
+
+// GetAlertRules returns the rules the tenant may see.
+func (service *Service) GetAlertRules(tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+	return service.newAlertResponse(http.StatusOK, alerts.Rules(tenant))
+}
+
+// GetAlertRule returns one rule.
+func (service *Service) GetAlertRule(id string, tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+	rule := alerts.Rule(id, tenant)
+	if rule == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no alert rule %s", id))
+	}
+	return service.newAlertResponse(http.StatusOK, rule)
+}
+
+// PostAlertRule adds a rule, which belongs to the tenant if there is one.
+func (service *Service) PostAlertRule(rule *AlertRule, tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+
+	rule.ID = ""
+	rule.Tenant = tenant
+	if resp := service.checkAlertRuleChannels(rule); resp != nil {
+		return resp
+	}
+	if err := alerts.Put(rule); err != nil {
+		return service.newAlertRuleErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusCreated, rule)
+}
+
+// PutAlertRule changes the name, query or rate, disabled flag, channels
+// and throttle of a rule.
+func (service *Service) PutAlertRule(id string, update *AlertRule, tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+
+	rule := alerts.Rule(id, tenant)
+	if rule == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no alert rule %s", id))
+	}
+	rule.Name = update.Name
+	rule.Query = update.Query
+	rule.Disabled = update.Disabled
+	rule.Channels = update.Channels
+	rule.Throttle = update.Throttle
+	rule.Rate = update.Rate
+	if resp := service.checkAlertRuleChannels(rule); resp != nil {
+		return resp
+	}
+	if err := alerts.Put(rule); err != nil {
+		return service.newAlertRuleErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusOK, rule)
+}
+
+// DeleteAlertRule removes a rule.
+func (service *Service) DeleteAlertRule(id string, tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+
+	rule := alerts.Rule(id, tenant)
+	if rule == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no alert rule %s", id))
+	}
+	if err := alerts.Delete(id); err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusOK, rule)
+}
+
+// newAlertRuleErrorResponse blames the caller for a rule that won't
+// parse, or that there is no room for, and the index for anything else.
+func (service *Service) newAlertRuleErrorResponse(err error) *piazza.JsonResponse {
+	if _, ok := err.(*alertRuleError); ok {
+		return service.newBadRequestResponse(err)
+	}
+	return service.newInternalErrorResponse(err)
+}
+
+// GetAlertEvents returns the events the tenant may see, filtered by rule
+// (a comma-separated list) and by after and before. Paging is as for GET
+// /syslog, cursor included; the default sort is by timeStamp.
+func (service *Service) GetAlertEvents(params *piazza.HttpQueryParams, tenant string) *piazza.JsonResponse {
+	alerts, resp := service.getAlertEngineOrError()
+	if resp != nil {
+		return resp
+	}
+
+	searchResult, pagination, nextCursor, resp := service.searchAlertIndex(alerts.esi, AlertEventType,
+		params, map[string]string{"rule": "ruleId"}, tenant)
+	if resp != nil {
+		return resp
+	}
+	events, err := extractAlertEvents(searchResult)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return service.newAlertListResponse(events, pagination, nextCursor)
+}
+
+// searchAlertIndex searches one of the types kept alongside the alert rules,
+// filtered by tenant, by after and before on timeStamp, and by the given
+// params, each a comma-separated list matching the field it is mapped to.
+func (service *Service) searchAlertIndex(
+	esi elasticsearch.IIndex,
+	typ string,
+	params *piazza.HttpQueryParams,
+	filters map[string]string,
+	tenant string,
+) (*elasticsearch.SearchResult, *piazza.JsonPagination, string, *piazza.JsonResponse) {
+	pagination, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return nil, nil, "", service.newBadRequestResponse(err)
+	}
+	paginationCreatedOnToTimeStamp(pagination)
+
+	cursor, err := params.GetAsString("cursor", "")
+	if err != nil {
+		return nil, nil, "", service.newBadRequestResponse(err)
+	}
+
+	must := []interface{}{}
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, err := getListParam(params, name)
+		if err != nil {
+			return nil, nil, "", service.newBadRequestResponse(err)
+		}
+		if len(values) > 0 {
+			must = append(must, map[string]interface{}{"terms": map[string]interface{}{filters[name]: values}})
+		}
+	}
+	if tenant != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"tenant": tenant}})
+	}
+
+	after, err := params.GetAfter(time.Time{})
+	if err != nil {
+		return nil, nil, "", service.newBadRequestResponse(err)
+	}
+	before, err := params.GetBefore(time.Time{})
+	if err != nil {
+		return nil, nil, "", service.newBadRequestResponse(err)
+	}
+	if !after.IsZero() || !before.IsZero() {
+		rangeParams := map[string]time.Time{}
+		if !after.IsZero() {
+			rangeParams["gte"] = after
+		}
+		if !before.IsZero() {
+			rangeParams["lte"] = before
+		}
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"timeStamp": rangeParams}})
+	}
+
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if len(must) > 0 {
+		query = map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"size":  pagination.PerPage,
+		"from":  pagination.PerPage * pagination.Page,
+		"sort":  map[string]string{pagination.SortBy: string(pagination.Order)},
+	})
+	if err != nil {
+		return nil, nil, "", service.newInternalErrorResponse(err)
+	}
+
+	dsl, err := applyCursor(string(byts), cursor)
+	if err != nil {
+		return nil, nil, "", service.newBadRequestResponse(err)
+	}
+
+	// not service.search: these may not be in the logger's index
+	searchResult, nextCursor, err := searchPage(esi, typ, dsl)
+	if err != nil {
+		service.telemetry.esError("search", 1)
+		return nil, nil, "", service.newInternalErrorResponse(err)
+	}
+
+	pagination.Count = int(searchResult.TotalHits())
+	return searchResult, pagination, nextCursor, nil
+}
+
+func (service *Service) newAlertListResponse(data interface{}, pagination *piazza.JsonPagination, nextCursor string) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       data,
+		Pagination: pagination,
+	}
+	if nextCursor != "" {
+		resp.Metadata = &CursorMetadata{NextCursor: nextCursor}
+	}
+
+	err := resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
@@ -0,0 +1,185 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func newAlertMessageForTest(application string, severity pzsyslog.Severity) *pzsyslog.Message {
+	m := pzsyslog.NewMessage("123456")
+	m.Application = application
+	m.Severity = severity
+	m.HostName = "host"
+	m.Message = "something happened"
+	return m
+}
+
+func TestAlertEngine(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("alerttest")
+	assert.NoError(esi.Create(""))
+
+	engine, err := NewAlertEngine(esi, nil)
+	assert.NoError(err)
+
+	now := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	engine.now = func() time.Time { return now }
+
+	jobs := &AlertRule{Name: "jobs", Query: "severity<=2 AND application:pz-jobmanager"}
+	assert.NoError(engine.Put(jobs))
+	assert.NotEmpty(jobs.ID)
+	assert.Equal(piazza.TimeStamp(now), jobs.CreatedOn)
+
+	now = now.Add(time.Minute)
+	acme := &AlertRule{Name: "acme", Query: "severity<=3", Tenant: "acme"}
+	assert.NoError(engine.Put(acme))
+
+	// bad rules
+	assert.Error(engine.Put(&AlertRule{Query: "severity<=2"}))
+	assert.Error(engine.Put(&AlertRule{Name: "empty"}))
+	assert.Error(engine.Put(&AlertRule{Name: "slow", Query: "severity<=2", Throttle: "-1m"}))
+	err = engine.Put(&AlertRule{Name: "bad", Query: "severity<="})
+	assert.IsType(&alertRuleError{}, err)
+
+	assert.Equal([]AlertRule{*jobs, *acme}, engine.Rules(""))
+	assert.Equal([]AlertRule{*acme}, engine.Rules("acme"))
+	assert.Empty(engine.Rules("globex"))
+	assert.Equal(jobs, engine.Rule(jobs.ID, ""))
+	assert.Nil(engine.Rule(jobs.ID, "acme"))
+
+	match := func(mssg *pzsyslog.Message, tenant string) []string {
+		events, err := engine.Match(mssg, tenant)
+		assert.NoError(err)
+		ids := []string{}
+		for _, event := range events {
+			assert.Equal(tenant, event.Tenant)
+			assert.Equal(mssg, event.Message)
+			ids = append(ids, event.RuleID)
+		}
+		return ids
+	}
+
+	// a rule without a tenant sees every message, one with only its own
+	assert.Equal([]string{jobs.ID}, match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Fatal), ""))
+	assert.Equal([]string{jobs.ID}, match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Fatal), "globex"))
+	assert.Len(match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Fatal), "acme"), 2)
+	assert.Empty(match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Warning), ""))
+	assert.Empty(match(newAlertMessageForTest("pz-gateway", pzsyslog.Fatal), ""))
+	assert.Equal([]string{acme.ID}, match(newAlertMessageForTest("pz-gateway", pzsyslog.Error), "acme"))
+
+	// disabled rules don't match
+	jobs.Disabled = true
+	assert.NoError(engine.Put(jobs))
+	assert.Empty(match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Fatal), ""))
+
+	// a new engine reads the rules back
+	again, err := NewAlertEngine(esi, nil)
+	assert.NoError(err)
+	assert.Equal(engine.Rules(""), again.Rules(""))
+
+	// ...and picks up changes made through the other on reload
+	gateway := &AlertRule{Name: "gateway", Query: "application:pz-gateway"}
+	assert.NoError(engine.Put(gateway))
+	assert.Nil(again.Rule(gateway.ID, ""))
+	assert.NoError(again.ReloadRules())
+	assert.Equal(gateway, again.Rule(gateway.ID, ""))
+
+	// a rule changed through an engine is kept as it is for a while, in
+	// case the index isn't showing the change yet
+	again.now = func() time.Time { return now }
+	assert.NoError(again.Delete(gateway.ID))
+	_, err = esi.PutData(AlertRuleType, gateway.ID, gateway)
+	assert.NoError(err)
+	assert.NoError(again.ReloadRules())
+	assert.Nil(again.Rule(gateway.ID, ""))
+	now = now.Add(time.Hour)
+	assert.NoError(again.ReloadRules())
+	assert.Equal(gateway, again.Rule(gateway.ID, ""))
+	assert.NoError(engine.Delete(gateway.ID))
+
+	assert.NoError(engine.Delete(acme.ID))
+	assert.Nil(engine.Rule(acme.ID, ""))
+	assert.Empty(match(newAlertMessageForTest("pz-gateway", pzsyslog.Error), "acme"))
+}
+
+func TestGetAlertEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("alerttest")
+	assert.NoError(esi.Create(""))
+
+	engine, err := NewAlertEngine(esi, nil)
+	assert.NoError(err)
+	now := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	engine.now = func() time.Time { return now }
+
+	errors := &AlertRule{Name: "errors", Query: "severity<=3"}
+	assert.NoError(engine.Put(errors))
+	gateway := &AlertRule{Name: "gateway", Query: "application:pz-gateway"}
+	assert.NoError(engine.Put(gateway))
+
+	for i, tenant := range []string{"", "acme", "", "acme"} {
+		now = now.Add(time.Minute)
+		_, err = engine.Match(newAlertMessageForTest("pz-gateway", pzsyslog.Error), tenant)
+		assert.NoError(err)
+		if i == 0 {
+			_, err = engine.Match(newAlertMessageForTest("pz-jobmanager", pzsyslog.Error), tenant)
+			assert.NoError(err)
+		}
+	}
+	engine.flushEvents()
+
+	service := &Service{esIndex: esi, alerts: engine}
+
+	get := func(path string, tenant string) []AlertEvent {
+		request, err := http.NewRequest("GET", path, nil)
+		assert.NoError(err)
+		resp := service.GetAlertEvents(newQueryParams(request), tenant)
+		if !assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		assert.Equal("alertevent-list", resp.Type)
+		events := resp.Data.([]AlertEvent)
+		assert.Equal(len(events), resp.Pagination.Count)
+		return events
+	}
+
+	assert.Len(get("/alerts/events", ""), 9)
+	assert.Len(get("/alerts/events?rule="+gateway.ID, ""), 4)
+	assert.Len(get("/alerts/events?rule="+gateway.ID+","+errors.ID, ""), 9)
+	assert.Len(get("/alerts/events", "acme"), 4)
+	assert.Len(get("/alerts/events?rule="+errors.ID, "acme"), 2)
+
+	events := get("/alerts/events?after=2016-07-26T01:03:00Z&order=asc", "")
+	if assert.Len(events, 4) {
+		assert.Equal(piazza.TimeStamp(time.Date(2016, time.July, 26, 1, 3, 0, 0, time.UTC)), events[0].TimeStamp)
+		assert.Equal("pz-gateway", events[0].Message.Application)
+	}
+
+	request, err := http.NewRequest("GET", "/alerts/events?after=yesterday", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, service.GetAlertEvents(newQueryParams(request), "").StatusCode)
+
+	resp := (&Service{}).GetAlertEvents(newQueryParams(request), "")
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,685 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// AuditRecordType is the type that the audit trail is kept in, in an index
+// of its own (see Kit.AuditIndex).
+const AuditRecordType = "AuditRecord"
+
+const (
+	// AuditVerifyPageSize is how many records /audit/verify fetches at a
+	// time.
+	AuditVerifyPageSize = 1000
+
+	// MaxAuditProblems is the most problems /audit/verify reports; past
+	// that it only says that the trail is not intact.
+	MaxAuditProblems = 100
+
+	// auditAppendAttempts is how many times Append tries to take the next
+	// number before giving up, when other instances keep taking it first.
+	auditAppendAttempts = 10
+)
+
+const auditRecordMapping = `{
+	"AuditRecord": {
+		"dynamic": "strict",
+		"properties": {
+			"seq":         {"type": "long"},
+			"tenant":      {"type": "string", "index": "not_analyzed"},
+			"timeStamp":   {"type": "date"},
+			"actor":       {"type": "string", "index": "not_analyzed"},
+			"action":      {"type": "string", "index": "not_analyzed"},
+			"actee":       {"type": "string", "index": "not_analyzed"},
+			"application": {"type": "string", "index": "not_analyzed"},
+			"hostName":    {"type": "string", "index": "not_analyzed"},
+			"message":     {"type": "string"},
+			"prevHash":    {"type": "string", "index": "not_analyzed"},
+			"hash":        {"type": "string", "index": "not_analyzed"}
+		}
+	}
+}`
+
+// AuditRecord is one entry in the audit trail, made from a message with
+// AuditData. Records are numbered from 1, and each holds the hash of the
+// one before it, so that editing or deleting any of them breaks the chain.
+// Tenant is that of the key the message was sent with, if any.
+type AuditRecord struct {
+	Seq         int64            `json:"seq"`
+	Tenant      string           `json:"tenant,omitempty"`
+	TimeStamp   piazza.TimeStamp `json:"timeStamp"`
+	Actor       string           `json:"actor"`
+	Action      string           `json:"action"`
+	Actee       string           `json:"actee"`
+	Application string           `json:"application"`
+	HostName    string           `json:"hostName"`
+	Message     string           `json:"message"`
+	PrevHash    string           `json:"prevHash"`
+	Hash        string           `json:"hash"`
+}
+
+// computeHash returns the hex HMAC-SHA256, with the key, of everything in
+// the record but the hash itself, or without a key its plain SHA-256. The
+// time is hashed as UTC with nanoseconds, so that it
+// hashes the same however it was written. The tenant comes last, and only
+// if there is one, so that records from before there were tenants still
+// verify.
+func (record *AuditRecord) computeHash(key []byte) (string, error) {
+	fields := []interface{}{
+		record.Seq,
+		time.Time(record.TimeStamp).UTC().Format(time.RFC3339Nano),
+		record.Actor,
+		record.Action,
+		record.Actee,
+		record.Application,
+		record.HostName,
+		record.Message,
+		record.PrevHash,
+	}
+	if record.Tenant != "" {
+		fields = append(fields, record.Tenant)
+	}
+	byts, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		sum := sha256.Sum256(byts)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(byts)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditProblem is something /audit/verify found wrong with the trail.
+type AuditProblem struct {
+	Seq     int64  `json:"seq"`
+	Problem string `json:"problem"`
+}
+
+// AuditVerifyResult is what /audit/verify returns. CheckpointSeq is the
+// last record that this instance has checkpointed, if it keeps a
+// checkpoint.
+type AuditVerifyResult struct {
+	Verified      bool           `json:"verified"`
+	NumRecords    int            `json:"numRecords"`
+	LastSeq       int64          `json:"lastSeq"`
+	LastHash      string         `json:"lastHash,omitempty"`
+	CheckpointSeq int64          `json:"checkpointSeq,omitempty"`
+	Problems      []AuditProblem `json:"problems,omitempty"`
+}
+
+// AuditConfig keeps the audit trail honest. Neither the key nor the
+// checkpoint is in the audit index, so that whoever can write to the index
+// still can't rewrite the trail, or cut off its end, unseen.
+type AuditConfig struct {
+	// If set, records are hashed with an HMAC using this key, which
+	// nobody without it can recompute for an edited record.
+	Key []byte
+
+	// If set, the number and hash of the last record appended are kept in
+	// this file, on local disk, and Verify checks that the trail still
+	// reaches that record.
+	CheckpointFile string
+}
+
+// auditCheckpoint is what the checkpoint file holds.
+type auditCheckpoint struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+//---------------------------------------------------------------------------
+
+// AuditTrail appends audit records, one at a time, so that each can be
+// chained to the last. Several instances may append to the same trail:
+// a record is only stored if its number hasn't been taken, and if it has,
+// the trail catches up with the records it missed and tries again.
+//
+// Every audit message is appended, so one sent twice is recorded twice.
+// (pzsyslog.Logger sends each audit message to both of its writers, so at
+// most one of them should be this service.)
+type AuditTrail struct {
+	sync.Mutex
+	esi      elasticsearch.IIndex
+	config   *AuditConfig
+	lastSeq  int64
+	lastHash string
+
+	// The checkpoint only moves on once the trail is known to reach it:
+	// if it doesn't, the end was cut off, and new records must not hide
+	// that.
+	checkpoint        auditCheckpoint
+	checkpointReached bool
+}
+
+// NewAuditTrail makes sure the index has the audit type, and picks up the
+// trail where it left off. The config may be nil.
+func NewAuditTrail(esi elasticsearch.IIndex, config *AuditConfig) (*AuditTrail, error) {
+	if config == nil {
+		config = &AuditConfig{}
+	}
+
+	ok, err := esi.TypeExists(AuditRecordType)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = esi.SetMapping(AuditRecordType, piazza.JsonString(auditRecordMapping)); err != nil {
+			return nil, err
+		}
+	}
+
+	trail := &AuditTrail{esi: esi, config: config}
+	if err = trail.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	dsl := `{"query":{"match_all":{}},"sort":{"seq":"desc"},"size":1}`
+	searchResult, err := esi.SearchByJSON(AuditRecordType, dsl)
+	if err != nil {
+		return nil, err
+	}
+	records, err := extractAuditRecords(searchResult)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 {
+		trail.lastSeq, trail.lastHash = records[0].Seq, records[0].Hash
+	}
+
+	// the latest records may not be searchable yet
+	if err = trail.catchUp(); err != nil {
+		return nil, err
+	}
+
+	if trail.checkpoint.Seq == 0 {
+		trail.checkpointReached = true
+	} else if trail.checkpoint.Seq <= trail.lastSeq {
+		record, err := trail.get(trail.checkpoint.Seq)
+		if err != nil {
+			return nil, err
+		}
+		trail.checkpointReached = record != nil && record.Hash == trail.checkpoint.Hash
+	}
+	if err = trail.writeCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	return trail, nil
+}
+
+func (trail *AuditTrail) readCheckpoint() error {
+	if trail.config.CheckpointFile == "" {
+		return nil
+	}
+	byts, err := ioutil.ReadFile(trail.config.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(byts, &trail.checkpoint); err != nil {
+		return fmt.Errorf("%s: %s", trail.config.CheckpointFile, err.Error())
+	}
+	return nil
+}
+
+// writeCheckpoint moves the checkpoint on to the end of the trail, if the
+// trail has got past it. The trail must be locked, or not yet shared.
+func (trail *AuditTrail) writeCheckpoint() error {
+	if trail.config.CheckpointFile == "" || !trail.checkpointReached || trail.lastSeq <= trail.checkpoint.Seq {
+		return nil
+	}
+	checkpoint := auditCheckpoint{Seq: trail.lastSeq, Hash: trail.lastHash}
+	byts, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	path := trail.config.CheckpointFile
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(byts); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	trail.checkpoint = checkpoint
+	return nil
+}
+
+// catchUp moves the end of the trail past any records stored since, by
+// this instance or another. Records are read by number, since the latest
+// may not be searchable yet. The trail must be locked, or not yet shared.
+func (trail *AuditTrail) catchUp() error {
+	for {
+		record, err := trail.get(trail.lastSeq + 1)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return trail.writeCheckpoint()
+		}
+		trail.lastSeq, trail.lastHash = record.Seq, record.Hash
+	}
+}
+
+// Append adds a record for the audit message, sent with the tenant's key or,
+// if the tenant is "", a global one, to the end of the trail.
+func (trail *AuditTrail) Append(mssg *pzsyslog.Message, tenant string) (*AuditRecord, error) {
+	if mssg.AuditData == nil {
+		return nil, errors.New("message has no audit data")
+	}
+
+	trail.Lock()
+	defer trail.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		record, err := trail.newRecord(mssg, tenant)
+		if err != nil {
+			return nil, err
+		}
+		created, err := trail.create(record)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			trail.lastSeq, trail.lastHash = record.Seq, record.Hash
+			if err = trail.writeCheckpoint(); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+
+		// another instance got there first
+		if attempt == auditAppendAttempts {
+			return nil, fmt.Errorf("unable to append to the audit trail: record %d was taken %d times", record.Seq, attempt)
+		}
+		if err = trail.catchUp(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newRecord makes the record for the message that would come next.
+func (trail *AuditTrail) newRecord(mssg *pzsyslog.Message, tenant string) (*AuditRecord, error) {
+	record := &AuditRecord{
+		Seq:         trail.lastSeq + 1,
+		Tenant:      tenant,
+		TimeStamp:   piazza.TimeStamp(time.Time(mssg.TimeStamp).UTC()),
+		Actor:       mssg.AuditData.Actor,
+		Action:      mssg.AuditData.Action,
+		Actee:       mssg.AuditData.Actee,
+		Application: mssg.Application,
+		HostName:    mssg.HostName,
+		Message:     mssg.Message,
+		PrevHash:    trail.lastHash,
+	}
+	hash, err := record.computeHash(trail.config.Key)
+	if err != nil {
+		return nil, err
+	}
+	record.Hash = hash
+	return record, nil
+}
+
+// create stores the record unless there is already one with its number,
+// returning false, and no error, if there is. (PutData would overwrite it,
+// losing a record appended by another instance.)
+func (trail *AuditTrail) create(record *AuditRecord) (bool, error) {
+	return createDocument(trail.esi, AuditRecordType, strconv.FormatInt(record.Seq, 10), record)
+}
+
+func (trail *AuditTrail) last() (int64, string, auditCheckpoint) {
+	trail.Lock()
+	defer trail.Unlock()
+	return trail.lastSeq, trail.lastHash, trail.checkpoint
+}
+
+// get returns the record with the given number, or nil if there isn't one.
+func (trail *AuditTrail) get(seq int64) (*AuditRecord, error) {
+	id := strconv.FormatInt(seq, 10)
+	ok, err := trail.esi.ItemExists(AuditRecordType, id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	getResult, err := trail.esi.GetByID(AuditRecordType, id)
+	if err != nil {
+		return nil, err
+	}
+	if !getResult.Found || getResult.Source == nil {
+		return nil, nil
+	}
+	record := &AuditRecord{}
+	if err = json.Unmarshal(*getResult.Source, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Verify walks the trail from the start, checking that no record is
+// missing, that each one still hashes to what it says, that each points
+// to the one before, and that the checkpointed record is still there.
+func (trail *AuditTrail) Verify() (*AuditVerifyResult, error) {
+	lastSeq, lastHash, checkpoint := trail.last()
+	v := &auditVerifier{
+		result:     &AuditVerifyResult{LastSeq: lastSeq, LastHash: lastHash, CheckpointSeq: checkpoint.Seq},
+		key:        trail.config.Key,
+		checkpoint: checkpoint,
+	}
+
+	dsl := fmt.Sprintf(`{"query":{"match_all":{}},"sort":{"seq":"asc"},"size":%d}`, AuditVerifyPageSize)
+	cursor := ""
+	for {
+		pageDsl, err := applyCursor(dsl, cursor)
+		if err != nil {
+			return nil, err
+		}
+		searchResult, next, err := searchPage(trail.esi, AuditRecordType, pageDsl)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range *searchResult.GetHits() {
+			if hit.Source == nil {
+				continue
+			}
+			record := &AuditRecord{}
+			if err = json.Unmarshal(*hit.Source, record); err != nil {
+				return nil, err
+			}
+			if record.Seq > lastSeq {
+				// appended since we started
+				continue
+			}
+			if hit.ID != strconv.FormatInt(record.Seq, 10) {
+				v.report(record.Seq, fmt.Sprintf("record is stored as %s", hit.ID))
+			}
+			if err = v.check(record); err != nil {
+				return nil, err
+			}
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+
+	// records appended since the last refresh aren't searchable yet
+	for seq := v.nextSeq + 1; seq <= lastSeq; seq++ {
+		record, err := trail.get(seq)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		if err = v.check(record); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.nextSeq < lastSeq {
+		v.reportMissing(v.nextSeq+1, lastSeq)
+	} else if v.prevHash != lastHash {
+		v.report(lastSeq, "record is not the last one appended")
+	}
+
+	// records removed from the end, even before this instance started
+	if checkpoint.Seq > lastSeq {
+		v.reportMissing(lastSeq+1, checkpoint.Seq)
+	} else if v.checkpointHash != "" && v.checkpointHash != checkpoint.Hash {
+		v.report(checkpoint.Seq, "record is not the one checkpointed")
+	}
+
+	v.result.Verified = len(v.result.Problems) == 0 && !v.truncated
+	return v.result, nil
+}
+
+// auditVerifier holds the state of a walk along the trail, in order.
+type auditVerifier struct {
+	result    *AuditVerifyResult
+	key       []byte
+	nextSeq   int64 // the last record seen, so far
+	prevHash  string
+	truncated bool
+
+	checkpoint     auditCheckpoint
+	checkpointHash string // of the record with the checkpoint's number
+}
+
+func (v *auditVerifier) check(record *AuditRecord) error {
+	if record.Seq <= v.nextSeq {
+		v.report(record.Seq, "record number is repeated")
+		return nil
+	}
+	v.result.NumRecords++
+
+	gap := record.Seq > v.nextSeq+1
+	if gap {
+		v.reportMissing(v.nextSeq+1, record.Seq-1)
+	}
+
+	hash, err := record.computeHash(v.key)
+	if err != nil {
+		return err
+	}
+	if record.Seq == v.checkpoint.Seq {
+		v.checkpointHash = record.Hash
+	}
+	if hash != record.Hash {
+		v.report(record.Seq, "record has been altered")
+	} else if !gap && record.PrevHash != v.prevHash {
+		// the record before was replaced by one with a good hash
+		v.report(record.Seq, "record does not follow the one before it")
+	}
+
+	v.nextSeq, v.prevHash = record.Seq, record.Hash
+	return nil
+}
+
+func (v *auditVerifier) reportMissing(from int64, to int64) {
+	if from == to {
+		v.report(from, "record is missing")
+	} else {
+		v.report(from, fmt.Sprintf("records %d to %d are missing", from, to))
+	}
+}
+
+func (v *auditVerifier) report(seq int64, problem string) {
+	if len(v.result.Problems) >= MaxAuditProblems {
+		v.truncated = true
+		return
+	}
+	v.result.Problems = append(v.result.Problems, AuditProblem{Seq: seq, Problem: problem})
+}
+
+func extractAuditRecords(searchResult *elasticsearch.SearchResult) ([]AuditRecord, error) {
+	records := make([]AuditRecord, 0, len(*searchResult.GetHits()))
+	for _, hit := range *searchResult.GetHits() {
+		if hit.Source == nil {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(*hit.Source, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+//---------------------------------------------------------------------------
+
+// GetAudit returns audit records, filtered by actor, action and actee
+// (each a comma-separated list) and by after and before. An actor or
+// actee passed in, as for the timelines, is ANDed with those. Paging is
+// as for GET /syslog, cursor included; the default sort is by seq.
+func (service *Service) GetAudit(params *piazza.HttpQueryParams, actor string, actee string) *piazza.JsonResponse {
+	trail := service.getAuditTrail()
+	if trail == nil {
+		return service.newServiceUnavailableResponse(errors.New("there is no audit trail"))
+	}
+
+	pagination, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if pagination.SortBy == "createdOn" {
+		pagination.SortBy = "seq"
+	}
+
+	cursor, err := params.GetAsString("cursor", "")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	must := []interface{}{}
+	fixed := map[string]string{"actor": actor, "actee": actee}
+	for _, field := range []string{"tenant", "actor", "action", "actee"} {
+		values, err := getListParam(params, field)
+		if err != nil {
+			return service.newBadRequestResponse(err)
+		}
+		if len(values) > 0 {
+			must = append(must, map[string]interface{}{"terms": map[string]interface{}{field: values}})
+		}
+		if fixed[field] != "" {
+			must = append(must, map[string]interface{}{"term": map[string]interface{}{field: fixed[field]}})
+		}
+	}
+
+	after, err := params.GetAfter(time.Time{})
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	before, err := params.GetBefore(time.Time{})
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if !after.IsZero() || !before.IsZero() {
+		rangeParams := map[string]time.Time{}
+		if !after.IsZero() {
+			rangeParams["gte"] = after
+		}
+		if !before.IsZero() {
+			rangeParams["lte"] = before
+		}
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"timeStamp": rangeParams}})
+	}
+
+	query := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if len(must) > 0 {
+		query = map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"size":  pagination.PerPage,
+		"from":  pagination.PerPage * pagination.Page,
+		"sort":  map[string]string{pagination.SortBy: string(pagination.Order)},
+	})
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	dsl, err := applyCursor(string(byts), cursor)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	// not service.searchPage: the trail may not be in the logger's index
+	searchResult, nextCursor, err := searchPage(trail.esi, AuditRecordType, dsl)
+	if err != nil {
+		service.telemetry.esError("search", 1)
+		return service.newInternalErrorResponse(err)
+	}
+	records, err := extractAuditRecords(searchResult)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	pagination.Count = int(searchResult.TotalHits())
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       records,
+		Pagination: pagination,
+	}
+	if nextCursor != "" {
+		resp.Metadata = &CursorMetadata{NextCursor: nextCursor}
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
+
+// VerifyAudit checks that the audit trail is intact.
+func (service *Service) VerifyAudit() *piazza.JsonResponse {
+	trail := service.getAuditTrail()
+	if trail == nil {
+		return service.newServiceUnavailableResponse(errors.New("there is no audit trail"))
+	}
+
+	result, err := trail.Verify()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       result,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
@@ -0,0 +1,308 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func newAuditTrailForTest(assert *assert.Assertions, config *AuditConfig) (*MemoryIndex, *AuditTrail) {
+	esi := NewMemoryIndex("audittest")
+	assert.NoError(esi.Create(""))
+
+	trail, err := NewAuditTrail(esi, config)
+	assert.NoError(err)
+
+	start := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	for i, audit := range []pzsyslog.AuditElement{
+		{Actor: "alice", Action: "create", Actee: "job1"},
+		{Actor: "bob", Action: "read", Actee: "job1"},
+		{Actor: "alice", Action: "delete", Actee: "job1"},
+		{Actor: "alice", Action: "create", Actee: "job2"},
+	} {
+		m := pzsyslog.NewMessage("123456")
+		m.Application = "pz-gateway"
+		m.HostName = "host"
+		m.TimeStamp = piazza.TimeStamp(start.Add(time.Duration(i) * time.Minute))
+		m.Message = audit.Actor + " " + audit.Action + "s " + audit.Actee
+		audit := audit
+		m.AuditData = &audit
+		tenant := ""
+		if i == 3 {
+			tenant = "acme"
+		}
+		record, err := trail.Append(m, tenant)
+		if assert.NoError(err) {
+			assert.Equal(int64(i+1), record.Seq)
+			assert.Equal(tenant, record.Tenant)
+		}
+	}
+
+	return esi, trail
+}
+
+func verifyAuditForTest(assert *assert.Assertions, trail *AuditTrail) *AuditVerifyResult {
+	result, err := trail.Verify()
+	assert.NoError(err)
+	return result
+}
+
+func TestAuditTrail(t *testing.T) {
+	assert := assert.New(t)
+
+	esi, trail := newAuditTrailForTest(assert, nil)
+
+	result := verifyAuditForTest(assert, trail)
+	assert.True(result.Verified)
+	assert.Equal(4, result.NumRecords)
+	assert.Equal(int64(4), result.LastSeq)
+	assert.Empty(result.Problems)
+
+	// a new trail on the same index carries on from the last record
+	again, err := NewAuditTrail(esi, nil)
+	assert.NoError(err)
+	seq, hash, _ := again.last()
+	assert.Equal(int64(4), seq)
+	assert.Equal(result.LastHash, hash)
+
+	get := func(seq int64) *AuditRecord {
+		record, err := trail.get(seq)
+		assert.NoError(err)
+		return record
+	}
+	put := func(record *AuditRecord) {
+		_, err := esi.PutData(AuditRecordType, strconv.FormatInt(record.Seq, 10), record)
+		assert.NoError(err)
+	}
+
+	// editing a record
+	original := get(2)
+	edited := *original
+	edited.Actor = "mallory"
+	put(&edited)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal([]AuditProblem{{Seq: 2, Problem: "record has been altered"}}, result.Problems)
+
+	// ...and fixing up its hash
+	edited.Hash, err = edited.computeHash(nil)
+	assert.NoError(err)
+	put(&edited)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal([]AuditProblem{{Seq: 3, Problem: "record does not follow the one before it"}}, result.Problems)
+	put(original)
+
+	// moving a record out of its tenant
+	original = get(4)
+	edited = *original
+	edited.Tenant = ""
+	put(&edited)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal([]AuditProblem{{Seq: 4, Problem: "record has been altered"}}, result.Problems)
+	put(original)
+
+	// deleting a record
+	_, err = esi.DeleteByID(AuditRecordType, "3")
+	assert.NoError(err)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal(3, result.NumRecords)
+	assert.Equal([]AuditProblem{{Seq: 3, Problem: "record is missing"}}, result.Problems)
+
+	// deleting the last ones
+	_, err = esi.DeleteByID(AuditRecordType, "4")
+	assert.NoError(err)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal([]AuditProblem{{Seq: 3, Problem: "records 3 to 4 are missing"}}, result.Problems)
+}
+
+func TestAuditTrailKeyed(t *testing.T) {
+	assert := assert.New(t)
+
+	esi, trail := newAuditTrailForTest(assert, &AuditConfig{Key: []byte("secret")})
+
+	result := verifyAuditForTest(assert, trail)
+	assert.True(result.Verified)
+	assert.Equal(4, result.NumRecords)
+
+	record, err := trail.get(2)
+	assert.NoError(err)
+	assert.NotEqual(record.Hash, func() string {
+		hash, err := record.computeHash(nil)
+		assert.NoError(err)
+		return hash
+	}())
+
+	// without the key, an edited record can't be given a hash that verifies
+	for _, key := range [][]byte{nil, []byte("guess")} {
+		edited := *record
+		edited.Actor = "mallory"
+		edited.Hash, err = edited.computeHash(key)
+		assert.NoError(err)
+		_, err = esi.PutData(AuditRecordType, "2", &edited)
+		assert.NoError(err)
+		result = verifyAuditForTest(assert, trail)
+		assert.False(result.Verified)
+		assert.Equal([]AuditProblem{
+			{Seq: 2, Problem: "record has been altered"},
+			{Seq: 3, Problem: "record does not follow the one before it"},
+		}, result.Problems)
+	}
+}
+
+func TestAuditTrailCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "audittest")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	config := &AuditConfig{CheckpointFile: filepath.Join(dir, "checkpoint")}
+
+	esi, trail := newAuditTrailForTest(assert, config)
+	lastSeq, lastHash, _ := trail.last()
+
+	byts, err := ioutil.ReadFile(config.CheckpointFile)
+	assert.NoError(err)
+	checkpoint := auditCheckpoint{}
+	assert.NoError(json.Unmarshal(byts, &checkpoint))
+	assert.Equal(auditCheckpoint{Seq: 4, Hash: lastHash}, checkpoint)
+	assert.Equal(int64(4), lastSeq)
+
+	result := verifyAuditForTest(assert, trail)
+	assert.True(result.Verified)
+	assert.Equal(int64(4), result.CheckpointSeq)
+
+	// the last records are removed, and the service restarted: the trail
+	// alone no longer shows they were there
+	for _, id := range []string{"3", "4"} {
+		_, err = esi.DeleteByID(AuditRecordType, id)
+		assert.NoError(err)
+	}
+	trail, err = NewAuditTrail(esi, config)
+	assert.NoError(err)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal(int64(2), result.LastSeq)
+	assert.Equal([]AuditProblem{{Seq: 3, Problem: "records 3 to 4 are missing"}}, result.Problems)
+
+	// nor do new records hide it
+	m := pzsyslog.NewMessage("123456")
+	m.Message = "mallory logs in"
+	m.AuditData = &pzsyslog.AuditElement{Actor: "mallory", Action: "login", Actee: "pz-gateway"}
+	_, err = trail.Append(m, "")
+	assert.NoError(err)
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal([]AuditProblem{{Seq: 4, Problem: "record is missing"}}, result.Problems)
+
+	for i := 0; i < 2; i++ {
+		_, err = trail.Append(m, "")
+		assert.NoError(err)
+	}
+	result = verifyAuditForTest(assert, trail)
+	assert.False(result.Verified)
+	assert.Equal(int64(5), result.LastSeq)
+	assert.Equal(int64(4), result.CheckpointSeq)
+	assert.Equal([]AuditProblem{{Seq: 4, Problem: "record is not the one checkpointed"}}, result.Problems)
+}
+
+func TestAuditTrailInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("audittest")
+	assert.NoError(esi.Create(""))
+
+	// two instances, neither knowing what the other appends
+	one, err := NewAuditTrail(esi, nil)
+	assert.NoError(err)
+	two, err := NewAuditTrail(esi, nil)
+	assert.NoError(err)
+
+	m := pzsyslog.NewMessage("123456")
+	m.Message = "alice logs in"
+	m.AuditData = &pzsyslog.AuditElement{Actor: "alice", Action: "login", Actee: "pz-gateway"}
+
+	seqs := []int64{}
+	for _, trail := range []*AuditTrail{one, two, one, one} {
+		record, err := trail.Append(m, "")
+		if assert.NoError(err) {
+			seqs = append(seqs, record.Seq)
+		}
+	}
+	assert.Equal([]int64{1, 2, 3, 4}, seqs)
+
+	result := verifyAuditForTest(assert, one)
+	assert.True(result.Verified)
+	assert.Equal(4, result.NumRecords)
+	assert.Empty(result.Problems)
+}
+
+func TestGetAudit(t *testing.T) {
+	assert := assert.New(t)
+
+	esi, trail := newAuditTrailForTest(assert, nil)
+	service := &Service{esIndex: esi, auditTrail: trail}
+
+	get := func(path string, actor string, actee string) []AuditRecord {
+		request, err := http.NewRequest("GET", path, nil)
+		assert.NoError(err)
+		resp := service.GetAudit(newQueryParams(request), actor, actee)
+		if !assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		assert.Equal("auditrecord-list", resp.Type)
+		return resp.Data.([]AuditRecord)
+	}
+	seqs := func(records []AuditRecord) []int64 {
+		list := []int64{}
+		for _, record := range records {
+			list = append(list, record.Seq)
+		}
+		return list
+	}
+
+	assert.Equal([]int64{4, 3, 2, 1}, seqs(get("/audit", "", "")))
+	assert.Equal([]int64{1, 2, 3, 4}, seqs(get("/audit?order=asc", "", "")))
+	assert.Equal([]int64{4, 1}, seqs(get("/audit?action=create", "", "")))
+	assert.Equal([]int64{3, 2}, seqs(get("/audit?action=read,delete", "", "")))
+	assert.Equal([]int64{4}, seqs(get("/audit?tenant=acme", "", "")))
+	assert.Equal([]int64{3, 2}, seqs(get("/audit?after=2016-07-26T01:01:00Z&before=2016-07-26T01:02:00Z", "", "")))
+
+	// the timelines
+	assert.Equal([]int64{4, 3, 1}, seqs(get("/audit/actor/alice", "alice", "")))
+	assert.Equal([]int64{3, 1}, seqs(get("/audit/actor/alice?actee=job1", "alice", "")))
+	assert.Equal([]int64{3, 2, 1}, seqs(get("/audit/actee/job1", "", "job1")))
+	assert.Empty(get("/audit/actor/nobody", "nobody", ""))
+
+	resp := service.VerifyAudit()
+	if assert.Equal(http.StatusOK, resp.StatusCode) {
+		assert.Equal("auditverify", resp.Type)
+		assert.True(resp.Data.(*AuditVerifyResult).Verified)
+	}
+}
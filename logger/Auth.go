@@ -0,0 +1,311 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// DefaultAuthCacheTTL is how long an HTTPAuthorizer remembers what it was
+// told about a key.
+const DefaultAuthCacheTTL = time.Minute
+
+// apiKeyContextKey is where the caller's APIKey is kept in the gin.Context.
+const apiKeyContextKey = "pzlogger.apiKey"
+
+// APIKey is what the holder of an API key may do.
+type APIKey struct {
+	Name string `json:"name"` // who holds it
+
+	// if set, the holder's messages are kept apart from everyone else's:
+	// what it writes is tagged with the tenant, and it reads only that
+	Tenant string `json:"tenant,omitempty"`
+
+	// the applications it may write messages as; * and ? are wildcards
+	Applications []string `json:"applications"`
+
+	Read   bool `json:"read"`   // GET /syslog, /metrics/query and the like, and /audit without a tenant
+	Query  bool `json:"query"`  // POST /query
+	Alerts bool `json:"alerts"` // changing the alert rules
+	Admin  bool `json:"admin"`  // /admin and /metrics, without a tenant
+}
+
+// mayWrite says if messages from the application may be written with the
+// key. With authentication off there is no key, and anything goes.
+func (key *APIKey) mayWrite(application string) bool {
+	if key == nil {
+		return true
+	}
+	for _, pattern := range key.Applications {
+		if matchMemoryWildcard(pattern, application) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNotAllowedToWrite is the rejection of a message the key may not write.
+func errNotAllowedToWrite(application string) error {
+	return fmt.Errorf("not allowed to write messages as application %q", application)
+}
+
+// apiAccess is what a route needs of the caller's key.
+type apiAccess int
+
+const (
+	accessPublic apiAccess = iota
+	accessWrite
+	accessRead
+	accessQuery
+	accessAlerts
+	accessAudit
+	accessAdmin
+)
+
+func (key *APIKey) may(access apiAccess) bool {
+	switch access {
+	case accessPublic:
+		return true
+	case accessWrite:
+		return len(key.Applications) > 0
+	case accessRead:
+		return key.Read
+	case accessQuery:
+		return key.Query
+	case accessAlerts:
+		return key.Alerts
+
+	// these see every tenant's messages
+	case accessAudit:
+		return key.Read && key.Tenant == ""
+	case accessAdmin:
+		return key.Admin && key.Tenant == ""
+	}
+	return false
+}
+
+// Authorizer looks up API keys.
+type Authorizer interface {
+	// Authorize returns what the key may do, or nil if it is not a key.
+	// An error means the key could not be checked.
+	Authorize(apiKey string) (*APIKey, error)
+}
+
+//---------------------------------------------------------------------------
+
+// KeyFileAuthorizer knows the keys listed in a local file.
+type KeyFileAuthorizer struct {
+	keys map[string]*APIKey
+}
+
+// LoadKeyFile reads a JSON object of API keys and what each may do, such as
+//
+//	{"1234-abcd": {"name": "gateway", "applications": ["pz-*"], "read": true}}
+func LoadKeyFile(path string) (*KeyFileAuthorizer, error) {
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*APIKey{}
+	if err = json.Unmarshal(byts, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	for apiKey, key := range keys {
+		if apiKey == "" || key == nil {
+			return nil, fmt.Errorf("%s: keys must not be empty", path)
+		}
+	}
+	return &KeyFileAuthorizer{keys: keys}, nil
+}
+
+func (authorizer *KeyFileAuthorizer) Authorize(apiKey string) (*APIKey, error) {
+	return authorizer.keys[apiKey], nil
+}
+
+//---------------------------------------------------------------------------
+
+// HTTPAuthorizer asks another service about each key, passing it as the
+// user name of a basic auth GET. A 200 response has the APIKey as its
+// body, and a 401, 403 or 404 says there is no such key. Answers are
+// remembered for CacheTTL.
+type HTTPAuthorizer struct {
+	URL      string
+	CacheTTL time.Duration
+
+	client *http.Client
+
+	sync.Mutex
+	cache map[string]*cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// NewHTTPAuthorizer returns an HTTPAuthorizer for the given URL.
+func NewHTTPAuthorizer(url string) *HTTPAuthorizer {
+	return &HTTPAuthorizer{
+		URL:      url,
+		CacheTTL: DefaultAuthCacheTTL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    map[string]*cachedAPIKey{},
+	}
+}
+
+func (authorizer *HTTPAuthorizer) Authorize(apiKey string) (*APIKey, error) {
+	now := time.Now()
+
+	authorizer.Lock()
+	cached, ok := authorizer.cache[apiKey]
+	authorizer.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := authorizer.fetch(apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizer.Lock()
+	for k, v := range authorizer.cache {
+		if !now.Before(v.expires) {
+			delete(authorizer.cache, k)
+		}
+	}
+	authorizer.cache[apiKey] = &cachedAPIKey{key: key, expires: now.Add(authorizer.CacheTTL)}
+	authorizer.Unlock()
+
+	return key, nil
+}
+
+func (authorizer *HTTPAuthorizer) fetch(apiKey string) (*APIKey, error) {
+	request, err := http.NewRequest("GET", authorizer.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth(apiKey, "")
+
+	resp, err := authorizer.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("authorizer returned %s", resp.Status)
+	}
+
+	key := &APIKey{}
+	if err = json.NewDecoder(resp.Body).Decode(key); err != nil {
+		return nil, fmt.Errorf("authorizer returned %s", err.Error())
+	}
+	return key, nil
+}
+
+//---------------------------------------------------------------------------
+
+func (service *Service) setAuthorizer(authorizer Authorizer) {
+	service.Lock()
+	service.authorizer = authorizer
+	service.Unlock()
+}
+
+func (service *Service) getAuthorizer() Authorizer {
+	service.Lock()
+	defer service.Unlock()
+	return service.authorizer
+}
+
+func (service *Service) newUnauthorizedResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusUnauthorized,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+func (service *Service) newForbiddenResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusForbidden,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+// authorize wraps a route's handler so that, if the service has an
+// Authorizer, the caller must give an API key, as the basic auth user
+// name, that allows the access. The key is then in the context, for the
+// handlers that look at each message's application.
+func (server *Server) authorize(access apiAccess, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorizer := server.service.getAuthorizer()
+		if authorizer == nil || access == accessPublic {
+			handler(c)
+			return
+		}
+
+		apiKey, _, ok := c.Request.BasicAuth()
+		if !ok || apiKey == "" {
+			c.Header("WWW-Authenticate", `Basic realm="pz-logger"`)
+			piazza.GinReturnJson(c, server.service.newUnauthorizedResponse(errors.New("API key required")))
+			return
+		}
+
+		key, err := authorizer.Authorize(apiKey)
+		if err != nil {
+			piazza.GinReturnJson(c, server.service.newServiceUnavailableResponse(
+				fmt.Errorf("unable to check API key: %s", err.Error())))
+			return
+		}
+		if key == nil {
+			c.Header("WWW-Authenticate", `Basic realm="pz-logger"`)
+			piazza.GinReturnJson(c, server.service.newUnauthorizedResponse(errors.New("invalid API key")))
+			return
+		}
+		if !key.may(access) {
+			piazza.GinReturnJson(c, server.service.newForbiddenResponse(
+				fmt.Errorf("API key of %s may not use %s %s", key.Name, c.Request.Method, c.Request.URL.Path)))
+			return
+		}
+
+		c.Set(apiKeyContextKey, key)
+		handler(c)
+	}
+}
+
+// getAPIKey returns the caller's key, or nil if authentication is off.
+func getAPIKey(c *gin.Context) *APIKey {
+	if value, ok := c.Get(apiKeyContextKey); ok {
+		return value.(*APIKey)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubAuthorizer knows a fixed set of keys, or fails with err.
+type stubAuthorizer struct {
+	keys map[string]*APIKey
+	err  error
+}
+
+func (stub *stubAuthorizer) Authorize(apiKey string) (*APIKey, error) {
+	if stub.err != nil {
+		return nil, stub.err
+	}
+	return stub.keys[apiKey], nil
+}
+
+func TestAPIKeyAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	var none *APIKey
+	assert.True(none.mayWrite("anything"))
+
+	key := &APIKey{Name: "gateway", Applications: []string{"pz-*", "exact"}, Read: true}
+	assert.True(key.mayWrite("pz-gateway"))
+	assert.True(key.mayWrite("exact"))
+	assert.False(key.mayWrite("exactly"))
+	assert.False(key.mayWrite("other"))
+
+	assert.True(key.may(accessPublic))
+	assert.True(key.may(accessWrite))
+	assert.True(key.may(accessRead))
+	assert.False(key.may(accessQuery))
+	assert.False(key.may(accessAlerts))
+	assert.False(key.may(accessAdmin))
+
+	assert.False((&APIKey{Admin: true}).may(accessWrite))
+	assert.True((&APIKey{Alerts: true}).may(accessAlerts))
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzlogger-auth")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	path := filepath.Join(dir, "keys.json")
+	assert.NoError(ioutil.WriteFile(path, []byte(`{
+		"1234": {"name": "gateway", "applications": ["pz-*"], "read": true},
+		"5678": {"name": "ops", "query": true, "admin": true}
+	}`), 0600))
+
+	authorizer, err := LoadKeyFile(path)
+	assert.NoError(err)
+
+	key, err := authorizer.Authorize("1234")
+	assert.NoError(err)
+	assert.Equal(&APIKey{Name: "gateway", Applications: []string{"pz-*"}, Read: true}, key)
+
+	key, err = authorizer.Authorize("5678")
+	assert.NoError(err)
+	assert.Equal(&APIKey{Name: "ops", Query: true, Admin: true}, key)
+
+	key, err = authorizer.Authorize("9999")
+	assert.NoError(err)
+	assert.Nil(key)
+
+	assert.NoError(ioutil.WriteFile(path, []byte(`{"": {"name": "nobody"}}`), 0600))
+	_, err = LoadKeyFile(path)
+	assert.Error(err)
+
+	assert.NoError(ioutil.WriteFile(path, []byte(`["1234"]`), 0600))
+	_, err = LoadKeyFile(path)
+	assert.Error(err)
+
+	_, err = LoadKeyFile(filepath.Join(dir, "missing.json"))
+	assert.Error(err)
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		apiKey, _, _ := r.BasicAuth()
+		switch {
+		case status != http.StatusOK:
+			w.WriteHeader(status)
+		case apiKey == "1234":
+			assert.NoError(json.NewEncoder(w).Encode(&APIKey{Name: "gateway", Applications: []string{"pz-*"}}))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	authorizer := NewHTTPAuthorizer(server.URL)
+
+	key, err := authorizer.Authorize("1234")
+	assert.NoError(err)
+	assert.Equal(&APIKey{Name: "gateway", Applications: []string{"pz-*"}}, key)
+
+	key, err = authorizer.Authorize("9999")
+	assert.NoError(err)
+	assert.Nil(key)
+	assert.Equal(2, calls)
+
+	// both answers are remembered
+	status = http.StatusInternalServerError
+	key, err = authorizer.Authorize("1234")
+	assert.NoError(err)
+	assert.NotNil(key)
+	key, err = authorizer.Authorize("9999")
+	assert.NoError(err)
+	assert.Nil(key)
+	assert.Equal(2, calls)
+
+	// until they expire
+	authorizer.cache["1234"].expires = time.Now()
+	_, err = authorizer.Authorize("1234")
+	assert.Error(err)
+	_, err = authorizer.Authorize("1234")
+	assert.Error(err)
+	assert.Equal(4, calls)
+}
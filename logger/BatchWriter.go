@@ -0,0 +1,404 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// ErrQueueFull is returned by BatchWriter.Write when the queue is full and
+// the policy is QueueFullReject.
+var ErrQueueFull = errors.New("write queue is full")
+
+var errBatchWriterClosed = errors.New("batch writer is closed")
+
+// QueueFullPolicy says what BatchWriter.Write does when the queue is full.
+type QueueFullPolicy string
+
+const (
+	// QueueFullBlock waits for room in the queue.
+	QueueFullBlock QueueFullPolicy = "block"
+
+	// QueueFullDropOldest discards the oldest queued message to make room.
+	QueueFullDropOldest QueueFullPolicy = "drop-oldest"
+
+	// QueueFullDropNewest discards the message being written.
+	QueueFullDropNewest QueueFullPolicy = "drop-newest"
+
+	// QueueFullReject returns ErrQueueFull, which the Service turns into a
+	// 429 for the client.
+	QueueFullReject QueueFullPolicy = "reject"
+)
+
+// BatchWriterConfig configures a BatchWriter. The zero value is usable.
+type BatchWriterConfig struct {
+	QueueSize     int // max messages waiting to be written
+	Workers       int
+	BatchSize     int           // a batch is flushed when it gets this big...
+	FlushInterval time.Duration // ...or this long after its first message
+	FullPolicy    QueueFullPolicy
+}
+
+func (config *BatchWriterConfig) setDefaults() {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 250 * time.Millisecond
+	}
+	if config.FullPolicy == "" {
+		config.FullPolicy = QueueFullBlock
+	}
+}
+
+// BatchWriterStats is reported in /admin/stats.
+type BatchWriterStats struct {
+	QueueLength   int `json:"queueLength"`
+	QueueCapacity int `json:"queueCapacity"`
+	Workers       int `json:"workers"`
+	NumWritten    int `json:"numWritten"`
+	NumFailed     int `json:"numFailed"`
+	NumDropped    int `json:"numDropped"`
+	NumRejected   int `json:"numRejected"`
+	NumAbandoned  int `json:"numAbandoned"`
+	NumBatches    int `json:"numBatches"`
+}
+
+// BatchWriter is a pzsyslog.Writer that puts async writes on a fixed-size
+// queue, from which a fixed number of workers write them in batches. If it
+// was given a bulkIndexer, each batch is one bulk request; otherwise the
+// messages of a batch are passed to the wrapped Writer one at a time.
+// Writes that are not async go straight to the wrapped Writer.
+//
+// As with the vendored writers, failed async writes can only be logged.
+type BatchWriter struct {
+	// The wrapped Writer. Embedding it is what lets us satisfy the
+	// pzsyslog.Writer interface from outside that package.
+	pzsyslog.Writer
+
+	config  BatchWriterConfig
+	indexer bulkIndexer
+
+	// held for reading while sending to the queue, and for writing to
+	// close it
+	queueLock sync.RWMutex
+	queue     chan *storedMessage
+	closed    bool
+
+	// closed when shutdown starts, to turn away writers waiting for room
+	// in the queue
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// closed when the shutdown deadline passes, after which the workers
+	// empty the queue without writing anything
+	abandon chan struct{}
+
+	statsLock sync.Mutex
+	stats     BatchWriterStats
+	pending   int // queued or being written
+
+	wg sync.WaitGroup
+}
+
+var _ pzsyslog.Writer = (*BatchWriter)(nil)
+
+// NewBatchWriter wraps the given Writer and starts the workers.
+func NewBatchWriter(writer pzsyslog.Writer, config *BatchWriterConfig) (*BatchWriter, error) {
+	return newBatchWriter(writer, nil, config)
+}
+
+func newBatchWriter(writer pzsyslog.Writer, indexer bulkIndexer, config *BatchWriterConfig) (*BatchWriter, error) {
+	if writer == nil {
+		return nil, errors.New("batch writer needs a writer")
+	}
+
+	bw := &BatchWriter{
+		Writer:  writer,
+		indexer: indexer,
+		closing: make(chan struct{}),
+		abandon: make(chan struct{}),
+	}
+	if config != nil {
+		bw.config = *config
+	}
+	bw.config.setDefaults()
+
+	switch bw.config.FullPolicy {
+	case QueueFullBlock, QueueFullDropOldest, QueueFullDropNewest, QueueFullReject:
+	default:
+		return nil, fmt.Errorf("unknown queue full policy: %s", bw.config.FullPolicy)
+	}
+
+	bw.queue = make(chan *storedMessage, bw.config.QueueSize)
+	bw.stats.QueueCapacity = bw.config.QueueSize
+	bw.stats.Workers = bw.config.Workers
+
+	for i := 0; i < bw.config.Workers; i++ {
+		bw.wg.Add(1)
+		go bw.work()
+	}
+
+	return bw, nil
+}
+
+// Write queues the message if async is set, and otherwise writes it
+// immediately.
+func (bw *BatchWriter) Write(mssg *pzsyslog.Message, async bool) error {
+	return bw.writeDoc(&storedMessage{Message: mssg}, async)
+}
+
+// writeDoc is Write for a message that may belong to a tenant. Only the
+// bulk indexer can store the tenant, so without one it is lost.
+func (bw *BatchWriter) writeDoc(mssg *storedMessage, async bool) error {
+	if !async {
+		if mssg.Tenant == "" || bw.indexer == nil {
+			return bw.Writer.Write(mssg.Message, false)
+		}
+		errs, err := bw.indexer.Bulk(pzsyslog.LoggerType, []interface{}{mssg})
+		if err != nil {
+			return err
+		}
+		return errs[0]
+	}
+
+	bw.queueLock.RLock()
+	defer bw.queueLock.RUnlock()
+
+	if bw.closed {
+		return errBatchWriterClosed
+	}
+
+	switch bw.config.FullPolicy {
+	case QueueFullBlock:
+		select {
+		case bw.queue <- mssg:
+			bw.addPending(1)
+			return nil
+		case <-bw.closing:
+			return errBatchWriterClosed
+		}
+
+	case QueueFullDropOldest:
+		for {
+			select {
+			case bw.queue <- mssg:
+				bw.addPending(1)
+				return nil
+			default:
+			}
+			select {
+			case <-bw.queue:
+				bw.statsLock.Lock()
+				bw.stats.NumDropped++
+				bw.pending--
+				bw.statsLock.Unlock()
+			default:
+			}
+		}
+
+	case QueueFullDropNewest:
+		select {
+		case bw.queue <- mssg:
+			bw.addPending(1)
+		default:
+			bw.count(func(stats *BatchWriterStats) { stats.NumDropped++ })
+		}
+		return nil
+	}
+
+	select {
+	case bw.queue <- mssg:
+		bw.addPending(1)
+		return nil
+	default:
+		bw.count(func(stats *BatchWriterStats) { stats.NumRejected++ })
+		return ErrQueueFull
+	}
+}
+
+// Close stops taking new messages, waits for the queue to be written out,
+// and then closes the wrapped Writer.
+func (bw *BatchWriter) Close() error {
+	_, _, err := bw.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown is like Close, except that it gives up once the context is
+// done: it returns then, without waiting for writes still under way, and
+// whatever is queued is thrown away. It returns how many messages were
+// written after it was called, and how many were abandoned, counting those
+// still being written at the deadline. Writers waiting for room in the
+// queue are turned away with an error.
+func (bw *BatchWriter) Shutdown(ctx context.Context) (int, int, error) {
+	bw.closingOnce.Do(func() { close(bw.closing) })
+
+	bw.queueLock.Lock()
+	if bw.closed {
+		bw.queueLock.Unlock()
+		return 0, 0, nil
+	}
+	bw.closed = true
+	close(bw.queue)
+	bw.queueLock.Unlock()
+
+	before := bw.Stats()
+
+	done := make(chan struct{})
+	go func() {
+		bw.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(bw.abandon)
+
+		bw.statsLock.Lock()
+		after, left := bw.stats, bw.pending
+		bw.statsLock.Unlock()
+
+		// the wrapped Writer can't be closed under a worker still using it
+		go func() {
+			<-done
+			if err := bw.Writer.Close(); err != nil {
+				log.Printf("Unable to close writer: %s", err.Error())
+			}
+		}()
+
+		flushed := after.NumWritten - before.NumWritten
+		abandoned := after.NumAbandoned - before.NumAbandoned + left
+		return flushed, abandoned, nil
+	}
+
+	after := bw.Stats()
+	flushed := after.NumWritten - before.NumWritten
+	abandoned := after.NumAbandoned - before.NumAbandoned
+
+	return flushed, abandoned, bw.Writer.Close()
+}
+
+// Stats returns the queue length and counters.
+func (bw *BatchWriter) Stats() BatchWriterStats {
+	bw.statsLock.Lock()
+	defer bw.statsLock.Unlock()
+
+	stats := bw.stats
+	stats.QueueLength = len(bw.queue)
+	return stats
+}
+
+func (bw *BatchWriter) count(f func(*BatchWriterStats)) {
+	bw.statsLock.Lock()
+	f(&bw.stats)
+	bw.statsLock.Unlock()
+}
+
+func (bw *BatchWriter) addPending(n int) {
+	bw.statsLock.Lock()
+	bw.pending += n
+	bw.statsLock.Unlock()
+}
+
+func (bw *BatchWriter) work() {
+	defer bw.wg.Done()
+
+	for {
+		mssg, ok := <-bw.queue
+		if !ok {
+			return
+		}
+
+		batch := []*storedMessage{mssg}
+		timer := time.NewTimer(bw.config.FlushInterval)
+
+	fill:
+		for len(batch) < bw.config.BatchSize {
+			select {
+			case mssg, ok = <-bw.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, mssg)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		select {
+		case <-bw.abandon:
+			bw.statsLock.Lock()
+			bw.stats.NumAbandoned += len(batch)
+			bw.pending -= len(batch)
+			bw.statsLock.Unlock()
+			continue
+		default:
+		}
+
+		bw.flush(batch)
+	}
+}
+
+func (bw *BatchWriter) flush(batch []*storedMessage) {
+	failed := 0
+
+	if bw.indexer != nil {
+		docs := make([]interface{}, len(batch))
+		for i, mssg := range batch {
+			docs[i] = mssg
+		}
+		errs, err := bw.indexer.Bulk(pzsyslog.LoggerType, docs)
+		if err != nil {
+			log.Printf("Unable to log %d messages: %s", len(batch), err.Error())
+			failed = len(batch)
+		} else {
+			for i, e := range errs {
+				if e != nil {
+					log.Printf("Unable to log message [%s] : %s", batch[i].String(), e.Error())
+					failed++
+				}
+			}
+		}
+	} else {
+		for _, mssg := range batch {
+			// the wrapped writer does its own logging of failures
+			if err := bw.Writer.Write(mssg.Message, false); err != nil {
+				failed++
+			}
+		}
+	}
+
+	bw.statsLock.Lock()
+	bw.stats.NumBatches++
+	bw.stats.NumWritten += len(batch) - failed
+	bw.stats.NumFailed += failed
+	bw.pending -= len(batch)
+	bw.statsLock.Unlock()
+}
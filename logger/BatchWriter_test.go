@@ -0,0 +1,224 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// gatedWriter holds up every write until the gate is opened.
+type gatedWriter struct {
+	*pzsyslog.LocalReaderWriter
+	lock sync.Mutex
+	gate chan struct{}
+}
+
+func (w *gatedWriter) Write(mssg *pzsyslog.Message, async bool) error {
+	<-w.gate
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.LocalReaderWriter.Write(mssg, false)
+}
+
+func (w *gatedWriter) texts() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ms, _ := w.LocalReaderWriter.Read(100)
+	texts := []string{}
+	for _, m := range ms {
+		texts = append(texts, m.Message)
+	}
+	return texts
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{LocalReaderWriter: &pzsyslog.LocalReaderWriter{}, gate: make(chan struct{})}
+}
+
+// fillBatchWriter writes "a" and waits for the one worker to take it, so
+// that it is stuck at the gate, and then fills the queue with "b" and "c".
+func fillBatchWriter(assert *assert.Assertions, bw *BatchWriter) {
+	assert.NoError(bw.Write(newSpoolTestMessage("a"), true))
+	for i := 0; i < 100 && bw.Stats().QueueLength > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(bw.Write(newSpoolTestMessage("b"), true))
+	assert.NoError(bw.Write(newSpoolTestMessage("c"), true))
+}
+
+func TestBatchWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	newConfig := func(policy QueueFullPolicy) *BatchWriterConfig {
+		return &BatchWriterConfig{
+			QueueSize:     2,
+			Workers:       1,
+			BatchSize:     1,
+			FlushInterval: time.Millisecond,
+			FullPolicy:    policy,
+		}
+	}
+
+	_, err := NewBatchWriter(newGatedWriter(), newConfig("sometimes"))
+	assert.Error(err)
+
+	{
+		w := newGatedWriter()
+		bw, err := NewBatchWriter(w, newConfig(QueueFullReject))
+		assert.NoError(err)
+		fillBatchWriter(assert, bw)
+		assert.Equal(ErrQueueFull, bw.Write(newSpoolTestMessage("d"), true))
+		close(w.gate)
+		assert.NoError(bw.Close())
+		assert.Equal([]string{"a", "b", "c"}, w.texts())
+		stats := bw.Stats()
+		assert.Equal(3, stats.NumWritten)
+		assert.Equal(1, stats.NumRejected)
+	}
+
+	{
+		w := newGatedWriter()
+		bw, err := NewBatchWriter(w, newConfig(QueueFullDropNewest))
+		assert.NoError(err)
+		fillBatchWriter(assert, bw)
+		assert.NoError(bw.Write(newSpoolTestMessage("d"), true))
+		close(w.gate)
+		assert.NoError(bw.Close())
+		assert.Equal([]string{"a", "b", "c"}, w.texts())
+		assert.Equal(1, bw.Stats().NumDropped)
+	}
+
+	{
+		w := newGatedWriter()
+		bw, err := NewBatchWriter(w, newConfig(QueueFullDropOldest))
+		assert.NoError(err)
+		fillBatchWriter(assert, bw)
+		assert.NoError(bw.Write(newSpoolTestMessage("d"), true))
+		close(w.gate)
+		assert.NoError(bw.Close())
+		assert.Equal([]string{"a", "c", "d"}, w.texts())
+		assert.Equal(1, bw.Stats().NumDropped)
+	}
+
+	{
+		w := newGatedWriter()
+		bw, err := NewBatchWriter(w, newConfig(QueueFullBlock))
+		assert.NoError(err)
+		fillBatchWriter(assert, bw)
+		done := make(chan error)
+		go func() {
+			done <- bw.Write(newSpoolTestMessage("d"), true)
+		}()
+		select {
+		case <-done:
+			assert.Fail("write did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(w.gate)
+		assert.NoError(<-done)
+		assert.NoError(bw.Close())
+		assert.Equal([]string{"a", "b", "c", "d"}, w.texts())
+		assert.Error(bw.Write(newSpoolTestMessage("e"), true))
+	}
+}
+
+func TestBatchWriterBulk(t *testing.T) {
+	assert := assert.New(t)
+
+	indexer := &fakeBulkIndexer{}
+	bw, err := newBatchWriter(&pzsyslog.NilWriter{}, indexer, &BatchWriterConfig{
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 25; i++ {
+		assert.NoError(bw.Write(newSpoolTestMessage("bulk"), true))
+	}
+	assert.NoError(bw.Close())
+
+	stats := bw.Stats()
+	assert.Equal(25, stats.NumWritten)
+	assert.Equal(0, stats.QueueLength)
+	assert.True(stats.NumBatches >= 3)
+	assert.Len(indexer.getTexts(), 25)
+}
+
+func TestBatchWriterShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newGatedWriter()
+	bw, err := NewBatchWriter(w, &BatchWriterConfig{
+		QueueSize:     10,
+		Workers:       1,
+		BatchSize:     1,
+		FlushInterval: time.Millisecond,
+	})
+	assert.NoError(err)
+	fillBatchWriter(assert, bw)
+
+	// "a" is still being written at the deadline, and "b" and "c" are
+	// queued: Shutdown doesn't wait for any of them
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	flushed, abandoned, err := bw.Shutdown(ctx)
+	assert.NoError(err)
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(0, flushed)
+	assert.Equal(3, abandoned)
+
+	close(w.gate)
+	for i := 0; i < 100 && bw.Stats().NumAbandoned < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(2, bw.Stats().NumAbandoned)
+}
+
+func TestBatchWriterShutdownBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	w := newGatedWriter()
+	bw, err := NewBatchWriter(w, &BatchWriterConfig{
+		QueueSize:     2,
+		Workers:       1,
+		BatchSize:     1,
+		FlushInterval: time.Millisecond,
+	})
+	assert.NoError(err)
+	fillBatchWriter(assert, bw)
+
+	// waiting for room in the full queue
+	done := make(chan error)
+	go func() {
+		done <- bw.Write(newSpoolTestMessage("d"), true)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, abandoned, err := bw.Shutdown(ctx)
+	assert.NoError(err)
+	assert.Equal(3, abandoned)
+	assert.Equal(errBatchWriterClosed, <-done)
+	close(w.gate)
+}
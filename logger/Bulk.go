@@ -0,0 +1,260 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// MaxBulkMessages is the largest number of messages accepted by a single
+// call to POST /syslog/bulk.
+const MaxBulkMessages = 5000
+
+// MaxBulkBodySize is the largest body, in bytes, accepted by POST
+// /syslog/bulk and POST /syslog/text. A larger one gets a 413 before it is
+// all read.
+const MaxBulkBodySize = 32 * 1024 * 1024
+
+//---------------------------------------------------------------------------
+
+// BulkItemResult reports what happened to one message of a bulk request.
+// Index is the position of the message in the request body.
+type BulkItemResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message,omitempty"`
+}
+
+// BulkResult is returned from POST /syslog/bulk.
+type BulkResult struct {
+	NumAccepted int              `json:"numAccepted"`
+	NumRejected int              `json:"numRejected"`
+	Items       []BulkItemResult `json:"items"`
+}
+
+func (result *BulkResult) accept(index int) {
+	result.NumAccepted++
+	result.Items[index] = BulkItemResult{Index: index, Accepted: true}
+}
+
+func (result *BulkResult) reject(index int, err error) {
+	result.NumRejected++
+	result.Items[index] = BulkItemResult{Index: index, Accepted: false, Message: err.Error()}
+}
+
+//---------------------------------------------------------------------------
+
+// splitBulkBody breaks a request body into its individual JSON documents.
+// The body may be either a JSON array or newline-delimited JSON; blank
+// lines in the latter are ignored.
+func splitBulkBody(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("request body is empty")
+	}
+
+	if body[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, fmt.Errorf("unable to parse JSON array: %s", err.Error())
+		}
+		return items, nil
+	}
+
+	items := []json.RawMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		item := make([]byte, len(line))
+		copy(item, line)
+		items = append(items, json.RawMessage(item))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+//---------------------------------------------------------------------------
+
+// bulkIndexer stores a batch of documents in a single round trip. The
+// returned slice has one entry per document: nil if the document was
+// stored, otherwise the reason it was not. The error return is reserved
+// for failures of the request as a whole.
+type bulkIndexer interface {
+	Bulk(typ string, docs []interface{}) ([]error, error)
+}
+
+func newBulkIndexer(sys *piazza.SystemConfig, esi elasticsearch.IIndex) (bulkIndexer, error) {
+	if _, ok := esi.(*elasticsearch.Index); !ok {
+		return &postDataBulkIndexer{esi: esi}, nil
+	}
+
+	client, err := newElasticClient(sys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elasticBulkIndexer{client: client, index: esi.IndexName()}, nil
+}
+
+// newElasticClient is for the requests that elasticsearch.IIndex has no
+// call for.
+func newElasticClient(sys *piazza.SystemConfig) (*elastic.Client, error) {
+	url, err := sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	return elastic.NewClient(
+		elastic.SetURL(url),
+		elastic.SetSniff(false),
+		elastic.SetMaxRetries(5),
+	)
+}
+
+// elasticBulkIndexer uses the Elasticsearch _bulk API.
+type elasticBulkIndexer struct {
+	client *elastic.Client
+	index  string
+
+	// if set, picks the index, or alias, for each document
+	route func(doc interface{}) (string, error)
+}
+
+func (bi *elasticBulkIndexer) Bulk(typ string, docs []interface{}) ([]error, error) {
+	errs := make([]error, len(docs))
+	if len(docs) == 0 {
+		return errs, nil
+	}
+
+	bulk := bi.client.Bulk().Index(bi.index).Type(typ)
+	for _, doc := range docs {
+		request := elastic.NewBulkIndexRequest().Doc(doc)
+		if bi.route != nil {
+			index, err := bi.route(doc)
+			if err != nil {
+				return nil, err
+			}
+			request.Index(index)
+		}
+		bulk.Add(request)
+	}
+
+	resp, err := bulk.Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Items) != len(docs) {
+		return nil, fmt.Errorf("bulk response has %d items, expected %d", len(resp.Items), len(docs))
+	}
+
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Error != nil || result.Status < 200 || result.Status > 299 {
+				e := &bulkItemError{Status: result.Status}
+				if result.Error != nil {
+					e.Type, e.Reason = result.Error.Type, result.Error.Reason
+				}
+				errs[i] = e
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// bulkItemError is why Elasticsearch did not store one document of a bulk
+// request.
+type bulkItemError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *bulkItemError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("elasticsearch returned status %d", e.Status)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+}
+
+// temporary says whether the document may be stored if sent again, as
+// when the cluster is too busy (429, es_rejected_execution) or a shard is
+// unavailable (503), rather than the document being unacceptable.
+func (e *bulkItemError) temporary() bool {
+	return e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests ||
+		e.Status >= http.StatusInternalServerError
+}
+
+// isTemporaryBulkError says whether a bulk item error is worth retrying.
+func isTemporaryBulkError(err error) bool {
+	var e *bulkItemError
+	return errors.As(err, &e) && e.temporary()
+}
+
+// postDataBulkIndexer falls back to one PostData call per document. It is
+// used when the index is not a live Elasticsearch index, e.g. under mocking.
+type postDataBulkIndexer struct {
+	esi elasticsearch.IIndex
+}
+
+func (bi *postDataBulkIndexer) Bulk(typ string, docs []interface{}) ([]error, error) {
+	if bi.esi == nil {
+		return nil, errors.New("index not set")
+	}
+
+	errs := make([]error, len(docs))
+	for i, doc := range docs {
+		_, errs[i] = bi.esi.PostData(typ, "", doc)
+	}
+	return errs, nil
+}
+
+//---------------------------------------------------------------------------
+
+// createDocument stores a document only if there is none with its ID yet,
+// saying whether it did.
+func createDocument(esi elasticsearch.IIndex, typ string, id string, doc interface{}) (bool, error) {
+	var result struct {
+		Status int                   `json:"status"`
+		Error  *elastic.ErrorDetails `json:"error"`
+	}
+	endpoint := fmt.Sprintf("/%s/%s/%s/_create", esi.IndexName(), typ, id)
+	if err := esi.DirectAccess("PUT", endpoint, doc, &result); err != nil {
+		return false, err
+	}
+	if result.Error == nil {
+		return true, nil
+	}
+	if result.Status == http.StatusConflict {
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to store %s %s: %s: %s", typ, id, result.Error.Type, result.Error.Reason)
+}
@@ -0,0 +1,250 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// cursorTiebreaker is the field added to the end of every sort so that no
+// two hits sort the same, which the cursor needs to be exact.
+const cursorTiebreaker = "_uid"
+
+// CursorMetadata goes in the metadata of a GET /syslog or POST /query
+// response. NextCursor is only set if there may be more results; passing
+// it back as ?cursor= gets the page after this one, no matter how many
+// messages have arrived since. (JsonPagination belongs to pz-gocommon,
+// which is why the cursor isn't in there.)
+type CursorMetadata struct {
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+var errBadCursor = errors.New("cursor is not valid for this query")
+
+// syslogCursor is what the opaque cursor token holds: the sort it was made
+// for and the sort values of the last hit of the page.
+type syslogCursor struct {
+	Sort   []cursorSortKey `json:"s"`
+	Values []interface{}   `json:"v"`
+}
+
+type cursorSortKey struct {
+	Field string `json:"f"`
+	Desc  bool   `json:"d,omitempty"`
+}
+
+func encodeCursor(cursor *syslogCursor) (string, error) {
+	byts, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(byts), nil
+}
+
+func decodeCursor(s string) (*syslogCursor, error) {
+	byts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	cursor := &syslogCursor{}
+	if err = json.Unmarshal(byts, cursor); err != nil {
+		return nil, errBadCursor
+	}
+	if len(cursor.Sort) == 0 || len(cursor.Sort) != len(cursor.Values) {
+		return nil, errBadCursor
+	}
+	return cursor, nil
+}
+
+// getCursorSort returns the sort of a query, with the tiebreaker added if
+// it isn't already there.
+func getCursorSort(dsl map[string]interface{}) ([]cursorSortKey, error) {
+	keys := []cursorSortKey{}
+
+	if sortDsl, ok := dsl["sort"]; ok {
+		memoryKeys, err := parseMemorySort(sortDsl)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range memoryKeys {
+			keys = append(keys, cursorSortKey{Field: key.field, Desc: key.desc})
+		}
+	}
+
+	if len(keys) == 0 || keys[len(keys)-1].Field != cursorTiebreaker {
+		desc := len(keys) > 0 && keys[len(keys)-1].Desc
+		keys = append(keys, cursorSortKey{Field: cursorTiebreaker, Desc: desc})
+	}
+
+	return keys, nil
+}
+
+// applyCursor makes a search sort with the tiebreaker and, if the cursor
+// isn't empty, start after the hit it was made from. (search_after would do
+// this, but it needs ES 5.) Note that the total hits are then those after
+// the cursor.
+func applyCursor(jsn string, cursor string) (string, error) {
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &dsl); err != nil {
+		return "", err
+	}
+
+	keys, err := getCursorSort(dsl)
+	if err != nil {
+		return "", err
+	}
+
+	sortDsl := make([]interface{}, len(keys))
+	for i, key := range keys {
+		order := "asc"
+		if key.Desc {
+			order = "desc"
+		}
+		sortDsl[i] = map[string]interface{}{key.Field: map[string]interface{}{"order": order}}
+	}
+	dsl["sort"] = sortDsl
+
+	if cursor != "" {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return "", err
+		}
+		if len(c.Sort) != len(keys) {
+			return "", errBadCursor
+		}
+		for i := range keys {
+			if c.Sort[i] != keys[i] || c.Values[i] == nil {
+				return "", errBadCursor
+			}
+		}
+
+		query, ok := dsl["query"]
+		if !ok {
+			query = map[string]interface{}{"match_all": map[string]interface{}{}}
+		}
+		dsl["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":   query,
+				"filter": cursorAfterQuery(c),
+			},
+		}
+		dsl["from"] = 0
+	}
+
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
+
+// cursorAfterQuery matches the hits that sort after the cursor's: those
+// past it on the first sort field, or level on that and past it on the
+// second, and so on.
+func cursorAfterQuery(cursor *syslogCursor) map[string]interface{} {
+	should := []interface{}{}
+	for i, key := range cursor.Sort {
+		must := []interface{}{}
+		for j := 0; j < i; j++ {
+			must = append(must, map[string]interface{}{
+				"term": map[string]interface{}{cursor.Sort[j].Field: cursor.Values[j]},
+			})
+		}
+		op := "gt"
+		if key.Desc {
+			op = "lt"
+		}
+		must = append(must, map[string]interface{}{
+			"range": map[string]interface{}{
+				key.Field: map[string]interface{}{op: cursor.Values[i]},
+			},
+		})
+		should = append(should, map[string]interface{}{
+			"bool": map[string]interface{}{"must": must},
+		})
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{"should": should},
+	}
+}
+
+// searchPage runs a search made by applyCursor, returning the cursor for
+// the page after it as well. The search goes straight to ES, since the
+// cursor is made of each hit's sort values, which SearchByJSON leaves out.
+func searchPage(esi elasticsearch.IIndex, typ string, jsn string) (*elasticsearch.SearchResult, string, error) {
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &dsl); err != nil {
+		return nil, "", err
+	}
+
+	var result struct {
+		Hits  *elastic.SearchHits   `json:"hits"`
+		Error *elastic.ErrorDetails `json:"error"`
+	}
+	endpoint := fmt.Sprintf("/%s/%s/_search", esi.IndexName(), typ)
+	if err := esi.DirectAccess("POST", endpoint, dsl, &result); err != nil {
+		return nil, "", err
+	}
+	if result.Error != nil {
+		return nil, "", fmt.Errorf("search failed: %s: %s", result.Error.Type, result.Error.Reason)
+	}
+	if result.Hits == nil {
+		return nil, "", errors.New("search failed: no hits in the response")
+	}
+
+	nextCursor, err := getNextCursor(dsl, result.Hits.Hits)
+	if err != nil {
+		return nil, "", err
+	}
+	return elasticsearch.NewSearchResult(&elastic.SearchResult{Hits: result.Hits}), nextCursor, nil
+}
+
+// getNextCursor returns the cursor for the page after the given hits, or
+// "" if there isn't one: the page wasn't full, or it is sorted by something
+// that can't be searched on, like _score, or that the last hit doesn't
+// have.
+func getNextCursor(dsl map[string]interface{}, hits []*elastic.SearchHit) (string, error) {
+	size := 10
+	if s, ok := dsl["size"].(float64); ok {
+		size = int(s)
+	}
+	if len(hits) == 0 || len(hits) < size {
+		return "", nil
+	}
+	last := hits[len(hits)-1]
+
+	keys, err := getCursorSort(dsl)
+	if err != nil {
+		return "", err
+	}
+	if len(last.Sort) != len(keys) {
+		return "", nil
+	}
+
+	for i, key := range keys {
+		if (strings.HasPrefix(key.Field, "_") && key.Field != cursorTiebreaker) || last.Sort[i] == nil {
+			return "", nil
+		}
+	}
+
+	return encodeCursor(&syslogCursor{Sort: keys, Values: last.Sort})
+}
@@ -0,0 +1,137 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+func TestCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("cursortest")
+	assert.NoError(esi.Create(""))
+
+	// five messages share each timestamp, so pages split ties
+	start := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	post := func(i int, when time.Time) {
+		m := pzsyslog.NewMessage("123456")
+		m.Message = strconv.Itoa(i)
+		m.TimeStamp = piazza.TimeStamp(when)
+		_, err := esi.PostData(pzsyslog.LoggerType, "", m)
+		assert.NoError(err)
+	}
+	for i := 0; i < 25; i++ {
+		post(i, start.Add(time.Duration(i/5)*time.Minute))
+	}
+
+	query := `{"query":{"match_all":{}},"size":10,"sort":{"timeStamp":"desc"}}`
+
+	seen := map[string]bool{}
+	last := time.Time{}
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		jsn, err := applyCursor(query, cursor)
+		assert.NoError(err)
+		assert.NotContains(jsn, "search_after")
+		result, next, err := searchPage(esi, pzsyslog.LoggerType, jsn)
+		assert.NoError(err)
+		if pages == 0 {
+			assert.EqualValues(25, result.TotalHits())
+		} else {
+			// only those after the cursor
+			assert.EqualValues(25-10*pages, result.TotalHits())
+		}
+
+		msgs, err := extractFromSearchResult(result)
+		assert.NoError(err)
+		for _, m := range msgs {
+			assert.False(seen[m.Message], m.Message)
+			seen[m.Message] = true
+			when := time.Time(m.TimeStamp)
+			assert.False(!last.IsZero() && when.After(last))
+			last = when
+		}
+
+		// new arrivals don't shift the pages still to come
+		post(100+pages, start.Add(time.Hour))
+
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	assert.Len(seen, 25)
+
+	// a cursor only works with the sort it came from
+	jsn, err := applyCursor(query, "")
+	assert.NoError(err)
+	_, cursor, err = searchPage(esi, pzsyslog.LoggerType, jsn)
+	assert.NoError(err)
+	assert.NotEmpty(cursor)
+
+	_, err = applyCursor(`{"sort":{"timeStamp":"asc"}}`, cursor)
+	assert.Equal(errBadCursor, err)
+	_, err = applyCursor(query, "not a cursor")
+	assert.Equal(errBadCursor, err)
+}
+
+func TestCursorQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	// made of the last hit's sort values, and then a range on each
+	cursor, err := getNextCursor(map[string]interface{}{
+		"size": 1.0,
+		"sort": []interface{}{map[string]interface{}{"timeStamp": "desc"}},
+	}, []*elastic.SearchHit{{Id: "7", Sort: []interface{}{1469494800000.0, "LogData#7"}}})
+	assert.NoError(err)
+
+	jsn, err := applyCursor(`{"query":{"term":{"application":"a"}},"sort":{"timeStamp":"desc"},"size":1}`, cursor)
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"query": {"bool": {
+			"must": {"term": {"application": "a"}},
+			"filter": {"bool": {"should": [
+				{"bool": {"must": [
+					{"range": {"timeStamp": {"lt": 1469494800000}}}
+				]}},
+				{"bool": {"must": [
+					{"term": {"timeStamp": 1469494800000}},
+					{"range": {"_uid": {"lt": "LogData#7"}}}
+				]}}
+			]}}
+		}},
+		"sort": [{"timeStamp": {"order": "desc"}}, {"_uid": {"order": "desc"}}],
+		"size": 1,
+		"from": 0
+	}`, jsn)
+
+	// nothing to page on
+	for _, hits := range [][]*elastic.SearchHit{
+		{{Id: "7", Sort: []interface{}{nil, "LogData#7"}}},
+		{{Id: "7"}},
+		{},
+	} {
+		cursor, err = getNextCursor(map[string]interface{}{"size": 1.0, "sort": "timeStamp"}, hits)
+		assert.NoError(err)
+		assert.Empty(cursor)
+	}
+}
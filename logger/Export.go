@@ -0,0 +1,223 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// ExportPageSize is how many messages GET /syslog/export fetches from
+// Elasticsearch at a time.
+const ExportPageSize = 1000
+
+// ExportStatusTrailer is the HTTP trailer that says whether an export got
+// to the end: "complete", or what went wrong.
+const ExportStatusTrailer = "X-Export-Status"
+
+// exportFormats maps each format GET /syslog/export takes to its content
+// type and file extension.
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"rfc5424": {"text/plain; charset=utf-8", "log"},
+}
+
+// exportCSVHeader names the columns of a CSV export, in order.
+var exportCSVHeader = []string{
+	"timeStamp", "severity", "facility", "version", "hostName", "application",
+	"process", "messageId", "message",
+	"auditData.actor", "auditData.action", "auditData.actee",
+	"metricData.name", "metricData.value", "metricData.object",
+	"sourceData.file", "sourceData.function", "sourceData.line",
+}
+
+// syslogExport writes every message matching a GET /syslog query, a page
+// at a time, following a cursor so that nothing is missed or repeated.
+type syslogExport struct {
+	service *Service
+	format  string
+	dsl     string
+}
+
+// NewExport checks the parameters of GET /syslog/export, which are those
+// of GET /syslog (except for paging) plus format.
+func (service *Service) NewExport(params *piazza.HttpQueryParams) (*syslogExport, *piazza.JsonResponse) {
+	format, err := params.GetAsString("format", "ndjson")
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+	if _, ok := exportFormats[format]; !ok {
+		return nil, service.newBadRequestResponse(
+			fmt.Errorf("format must be one of ndjson, csv or rfc5424, not %q", format))
+	}
+
+	order, err := params.GetAsSortOrder("order", piazza.SortOrderAscending)
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+	pagination := &piazza.JsonPagination{
+		PerPage: ExportPageSize,
+		SortBy:  "timeStamp",
+		Order:   order,
+	}
+
+	dsl, err := createQueryDslAsString(pagination, params)
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+	if dsl == "" {
+		dsl, err = createMatchAllDslAsString(pagination)
+		if err != nil {
+			return nil, service.newInternalErrorResponse(err)
+		}
+	}
+
+	return &syslogExport{service: service, format: format, dsl: dsl}, nil
+}
+
+func (export *syslogExport) contentType() string {
+	return exportFormats[export.format].contentType
+}
+
+func (export *syslogExport) fileName() string {
+	return "syslog." + exportFormats[export.format].extension
+}
+
+// WriteTo writes the messages, calling flush after each page. Once it has
+// started, an error can only cut the output short, so the output then ends
+// with a line saying so: {"error": ...} for ndjson, and otherwise one
+// starting "# export cut short".
+func (export *syslogExport) WriteTo(w io.Writer, flush func()) (int, error) {
+	var csvWriter *csv.Writer
+	if export.format == "csv" {
+		csvWriter = csv.NewWriter(w)
+	}
+
+	count, err := export.writePages(w, csvWriter, flush)
+	if err == nil {
+		return count, nil
+	}
+
+	// the output may well be unwritable by now, so this is best effort
+	text := "export cut short: " + err.Error()
+	switch export.format {
+	case "ndjson":
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": text})
+	case "csv":
+		_ = csvWriter.Write([]string{"# " + text})
+		csvWriter.Flush()
+	default:
+		_, _ = io.WriteString(w, "# "+text+"\n")
+	}
+	flush()
+
+	return count, err
+}
+
+func (export *syslogExport) writePages(w io.Writer, csvWriter *csv.Writer, flush func()) (int, error) {
+	if csvWriter != nil {
+		if err := csvWriter.Write(exportCSVHeader); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	cursor := ""
+	for {
+		dsl, err := applyCursor(export.dsl, cursor)
+		if err != nil {
+			return count, err
+		}
+		searchResult, next, err := export.service.searchPage(pzsyslog.LoggerType, dsl)
+		if err != nil {
+			return count, err
+		}
+
+		for _, hit := range *searchResult.GetHits() {
+			if hit.Source == nil {
+				continue
+			}
+			// so that the SDEs get our PEN
+			mssg := pzsyslog.NewMessage(export.service.pen)
+			if err = json.Unmarshal(*hit.Source, mssg); err != nil {
+				return count, err
+			}
+
+			switch export.format {
+			case "ndjson":
+				err = json.NewEncoder(w).Encode(mssg)
+			case "csv":
+				err = csvWriter.Write(exportCSVRecord(mssg))
+			case "rfc5424":
+				_, err = io.WriteString(w, mssg.String()+"\n")
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if csvWriter != nil {
+			csvWriter.Flush()
+			if err = csvWriter.Error(); err != nil {
+				return count, err
+			}
+		}
+		flush()
+
+		if cursor = next; cursor == "" {
+			return count, nil
+		}
+	}
+}
+
+func exportCSVRecord(mssg *pzsyslog.Message) []string {
+	record := []string{
+		mssg.TimeStamp.String(),
+		strconv.Itoa(mssg.Severity.Value()),
+		strconv.Itoa(mssg.Facility),
+		strconv.Itoa(mssg.Version),
+		mssg.HostName,
+		mssg.Application,
+		mssg.Process,
+		mssg.MessageID,
+		mssg.Message,
+		"", "", "",
+		"", "", "",
+		"", "", "",
+	}
+	if audit := mssg.AuditData; audit != nil {
+		record[9], record[10], record[11] = audit.Actor, audit.Action, audit.Actee
+	}
+	if metric := mssg.MetricData; metric != nil {
+		record[12] = metric.Name
+		record[13] = strconv.FormatFloat(metric.Value, 'g', -1, 64)
+		record[14] = metric.Object
+	}
+	if source := mssg.SourceData; source != nil {
+		record[15], record[16], record[17] = source.File, source.Function, strconv.Itoa(source.Line)
+	}
+	return record
+}
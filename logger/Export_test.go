@@ -0,0 +1,135 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("exporttest")
+	assert.NoError(esi.Create(""))
+
+	// more than one page's worth, all with the same timestamp
+	start := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	for i := 0; i < ExportPageSize+5; i++ {
+		m := pzsyslog.NewMessage("123456")
+		m.Application = "pz-exporter"
+		m.TimeStamp = piazza.TimeStamp(start)
+		m.Message = "bulk"
+		_, err := esi.PostData(pzsyslog.LoggerType, "", m)
+		assert.NoError(err)
+	}
+	{
+		m := pzsyslog.NewMessage("123456")
+		m.Application = "pz-auditor"
+		m.HostName = "host"
+		m.Severity = pzsyslog.Notice
+		m.TimeStamp = piazza.TimeStamp(start.Add(time.Minute))
+		m.Message = `said "hi", twice`
+		m.AuditData = &pzsyslog.AuditElement{Actor: "me", Action: "login", Actee: "you"}
+		_, err := esi.PostData(pzsyslog.LoggerType, "", m)
+		assert.NoError(err)
+	}
+
+	service := &Service{esIndex: esi, pen: "123456"}
+
+	export := func(query string) string {
+		request, err := http.NewRequest("GET", "/syslog/export?"+query, nil)
+		assert.NoError(err)
+		export, jErr := service.NewExport(newQueryParams(request))
+		if !assert.Nil(jErr) {
+			return ""
+		}
+		buf := &bytes.Buffer{}
+		flushes := 0
+		_, err = export.WriteTo(buf, func() { flushes++ })
+		assert.NoError(err)
+		assert.True(flushes > 0)
+		return buf.String()
+	}
+
+	{
+		out := export("format=ndjson")
+		lines := 0
+		scanner := bufio.NewScanner(strings.NewReader(out))
+		for scanner.Scan() {
+			m := pzsyslog.Message{}
+			assert.NoError(json.Unmarshal(scanner.Bytes(), &m))
+			lines++
+		}
+		assert.Equal(ExportPageSize+6, lines)
+	}
+
+	{
+		out := export("format=csv&service=pz-auditor")
+		records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+		assert.NoError(err)
+		if assert.Len(records, 2) {
+			assert.Equal(exportCSVHeader, records[0])
+			assert.Equal(`said "hi", twice`, records[1][8])
+			assert.Equal("me", records[1][9])
+			assert.Equal("", records[1][12])
+		}
+	}
+
+	{
+		out := export("format=rfc5424&service=pz-auditor")
+		assert.Equal(1, strings.Count(out, "\n"))
+		assert.Contains(out, `<13>1 2016-07-26T01:01:00Z host pz-auditor`)
+		assert.Contains(out, `[pzaudit@123456 actor="me" action="login" actee="you"]`)
+	}
+
+	request, err := http.NewRequest("GET", "/syslog/export?format=xml", nil)
+	assert.NoError(err)
+	_, jErr := service.NewExport(newQueryParams(request))
+	if assert.NotNil(jErr) {
+		assert.Equal(http.StatusBadRequest, jErr.StatusCode)
+	}
+
+	// a failure says so at the end of the output
+	broken := &Service{esIndex: elasticsearch.NewMockIndex("exporttest"), pen: "123456"}
+	for format, last := range map[string]string{
+		"ndjson":  `{"error":"export cut short: DirectAccess not supported"}`,
+		"csv":     `# export cut short: DirectAccess not supported`,
+		"rfc5424": `# export cut short: DirectAccess not supported`,
+	} {
+		request, err = http.NewRequest("GET", "/syslog/export?format="+format, nil)
+		assert.NoError(err)
+		export, jErr := broken.NewExport(newQueryParams(request))
+		if !assert.Nil(jErr) {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		_, err = export.WriteTo(buf, func() {})
+		assert.Error(err)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Equal(last, lines[len(lines)-1], format)
+	}
+}
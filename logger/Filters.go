@@ -0,0 +1,163 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// exactFilterFields are the fields that GET /syslog can filter on by exact
+// match. The query parameter has the same name as the field. A parameter
+// may have several values, given either as repeated parameters or
+// separated by commas, and matches any of them.
+var exactFilterFields = []string{
+	"hostName",
+	"process",
+	"messageId",
+	"auditData.actor",
+	"auditData.action",
+	"auditData.actee",
+	"metricData.name",
+	"sourceData.file",
+	"sourceData.function",
+	"tenant",
+}
+
+var severityNames = map[string]pzsyslog.Severity{
+	"emergency":     pzsyslog.Emergency,
+	"alert":         pzsyslog.Alert,
+	"fatal":         pzsyslog.Fatal,
+	"critical":      pzsyslog.Fatal,
+	"error":         pzsyslog.Error,
+	"warning":       pzsyslog.Warning,
+	"notice":        pzsyslog.Notice,
+	"informational": pzsyslog.Informational,
+	"info":          pzsyslog.Informational,
+	"debug":         pzsyslog.Debug,
+}
+
+// parseSeverity accepts either a severity's number or its name.
+func parseSeverity(s string) (pzsyslog.Severity, error) {
+	if sev, ok := severityNames[strings.ToLower(s)]; ok {
+		return sev, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < int(pzsyslog.Emergency) || i > int(pzsyslog.Debug) {
+		return 0, fmt.Errorf("invalid severity: %s", s)
+	}
+	return pzsyslog.Severity(i), nil
+}
+
+// newQueryParams is piazza.NewQueryParams, except that a parameter given
+// more than once keeps all its values, joined with commas.
+func newQueryParams(request *http.Request) *piazza.HttpQueryParams {
+	params := piazza.NewQueryParams(request)
+	for key, values := range request.URL.Query() {
+		if len(values) > 1 {
+			params.AddString(key, strings.Join(values, ","))
+		}
+	}
+	return params
+}
+
+func getListParam(params *piazza.HttpQueryParams, key string) ([]string, error) {
+	s, err := params.GetAsString(key, "")
+	if err != nil || s == "" {
+		return nil, err
+	}
+
+	list := []string{}
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list, nil
+}
+
+// createFilterClauses returns a clause for each of the field filters in
+// the params. They are meant to be ANDed together.
+//
+// Severity numbers go down as things get worse, so "errors and worse" is
+// maxSeverity=error. The severity parameters accept numbers or names.
+func createFilterClauses(params *piazza.HttpQueryParams) ([]map[string]interface{}, error) {
+	must := []map[string]interface{}{}
+
+	severities, err := getListParam(params, "severity")
+	if err != nil {
+		return nil, err
+	}
+	if len(severities) > 0 {
+		values := make([]int, len(severities))
+		for i, s := range severities {
+			sev, err := parseSeverity(s)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = sev.Value()
+		}
+		must = append(must, map[string]interface{}{
+			"terms": map[string]interface{}{
+				"severity": values,
+			},
+		})
+	}
+
+	rangeParams := map[string]int{}
+	for key, op := range map[string]string{"minSeverity": "gte", "maxSeverity": "lte"} {
+		s, err := params.GetAsString(key, "")
+		if err != nil {
+			return nil, err
+		}
+		if s == "" {
+			continue
+		}
+		sev, err := parseSeverity(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err.Error())
+		}
+		rangeParams[op] = sev.Value()
+	}
+	if len(rangeParams) > 0 {
+		must = append(must, map[string]interface{}{
+			"range": map[string]interface{}{
+				"severity": rangeParams,
+			},
+		})
+	}
+
+	for _, field := range exactFilterFields {
+		values, err := getListParam(params, field)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		must = append(must, map[string]interface{}{
+			"terms": map[string]interface{}{
+				field: values,
+			},
+		})
+	}
+
+	return must, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestParseSeverity(t *testing.T) {
+	assert := assert.New(t)
+
+	sev, err := parseSeverity("Error")
+	assert.NoError(err)
+	assert.Equal(pzsyslog.Error, sev)
+
+	sev, err = parseSeverity("7")
+	assert.NoError(err)
+	assert.Equal(pzsyslog.Debug, sev)
+
+	_, err = parseSeverity("8")
+	assert.Error(err)
+	_, err = parseSeverity("loud")
+	assert.Error(err)
+}
+
+func TestFilterDsl(t *testing.T) {
+	assert := assert.New(t)
+
+	format := &piazza.JsonPagination{
+		PerPage: 10,
+		Page:    0,
+		Order:   piazza.SortOrderDescending,
+		SortBy:  "timeStamp",
+	}
+
+	request, err := http.NewRequest("GET",
+		"/syslog?maxSeverity=error&hostName=h1&hostName=h2&auditData.actor=me&sourceData.function=f,g", nil)
+	assert.NoError(err)
+	params := newQueryParams(request)
+
+	actual, err := createQueryDslAsString(format, params)
+	assert.NoError(err)
+
+	expected := `
+	{
+		"from":0,
+		"query": {
+			"filtered":{
+				"query":{
+					"bool":{
+						"must":
+						[
+							{"range":{"severity":{"lte":3}}},
+							{"terms":{"hostName":["h1","h2"]}},
+							{"terms":{"auditData.actor":["me"]}},
+							{"terms":{"sourceData.function":["f","g"]}}
+						]
+					}
+				}
+			}
+		},
+		"size":10,
+		"sort":{"timeStamp":"desc"}
+	}`
+	assert.JSONEq(expected, actual)
+
+	params = &piazza.HttpQueryParams{}
+	params.AddString("severity", "fatal,4")
+	params.AddString("minSeverity", "1")
+	params.AddString("metricData.name", "size")
+	actual, err = createQueryDslAsString(format, params)
+	assert.NoError(err)
+	assert.Contains(actual, `{"terms":{"severity":[2,4]}}`)
+	assert.Contains(actual, `{"range":{"severity":{"gte":1}}}`)
+	assert.Contains(actual, `{"terms":{"metricData.name":["size"]}}`)
+
+	params = &piazza.HttpQueryParams{}
+	params.AddString("maxSeverity", "worst")
+	_, err = createQueryDslAsString(format, params)
+	assert.Error(err)
+}
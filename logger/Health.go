@@ -0,0 +1,193 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// DefaultSchemaCheckInterval is how long the result of a schema check is
+// reused by GET /health/ready, since it takes a request per index.
+const DefaultSchemaCheckInterval = time.Minute
+
+// HealthConfig says when GET /health/ready is to fail.
+type HealthConfig struct {
+	// The most messages that may be waiting to be written, in the queue
+	// and the spool together. The default is 90% of the queue's capacity,
+	// or no limit if there is no queue.
+	MaxBacklog int
+
+	// If set, called to check that the indices have the expected mapping.
+	SchemaCheck         func() error
+	SchemaCheckInterval time.Duration
+}
+
+// HealthCheck is the state of one dependency.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is what GET /health/live and GET /health/ready return. It
+// is ok only if all its checks are.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+func (report *HealthReport) add(name string, err error, message string) {
+	check := HealthCheck{Name: name, Status: HealthOK, Message: message}
+	if err != nil {
+		check.Status = HealthFail
+		check.Message = err.Error()
+		report.Status = HealthFail
+	}
+	report.Checks = append(report.Checks, check)
+}
+
+// healthChecker remembers the last schema check.
+type healthChecker struct {
+	sync.Mutex
+	config      HealthConfig
+	schemaErr   error
+	schemaTime  time.Time
+	schemaKnown bool
+}
+
+func newHealthChecker(config *HealthConfig) *healthChecker {
+	hc := &healthChecker{}
+	if config != nil {
+		hc.config = *config
+	}
+	if hc.config.SchemaCheckInterval == 0 {
+		hc.config.SchemaCheckInterval = DefaultSchemaCheckInterval
+	}
+	return hc
+}
+
+func (hc *healthChecker) checkSchema(now time.Time) error {
+	hc.Lock()
+	defer hc.Unlock()
+
+	if !hc.schemaKnown || now.Sub(hc.schemaTime) >= hc.config.SchemaCheckInterval {
+		hc.schemaErr = hc.config.SchemaCheck()
+		hc.schemaTime = now
+		hc.schemaKnown = true
+	}
+	return hc.schemaErr
+}
+
+func (service *Service) setHealthChecker(health *healthChecker) {
+	service.Lock()
+	service.health = health
+	service.Unlock()
+}
+
+func (service *Service) getHealthChecker() *healthChecker {
+	service.Lock()
+	defer service.Unlock()
+	return service.health
+}
+
+// GetLive says the service is up. It checks nothing else: a service that
+// can't reach Elasticsearch should be taken out of rotation, by
+// GetReady, but restarting it won't help.
+func (service *Service) GetLive() *piazza.JsonResponse {
+	return service.newHealthResponse(&HealthReport{Status: HealthOK})
+}
+
+// GetReady checks that the index exists, that its mapping is the one
+// expected, and that the writes are keeping up.
+func (service *Service) GetReady() *piazza.JsonResponse {
+	health := service.getHealthChecker()
+	if health == nil {
+		health = newHealthChecker(nil)
+	}
+
+	report := &HealthReport{Status: HealthOK}
+
+	ok, err := service.esIndex.IndexExists()
+	if err == nil && !ok {
+		err = fmt.Errorf("index %s does not exist", service.esIndex.IndexName())
+	}
+	if err != nil {
+		service.telemetry.esError("exists", 1)
+	}
+	report.add("elasticsearch", err, "")
+
+	if health.config.SchemaCheck != nil {
+		report.add("schema", health.checkSchema(time.Now()), "")
+	}
+
+	service.Lock()
+	logWriter := service.logWriter
+	spool := service.spool
+	service.Unlock()
+
+	backlog := 0
+	limit := health.config.MaxBacklog
+	checked := false
+	if bw, ok := logWriter.(*BatchWriter); ok {
+		stats := bw.Stats()
+		backlog += stats.QueueLength
+		if limit == 0 {
+			limit = stats.QueueCapacity * 9 / 10
+		}
+		checked = true
+	}
+	if spool != nil {
+		backlog += spool.Stats().Depth
+		checked = true
+	}
+	if checked {
+		err = nil
+		if limit > 0 && backlog >= limit {
+			err = fmt.Errorf("%d messages waiting to be written (limit %d)", backlog, limit)
+		}
+		report.add("backlog", err, fmt.Sprintf("%d messages waiting to be written", backlog))
+	}
+
+	return service.newHealthResponse(report)
+}
+
+func (service *Service) newHealthResponse(report *HealthReport) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       report,
+	}
+	if report.Status != HealthOK {
+		resp.StatusCode = http.StatusServiceUnavailable
+		resp.Message = "not ready"
+		resp.Origin = service.origin
+	}
+
+	err := resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
@@ -0,0 +1,108 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("healthtest")
+	service := &Service{esIndex: esi}
+
+	ready := func(expected int) *HealthReport {
+		resp := service.GetReady()
+		assert.Equal(expected, resp.StatusCode, resp.Message)
+		assert.Equal("health", resp.Type)
+		return resp.Data.(*HealthReport)
+	}
+
+	resp := service.GetLive()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// no index
+	report := ready(http.StatusServiceUnavailable)
+	assert.Equal(HealthFail, report.Status)
+	assert.Equal([]HealthCheck{{Name: "elasticsearch", Status: HealthFail, Message: "index healthtest does not exist"}},
+		report.Checks)
+
+	assert.NoError(esi.Create(""))
+	report = ready(http.StatusOK)
+	assert.Equal(HealthOK, report.Status)
+
+	// the schema check is remembered for a while
+	checks := 0
+	var schemaErr error
+	service.setHealthChecker(newHealthChecker(&HealthConfig{
+		SchemaCheck: func() error {
+			checks++
+			return schemaErr
+		},
+	}))
+	ready(http.StatusOK)
+	schemaErr = errors.New("schema of pzlogger5 is older than version 2")
+	ready(http.StatusOK)
+	assert.Equal(1, checks)
+	service.getHealthChecker().schemaTime = time.Now().Add(-DefaultSchemaCheckInterval)
+	report = ready(http.StatusServiceUnavailable)
+	assert.Equal(2, checks)
+	assert.Equal(HealthCheck{Name: "schema", Status: HealthFail, Message: schemaErr.Error()}, report.Checks[1])
+}
+
+func TestHealthBacklog(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("healthtest")
+	assert.NoError(esi.Create(""))
+
+	// the one worker gets stuck on its first batch
+	indexer := &fakeBulkIndexer{}
+	indexer.Lock()
+	bw, err := newBatchWriter(&pzsyslog.LocalReaderWriter{}, indexer,
+		&BatchWriterConfig{QueueSize: 10, Workers: 1, BatchSize: 1})
+	if !assert.NoError(err) {
+		return
+	}
+
+	service := &Service{esIndex: esi, logWriter: bw}
+	service.setHealthChecker(newHealthChecker(&HealthConfig{MaxBacklog: 5}))
+
+	resp := service.GetReady()
+	if assert.Equal(http.StatusOK, resp.StatusCode) {
+		assert.Equal(HealthCheck{Name: "backlog", Status: HealthOK, Message: "0 messages waiting to be written"},
+			resp.Data.(*HealthReport).Checks[1])
+	}
+
+	for i := 0; i < 7; i++ {
+		assert.NoError(bw.Write(newSpoolTestMessage("stuck"), true))
+	}
+	resp = service.GetReady()
+	if assert.Equal(http.StatusServiceUnavailable, resp.StatusCode) {
+		assert.Equal(HealthFail, resp.Data.(*HealthReport).Checks[1].Status)
+	}
+
+	indexer.Unlock()
+	_, _, err = bw.Shutdown(context.Background())
+	assert.NoError(err)
+}
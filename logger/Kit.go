@@ -15,6 +15,10 @@
 package logger
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
@@ -27,12 +31,86 @@ type Kit struct {
 	Server        *Server
 	LogWriter     pzsyslog.Writer
 	AuditWriter   pzsyslog.Writer
+	AuditTrail    *AuditTrail
 	Sys           *piazza.SystemConfig
 	GenericServer *piazza.GenericServer
 	Url           string
 	Async         bool
 
-	done chan error
+	// If set before Start is called, native syslog listeners are started
+	// alongside the HTTP server.
+	ListenerConfig *SyslogListenerConfig
+	Listener       *SyslogListener
+
+	// If set before Start is called, log messages are written to a spool
+	// on local disk and drained to Elasticsearch from there.
+	SpoolConfig *SpoolConfig
+	Spool       *Spool
+
+	// If set before Start is called, messages are written to rolling
+	// indices, which the Retention manager rolls and removes. Writes must
+	// be async, since only the bulk indexer knows about the write aliases.
+	RollingConfig *RollingConfig
+	Retention     *RetentionManager
+
+	// The audit trail is kept in AuditIndex, and the alert rules, events
+	// and notifications in AlertIndex. Unless they are set before Start is
+	// called, they are <index>_audit and <index>_alerts, for the logger's
+	// index: their types map message and timeStamp differently from
+	// LogData, which ES won't have in one index, and the audit trail must
+	// outlive rolling indices. Only an in-memory index, which has no
+	// mappings, is shared.
+	AuditIndex  elasticsearch.IIndex
+	AlertIndex  elasticsearch.IIndex
+	AlertEngine *AlertEngine
+
+	// If set before Start is called, the audit trail is hashed with its
+	// key and checkpointed in its file.
+	AuditConfig *AuditConfig
+
+	// Notifies the alert rules' channels, configured by this if it is set
+	// before Start is called.
+	NotifierConfig *NotifierConfig
+	Notifier       *Notifier
+
+	// How often the rate alert rules are checked; DefaultRateCheckInterval
+	// if not set before Start is called.
+	RateCheckInterval time.Duration
+
+	// How often the alert rules and notification channels are reloaded
+	// from the index; DefaultAlertRuleReloadInterval if not set before
+	// Start is called.
+	AlertReloadInterval time.Duration
+
+	// Async writes to the LogWriter and AuditWriter go through
+	// BatchWriters, configured by this if it is set before Start is called.
+	BatchWriterConfig *BatchWriterConfig
+	BatchWriter       *BatchWriter
+	AuditBatchWriter  *BatchWriter
+
+	// If set before Start is called, says when GET /health/ready fails.
+	HealthConfig *HealthConfig
+
+	// If set before Start is called, the HTTP API needs an API key that
+	// it accepts. The native syslog listeners are not affected.
+	Authorizer Authorizer
+
+	// If set before Start is called, limits what each tenant may write.
+	// The DefaultTenantQuota entry applies to tenants not listed.
+	TenantQuotas map[string]*TenantQuota
+
+	stopped   chan struct{}
+	serverErr error
+}
+
+// ShutdownReport says what happened to the messages that were still
+// queued when Kit.Shutdown was called.
+type ShutdownReport struct {
+	NumFlushed   int `json:"numFlushed"`
+	NumAbandoned int `json:"numAbandoned"`
+
+	// left on disk, to be drained on the next start
+	NumSpooled int `json:"numSpooled"`
 }
 
 // NewKit starts a logger.Server, using a real or mocked ES backend.
@@ -82,15 +160,229 @@ func NewKit(
 
 func (kit *Kit) Start() error {
 	var err error
-	kit.done, err = kit.GenericServer.Start()
+
+	if kit.AuditIndex == nil {
+		if kit.AuditIndex, err = kit.newOwnIndex("_audit"); err != nil {
+			return err
+		}
+	}
+	if kit.AlertIndex == nil {
+		if kit.AlertIndex, err = kit.newOwnIndex("_alerts"); err != nil {
+			return err
+		}
+	}
+
+	if kit.RollingConfig != nil {
+		if err = kit.startRetention(); err != nil {
+			return err
+		}
+	}
+
+	kit.AuditTrail, err = NewAuditTrail(kit.AuditIndex, kit.AuditConfig)
+	if err != nil {
+		return err
+	}
+	kit.Service.setAuditTrail(kit.AuditTrail)
+
+	alertIndexer, err := newBulkIndexer(kit.Sys, kit.AlertIndex)
+	if err != nil {
+		return err
+	}
+	kit.AlertEngine, err = NewAlertEngine(kit.AlertIndex, kit.Service.telemetry.countBulk(alertIndexer))
+	if err != nil {
+		return err
+	}
+	kit.Notifier, err = NewNotifier(kit.AlertIndex, kit.NotifierConfig)
+	if err != nil {
+		return err
+	}
+	kit.AlertEngine.onEvent = kit.Notifier.alert
+	kit.Service.setNotifier(kit.Notifier)
+	kit.Service.setAlertEngine(kit.AlertEngine)
+	kit.AlertEngine.startRateChecks(kit.Service.rates, kit.RateCheckInterval)
+	kit.AlertEngine.startRuleReloads(kit.AlertReloadInterval)
+	kit.Notifier.startChannelReloads(kit.AlertReloadInterval)
+
+	kit.Service.setHealthChecker(newHealthChecker(kit.HealthConfig))
+	kit.Service.setAuthorizer(kit.Authorizer)
+	kit.Service.tenants.setQuotas(kit.TenantQuotas)
+
+	if kit.LogWriter != nil {
+		// only an ElasticWriter can be replaced by bulk requests
+		var indexer bulkIndexer
+		if _, ok := kit.LogWriter.(*pzsyslog.ElasticWriter); ok {
+			indexer = kit.Service.bulkIndexer
+		}
+		kit.BatchWriter, err = newBatchWriter(kit.LogWriter, indexer, kit.BatchWriterConfig)
+		if err != nil {
+			return err
+		}
+		kit.Service.setLogWriter(kit.BatchWriter)
+	}
+
+	if kit.AuditWriter != nil {
+		kit.AuditBatchWriter, err = newBatchWriter(kit.AuditWriter, nil, kit.BatchWriterConfig)
+		if err != nil {
+			return err
+		}
+		kit.Service.setAuditWriter(kit.AuditBatchWriter)
+	}
+
+	if kit.SpoolConfig != nil {
+		kit.Spool, err = newSpool(kit.SpoolConfig, kit.Service.bulkIndexer, pzsyslog.LoggerType)
+		if err != nil {
+			return err
+		}
+		kit.Spool.Start()
+		kit.Service.setSpool(kit.Spool)
+	}
+
+	done, err := kit.GenericServer.Start()
+	if err != nil {
+		return err
+	}
+	kit.stopped = make(chan struct{})
+	go func() {
+		kit.serverErr = <-done
+		close(kit.stopped)
+	}()
+
+	if !kit.ListenerConfig.IsEmpty() {
+		kit.Listener, err = NewSyslogListener(kit.Service, kit.ListenerConfig)
+		if err != nil {
+			return err
+		}
+		err = kit.Listener.Start()
+	}
+
 	return err
 }
 
+// newOwnIndex returns the index named for the logger's with the suffix, or,
+// for an in-memory logger index, the logger's index itself.
+func (kit *Kit) newOwnIndex(suffix string) (elasticsearch.IIndex, error) {
+	if _, ok := kit.esi.(*elasticsearch.Index); !ok {
+		return kit.esi, nil
+	}
+	return elasticsearch.NewIndex(kit.Sys, kit.esi.IndexName()+suffix, "")
+}
+
+// startRetention rolls the indices, so that there is somewhere to write,
+// and has the bulk indexer write through the aliases.
+func (kit *Kit) startRetention() error {
+	if !kit.Async {
+		return errors.New("rolling indices need async logging")
+	}
+	if kit.AuditIndex == kit.esi {
+		return errors.New("rolling indices need a separate audit index")
+	}
+	if _, ok := kit.esi.(*elasticsearch.Index); !ok {
+		return errors.New("rolling indices need Elasticsearch")
+	}
+
+	client, err := newElasticClient(kit.Sys)
+	if err != nil {
+		return err
+	}
+
+	kit.Retention, err = newRetentionManager(kit.RollingConfig, &elasticIndexAdmin{client: client},
+		kit.esi.IndexName(), pzsyslog.LoggerType)
+	if err != nil {
+		return err
+	}
+	if err = kit.Retention.Start(); err != nil {
+		return err
+	}
+
+	kit.Service.bulkIndexer = kit.Service.telemetry.countBulk(
+		&elasticBulkIndexer{client: client, index: kit.esi.IndexName(), route: kit.Retention.route})
+	kit.Service.setRetentionManager(kit.Retention)
+	return nil
+}
+
 func (kit *Kit) Wait() error {
-	return <-kit.done
+	<-kit.stopped
+	return kit.serverErr
 }
 
 func (kit *Kit) Stop() error {
-	err := kit.GenericServer.Stop()
+	_, err := kit.stop(context.Background())
 	return err
 }
+
+// Shutdown stops taking new messages, waits for requests in progress, and
+// writes out everything still queued before closing the index. Whatever
+// has not been written by the time the context is done is abandoned,
+// except that the spool, if any, keeps its messages for next time. Every
+// step is taken whatever went wrong before it, and the errors are
+// returned together.
+func (kit *Kit) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	report, err := kit.stop(ctx)
+	if kit.esi != nil {
+		err = errors.Join(err, kit.esi.Close())
+	}
+	return report, err
+}
+
+func (kit *Kit) stop(ctx context.Context) (*ShutdownReport, error) {
+	report := &ShutdownReport{}
+	errs := []error{}
+
+	if kit.Listener != nil {
+		errs = append(errs, kit.Listener.Stop())
+	}
+
+	select {
+	case <-kit.stopped:
+		// the server has exited by itself, and may never have listened
+	default:
+		errs = append(errs, kit.GenericServer.Stop())
+	}
+	// open streams never finish by themselves
+	kit.Service.closeStreams()
+	if kit.stopped != nil {
+		select {
+		case <-kit.stopped:
+		case <-ctx.Done():
+		}
+	}
+
+	if kit.Spool != nil {
+		errs = append(errs, kit.Spool.Close())
+		report.NumSpooled = kit.Spool.Stats().Depth
+	}
+
+	if kit.Retention != nil {
+		kit.Retention.Stop()
+	}
+
+	if kit.AlertEngine != nil {
+		kit.AlertEngine.stopRateChecks()
+		kit.AlertEngine.stopRuleReloads()
+	}
+	if kit.Notifier != nil {
+		kit.Notifier.stopChannelReloads()
+	}
+
+	// the messages come first: notifications get whatever time is left
+	for _, bw := range []*BatchWriter{kit.BatchWriter, kit.AuditBatchWriter} {
+		if bw == nil {
+			continue
+		}
+		flushed, abandoned, err := bw.Shutdown(ctx)
+		report.NumFlushed += flushed
+		report.NumAbandoned += abandoned
+		errs = append(errs, err)
+	}
+
+	// the events are passed on to the Notifier
+	if kit.AlertEngine != nil {
+		errs = append(errs, kit.AlertEngine.Close(ctx))
+	}
+
+	if kit.Notifier != nil {
+		errs = append(errs, kit.Notifier.Close(ctx))
+	}
+
+	return report, errors.Join(errs...)
+}
@@ -0,0 +1,311 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSyslogFrameSize is the largest syslog message we will read from the
+// network. RFC 5425 requires receivers to handle at least 2048 octets and
+// recommends 8192; we are more generous than that.
+const MaxSyslogFrameSize = 64 * 1024
+
+// SyslogListenerConfig says which native syslog transports to listen on.
+// An empty address disables that transport. TLSConfig is required if
+// TLSAddr is set.
+type SyslogListenerConfig struct {
+	UDPAddr   string // RFC 5426
+	TCPAddr   string // RFC 6587
+	TLSAddr   string // RFC 5425
+	TLSConfig *tls.Config
+}
+
+// IsEmpty returns true if no transports are enabled.
+func (config *SyslogListenerConfig) IsEmpty() bool {
+	return config == nil || (config.UDPAddr == "" && config.TCPAddr == "" && config.TLSAddr == "")
+}
+
+// SyslogListener receives syslog messages over UDP, TCP, and TCP+TLS, and
+// sends each one through Service.PostSyslog. Messages may be in either
+// RFC 5424 or the older RFC 3164 form; the latter are converted using the
+// Service's RFC3164Options, with the sender's address as the default
+// HOSTNAME. Since there is no way to return an error to the sender, bad
+// messages are logged and dropped.
+type SyslogListener struct {
+	sync.Mutex
+
+	service *Service
+	config  SyslogListenerConfig
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	tlsListener net.Listener
+
+	conns   map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewSyslogListener(service *Service, config *SyslogListenerConfig) (*SyslogListener, error) {
+	if config == nil {
+		return nil, errors.New("syslog listener config not set")
+	}
+	if config.TLSAddr != "" && config.TLSConfig == nil {
+		return nil, errors.New("syslog listener TLS address set without a TLS config")
+	}
+
+	listener := &SyslogListener{
+		service: service,
+		config:  *config,
+		conns:   map[net.Conn]bool{},
+	}
+	return listener, nil
+}
+
+// Start opens all the configured sockets and begins serving them.
+func (listener *SyslogListener) Start() error {
+	var err error
+
+	if listener.config.UDPAddr != "" {
+		listener.udpConn, err = net.ListenPacket("udp", listener.config.UDPAddr)
+		if err != nil {
+			_ = listener.Stop()
+			return err
+		}
+		listener.wg.Add(1)
+		go listener.serveUDP(listener.udpConn)
+	}
+
+	if listener.config.TCPAddr != "" {
+		listener.tcpListener, err = net.Listen("tcp", listener.config.TCPAddr)
+		if err != nil {
+			_ = listener.Stop()
+			return err
+		}
+		listener.wg.Add(1)
+		go listener.serveStream(listener.tcpListener)
+	}
+
+	if listener.config.TLSAddr != "" {
+		listener.tlsListener, err = tls.Listen("tcp", listener.config.TLSAddr, listener.config.TLSConfig)
+		if err != nil {
+			_ = listener.Stop()
+			return err
+		}
+		listener.wg.Add(1)
+		go listener.serveStream(listener.tlsListener)
+	}
+
+	return nil
+}
+
+// Stop closes all sockets, including open client connections, and waits
+// for the serving goroutines to finish.
+func (listener *SyslogListener) Stop() error {
+	listener.Lock()
+	listener.closing = true
+	if listener.udpConn != nil {
+		_ = listener.udpConn.Close()
+	}
+	if listener.tcpListener != nil {
+		_ = listener.tcpListener.Close()
+	}
+	if listener.tlsListener != nil {
+		_ = listener.tlsListener.Close()
+	}
+	for conn := range listener.conns {
+		_ = conn.Close()
+	}
+	listener.Unlock()
+
+	listener.wg.Wait()
+	return nil
+}
+
+// UDPAddr returns the bound UDP address, or nil if UDP is not enabled.
+func (listener *SyslogListener) UDPAddr() net.Addr {
+	if listener.udpConn == nil {
+		return nil
+	}
+	return listener.udpConn.LocalAddr()
+}
+
+// TCPAddr returns the bound TCP address, or nil if TCP is not enabled.
+func (listener *SyslogListener) TCPAddr() net.Addr {
+	if listener.tcpListener == nil {
+		return nil
+	}
+	return listener.tcpListener.Addr()
+}
+
+// TLSAddr returns the bound TLS address, or nil if TLS is not enabled.
+func (listener *SyslogListener) TLSAddr() net.Addr {
+	if listener.tlsListener == nil {
+		return nil
+	}
+	return listener.tlsListener.Addr()
+}
+
+func (listener *SyslogListener) isClosing() bool {
+	listener.Lock()
+	defer listener.Unlock()
+	return listener.closing
+}
+
+func (listener *SyslogListener) serveUDP(conn net.PacketConn) {
+	defer listener.wg.Done()
+
+	buf := make([]byte, MaxSyslogFrameSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !listener.isClosing() {
+				log.Printf("syslog listener (udp): %s", err.Error())
+			}
+			return
+		}
+		listener.handleFrame(string(buf[:n]), addr)
+	}
+}
+
+func (listener *SyslogListener) serveStream(l net.Listener) {
+	defer listener.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !listener.isClosing() {
+				log.Printf("syslog listener (%s): %s", l.Addr().Network(), err.Error())
+			}
+			return
+		}
+
+		listener.Lock()
+		if listener.closing {
+			listener.Unlock()
+			_ = conn.Close()
+			return
+		}
+		listener.conns[conn] = true
+		listener.wg.Add(1)
+		listener.Unlock()
+
+		go listener.serveConn(conn)
+	}
+}
+
+func (listener *SyslogListener) serveConn(conn net.Conn) {
+	defer func() {
+		listener.Lock()
+		delete(listener.conns, conn)
+		listener.Unlock()
+		_ = conn.Close()
+		listener.wg.Done()
+	}()
+
+	reader := bufio.NewReaderSize(conn, MaxSyslogFrameSize)
+	for {
+		frame, err := readStreamFrame(reader)
+		if err != nil {
+			if err != io.EOF && !listener.isClosing() {
+				log.Printf("syslog listener (%s): %s", conn.RemoteAddr().String(), err.Error())
+			}
+			return
+		}
+		listener.handleFrame(frame, conn.RemoteAddr())
+	}
+}
+
+// readStreamFrame reads one message from a stream. RFC 6587 octet counting
+// ("LEN SP MSG") is used when the frame starts with a digit, as RFC 5425
+// requires; otherwise we fall back to newline-terminated framing, which is
+// what many older senders do. The reader's buffer must be at least
+// MaxSyslogFrameSize.
+func readStreamFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		// the reader's buffer is MaxSyslogFrameSize, so a line that
+		// doesn't fit is refused rather than read into memory
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("frame too large: more than %d octets", MaxSyslogFrameSize)
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+
+	length := 0
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == ' ' {
+			break
+		}
+		if b < '0' || b > '9' {
+			return "", fmt.Errorf("invalid octet count: unexpected %q", b)
+		}
+		length = length*10 + int(b-'0')
+		if length > MaxSyslogFrameSize {
+			break
+		}
+	}
+	if length <= 0 || length > MaxSyslogFrameSize {
+		return "", fmt.Errorf("invalid octet count: %d", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (listener *SyslogListener) handleFrame(frame string, addr net.Addr) {
+	opts := listener.service.getRFC3164Options()
+	if opts.HostName == "" && addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			opts.HostName = host
+		}
+	}
+
+	mssg, err := ParseSyslogString(frame, time.Now(), &opts)
+	if err != nil {
+		log.Printf("syslog listener: unable to parse message [%s]: %s", frame, err.Error())
+		return
+	}
+
+	resp := listener.service.PostSyslog(mssg, nil)
+	if resp.IsError() {
+		log.Printf("syslog listener: unable to post message [%s]: %s", frame, resp.Message)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// endlessReader is a sender that never sends a newline.
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestReadStreamFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	reader := bufio.NewReaderSize(strings.NewReader("<13>one\r\n11 <13>1 - - -<13>two"), MaxSyslogFrameSize)
+	for _, expected := range []string{"<13>one", "<13>1 - - -", "<13>two"} {
+		frame, err := readStreamFrame(reader)
+		assert.NoError(err)
+		assert.Equal(expected, frame)
+	}
+	_, err := readStreamFrame(reader)
+	assert.Equal(io.EOF, err)
+
+	_, err = readStreamFrame(bufio.NewReaderSize(strings.NewReader("99999999 <13>"), MaxSyslogFrameSize))
+	assert.EqualError(err, "invalid octet count: 99999")
+
+	// no more than a frame's worth is read from a sender that never stops
+	endless := &endlessReader{}
+	_, err = readStreamFrame(bufio.NewReaderSize(endless, MaxSyslogFrameSize))
+	assert.EqualError(err, "frame too large: more than 65536 octets")
+	assert.True(endless.read <= MaxSyslogFrameSize, endless.read)
+}
@@ -0,0 +1,628 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// MemoryIndex is an elasticsearch.MockIndex that can also run searches.
+// It understands the parts of the query DSL that pz-logger generates and
+// accepts in POST /query: bool (must, should, must_not, filter),
+// filtered, query, match_all, match, term, terms, wildcard and range
+// queries, on any field or _id and _uid, plus sort, from and size. Fields
+// are compared exactly, as they are for the not_analyzed fields of LogData.
+// Through DirectAccess, POST /<index>/<type>/_search runs a search and
+// returns each hit's sort values, as ES does, and PUT
+// /<index>/<type>/<id>/_create stores a document only if it is new.
+//
+// Unlike MockIndex, it is safe to use from several goroutines.
+type MemoryIndex struct {
+	sync.Mutex
+	*elasticsearch.MockIndex
+}
+
+// NewMemoryIndex returns an empty MemoryIndex. As with MockIndex, the index
+// itself must be created before anything is stored in it.
+func NewMemoryIndex(indexName string) *MemoryIndex {
+	var _ elasticsearch.IIndex = (*MemoryIndex)(nil)
+
+	return &MemoryIndex{MockIndex: elasticsearch.NewMockIndex(indexName)}
+}
+
+func (esi *MemoryIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.Lock()
+	defer esi.Unlock()
+	return esi.MockIndex.PostData(typ, id, obj)
+}
+
+func (esi *MemoryIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	esi.Lock()
+	defer esi.Unlock()
+	return esi.MockIndex.PutData(typ, id, obj)
+}
+
+func (esi *MemoryIndex) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	esi.Lock()
+	defer esi.Unlock()
+	return esi.MockIndex.GetByID(typ, id)
+}
+
+func (esi *MemoryIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	esi.Lock()
+	defer esi.Unlock()
+	return esi.MockIndex.DeleteByID(typ, id)
+}
+
+// FilterByMatchAll is MockIndex.FilterByMatchAll, except that it sorts.
+func (esi *MemoryIndex) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+		"size":  format.PerPage,
+		"from":  format.PerPage * format.Page,
+	}
+	if format.SortBy != "" {
+		dsl["sort"] = map[string]interface{}{format.SortBy: string(format.Order)}
+	}
+
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return nil, err
+	}
+	return esi.SearchByJSON(typ, string(byts))
+}
+
+func (esi *MemoryIndex) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &dsl); err != nil {
+		return nil, err
+	}
+	result, err := esi.search(typ, dsl)
+	if err != nil {
+		return nil, err
+	}
+	return elasticsearch.NewSearchResult(result), nil
+}
+
+// DirectAccess answers searches, as POST /<index>/<type>/_search, and
+// creates, as PUT /<index>/<type>/<id>/_create, by sending back what ES
+// would. Anything else is left to MockIndex.
+func (esi *MemoryIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	parts := strings.Split(strings.TrimPrefix(endpoint, "/"), "/")
+	if len(parts) == 0 || parts[0] != esi.IndexName() {
+		return esi.MockIndex.DirectAccess(verb, endpoint, input, output)
+	}
+
+	var result interface{}
+	var err error
+	switch {
+	case verb == "POST" && len(parts) == 3 && parts[2] == "_search":
+		// through JSON and back, as over HTTP
+		var byts []byte
+		if byts, err = json.Marshal(input); err != nil {
+			return err
+		}
+		dsl := map[string]interface{}{}
+		if err = json.Unmarshal(byts, &dsl); err != nil {
+			return err
+		}
+		result, err = esi.search(parts[1], dsl)
+	case verb == "PUT" && len(parts) == 4 && parts[3] == "_create":
+		result, err = esi.create(parts[1], parts[2], input)
+	default:
+		return esi.MockIndex.DirectAccess(verb, endpoint, input, output)
+	}
+	if err != nil {
+		return err
+	}
+
+	byts, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
+
+// create stores the document unless there is one with its id, returning
+// what ES would, with the error and a 409 status if there is.
+func (esi *MemoryIndex) create(typ string, id string, obj interface{}) (interface{}, error) {
+	esi.Lock()
+	defer esi.Unlock()
+
+	ok, err := esi.MockIndex.ItemExists(typ, id)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":   "document_already_exists_exception",
+				"reason": fmt.Sprintf("[%s][%s]: document already exists", typ, id),
+			},
+			"status": http.StatusConflict,
+		}, nil
+	}
+
+	resp, err := esi.MockIndex.PutData(typ, id, obj)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"_index":  resp.Index,
+		"_type":   resp.Type,
+		"_id":     resp.ID,
+		"created": true,
+	}, nil
+}
+
+func (esi *MemoryIndex) search(typ string, dsl map[string]interface{}) (*elastic.SearchResult, error) {
+
+	docs, err := esi.getAll(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	query, ok := dsl["query"]
+	if !ok {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+
+	matches := []*memoryDoc{}
+	for _, doc := range docs {
+		ok, err := evalMemoryQuery(query, doc.queryFields(typ))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, doc)
+		}
+	}
+
+	keys := []memorySortKey{}
+	if sortDsl, ok := dsl["sort"]; ok {
+		keys, err = parseMemorySort(sortDsl)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(matches, func(i, j int) bool {
+			for _, key := range keys {
+				c := compareMemoryValues(matches[i].sortValue(typ, key.field),
+					matches[j].sortValue(typ, key.field))
+				if c != 0 {
+					return (c < 0) != key.desc
+				}
+			}
+			return false
+		})
+	}
+
+	total := len(matches)
+
+	from, size := 0, 10
+	if f, ok := dsl["from"].(float64); ok {
+		from = int(f)
+	}
+	if s, ok := dsl["size"].(float64); ok {
+		size = int(s)
+	}
+	if from > len(matches) {
+		from = len(matches)
+	}
+	matches = matches[from:]
+	if size < len(matches) {
+		matches = matches[:size]
+	}
+
+	result := &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: int64(total), Hits: []*elastic.SearchHit{}}}
+	for _, doc := range matches {
+		hit := &elastic.SearchHit{Id: doc.id, Source: doc.source}
+		for _, key := range keys {
+			hit.Sort = append(hit.Sort, doc.sortValue(typ, key.field))
+		}
+		result.Hits.Hits = append(result.Hits.Hits, hit)
+	}
+	return result, nil
+}
+
+//---------------------------------------------------------------------------
+
+type memoryDoc struct {
+	id     string
+	source *json.RawMessage
+	fields map[string]interface{}
+}
+
+// sortValue is the value of a field to sort on, as ES sees it.
+func (doc *memoryDoc) sortValue(typ string, field string) interface{} {
+	switch field {
+	case "_id":
+		return doc.id
+	case "_uid":
+		return typ + "#" + doc.id
+	}
+	return lookupMemoryField(doc.fields, field)
+}
+
+// queryFields is the document's fields, plus _id and _uid to query on.
+func (doc *memoryDoc) queryFields(typ string) map[string]interface{} {
+	fields := map[string]interface{}{"_id": doc.id, "_uid": typ + "#" + doc.id}
+	for name, value := range doc.fields {
+		fields[name] = value
+	}
+	return fields
+}
+
+// getAll returns every document of the given type, in the order they were
+// stored.
+func (esi *MemoryIndex) getAll(typ string) ([]*memoryDoc, error) {
+	esi.Lock()
+	all, err := esi.MockIndex.FilterByMatchAll(typ, &piazza.JsonPagination{PerPage: math.MaxInt32})
+	esi.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []*memoryDoc{}
+	for _, hit := range *all.GetHits() {
+		fields := map[string]interface{}{}
+		if err = json.Unmarshal(*hit.Source, &fields); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &memoryDoc{id: hit.ID, source: hit.Source, fields: fields})
+	}
+
+	// MockIndex sorts its ids as strings
+	sort.SliceStable(docs, func(i, j int) bool {
+		a, errA := strconv.Atoi(docs[i].id)
+		b, errB := strconv.Atoi(docs[j].id)
+		if errA != nil || errB != nil {
+			return docs[i].id < docs[j].id
+		}
+		return a < b
+	})
+
+	return docs, nil
+}
+
+// lookupMemoryField follows a dotted field name into a document.
+func lookupMemoryField(fields map[string]interface{}, name string) interface{} {
+	var value interface{} = fields
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[part]
+	}
+	return value
+}
+
+// compareMemoryValues orders numbers numerically, times chronologically,
+// and anything else as strings. Missing values come last.
+func compareMemoryValues(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	// a string is only taken as a number when compared with one
+	_, isNumA := a.(float64)
+	_, isNumB := b.(float64)
+	fa, okA := toMemoryNumber(a)
+	fb, okB := toMemoryNumber(b)
+	if (isNumA || isNumB) && okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	ta, errA := time.Parse(time.RFC3339Nano, sa)
+	tb, errB := time.Parse(time.RFC3339Nano, sb)
+	if errA == nil && errB == nil {
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(sa, sb)
+}
+
+func toMemoryNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// matchMemoryWildcard matches s against a pattern where * is any run of
+// characters and ? is any one character.
+func matchMemoryWildcard(pattern string, s string) bool {
+	p, r := []rune(pattern), []rune(s)
+	pi, ri := 0, 0
+	star, mark := -1, 0
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi++
+			ri++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ri
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			ri = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+//---------------------------------------------------------------------------
+
+type memorySortKey struct {
+	field string
+	desc  bool
+}
+
+// parseMemorySort accepts the sort forms ES does: a field name, an object
+// of field to order or to {"order": order}, or a list of those.
+func parseMemorySort(dsl interface{}) ([]memorySortKey, error) {
+	keys := []memorySortKey{}
+
+	switch s := dsl.(type) {
+	case string:
+		keys = append(keys, memorySortKey{field: s})
+
+	case []interface{}:
+		for _, item := range s {
+			more, err := parseMemorySort(item)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, more...)
+		}
+
+	case map[string]interface{}:
+		fields := []string{}
+		for field := range s {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			order := s[field]
+			if obj, ok := order.(map[string]interface{}); ok {
+				order = obj["order"]
+			}
+			keys = append(keys, memorySortKey{field: field, desc: order == "desc"})
+		}
+
+	default:
+		return nil, fmt.Errorf("MemoryIndex: unsupported sort: %v", dsl)
+	}
+
+	return keys, nil
+}
+
+// evalMemoryQuery says whether a document matches a query (or filter).
+func evalMemoryQuery(dsl interface{}, fields map[string]interface{}) (bool, error) {
+	obj, ok := dsl.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return false, fmt.Errorf("MemoryIndex: a query must be an object with one key: %v", dsl)
+	}
+
+	for kind, body := range obj {
+		switch kind {
+		case "match_all":
+			return true, nil
+
+		case "query":
+			return evalMemoryQuery(body, fields)
+
+		case "bool":
+			return evalMemoryBool(body, fields)
+
+		case "filtered":
+			args, ok := body.(map[string]interface{})
+			if !ok {
+				return false, fmt.Errorf("MemoryIndex: bad filtered query: %v", body)
+			}
+			for _, key := range []string{"query", "filter"} {
+				if args[key] == nil {
+					continue
+				}
+				ok, err := evalMemoryQuery(args[key], fields)
+				if err != nil || !ok {
+					return false, err
+				}
+			}
+			return true, nil
+
+		case "match", "term", "terms", "wildcard", "range":
+			return evalMemoryLeaf(kind, body, fields)
+		}
+
+		return false, fmt.Errorf("MemoryIndex: query type %q is not supported", kind)
+	}
+
+	return false, nil
+}
+
+// memoryClauses turns a clause, or a list of clauses, into a list.
+func memoryClauses(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+func evalMemoryBool(body interface{}, fields map[string]interface{}) (bool, error) {
+	args, ok := body.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("MemoryIndex: bad bool query: %v", body)
+	}
+
+	for _, key := range []string{"must", "filter"} {
+		for _, clause := range memoryClauses(args[key]) {
+			ok, err := evalMemoryQuery(clause, fields)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+
+	for _, clause := range memoryClauses(args["must_not"]) {
+		ok, err := evalMemoryQuery(clause, fields)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+
+	should := memoryClauses(args["should"])
+	if len(should) == 0 {
+		return true, nil
+	}
+
+	// as in ES, should clauses are optional if there are must clauses,
+	// unless minimum_should_match says otherwise
+	minimum := 1
+	if args["must"] != nil || args["filter"] != nil {
+		minimum = 0
+	}
+	if m, ok := args["minimum_should_match"].(float64); ok {
+		minimum = int(m)
+	}
+
+	n := 0
+	for _, clause := range should {
+		ok, err := evalMemoryQuery(clause, fields)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n >= minimum, nil
+}
+
+func evalMemoryLeaf(kind string, body interface{}, fields map[string]interface{}) (bool, error) {
+	args, ok := body.(map[string]interface{})
+	if !ok || len(args) != 1 {
+		return false, fmt.Errorf("MemoryIndex: %s query must name one field: %v", kind, body)
+	}
+
+	for field, arg := range args {
+		value := lookupMemoryField(fields, field)
+		if value == nil {
+			return false, nil
+		}
+
+		switch kind {
+		case "match", "term":
+			if obj, ok := arg.(map[string]interface{}); ok {
+				if arg, ok = obj["value"]; !ok {
+					arg = obj["query"]
+				}
+			}
+			return compareMemoryValues(value, arg) == 0, nil
+
+		case "terms":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("MemoryIndex: terms query needs a list: %v", arg)
+			}
+			for _, item := range list {
+				if compareMemoryValues(value, item) == 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+
+		case "wildcard":
+			if obj, ok := arg.(map[string]interface{}); ok {
+				arg = obj["value"]
+			}
+			pattern, ok := arg.(string)
+			if !ok {
+				return false, fmt.Errorf("MemoryIndex: wildcard query needs a string: %v", arg)
+			}
+			return matchMemoryWildcard(pattern, fmt.Sprint(value)), nil
+
+		case "range":
+			bounds, ok := arg.(map[string]interface{})
+			if !ok {
+				return false, fmt.Errorf("MemoryIndex: bad range query: %v", arg)
+			}
+			for op, bound := range bounds {
+				c := compareMemoryValues(value, bound)
+				switch op {
+				case "gt":
+					ok = c > 0
+				case "gte":
+					ok = c >= 0
+				case "lt":
+					ok = c < 0
+				case "lte":
+					ok = c <= 0
+				default:
+					return false, fmt.Errorf("MemoryIndex: range operator %q is not supported", op)
+				}
+				if !ok {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func newMemoryIndexForTest(assert *assert.Assertions) *MemoryIndex {
+	esi := NewMemoryIndex("memtest")
+	assert.NoError(esi.Create(""))
+
+	start := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	for i, app := range []string{"pz-workflow", "pz-gateway", "pz-workflow", "pz-jobmanager"} {
+		m := pzsyslog.NewMessage("123456")
+		m.Application = app
+		m.HostName = "host"
+		m.Severity = pzsyslog.Severity(3 + i)
+		m.TimeStamp = piazza.TimeStamp(start.Add(time.Duration(i) * time.Minute))
+		m.Message = app + " says hi"
+		if i == 1 {
+			m.AuditData = &pzsyslog.AuditElement{Actor: "me", Action: "login", Actee: "you"}
+		}
+		_, err := esi.PostData(pzsyslog.LoggerType, "", m)
+		assert.NoError(err)
+	}
+	return esi
+}
+
+func searchMemoryIndex(assert *assert.Assertions, esi *MemoryIndex, jsn string) ([]string, int) {
+	result, err := esi.SearchByJSON(pzsyslog.LoggerType, jsn)
+	assert.NoError(err)
+	if result == nil {
+		return nil, 0
+	}
+	msgs, err := extractFromSearchResult(result)
+	assert.NoError(err)
+	apps := []string{}
+	for _, m := range msgs {
+		apps = append(apps, m.Application)
+	}
+	return apps, int(result.TotalHits())
+}
+
+func TestMemoryIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := newMemoryIndexForTest(assert)
+
+	apps, total := searchMemoryIndex(assert, esi, `{"query":{"match_all":{}}}`)
+	assert.Equal([]string{"pz-workflow", "pz-gateway", "pz-workflow", "pz-jobmanager"}, apps)
+	assert.Equal(4, total)
+
+	apps, total = searchMemoryIndex(assert, esi,
+		`{"query":{"range":{"severity":{"gte":4}}},"sort":[{"timeStamp":{"order":"desc"}}],"from":1,"size":1}`)
+	assert.Equal([]string{"pz-workflow"}, apps)
+	assert.Equal(3, total)
+
+	apps, _ = searchMemoryIndex(assert, esi,
+		`{"query":{"range":{"timeStamp":{"lt":"2016-07-26T01:02:00Z"}}},"sort":{"application":"asc"}}`)
+	assert.Equal([]string{"pz-gateway", "pz-workflow"}, apps)
+
+	apps, _ = searchMemoryIndex(assert, esi, `{"query":{"filtered":{
+		"query":{"match":{"application":"pz-workflow"}},
+		"filter":{"bool":{"should":[{"query":{"wildcard":{"message":{"value":"*says*"}}}}]}}}}}`)
+	assert.Equal([]string{"pz-workflow", "pz-workflow"}, apps)
+
+	apps, _ = searchMemoryIndex(assert, esi, `{"query":{"bool":{
+		"must":{"term":{"hostName":"host"}},
+		"must_not":[{"terms":{"application":["pz-workflow","pz-jobmanager"]}}]}}}`)
+	assert.Equal([]string{"pz-gateway"}, apps)
+
+	apps, _ = searchMemoryIndex(assert, esi, `{"query":{"term":{"auditData.actor":"me"}}}`)
+	assert.Equal([]string{"pz-gateway"}, apps)
+
+	// should is optional beside a must, unless minimum_should_match is set
+	apps, _ = searchMemoryIndex(assert, esi, `{"query":{"bool":{
+		"must":[{"term":{"severity":6}}],
+		"should":[{"term":{"application":"nobody"}}]}}}`)
+	assert.Equal([]string{"pz-jobmanager"}, apps)
+	apps, _ = searchMemoryIndex(assert, esi, `{"query":{"bool":{
+		"must":[{"term":{"severity":6}}],
+		"should":[{"term":{"application":"nobody"}}],
+		"minimum_should_match":1}}}`)
+	assert.Empty(apps)
+
+	_, err := esi.SearchByJSON(pzsyslog.LoggerType, `{"query":{"fuzzy":{"message":"hi"}}}`)
+	assert.Error(err)
+}
+
+func TestMatchMemoryWildcard(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(matchMemoryWildcard("dev-*", "dev-1"))
+	assert.True(matchMemoryWildcard("*time?ut*", "a timeout here"))
+	assert.True(matchMemoryWildcard("*", ""))
+	assert.False(matchMemoryWildcard("dev-?", "dev-12"))
+	assert.False(matchMemoryWildcard("a*b", "abc"))
+}
@@ -0,0 +1,154 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// DefaultMetricPercentiles are the percentiles GET /metrics/query returns
+// unless it is asked for others.
+var DefaultMetricPercentiles = []float64{50, 95, 99}
+
+// metricGroupByFields maps what GET /metrics/query can group by to the
+// field it groups on.
+var metricGroupByFields = map[string]string{
+	"object":            "metricData.object",
+	"metricData.object": "metricData.object",
+	"application":       "application",
+}
+
+// MetricQueryResult is what GET /metrics/query returns. Summary has one
+// bucket per group, or just the one if there is no grouping; Series has a
+// bucket per group per interval, and is only there if an interval was
+// asked for. Each bucket's Metric summarizes metricData.value.
+type MetricQueryResult struct {
+	Name        string            `json:"name"`
+	GroupBy     string            `json:"groupBy,omitempty"`
+	Interval    string            `json:"interval,omitempty"`
+	Percentiles []float64         `json:"percentiles"`
+	Count       int               `json:"count"` // number of messages matched
+	Summary     []AggregateBucket `json:"summary"`
+	Series      []AggregateBucket `json:"series,omitempty"`
+}
+
+// QueryMetric takes the name of a metric, plus optionally groupBy (object
+// or application), interval, percentiles (a list of numbers from 0 to
+// 100) and the filters of GET /syslog, such as after and before.
+func (service *Service) QueryMetric(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	name, err := params.GetAsString("name", "")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if name == "" {
+		return service.newBadRequestResponse(errors.New("name is required"))
+	}
+
+	result := &MetricQueryResult{Name: name}
+	spec := &aggregateSpec{metricField: "metricData.value"}
+
+	if result.GroupBy, err = params.GetAsString("groupBy", ""); err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if result.GroupBy != "" {
+		field, ok := metricGroupByFields[result.GroupBy]
+		if !ok {
+			return service.newBadRequestResponse(
+				fmt.Errorf("groupBy must be object or application, not %q", result.GroupBy))
+		}
+		spec.groupBy = []string{field}
+	}
+
+	if result.Interval, err = params.GetAsString("interval", ""); err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	var interval *aggregateInterval
+	if result.Interval != "" {
+		if interval, err = parseAggregateInterval(result.Interval); err != nil {
+			return service.newBadRequestResponse(err)
+		}
+	}
+
+	percents, err := getListParam(params, "percentiles")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if percents == nil {
+		spec.percentiles = DefaultMetricPercentiles
+	}
+	for _, s := range percents {
+		percent, err := strconv.ParseFloat(s, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return service.newBadRequestResponse(
+				fmt.Errorf("percentiles must be numbers from 0 to 100, not %q", s))
+		}
+		spec.percentiles = append(spec.percentiles, percent)
+	}
+	result.Percentiles = spec.percentiles
+
+	pagination := &piazza.JsonPagination{SortBy: "timeStamp", Order: piazza.SortOrderAscending}
+	dsl, err := createQueryDslAsString(pagination, params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	must := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"metricData.name": name}},
+	}
+	if dsl != "" {
+		obj := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(dsl), &obj); err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		must = append(must, obj["query"])
+	}
+	query := map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+
+	summary, err := service.aggregator.Aggregate(pzsyslog.LoggerType, query, spec)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	sortAggregateBuckets(summary.Buckets)
+	result.Count = summary.Count
+	result.Summary = summary.Buckets
+
+	if interval != nil {
+		spec.interval = interval
+		series, err := service.aggregator.Aggregate(pzsyslog.LoggerType, query, spec)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		sortAggregateBuckets(series.Buckets)
+		result.Series = series.Buckets
+	}
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       result,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
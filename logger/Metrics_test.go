@@ -0,0 +1,137 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestComputeMetricStats(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(computeMetricStats(nil, []float64{50}))
+
+	metric := computeMetricStats([]float64{4, 1, 3, 2}, []float64{0, 50, 100})
+	assert.Equal(1.0, metric.Min)
+	assert.Equal(4.0, metric.Max)
+	assert.Equal(10.0, metric.Sum)
+	assert.Equal(2.5, metric.Avg)
+	assert.Equal(map[string]float64{"0": 1, "50": 2.5, "100": 4}, metric.Percentiles)
+}
+
+func TestQueryMetric(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("metrictest")
+	assert.NoError(esi.Create(""))
+
+	start := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	post := func(name string, object string, value float64, minutes int) {
+		m := pzsyslog.NewMessage("123456")
+		m.Application = "pz-jobmanager"
+		m.TimeStamp = piazza.TimeStamp(start.Add(time.Duration(minutes) * time.Minute))
+		m.MetricData = &pzsyslog.MetricElement{Name: name, Value: value, Object: object}
+		_, err := esi.PostData(pzsyslog.LoggerType, "", m)
+		assert.NoError(err)
+	}
+	post("duration", "job-a", 10, 0)
+	post("duration", "job-a", 30, 1)
+	post("duration", "job-b", 5, 61)
+	post("queueSize", "queue", 1000, 2)
+
+	service := &Service{esIndex: esi, aggregator: &searchAggregator{esi: esi}}
+
+	query := func(s string) *MetricQueryResult {
+		request, err := http.NewRequest("GET", "/metrics/query?"+s, nil)
+		assert.NoError(err)
+		resp := service.QueryMetric(newQueryParams(request))
+		if !assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		assert.Equal("logmetricquery", resp.Type)
+		return resp.Data.(*MetricQueryResult)
+	}
+
+	result := query("name=duration")
+	assert.Equal(3, result.Count)
+	assert.Equal(DefaultMetricPercentiles, result.Percentiles)
+	assert.Nil(result.Series)
+	if assert.Len(result.Summary, 1) && assert.NotNil(result.Summary[0].Metric) {
+		assert.Equal(5.0, result.Summary[0].Metric.Min)
+		assert.Equal(30.0, result.Summary[0].Metric.Max)
+		assert.Equal(15.0, result.Summary[0].Metric.Avg)
+		assert.Equal(10.0, result.Summary[0].Metric.Percentiles["50"])
+	}
+
+	result = query("name=duration&groupBy=object&interval=hour&percentiles=90&before=2016-07-26T01:30:00Z")
+	assert.Equal(2, result.Count)
+	if assert.Len(result.Summary, 1) {
+		assert.Equal("job-a", result.Summary[0].Key["metricData.object"])
+		assert.Equal(40.0, result.Summary[0].Metric.Sum)
+		assert.Equal(map[string]float64{"90": 28}, result.Summary[0].Metric.Percentiles)
+	}
+	if assert.Len(result.Series, 1) {
+		assert.Equal(start, *result.Series[0].Time)
+		assert.Equal(2, result.Series[0].Count)
+	}
+
+	result = query("name=duration&interval=hour")
+	if assert.Len(result.Series, 2) {
+		assert.Equal(20.0, result.Series[0].Metric.Avg)
+		assert.Equal(5.0, result.Series[1].Metric.Avg)
+	}
+
+	for _, s := range []string{"", "name=duration&groupBy=host", "name=duration&percentiles=101", "name=duration&interval=1s"} {
+		request, err := http.NewRequest("GET", "/metrics/query?"+s, nil)
+		assert.NoError(err)
+		resp := service.QueryMetric(newQueryParams(request))
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, s)
+	}
+}
+
+func TestElasticMetricStats(t *testing.T) {
+	assert := assert.New(t)
+
+	var request map[string]interface{}
+	ag, closer := newFakeElasticAggregator(assert, `{
+		"hits": {"total": 3, "hits": []},
+		"aggregations": {
+			"stats": {"count": 3, "min": 5, "max": 30, "avg": 15, "sum": 45},
+			"percentiles": {"values": {"50.0": 10, "99.9": 29.9}}
+		}
+	}`, &request)
+	defer closer()
+
+	result, err := ag.Aggregate(pzsyslog.LoggerType, map[string]interface{}{"match_all": map[string]interface{}{}},
+		&aggregateSpec{metricField: "metricData.value", percentiles: []float64{50, 99.9}})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Contains(request, "aggs")
+	assert.Equal(3, result.Count)
+	if assert.Len(result.Buckets, 1) && assert.NotNil(result.Buckets[0].Metric) {
+		metric := result.Buckets[0].Metric
+		assert.Equal(5.0, metric.Min)
+		assert.Equal(45.0, metric.Sum)
+		assert.Equal(map[string]float64{"50": 10, "99.9": 29.9}, metric.Percentiles)
+	}
+}
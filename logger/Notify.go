@@ -0,0 +1,1176 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+const (
+	// NotificationChannelType and NotificationDeliveryType are the types,
+	// alongside the alert rules, that channels and the record of what was
+	// sent through them are kept in.
+	NotificationChannelType  = "NotificationChannel"
+	NotificationDeliveryType = "NotificationDelivery"
+
+	// the kinds of channel
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+
+	// the outcomes of a delivery
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	// MaxNotificationChannels is the most channels there may be.
+	MaxNotificationChannels = 1000
+
+	// MaxNotificationEvents is the most events a notification lists; it
+	// counts the rest.
+	MaxNotificationEvents = 10
+
+	// DefaultEmailSubject is the subject of emails from channels without one.
+	DefaultEmailSubject = "pz-logger alert: {{.RuleName}} ({{.NumMatches}})"
+)
+
+const notificationChannelMapping = `{
+	"NotificationChannel": {
+		"dynamic": "strict",
+		"properties": {
+			"id":        {"type": "string", "index": "not_analyzed"},
+			"name":      {"type": "string", "index": "not_analyzed"},
+			"type":      {"type": "string", "index": "not_analyzed"},
+			"url":       {"type": "string", "index": "not_analyzed"},
+			"template":  {"type": "string", "index": "no"},
+			"to":        {"type": "string", "index": "not_analyzed"},
+			"subject":   {"type": "string", "index": "no"},
+			"tenant":    {"type": "string", "index": "not_analyzed"},
+			"createdOn": {"type": "date"}
+		}
+	}
+}`
+
+const notificationDeliveryMapping = `{
+	"NotificationDelivery": {
+		"dynamic": "strict",
+		"properties": {
+			"id":         {"type": "string", "index": "not_analyzed"},
+			"channelId":  {"type": "string", "index": "not_analyzed"},
+			"ruleId":     {"type": "string", "index": "not_analyzed"},
+			"tenant":     {"type": "string", "index": "not_analyzed"},
+			"timeStamp":  {"type": "date"},
+			"numMatches": {"type": "integer"},
+			"attempts":   {"type": "integer"},
+			"status":     {"type": "string", "index": "not_analyzed"},
+			"error":      {"type": "string", "index": "no"}
+		}
+	}
+}`
+
+// NotificationChannel is somewhere to send notifications of alert rule
+// matches: a webhook, which is POSTed a JSON body, or email addresses.
+type NotificationChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"` // ChannelWebhook or ChannelEmail
+
+	// for a webhook: where to POST, and a text/template of the JSON body,
+	// which is given the Notification; if there is no template, the body
+	// is the Notification itself
+	URL      string `json:"url,omitempty"`
+	Template string `json:"template,omitempty"`
+
+	// for email: who to send it to, and a text/template of the subject
+	To      []string `json:"to,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+
+	Tenant    string           `json:"tenant,omitempty"`
+	CreatedOn piazza.TimeStamp `json:"createdOn"`
+}
+
+// Notification is what a channel is told: that a rule matched one or more
+// messages.
+type Notification struct {
+	RuleID     string           `json:"ruleId"`
+	RuleName   string           `json:"ruleName"`
+	Tenant     string           `json:"tenant,omitempty"`
+	NumMatches int              `json:"numMatches"`
+	First      piazza.TimeStamp `json:"first"`
+	Last       piazza.TimeStamp `json:"last"`
+
+	// the first MaxNotificationEvents of the matches
+	Events []*AlertEvent `json:"events"`
+}
+
+func (n *Notification) add(event *AlertEvent) {
+	if n.NumMatches == 0 {
+		n.First = event.TimeStamp
+	}
+	n.Last = event.TimeStamp
+	n.NumMatches++
+	if len(n.Events) < MaxNotificationEvents {
+		n.Events = append(n.Events, event)
+	}
+}
+
+// NotificationDelivery records the sending of a notification to a channel.
+type NotificationDelivery struct {
+	ID         string           `json:"id"`
+	ChannelID  string           `json:"channelId"`
+	RuleID     string           `json:"ruleId"`
+	Tenant     string           `json:"tenant,omitempty"`
+	TimeStamp  piazza.TimeStamp `json:"timeStamp"` // when it was delivered or given up on
+	NumMatches int              `json:"numMatches"`
+	Attempts   int              `json:"attempts"`
+	Status     string           `json:"status"` // DeliveryDelivered or DeliveryFailed
+	Error      string           `json:"error,omitempty"`
+}
+
+// channelError is what is wrong with a channel that can't be saved.
+type channelError struct {
+	problem string
+}
+
+func (e *channelError) Error() string {
+	return e.problem
+}
+
+// permanentError is a failure to deliver that retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+//---------------------------------------------------------------------------
+
+// SMTPConfig is the mail server that email channels send through.
+type SMTPConfig struct {
+	Addr     string // host:port
+	From     string
+	Username string // if set, with Password, for PLAIN auth
+	Password string
+}
+
+// NotifierConfig says how hard a Notifier tries.
+type NotifierConfig struct {
+	QueueSize      int // max notifications waiting to be sent
+	Workers        int
+	MaxAttempts    int           // per notification, per channel
+	InitialBackoff time.Duration // between the first and second attempts, doubling after
+	MaxBackoff     time.Duration
+	Timeout        time.Duration // of each webhook request or SMTP exchange
+
+	// If set, webhooks may only be on these hosts: a name matches exactly,
+	// and one starting with a dot, such as ".example.com", matches every
+	// host in the domain.
+	WebhookHosts []string
+
+	// if not set, there can be no email channels
+	SMTP *SMTPConfig
+}
+
+func (config *NotifierConfig) setDefaults() {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = time.Minute
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+}
+
+// notificationJob is a notification on its way to one channel.
+type notificationJob struct {
+	channel      NotificationChannel
+	notification *Notification
+}
+
+// throttleWindow is where a throttled rule's matches wait for the next
+// notification.
+type throttleWindow struct {
+	last     time.Time // when the last notification went out
+	pending  *Notification
+	channels []string
+	timer    *time.Timer
+}
+
+// Notifier sends notifications of alert rule matches to the rules'
+// channels, at most one per rule per throttle period, retrying each with
+// backoff. Channels are kept in the index, and in memory, as rules are,
+// and reloaded as often, for the changes made through other instances.
+type Notifier struct {
+	sync.Mutex
+	config   NotifierConfig
+	esi      elasticsearch.IIndex
+	channels map[string]*NotificationChannel
+	windows  map[string]*throttleWindow // by rule ID
+
+	// the channels changed through this notifier lately, by ID, nil if
+	// deleted, which a reload leaves alone
+	changes     map[string]channelChange
+	stopReloads chan struct{}
+
+	queue   chan *notificationJob
+	stop    chan struct{}
+	closed  bool
+	workers sync.WaitGroup
+
+	// tenants' webhooks go through tenantClient, which won't connect to
+	// private addresses
+	client       *http.Client
+	tenantClient *http.Client
+	now          func() time.Time
+}
+
+type channelChange struct {
+	channel *NotificationChannel
+	at      time.Time
+}
+
+// NewNotifier makes sure the index has the notification types, reads the
+// channels, and starts the workers.
+func NewNotifier(esi elasticsearch.IIndex, config *NotifierConfig) (*Notifier, error) {
+	for typ, mapping := range map[string]string{
+		NotificationChannelType:  notificationChannelMapping,
+		NotificationDeliveryType: notificationDeliveryMapping,
+	} {
+		ok, err := esi.TypeExists(typ)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err = esi.SetMapping(typ, piazza.JsonString(mapping)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	notifier := &Notifier{
+		esi:      esi,
+		channels: map[string]*NotificationChannel{},
+		windows:  map[string]*throttleWindow{},
+		changes:  map[string]channelChange{},
+		stop:     make(chan struct{}),
+		now:      time.Now,
+	}
+	if config != nil {
+		notifier.config = *config
+	}
+	notifier.config.setDefaults()
+	notifier.queue = make(chan *notificationJob, notifier.config.QueueSize)
+	notifier.client = &http.Client{
+		Timeout:       notifier.config.Timeout,
+		CheckRedirect: notifier.checkRedirect,
+	}
+	notifier.tenantClient = &http.Client{
+		Timeout:       notifier.config.Timeout,
+		CheckRedirect: notifier.checkRedirect,
+		// no proxy, which would be the one connecting
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: notifier.config.Timeout,
+				Control: refusePrivateAddress,
+			}).DialContext,
+		},
+	}
+
+	var err error
+	if notifier.channels, err = notifier.readChannels(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < notifier.config.Workers; i++ {
+		notifier.workers.Add(1)
+		go notifier.work()
+	}
+
+	return notifier, nil
+}
+
+// readChannels reads the channels from the index.
+func (notifier *Notifier) readChannels() (map[string]*NotificationChannel, error) {
+	dsl := fmt.Sprintf(`{"query":{"match_all":{}},"size":%d}`, MaxNotificationChannels)
+	searchResult, err := notifier.esi.SearchByJSON(NotificationChannelType, dsl)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := map[string]*NotificationChannel{}
+	for _, hit := range *searchResult.GetHits() {
+		if hit.Source == nil {
+			continue
+		}
+		channel := &NotificationChannel{}
+		if err = json.Unmarshal(*hit.Source, channel); err != nil {
+			return nil, err
+		}
+		channels[channel.ID] = channel
+	}
+	return channels, nil
+}
+
+// ReloadChannels reads the channels back from the index, except for those
+// changed through this notifier lately.
+func (notifier *Notifier) ReloadChannels() error {
+	channels, err := notifier.readChannels()
+	if err != nil {
+		return err
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	now := notifier.now()
+	for id, change := range notifier.changes {
+		if now.Sub(change.at) > alertRuleChangeSlack {
+			delete(notifier.changes, id)
+			continue
+		}
+		if change.channel == nil {
+			delete(channels, id)
+		} else {
+			channels[id] = change.channel
+		}
+	}
+	notifier.channels = channels
+	return nil
+}
+
+// startChannelReloads reloads the channels every interval until
+// stopChannelReloads.
+func (notifier *Notifier) startChannelReloads(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultAlertRuleReloadInterval
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+	if notifier.stopReloads != nil {
+		return
+	}
+	stop := make(chan struct{})
+	notifier.stopReloads = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := notifier.ReloadChannels(); err != nil {
+					log.Printf("Unable to reload notification channels: %s", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (notifier *Notifier) stopChannelReloads() {
+	notifier.Lock()
+	defer notifier.Unlock()
+	if notifier.stopReloads != nil {
+		close(notifier.stopReloads)
+		notifier.stopReloads = nil
+	}
+}
+
+// Channels returns the channels the tenant may see, oldest first.
+func (notifier *Notifier) Channels(tenant string) []NotificationChannel {
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	channels := []NotificationChannel{}
+	for _, channel := range notifier.channels {
+		if sees(tenant, channel.Tenant) {
+			channels = append(channels, *channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		ti, tj := time.Time(channels[i].CreatedOn), time.Time(channels[j].CreatedOn)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return channels[i].ID < channels[j].ID
+	})
+	return channels
+}
+
+// Channel returns the channel, or nil if there is none the tenant may see.
+func (notifier *Notifier) Channel(id string, tenant string) *NotificationChannel {
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	channel, ok := notifier.channels[id]
+	if !ok || !sees(tenant, channel.Tenant) {
+		return nil
+	}
+	c := *channel
+	return &c
+}
+
+// Put stores a new or changed channel. A new channel, one without an ID,
+// is given one.
+func (notifier *Notifier) Put(channel *NotificationChannel) error {
+	if err := notifier.check(channel); err != nil {
+		return err
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	if channel.ID == "" {
+		if len(notifier.channels) >= MaxNotificationChannels {
+			return &channelError{fmt.Sprintf("there may be at most %d notification channels", MaxNotificationChannels)}
+		}
+		channel.ID = piazza.NewUuid().String()
+		channel.CreatedOn = piazza.TimeStamp(notifier.now().UTC())
+	}
+
+	if _, err := notifier.esi.PutData(NotificationChannelType, channel.ID, channel); err != nil {
+		return err
+	}
+	c := *channel
+	notifier.channels[channel.ID] = &c
+	notifier.changes[channel.ID] = channelChange{channel: &c, at: notifier.now()}
+	return nil
+}
+
+// Delete removes a channel. Its deliveries are kept.
+func (notifier *Notifier) Delete(id string) error {
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	if _, err := notifier.esi.DeleteByID(NotificationChannelType, id); err != nil {
+		return err
+	}
+	delete(notifier.channels, id)
+	notifier.changes[id] = channelChange{at: notifier.now()}
+	return nil
+}
+
+// check makes sure a channel has what its type needs, and that its
+// templates work, by trying them on an example.
+func (notifier *Notifier) check(channel *NotificationChannel) error {
+	if channel.Name == "" {
+		return &channelError{"notification channel has no name"}
+	}
+
+	example := &Notification{RuleID: "example", RuleName: "example"}
+	example.add(&AlertEvent{ID: "example", RuleID: "example", RuleName: "example",
+		TimeStamp: piazza.TimeStamp(notifier.now().UTC()), Message: pzsyslog.NewMessage("0")})
+
+	switch channel.Type {
+	case ChannelWebhook:
+		if !strings.HasPrefix(channel.URL, "http://") && !strings.HasPrefix(channel.URL, "https://") {
+			return &channelError{"webhook channel needs an http or https url"}
+		}
+		u, err := url.Parse(channel.URL)
+		if err != nil || u.Hostname() == "" {
+			return &channelError{fmt.Sprintf("bad webhook url %q", channel.URL)}
+		}
+		if !notifier.webhookHostAllowed(u.Hostname()) {
+			return &channelError{fmt.Sprintf("webhooks may not be on %s", u.Hostname())}
+		}
+		if channel.Tenant != "" && isPrivateHost(u.Hostname()) {
+			return &channelError{"a tenant's webhook can't be on a private address"}
+		}
+		if _, err := renderWebhookBody(channel, example); err != nil {
+			return &channelError{err.Error()}
+		}
+	case ChannelEmail:
+		if notifier.config.SMTP == nil {
+			return &channelError{"there is no SMTP server for email channels"}
+		}
+		if len(channel.To) == 0 {
+			return &channelError{"email channel has no to addresses"}
+		}
+		for _, to := range channel.To {
+			if strings.ContainsAny(to, "\r\n,") {
+				return &channelError{fmt.Sprintf("bad email address %q", to)}
+			}
+		}
+		if _, err := renderEmailSubject(channel, example); err != nil {
+			return &channelError{err.Error()}
+		}
+	default:
+		return &channelError{fmt.Sprintf("notification channel type must be %s or %s", ChannelWebhook, ChannelEmail)}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+// alert is called with each alert event. If the rule has channels, the
+// event goes out in a notification now, or, if the rule is throttled and
+// one went out too recently, in a summary at the end of the throttle period.
+func (notifier *Notifier) alert(rule AlertRule, event *AlertEvent) {
+	if len(rule.Channels) == 0 {
+		return
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	if notifier.closed {
+		return
+	}
+
+	now := notifier.now()
+	throttle := rule.throttle()
+
+	w := notifier.windows[rule.ID]
+	if throttle <= 0 || w == nil || (w.pending == nil && !now.Before(w.last.Add(throttle))) {
+		n := &Notification{RuleID: rule.ID, RuleName: rule.Name, Tenant: rule.Tenant}
+		n.add(event)
+		notifier.dispatch(n, rule.Channels)
+		if throttle > 0 {
+			notifier.windows[rule.ID] = &throttleWindow{last: now}
+		} else {
+			delete(notifier.windows, rule.ID)
+		}
+		return
+	}
+
+	if w.pending == nil {
+		w.pending = &Notification{RuleID: rule.ID, RuleName: rule.Name, Tenant: rule.Tenant}
+		w.timer = time.AfterFunc(w.last.Add(throttle).Sub(now), func() {
+			notifier.flush(rule.ID)
+		})
+	}
+	w.pending.RuleName = rule.Name
+	w.pending.add(event)
+	w.channels = rule.Channels
+}
+
+// flush sends the summary of a throttled rule's matches.
+func (notifier *Notifier) flush(ruleID string) {
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	w := notifier.windows[ruleID]
+	if notifier.closed || w == nil || w.pending == nil {
+		return
+	}
+	notifier.dispatch(w.pending, w.channels)
+	w.pending = nil
+	w.timer = nil
+	w.last = notifier.now()
+}
+
+// dispatch queues a notification for each of the channels. It is called
+// with the lock held, so the queue can't be closed underneath it.
+func (notifier *Notifier) dispatch(n *Notification, channelIDs []string) {
+	for _, id := range channelIDs {
+		channel, ok := notifier.channels[id]
+		if !ok {
+			log.Printf("alert rule %s: no notification channel %s", n.RuleID, id)
+			continue
+		}
+		job := &notificationJob{channel: *channel, notification: n}
+		select {
+		case notifier.queue <- job:
+		default:
+			go notifier.record(job, 0, errors.New("notification queue is full"))
+		}
+	}
+}
+
+func (notifier *Notifier) work() {
+	defer notifier.workers.Done()
+	for job := range notifier.queue {
+		select {
+		case <-notifier.stop:
+			notifier.abandon(job)
+		default:
+			notifier.deliver(job)
+		}
+	}
+}
+
+// abandon records a job that shutdown left no time for.
+func (notifier *Notifier) abandon(job *notificationJob) {
+	notifier.record(job, 0, errors.New("shut down before sending"))
+}
+
+// deliver sends a notification, retrying with backoff, and records how
+// that went.
+func (notifier *Notifier) deliver(job *notificationJob) {
+	backoff := notifier.config.InitialBackoff
+	var err error
+	attempts := 0
+	for attempts < notifier.config.MaxAttempts {
+		attempts++
+		if err = notifier.send(job); err == nil {
+			break
+		}
+		if _, ok := err.(*permanentError); ok || attempts == notifier.config.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-notifier.stop:
+			err = fmt.Errorf("shut down while retrying: %s", err.Error())
+			notifier.record(job, attempts, err)
+			return
+		}
+		backoff *= 2
+		if backoff > notifier.config.MaxBackoff {
+			backoff = notifier.config.MaxBackoff
+		}
+	}
+	notifier.record(job, attempts, err)
+}
+
+func (notifier *Notifier) send(job *notificationJob) error {
+	switch job.channel.Type {
+	case ChannelWebhook:
+		return notifier.sendWebhook(&job.channel, job.notification)
+	case ChannelEmail:
+		return notifier.sendEmail(&job.channel, job.notification)
+	}
+	return &permanentError{fmt.Errorf("unknown channel type %q", job.channel.Type)}
+}
+
+func (notifier *Notifier) record(job *notificationJob, attempts int, err error) {
+	delivery := &NotificationDelivery{
+		ID:         piazza.NewUuid().String(),
+		ChannelID:  job.channel.ID,
+		RuleID:     job.notification.RuleID,
+		Tenant:     job.notification.Tenant,
+		TimeStamp:  piazza.TimeStamp(notifier.now().UTC()),
+		NumMatches: job.notification.NumMatches,
+		Attempts:   attempts,
+		Status:     DeliveryDelivered,
+	}
+	if err != nil {
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+		log.Printf("Unable to notify channel %s of alert rule %s: %s", job.channel.ID, job.notification.RuleID, err.Error())
+	}
+	if _, err = notifier.esi.PostData(NotificationDeliveryType, delivery.ID, delivery); err != nil {
+		log.Printf("Unable to record notification delivery: %s", err.Error())
+	}
+}
+
+// Close sends the summaries still waiting out their throttle periods, and
+// waits for everything queued to be delivered. When the context is done, it
+// returns at once: whatever is waiting to be sent or retried is abandoned,
+// and recorded as failed, and sends still under way are left to finish or
+// time out.
+func (notifier *Notifier) Close(ctx context.Context) error {
+	notifier.Lock()
+	if notifier.closed {
+		notifier.Unlock()
+		return nil
+	}
+	for _, w := range notifier.windows {
+		if w.pending != nil {
+			w.timer.Stop()
+			notifier.dispatch(w.pending, w.channels)
+			w.pending = nil
+		}
+	}
+	notifier.closed = true
+	close(notifier.queue)
+	notifier.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		notifier.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(notifier.stop)
+		// the workers may all be stuck sending
+		go func() {
+			for job := range notifier.queue {
+				notifier.abandon(job)
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+//---------------------------------------------------------------------------
+
+var notificationTemplateFuncs = template.FuncMap{
+	// json quotes a value for use in a webhook template
+	"json": func(v interface{}) (string, error) {
+		byts, err := json.Marshal(v)
+		return string(byts), err
+	},
+}
+
+func renderWebhookBody(channel *NotificationChannel, n *Notification) ([]byte, error) {
+	if channel.Template == "" {
+		return json.Marshal(n)
+	}
+
+	tmpl, err := template.New("body").Funcs(notificationTemplateFuncs).Parse(channel.Template)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, n); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template does not make valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func (notifier *Notifier) sendWebhook(channel *NotificationChannel, n *Notification) error {
+	body, err := renderWebhookBody(channel, n)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	// the allowed hosts may have changed since the channel was made
+	u, err := url.Parse(channel.URL)
+	if err != nil {
+		return &permanentError{err}
+	}
+	if !notifier.webhookHostAllowed(u.Hostname()) {
+		return &permanentError{fmt.Errorf("webhooks may not be on %s", u.Hostname())}
+	}
+
+	client := notifier.client
+	if channel.Tenant != "" {
+		client = notifier.tenantClient
+	}
+	resp, err := client.Post(channel.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return &permanentError{err}
+		}
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return &permanentError{fmt.Errorf("webhook returned %s", resp.Status)}
+}
+
+// webhookHostAllowed says whether WebhookHosts, if it is set, lets
+// webhooks be on the host.
+func (notifier *Notifier) webhookHostAllowed(host string) bool {
+	if len(notifier.config.WebhookHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range notifier.config.WebhookHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirect keeps webhooks from being redirected to hosts they may not
+// be on.
+func (notifier *Notifier) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !notifier.webhookHostAllowed(req.URL.Hostname()) {
+		return fmt.Errorf("webhooks may not be on %s", req.URL.Hostname())
+	}
+	return nil
+}
+
+// errPrivateAddress is the error refusePrivateAddress refuses with.
+var errPrivateAddress = errors.New("a tenant's webhook can't be on a private address")
+
+// isPrivateIP says whether the address is loopback, private, link-local
+// (such as a cloud metadata service), or otherwise not on the internet.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// isPrivateHost says whether the host is a private address, or localhost.
+// Other names are only checked when they are connected to.
+func isPrivateHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return isPrivateIP(ip)
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// refusePrivateAddress is a net.Dialer Control that won't connect to a
+// private address, whatever name it was looked up from.
+func refusePrivateAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func renderEmailSubject(channel *NotificationChannel, n *Notification) (string, error) {
+	subject := channel.Subject
+	if subject == "" {
+		subject = DefaultEmailSubject
+	}
+	tmpl, err := template.New("subject").Funcs(notificationTemplateFuncs).Parse(subject)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	// it is a header
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(buf.String()), nil
+}
+
+// renderEmail makes a plain text email listing the matches.
+func (notifier *Notifier) renderEmail(channel *NotificationChannel, n *Notification) ([]byte, error) {
+	subject, err := renderEmailSubject(channel, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", notifier.config.SMTP.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(channel.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", notifier.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(&buf, "Alert rule %q matched %d time(s) from %s to %s.\r\n\r\n", n.RuleName, n.NumMatches,
+		time.Time(n.First).Format(time.RFC3339), time.Time(n.Last).Format(time.RFC3339))
+	for _, event := range n.Events {
+		if event.Rate != nil {
+			fmt.Fprintf(&buf, "%s %s\r\n", time.Time(event.TimeStamp).Format(time.RFC3339), event.Rate.Reason)
+		}
+		m := event.Message
+		if m == nil {
+			continue
+		}
+		text := strings.NewReplacer("\r", " ", "\n", " ").Replace(m.Message)
+		fmt.Fprintf(&buf, "%s severity %d %s %s: %s\r\n", time.Time(m.TimeStamp).Format(time.RFC3339),
+			m.Severity.Value(), m.Application, m.HostName, text)
+	}
+	if more := n.NumMatches - len(n.Events); more > 0 {
+		fmt.Fprintf(&buf, "...and %d more\r\n", more)
+	}
+	return buf.Bytes(), nil
+}
+
+func (notifier *Notifier) sendEmail(channel *NotificationChannel, n *Notification) error {
+	config := notifier.config.SMTP
+	if config == nil {
+		return &permanentError{errors.New("there is no SMTP server")}
+	}
+
+	mail, err := notifier.renderEmail(channel, n)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		host, _, err := net.SplitHostPort(config.Addr)
+		if err != nil {
+			return &permanentError{err}
+		}
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+
+	err = sendMail(config.Addr, notifier.config.Timeout, auth, config.From, channel.To, mail)
+	if tperr, ok := err.(*textproto.Error); ok && tperr.Code >= 500 {
+		return &permanentError{err}
+	}
+	return err
+}
+
+// sendMail is smtp.SendMail, except that the whole exchange, from dialing
+// the server on, must be over within the timeout.
+func sendMail(addr string, timeout time.Duration, auth smtp.Auth, from string, to []string, mail []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("the SMTP server doesn't support AUTH")
+		}
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(mail); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+//---------------------------------------------------------------------------
+
+func (service *Service) setNotifier(notifier *Notifier) {
+	service.Lock()
+	service.notifier = notifier
+	service.Unlock()
+}
+
+func (service *Service) getNotifier() *Notifier {
+	service.Lock()
+	defer service.Unlock()
+	return service.notifier
+}
+
+func (service *Service) getNotifierOrError() (*Notifier, *piazza.JsonResponse) {
+	notifier := service.getNotifier()
+	if notifier == nil {
+		return nil, service.newServiceUnavailableResponse(errors.New("notifications are not set up"))
+	}
+	return notifier, nil
+}
+
+// checkAlertRuleChannels makes sure a rule's channels exist and are its
+// tenant's, so that no one is told of messages they may not read.
+func (service *Service) checkAlertRuleChannels(rule *AlertRule) *piazza.JsonResponse {
+	if len(rule.Channels) == 0 {
+		return nil
+	}
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+	for _, id := range rule.Channels {
+		channel := notifier.Channel(id, rule.Tenant)
+		if channel == nil || channel.Tenant != rule.Tenant {
+			return service.newBadRequestResponse(fmt.Errorf("no notification channel %s", id))
+		}
+	}
+	return nil
+}
+
+// newChannelErrorResponse blames the caller for a channel that is not
+// right, and the index for anything else.
+func (service *Service) newChannelErrorResponse(err error) *piazza.JsonResponse {
+	if _, ok := err.(*channelError); ok {
+		return service.newBadRequestResponse(err)
+	}
+	return service.newInternalErrorResponse(err)
+}
+
+// GetNotificationChannels returns the channels the tenant may see.
+func (service *Service) GetNotificationChannels(tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+	return service.newAlertResponse(http.StatusOK, notifier.Channels(tenant))
+}
+
+// GetNotificationChannel returns one channel.
+func (service *Service) GetNotificationChannel(id string, tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+	channel := notifier.Channel(id, tenant)
+	if channel == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no notification channel %s", id))
+	}
+	return service.newAlertResponse(http.StatusOK, channel)
+}
+
+// PostNotificationChannel adds a channel, which belongs to the tenant if
+// there is one.
+func (service *Service) PostNotificationChannel(channel *NotificationChannel, tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+
+	channel.ID = ""
+	channel.Tenant = tenant
+	if err := notifier.Put(channel); err != nil {
+		return service.newChannelErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusCreated, channel)
+}
+
+// PutNotificationChannel changes a channel. Its type stays the same.
+func (service *Service) PutNotificationChannel(id string, update *NotificationChannel, tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+
+	channel := notifier.Channel(id, tenant)
+	if channel == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no notification channel %s", id))
+	}
+	channel.Name = update.Name
+	channel.URL = update.URL
+	channel.Template = update.Template
+	channel.To = update.To
+	channel.Subject = update.Subject
+	if err := notifier.Put(channel); err != nil {
+		return service.newChannelErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusOK, channel)
+}
+
+// DeleteNotificationChannel removes a channel, unless a rule still uses it.
+func (service *Service) DeleteNotificationChannel(id string, tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+
+	channel := notifier.Channel(id, tenant)
+	if channel == nil {
+		return service.newNotFoundResponse(fmt.Errorf("no notification channel %s", id))
+	}
+	if alerts := service.getAlertEngine(); alerts != nil {
+		for _, rule := range alerts.Rules("") {
+			for _, c := range rule.Channels {
+				if c == id {
+					return service.newBadRequestResponse(
+						fmt.Errorf("notification channel %s is used by alert rule %s", id, rule.ID))
+				}
+			}
+		}
+	}
+	if err := notifier.Delete(id); err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newAlertResponse(http.StatusOK, channel)
+}
+
+// GetNotificationDeliveries returns the record of notifications sent, or
+// not, that the tenant may see, filtered by channel, rule and status (each
+// a comma-separated list) and by after and before. Paging is as for GET
+// /alerts/events.
+func (service *Service) GetNotificationDeliveries(params *piazza.HttpQueryParams, tenant string) *piazza.JsonResponse {
+	notifier, resp := service.getNotifierOrError()
+	if resp != nil {
+		return resp
+	}
+
+	searchResult, pagination, nextCursor, resp := service.searchAlertIndex(notifier.esi, NotificationDeliveryType,
+		params, map[string]string{"channel": "channelId", "rule": "ruleId", "status": "status"}, tenant)
+	if resp != nil {
+		return resp
+	}
+
+	deliveries := make([]NotificationDelivery, 0, len(*searchResult.GetHits()))
+	for _, hit := range *searchResult.GetHits() {
+		if hit.Source == nil {
+			continue
+		}
+		var delivery NotificationDelivery
+		if err := json.Unmarshal(*hit.Source, &delivery); err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return service.newAlertListResponse(deliveries, pagination, nextCursor)
+}
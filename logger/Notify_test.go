@@ -0,0 +1,539 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// webhookStandIn is a webhook that fails with each status in turn, then
+// succeeds, and passes on the bodies it is sent.
+type webhookStandIn struct {
+	sync.Mutex
+	fail   []int
+	bodies chan []byte
+	*httptest.Server
+}
+
+func newWebhookStandIn(fail ...int) *webhookStandIn {
+	hook := &webhookStandIn{fail: fail, bodies: make(chan []byte, 100)}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook.Lock()
+		defer hook.Unlock()
+		if len(hook.fail) > 0 {
+			w.WriteHeader(hook.fail[0])
+			hook.fail = hook.fail[1:]
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		hook.bodies <- body
+	}))
+	return hook
+}
+
+func (hook *webhookStandIn) next(t *testing.T) map[string]interface{} {
+	select {
+	case body := <-hook.bodies:
+		obj := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(body, &obj), string(body))
+		return obj
+	case <-time.After(5 * time.Second):
+		t.Error("no webhook call")
+		return nil
+	}
+}
+
+// smtpStandIn is just enough of an SMTP server for net/smtp.SendMail. It
+// passes on each mail it is sent.
+type smtpStandIn struct {
+	listener net.Listener
+	mails    chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &smtpStandIn{listener: listener, mails: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(line string) {
+		_ = text.PrintfLine("%s", line)
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			server.mails <- strings.Join(lines, "\n")
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (server *smtpStandIn) next(t *testing.T) string {
+	select {
+	case mail := <-server.mails:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Error("no mail")
+		return ""
+	}
+}
+
+func newNotifierForTest(assert *assert.Assertions, smtpAddr string) (*MemoryIndex, *Notifier) {
+	esi := NewMemoryIndex("notifytest")
+	assert.NoError(esi.Create(""))
+
+	config := &NotifierConfig{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond}
+	if smtpAddr != "" {
+		config.SMTP = &SMTPConfig{Addr: smtpAddr, From: "pz-logger@localhost"}
+	}
+	notifier, err := NewNotifier(esi, config)
+	assert.NoError(err)
+	return esi, notifier
+}
+
+func newEventForTest(rule *AlertRule, text string) *AlertEvent {
+	m := pzsyslog.NewMessage("123456")
+	m.Application = "pz-jobmanager"
+	m.Severity = pzsyslog.Error
+	m.HostName = "host"
+	m.Message = text
+	return &AlertEvent{ID: piazza.NewUuid().String(), RuleID: rule.ID, RuleName: rule.Name,
+		TimeStamp: piazza.TimeStamp(time.Now().UTC()), Message: m}
+}
+
+// waitForDeliveries waits until n deliveries have been recorded.
+func waitForDeliveries(assert *assert.Assertions, service *Service, query string, n int) []NotificationDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		request, err := http.NewRequest("GET", "/alerts/deliveries?"+query, nil)
+		assert.NoError(err)
+		resp := service.GetNotificationDeliveries(newQueryParams(request), "")
+		if !assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		deliveries := resp.Data.([]NotificationDelivery)
+		if len(deliveries) >= n || time.Now().After(deadline) {
+			assert.Len(deliveries, n)
+			return deliveries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotificationChannels(t *testing.T) {
+	assert := assert.New(t)
+
+	esi, notifier := newNotifierForTest(assert, "")
+	defer func() {
+		assert.NoError(notifier.Close(context.Background()))
+	}()
+
+	hook := &NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: "http://localhost/hook",
+		Template: `{"text": {{json .RuleName}}, "count": {{.NumMatches}}}`}
+	assert.NoError(notifier.Put(hook))
+	assert.NotEmpty(hook.ID)
+
+	for _, bad := range []*NotificationChannel{
+		{Type: ChannelWebhook, URL: "http://localhost/hook"},
+		{Name: "no url", Type: ChannelWebhook},
+		{Name: "ftp", Type: ChannelWebhook, URL: "ftp://localhost/hook"},
+		{Name: "not json", Type: ChannelWebhook, URL: "http://localhost/hook", Template: `{"text": {{.RuleName}}}`},
+		{Name: "no field", Type: ChannelWebhook, URL: "http://localhost/hook", Template: `{{.Nothing}}`},
+		{Name: "no smtp", Type: ChannelEmail, To: []string{"ops@localhost"}},
+		{Name: "carrier pigeon", Type: "pigeon"},
+		{Name: "loopback", Type: ChannelWebhook, URL: "http://localhost/hook", Tenant: "acme"},
+		{Name: "metadata", Type: ChannelWebhook, URL: "http://169.254.169.254/latest", Tenant: "acme"},
+		{Name: "private", Type: ChannelWebhook, URL: "http://10.0.0.1:8080/hook", Tenant: "acme"},
+		{Name: "v6", Type: ChannelWebhook, URL: "http://[::1]/hook", Tenant: "acme"},
+	} {
+		err := notifier.Put(bad)
+		assert.IsType(&channelError{}, err, bad.Name)
+	}
+
+	mine := &NotificationChannel{Name: "mine", Type: ChannelWebhook, URL: "https://hooks.example.com/mine", Tenant: "acme"}
+	assert.NoError(notifier.Put(mine))
+	assert.Len(notifier.Channels(""), 2)
+	assert.Equal([]NotificationChannel{*mine}, notifier.Channels("acme"))
+	assert.Nil(notifier.Channel(hook.ID, "acme"))
+
+	// a new notifier reads the channels back...
+	again, err := NewNotifier(esi, nil)
+	assert.NoError(err)
+	assert.Equal(notifier.Channels(""), again.Channels(""))
+
+	// ...and picks up channels made through the other on reload
+	other := &NotificationChannel{Name: "other", Type: ChannelWebhook, URL: "http://localhost/other"}
+	assert.NoError(again.Put(other))
+	assert.Nil(notifier.Channel(other.ID, ""))
+	assert.NoError(notifier.ReloadChannels())
+	assert.Equal(other, notifier.Channel(other.ID, ""))
+
+	// a channel changed through a notifier is kept as it is for a while,
+	// in case the index isn't showing the change yet
+	now := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	notifier.now = func() time.Time { return now }
+	assert.NoError(notifier.Delete(other.ID))
+	_, err = esi.PutData(NotificationChannelType, other.ID, other)
+	assert.NoError(err)
+	assert.NoError(notifier.ReloadChannels())
+	assert.Nil(notifier.Channel(other.ID, ""))
+	now = now.Add(time.Hour)
+	assert.NoError(notifier.ReloadChannels())
+	assert.Equal(other, notifier.Channel(other.ID, ""))
+	assert.NoError(again.Delete(other.ID))
+	assert.NoError(again.Close(context.Background()))
+
+	assert.NoError(notifier.Delete(mine.ID))
+	assert.Nil(notifier.Channel(mine.ID, ""))
+}
+
+func TestNotifierWebhookHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	webhook := newWebhookStandIn()
+	defer webhook.Close()
+
+	esi := NewMemoryIndex("notifytest")
+	assert.NoError(esi.Create(""))
+	notifier, err := NewNotifier(esi, &NotifierConfig{WebhookHosts: []string{".example.com", "127.0.0.1"}})
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(notifier.Close(context.Background()))
+	}()
+
+	for url, ok := range map[string]bool{
+		"https://hooks.example.com/hook": true,
+		"https://HOOKS.EXAMPLE.COM/hook": true,
+		"https://example.com/hook":       false,
+		"https://badexample.com/hook":    false,
+		"https://example.org/hook":       false,
+		webhook.URL:                      true,
+	} {
+		err := notifier.Put(&NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: url})
+		if ok {
+			assert.NoError(err, url)
+		} else {
+			assert.IsType(&channelError{}, err, url)
+		}
+	}
+
+	// the check at Put can't see what a name resolves to, but sending does
+	n := &Notification{RuleID: "rule1", RuleName: "jobs", Tenant: "acme"}
+	err = notifier.send(&notificationJob{
+		channel:      NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL, Tenant: "acme"},
+		notification: n,
+	})
+	assert.IsType(&permanentError{}, err)
+	assert.Contains(err.Error(), "private address")
+
+	n.Tenant = ""
+	assert.NoError(notifier.send(&notificationJob{
+		channel:      NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL},
+		notification: n,
+	}))
+	assert.Equal("jobs", webhook.next(t)["ruleName"])
+}
+
+func TestNotifierWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	webhook := newWebhookStandIn(http.StatusServiceUnavailable)
+	defer webhook.Close()
+
+	esi, notifier := newNotifierForTest(assert, "")
+	service := &Service{esIndex: esi, notifier: notifier}
+
+	channel := &NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL,
+		Template: `{"text": {{json .RuleName}}, "count": {{.NumMatches}}, "first": {{json (index .Events 0).Message.Message}}}`}
+	assert.NoError(notifier.Put(channel))
+
+	rule := &AlertRule{ID: "rule1", Name: `jobs "failing"`, Channels: []string{channel.ID}}
+
+	// a 503 is retried
+	notifier.alert(*rule, newEventForTest(rule, "one"))
+	body := webhook.next(t)
+	assert.Equal(`jobs "failing"`, body["text"])
+	assert.EqualValues(1, body["count"])
+	assert.Equal("one", body["first"])
+
+	deliveries := waitForDeliveries(assert, service, "", 1)
+	if len(deliveries) == 1 {
+		assert.Equal(DeliveryDelivered, deliveries[0].Status)
+		assert.Equal(2, deliveries[0].Attempts)
+		assert.Equal(channel.ID, deliveries[0].ChannelID)
+		assert.Equal("rule1", deliveries[0].RuleID)
+	}
+
+	// without a template, the body is the notification
+	channel.Template = ""
+	assert.NoError(notifier.Put(channel))
+	notifier.alert(*rule, newEventForTest(rule, "two"))
+	body = webhook.next(t)
+	assert.Equal("rule1", body["ruleId"])
+	assert.Len(body["events"], 1)
+
+	// a 400 is not retried
+	webhook.Lock()
+	webhook.fail = []int{http.StatusBadRequest}
+	webhook.Unlock()
+	notifier.alert(*rule, newEventForTest(rule, "three"))
+	deliveries = waitForDeliveries(assert, service, "status=failed", 1)
+	if len(deliveries) == 1 {
+		assert.Equal(1, deliveries[0].Attempts)
+		assert.Contains(deliveries[0].Error, "400")
+	}
+
+	// nor is it retried forever
+	webhook.Lock()
+	webhook.fail = []int{500, 500, 500}
+	webhook.Unlock()
+	notifier.alert(*rule, newEventForTest(rule, "four"))
+	deliveries = waitForDeliveries(assert, service, "status=failed&order=asc", 2)
+	if len(deliveries) == 2 {
+		assert.Equal(3, deliveries[1].Attempts)
+		assert.Contains(deliveries[1].Error, "500")
+	}
+
+	assert.NoError(notifier.Close(context.Background()))
+	waitForDeliveries(assert, service, "rule=rule1&channel="+channel.ID, 4)
+}
+
+func TestNotifierThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	webhook := newWebhookStandIn()
+	defer webhook.Close()
+
+	_, notifier := newNotifierForTest(assert, "")
+
+	channel := &NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL}
+	assert.NoError(notifier.Put(channel))
+
+	rule := &AlertRule{ID: "rule1", Name: "jobs", Channels: []string{channel.ID}, Throttle: "200ms"}
+
+	// the first match goes out at once...
+	notifier.alert(*rule, newEventForTest(rule, "one"))
+	assert.EqualValues(1, webhook.next(t)["numMatches"])
+
+	// ...and the rest at the end of the throttle period, together
+	for i := 0; i < MaxNotificationEvents+2; i++ {
+		notifier.alert(*rule, newEventForTest(rule, "more"))
+	}
+	select {
+	case <-webhook.bodies:
+		assert.Fail("not throttled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	body := webhook.next(t)
+	assert.EqualValues(MaxNotificationEvents+2, body["numMatches"])
+	assert.Len(body["events"], MaxNotificationEvents)
+
+	// once a period has passed with nothing, the next match goes out at once
+	time.Sleep(250 * time.Millisecond)
+	notifier.alert(*rule, newEventForTest(rule, "late"))
+	select {
+	case <-webhook.bodies:
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail("throttled")
+	}
+
+	// closing sends what is waiting
+	notifier.alert(*rule, newEventForTest(rule, "last"))
+	assert.NoError(notifier.Close(context.Background()))
+	assert.EqualValues(1, webhook.next(t)["numMatches"])
+}
+
+func TestNotifierEmail(t *testing.T) {
+	assert := assert.New(t)
+
+	smtpServer := newSMTPStandIn(t)
+	defer smtpServer.listener.Close()
+
+	esi, notifier := newNotifierForTest(assert, smtpServer.listener.Addr().String())
+	service := &Service{esIndex: esi, notifier: notifier}
+
+	assert.IsType(&channelError{}, notifier.Put(&NotificationChannel{Name: "nobody", Type: ChannelEmail}))
+	assert.IsType(&channelError{}, notifier.Put(&NotificationChannel{Name: "header", Type: ChannelEmail,
+		To: []string{"ops@localhost\r\nBcc: everyone@localhost"}}))
+
+	channel := &NotificationChannel{Name: "ops", Type: ChannelEmail, To: []string{"ops@localhost", "dev@localhost"}}
+	assert.NoError(notifier.Put(channel))
+
+	rule := &AlertRule{ID: "rule1", Name: "jobs", Channels: []string{channel.ID}}
+	notifier.alert(*rule, newEventForTest(rule, "the job\nfailed"))
+
+	mail := smtpServer.next(t)
+	assert.Contains(mail, "To: ops@localhost, dev@localhost")
+	assert.Contains(mail, "Subject: pz-logger alert: jobs (1)")
+	assert.Contains(mail, `Alert rule "jobs" matched 1 time(s)`)
+	assert.Contains(mail, "severity 3 pz-jobmanager host: the job failed")
+
+	deliveries := waitForDeliveries(assert, service, "", 1)
+	if len(deliveries) == 1 {
+		assert.Equal(DeliveryDelivered, deliveries[0].Status)
+	}
+
+	assert.NoError(notifier.Close(context.Background()))
+}
+
+func TestNotifierEmailTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// a server that never says hello
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	esi, notifier := newNotifierForTest(assert, listener.Addr().String())
+	notifier.config.Timeout = 100 * time.Millisecond
+	notifier.config.MaxAttempts = 1
+	service := &Service{esIndex: esi, notifier: notifier}
+
+	channel := &NotificationChannel{Name: "ops", Type: ChannelEmail, To: []string{"ops@localhost"}}
+	assert.NoError(notifier.Put(channel))
+	rule := &AlertRule{ID: "rule1", Name: "jobs", Channels: []string{channel.ID}}
+	notifier.alert(*rule, newEventForTest(rule, "the job failed"))
+
+	deliveries := waitForDeliveries(assert, service, "", 1)
+	if len(deliveries) == 1 {
+		assert.Equal(DeliveryFailed, deliveries[0].Status)
+		assert.Contains(deliveries[0].Error, "timeout")
+	}
+
+	assert.NoError(notifier.Close(context.Background()))
+}
+
+func TestNotifierClose(t *testing.T) {
+	assert := assert.New(t)
+
+	webhook := newWebhookStandIn(500, 500, 500)
+	defer webhook.Close()
+
+	esi, notifier := newNotifierForTest(assert, "")
+	notifier.config.InitialBackoff = time.Hour
+	service := &Service{esIndex: esi, notifier: notifier}
+
+	channel := &NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL}
+	assert.NoError(notifier.Put(channel))
+	rule := &AlertRule{ID: "rule1", Name: "jobs", Channels: []string{channel.ID}}
+	notifier.alert(*rule, newEventForTest(rule, "one"))
+
+	// stuck waiting to retry
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, notifier.Close(ctx))
+
+	deliveries := waitForDeliveries(assert, service, "", 1)
+	if len(deliveries) == 1 {
+		assert.Equal(DeliveryFailed, deliveries[0].Status)
+		assert.Contains(deliveries[0].Error, "shut down")
+	}
+
+	// nothing more is taken
+	notifier.alert(*rule, newEventForTest(rule, "two"))
+	assert.NoError(notifier.Close(context.Background()))
+}
+
+func TestNotifierCloseHung(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	esi := NewMemoryIndex("notifytest")
+	assert.NoError(esi.Create(""))
+	notifier, err := NewNotifier(esi, &NotifierConfig{Workers: 1})
+	assert.NoError(err)
+	service := &Service{esIndex: esi, notifier: notifier}
+
+	channel := &NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: webhook.URL}
+	assert.NoError(notifier.Put(channel))
+	rule := &AlertRule{ID: "rule1", Name: "jobs", Channels: []string{channel.ID}}
+	notifier.alert(*rule, newEventForTest(rule, "one"))
+	notifier.alert(*rule, newEventForTest(rule, "two"))
+	notifier.alert(*rule, newEventForTest(rule, "three"))
+
+	// stuck sending, with more queued behind: Close doesn't wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(context.DeadlineExceeded, notifier.Close(ctx))
+	assert.True(time.Since(start) < time.Second)
+
+	// what was waiting is recorded as abandoned, without being sent
+	deliveries := waitForDeliveries(assert, service, "status=failed", 2)
+	for _, delivery := range deliveries {
+		assert.Equal(0, delivery.Attempts)
+		assert.Contains(delivery.Error, "shut down")
+	}
+}
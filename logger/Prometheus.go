@@ -0,0 +1,466 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// PrometheusContentType is the content type of GET /metrics, version 0.0.4
+// of the Prometheus text format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the request
+// latency histograms; they are those of the Prometheus client libraries.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	// MaxMetricApplications is how many applications the message counters
+	// name. Past it, accepted messages from other applications are counted
+	// under metricOtherApplication.
+	MaxMetricApplications = 1000
+
+	metricOtherApplication = "(other)"
+
+	// the application of a rejected message not from one of those named
+	metricUnknownApplication = "(unknown)"
+)
+
+// Telemetry is what pz-logger counts about itself for GET /metrics. A nil
+// *Telemetry counts nothing, so that a Service made without Init works.
+type Telemetry struct {
+	accepted *promCounterVec
+	rejected *promCounterVec
+	latency  *promHistogramVec
+	esErrors *promCounterVec
+
+	// the applications named so far, all from accepted messages, since
+	// those of rejected ones are whatever the client sent
+	applicationsLock sync.Mutex
+	applications     map[string]bool
+	maxApplications  int
+}
+
+func newTelemetry() *Telemetry {
+	return &Telemetry{
+		accepted: newPromCounterVec("pzlogger_messages_accepted_total",
+			"Log messages accepted.", "application", "severity"),
+		rejected: newPromCounterVec("pzlogger_messages_rejected_total",
+			"Log messages rejected, whether invalid or not stored.", "application", "severity"),
+		latency: newPromHistogramVec("pzlogger_request_duration_seconds",
+			"Time taken to handle requests.", DefaultLatencyBuckets, "handler"),
+		esErrors: newPromCounterVec("pzlogger_elasticsearch_errors_total",
+			"Failed Elasticsearch requests, and documents a bulk request failed to store.", "operation"),
+		applications:    map[string]bool{},
+		maxApplications: MaxMetricApplications,
+	}
+}
+
+// messageLabels are the application and severity of a message. A message
+// that could not be read at all has neither.
+func messageLabels(mssg *pzsyslog.Message) (string, string) {
+	if mssg == nil {
+		return "", ""
+	}
+	severity := "invalid"
+	if mssg.Severity >= pzsyslog.Emergency && mssg.Severity <= pzsyslog.Debug {
+		severity = strconv.Itoa(mssg.Severity.Value())
+	}
+	return mssg.Application, severity
+}
+
+// applicationLabel returns the label for a message's application: the
+// application, if it is named already or, for an accepted message, there
+// is room to name it.
+func (t *Telemetry) applicationLabel(application string, accepted bool) string {
+	t.applicationsLock.Lock()
+	defer t.applicationsLock.Unlock()
+
+	switch {
+	case t.applications[application]:
+		return application
+	case !accepted:
+		return metricUnknownApplication
+	case len(t.applications) >= t.maxApplications:
+		return metricOtherApplication
+	}
+	t.applications[application] = true
+	return application
+}
+
+func (t *Telemetry) messageAccepted(mssg *pzsyslog.Message) {
+	if t == nil {
+		return
+	}
+	application, severity := messageLabels(mssg)
+	t.accepted.add(1, t.applicationLabel(application, true), severity)
+}
+
+func (t *Telemetry) messageRejected(mssg *pzsyslog.Message) {
+	if t == nil {
+		return
+	}
+	application, severity := messageLabels(mssg)
+	if mssg != nil {
+		application = t.applicationLabel(application, false)
+	}
+	t.rejected.add(1, application, severity)
+}
+
+// observeRequest records the time since start against a handler. It is
+// meant to be deferred.
+func (t *Telemetry) observeRequest(handler string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.latency.observe(time.Since(start).Seconds(), handler)
+}
+
+func (t *Telemetry) esError(operation string, n int) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.esErrors.add(float64(n), operation)
+}
+
+// countBulk returns a bulkIndexer that counts the failures of indexer.
+func (t *Telemetry) countBulk(indexer bulkIndexer) bulkIndexer {
+	if t == nil {
+		return indexer
+	}
+	return &countingBulkIndexer{bulkIndexer: indexer, telemetry: t}
+}
+
+// countAggregate returns an aggregator that counts the failures of agg.
+func (t *Telemetry) countAggregate(agg aggregator) aggregator {
+	if t == nil {
+		return agg
+	}
+	return &countingAggregator{aggregator: agg, telemetry: t}
+}
+
+func (t *Telemetry) write(w io.Writer) error {
+	if t == nil {
+		return nil
+	}
+	for _, family := range []interface {
+		write(io.Writer) error
+	}{t.accepted, t.rejected, t.latency, t.esErrors} {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type countingBulkIndexer struct {
+	bulkIndexer
+	telemetry *Telemetry
+}
+
+func (bi *countingBulkIndexer) Bulk(typ string, docs []interface{}) ([]error, error) {
+	errs, err := bi.bulkIndexer.Bulk(typ, docs)
+	if err != nil {
+		bi.telemetry.esError("bulk", 1)
+		return errs, err
+	}
+	failed := 0
+	for _, e := range errs {
+		if e != nil {
+			failed++
+		}
+	}
+	bi.telemetry.esError("bulk_item", failed)
+	return errs, nil
+}
+
+type countingAggregator struct {
+	aggregator
+	telemetry *Telemetry
+}
+
+func (agg *countingAggregator) Aggregate(typ string, query interface{}, spec *aggregateSpec) (*AggregateResult, error) {
+	result, err := agg.aggregator.Aggregate(typ, query, spec)
+	if err != nil {
+		agg.telemetry.esError("aggregate", 1)
+	}
+	return result, err
+}
+
+//---------------------------------------------------------------------------
+
+// search is esIndex.SearchByJSON, counting the failures.
+func (service *Service) search(typ string, dsl string) (*elasticsearch.SearchResult, error) {
+	result, err := service.esIndex.SearchByJSON(typ, dsl)
+	if err != nil {
+		service.telemetry.esError("search", 1)
+	}
+	return result, err
+}
+
+// searchPage is searchPage on the logger's index, counting failures as
+// search does.
+func (service *Service) searchPage(typ string, dsl string) (*elasticsearch.SearchResult, string, error) {
+	result, nextCursor, err := searchPage(service.esIndex, typ, dsl)
+	if err != nil {
+		service.telemetry.esError("search", 1)
+	}
+	return result, nextCursor, err
+}
+
+// WritePrometheus writes what GET /metrics returns: the Telemetry, plus
+// the state of the write queues and the spool as they are now.
+func (service *Service) WritePrometheus(w io.Writer) error {
+	service.Lock()
+	logWriter := service.logWriter
+	auditWriter := service.auditWriter
+	spool := service.spool
+	service.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	if err := service.telemetry.write(bw); err != nil {
+		return err
+	}
+
+	writers := []*BatchWriter{}
+	names := []string{}
+	for i, writer := range []pzsyslog.Writer{logWriter, auditWriter} {
+		if batchWriter, ok := writer.(*BatchWriter); ok {
+			writers = append(writers, batchWriter)
+			names = append(names, []string{"log", "audit"}[i])
+		}
+	}
+	if len(writers) > 0 {
+		depth := newPromGaugeVec("pzlogger_queue_depth", "Async writes waiting in the queue.", "writer")
+		capacity := newPromGaugeVec("pzlogger_queue_capacity", "Length of the async write queue.", "writer")
+		failed := newPromCounterVec("pzlogger_async_write_failures_total",
+			"Async writes that could not be stored.", "writer")
+		dropped := newPromCounterVec("pzlogger_queue_dropped_total",
+			"Async writes dropped or refused because the queue was full.", "writer")
+		for i, batchWriter := range writers {
+			stats := batchWriter.Stats()
+			depth.add(float64(stats.QueueLength), names[i])
+			capacity.add(float64(stats.QueueCapacity), names[i])
+			failed.add(float64(stats.NumFailed), names[i])
+			dropped.add(float64(stats.NumDropped+stats.NumRejected), names[i])
+		}
+		for _, family := range []*promCounterVec{depth, capacity, failed, dropped} {
+			if err := family.write(bw); err != nil {
+				return err
+			}
+		}
+	}
+
+	if spool != nil {
+		stats := spool.Stats()
+		depth := newPromGaugeVec("pzlogger_spool_depth", "Messages in the spool, not yet stored.")
+		depth.add(float64(stats.Depth))
+		age := newPromGaugeVec("pzlogger_spool_oldest_age_seconds", "Age of the oldest message in the spool.")
+		age.add(stats.OldestAgeSeconds)
+		for _, family := range []*promCounterVec{depth, age} {
+			if err := family.write(bw); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+//---------------------------------------------------------------------------
+
+// promCounterVec is a counter, or a gauge, with a value per combination of
+// label values.
+type promCounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	labelValues []string
+	value       float64
+
+	// histograms only
+	counts []uint64
+	count  uint64
+}
+
+func newPromCounterVec(name string, help string, labels ...string) *promCounterVec {
+	return &promCounterVec{name: name, help: help, typ: "counter", labels: labels, series: map[string]*promSeries{}}
+}
+
+func newPromGaugeVec(name string, help string, labels ...string) *promCounterVec {
+	vec := newPromCounterVec(name, help, labels...)
+	vec.typ = "gauge"
+	return vec
+}
+
+func promSeriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func (vec *promCounterVec) add(delta float64, labelValues ...string) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	key := promSeriesKey(labelValues)
+	series, ok := vec.series[key]
+	if !ok {
+		series = &promSeries{labelValues: labelValues}
+		vec.series[key] = series
+	}
+	series.value += delta
+}
+
+func (vec *promCounterVec) write(w io.Writer) error {
+	vec.Lock()
+	defer vec.Unlock()
+
+	if err := writePromHeader(w, vec.name, vec.help, vec.typ); err != nil {
+		return err
+	}
+	for _, series := range sortPromSeries(vec.series) {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", vec.name,
+			formatPromLabels(vec.labels, series.labelValues, "", ""), formatPromValue(series.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promHistogramVec is a histogram with a set of buckets per combination
+// of label values.
+type promHistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+func newPromHistogramVec(name string, help string, buckets []float64, labels ...string) *promHistogramVec {
+	return &promHistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*promSeries{}}
+}
+
+func (vec *promHistogramVec) observe(value float64, labelValues ...string) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	key := promSeriesKey(labelValues)
+	series, ok := vec.series[key]
+	if !ok {
+		series = &promSeries{labelValues: labelValues, counts: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.value += value
+	series.count++
+}
+
+func (vec *promHistogramVec) write(w io.Writer) error {
+	vec.Lock()
+	defer vec.Unlock()
+
+	if err := writePromHeader(w, vec.name, vec.help, "histogram"); err != nil {
+		return err
+	}
+	for _, series := range sortPromSeries(vec.series) {
+		for i, bound := range vec.buckets {
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name,
+				formatPromLabels(vec.labels, series.labelValues, "le", formatPromValue(bound)), series.counts[i])
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name,
+			formatPromLabels(vec.labels, series.labelValues, "le", "+Inf"), series.count)
+		if err != nil {
+			return err
+		}
+		labels := formatPromLabels(vec.labels, series.labelValues, "", "")
+		if _, err = fmt.Fprintf(w, "%s_sum%s %s\n", vec.name, labels, formatPromValue(series.value)); err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "%s_count%s %d\n", vec.name, labels, series.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePromHeader(w io.Writer, name string, help string, typ string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	return err
+}
+
+func sortPromSeries(series map[string]*promSeries) []*promSeries {
+	keys := []string{}
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*promSeries, len(keys))
+	for i, key := range keys {
+		list[i] = series[key]
+	}
+	return list
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatPromLabels gives the {name="value",...} of a sample, with an
+// extra label if extraName is set.
+func formatPromLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+promLabelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatPromValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
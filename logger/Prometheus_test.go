@@ -0,0 +1,122 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+type failingBulkIndexer struct {
+	errs []error
+	err  error
+}
+
+func (bi *failingBulkIndexer) Bulk(typ string, docs []interface{}) ([]error, error) {
+	return bi.errs, bi.err
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	counter := newPromCounterVec("test_total", "A test.", "name")
+	counter.add(1, `say "hi"\now`)
+	counter.add(2.5, "a")
+	counter.add(1, "a")
+
+	histogram := newPromHistogramVec("test_seconds", "Test times.", []float64{.1, 1}, "handler")
+	histogram.observe(.05, "h")
+	histogram.observe(.5, "h")
+	histogram.observe(5, "h")
+
+	var buf bytes.Buffer
+	assert.NoError(counter.write(&buf))
+	assert.NoError(histogram.write(&buf))
+	assert.Equal(`# HELP test_total A test.
+# TYPE test_total counter
+test_total{name="a"} 3.5
+test_total{name="say \"hi\"\\now"} 1
+# HELP test_seconds Test times.
+# TYPE test_seconds histogram
+test_seconds_bucket{handler="h",le="0.1"} 1
+test_seconds_bucket{handler="h",le="1"} 2
+test_seconds_bucket{handler="h",le="+Inf"} 3
+test_seconds_sum{handler="h"} 5.55
+test_seconds_count{handler="h"} 3
+`, buf.String())
+}
+
+func TestTelemetryElasticErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	telemetry := newTelemetry()
+
+	bi := telemetry.countBulk(&failingBulkIndexer{errs: []error{nil, errors.New("no"), errors.New("no")}})
+	_, err := bi.Bulk("LogData", nil)
+	assert.NoError(err)
+	bi = telemetry.countBulk(&failingBulkIndexer{err: errors.New("down")})
+	_, err = bi.Bulk("LogData", nil)
+	assert.Error(err)
+
+	var buf bytes.Buffer
+	assert.NoError(telemetry.esErrors.write(&buf))
+	assert.Contains(buf.String(), `pzlogger_elasticsearch_errors_total{operation="bulk"} 1`)
+	assert.Contains(buf.String(), `pzlogger_elasticsearch_errors_total{operation="bulk_item"} 2`)
+
+	// a Service made without Init counts nothing, and doesn't fall over
+	service := &Service{}
+	var nothing *Telemetry
+	nothing.messageAccepted(nil)
+	buf.Reset()
+	assert.NoError(service.WritePrometheus(&buf))
+	assert.Empty(buf.String())
+}
+
+func TestTelemetryMessageLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	telemetry := newTelemetry()
+	telemetry.maxApplications = 2
+	message := func(application string) *pzsyslog.Message {
+		mssg := pzsyslog.NewMessage("123456")
+		mssg.Application = application
+		mssg.Severity = pzsyslog.Error
+		return mssg
+	}
+
+	telemetry.messageAccepted(message("a"))
+	telemetry.messageAccepted(message("b"))
+	telemetry.messageAccepted(message("c"))
+	telemetry.messageRejected(message("a"))
+	telemetry.messageRejected(message("junk"))
+	telemetry.messageRejected(message("c"))
+	telemetry.messageRejected(nil)
+
+	var buf bytes.Buffer
+	assert.NoError(telemetry.accepted.write(&buf))
+	assert.NoError(telemetry.rejected.write(&buf))
+	text := buf.String()
+	assert.Contains(text, `pzlogger_messages_accepted_total{application="a",severity="3"} 1`)
+	assert.Contains(text, `pzlogger_messages_accepted_total{application="b",severity="3"} 1`)
+	assert.Contains(text, `pzlogger_messages_accepted_total{application="(other)",severity="3"} 1`)
+	assert.Contains(text, `pzlogger_messages_rejected_total{application="a",severity="3"} 1`)
+	assert.Contains(text, `pzlogger_messages_rejected_total{application="(unknown)",severity="3"} 2`)
+	assert.Contains(text, `pzlogger_messages_rejected_total{application="",severity=""} 1`)
+	assert.NotContains(text, "junk")
+}
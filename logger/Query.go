@@ -0,0 +1,469 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The query language of GET /syslog?q= looks like this:
+//
+//     severity<=3 AND application:pz-workflow AND message:"timeout*" AND NOT hostName:dev-*
+//
+// A comparison is a field name, one of : = < <= > >=, and a value; : and =
+// both mean equality. A value is a bare word or a double-quoted string, and
+// may use * and ? as wildcards when compared for equality. Comparisons are
+// combined with AND, OR, NOT and parentheses; AND binds tighter than OR,
+// and two comparisons with nothing between them are ANDed.
+//
+// Queries are parsed into a tree of queryNodes, checked against the fields
+// of the LogData mapping, and compiled into Elasticsearch DSL.
+
+// QuerySyntaxError reports where in the query string something went wrong.
+// Pos counts characters, starting at 1.
+type QuerySyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("query syntax error at position %d: %s", e.Pos, e.Message)
+}
+
+type queryFieldType int
+
+const (
+	queryFieldString queryFieldType = iota
+	queryFieldInteger
+	queryFieldDouble
+	queryFieldDate
+)
+
+// queryFields are the fields of LogData, as laid out in the schema
+// package.
+var queryFields = map[string]queryFieldType{
+	"facility":            queryFieldInteger,
+	"severity":            queryFieldInteger,
+	"version":             queryFieldInteger,
+	"timeStamp":           queryFieldDate,
+	"hostName":            queryFieldString,
+	"application":         queryFieldString,
+	"process":             queryFieldString,
+	"messageId":           queryFieldString,
+	"auditData.actor":     queryFieldString,
+	"auditData.actee":     queryFieldString,
+	"auditData.action":    queryFieldString,
+	"metricData.name":     queryFieldString,
+	"metricData.value":    queryFieldDouble,
+	"metricData.object":   queryFieldString,
+	"sourceData.file":     queryFieldString,
+	"sourceData.line":     queryFieldInteger,
+	"sourceData.function": queryFieldString,
+	"message":             queryFieldString,
+	"tenant":              queryFieldString,
+}
+
+//---------------------------------------------------------------------------
+
+type queryTokenKind int
+
+const (
+	queryTokenEOF queryTokenKind = iota
+	queryTokenWord
+	queryTokenString
+	queryTokenOp
+	queryTokenLParen
+	queryTokenRParen
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+// lexQuery splits the query into tokens. A value may contain characters
+// such as : that would otherwise end a word, so the word following an
+// operator runs up to the next space or closing parenthesis.
+func lexQuery(s string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	runes := []rune(s)
+	afterOp := false
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: queryTokenLParen, text: "(", pos: pos})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: queryTokenRParen, text: ")", pos: pos})
+			i++
+
+		case r == ':' || r == '=' || r == '<' || r == '>':
+			op := string(r)
+			i++
+			if (r == '<' || r == '>') && i < len(runes) && runes[i] == '=' {
+				op += "="
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenOp, text: op, pos: pos})
+			afterOp = true
+			continue
+
+		case r == '"':
+			text := []rune{}
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					text = append(text, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				text = append(text, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &QuerySyntaxError{Pos: pos, Message: "unterminated string"}
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenString, text: string(text), pos: pos})
+
+		default:
+			start := i
+			for i < len(runes) {
+				r = runes[i]
+				if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' {
+					break
+				}
+				if !afterOp && (r == ':' || r == '=' || r == '<' || r == '>') {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: queryTokenWord, text: string(runes[start:i]), pos: pos})
+		}
+
+		afterOp = false
+	}
+
+	tokens = append(tokens, queryToken{kind: queryTokenEOF, pos: len(runes) + 1})
+	return tokens, nil
+}
+
+//---------------------------------------------------------------------------
+
+// queryNode is one node of a parsed query.
+type queryNode interface {
+	toDsl() map[string]interface{}
+}
+
+type queryAnd struct {
+	children []queryNode
+}
+
+type queryOr struct {
+	children []queryNode
+}
+
+type queryNot struct {
+	child queryNode
+}
+
+type queryComparison struct {
+	field string
+	op    string
+	value interface{} // string, int, or float64, according to the field
+}
+
+func (node *queryAnd) toDsl() map[string]interface{} {
+	must := make([]interface{}, len(node.children))
+	for i, child := range node.children {
+		must[i] = child.toDsl()
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{"must": must},
+	}
+}
+
+func (node *queryOr) toDsl() map[string]interface{} {
+	should := make([]interface{}, len(node.children))
+	for i, child := range node.children {
+		should[i] = child.toDsl()
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+func (node *queryNot) toDsl() map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": []interface{}{node.child.toDsl()},
+		},
+	}
+}
+
+func (node *queryComparison) toDsl() map[string]interface{} {
+	switch node.op {
+	case "<", "<=", ">", ">=":
+		op := map[string]string{"<": "lt", "<=": "lte", ">": "gt", ">=": "gte"}[node.op]
+		return map[string]interface{}{
+			"range": map[string]interface{}{
+				node.field: map[string]interface{}{op: node.value},
+			},
+		}
+	}
+
+	if s, ok := node.value.(string); ok && strings.ContainsAny(s, "*?") {
+		return map[string]interface{}{
+			"wildcard": map[string]interface{}{
+				node.field: map[string]interface{}{"value": s},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"term": map[string]interface{}{node.field: node.value},
+	}
+}
+
+//---------------------------------------------------------------------------
+
+type queryParser struct {
+	tokens []queryToken
+	next   int
+}
+
+// ParseQuery parses a query string into its DSL form, ready to be used as
+// a clause of a bool query. Errors are *QuerySyntaxErrors.
+func ParseQuery(s string) (map[string]interface{}, error) {
+	node, err := parseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	return node.toDsl(), nil
+}
+
+func parseQuery(s string) (queryNode, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &queryParser{tokens: tokens}
+	if parser.peek().kind == queryTokenEOF {
+		return nil, parser.errorf("query is empty")
+	}
+
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != queryTokenEOF {
+		return nil, parser.errorf("unexpected %q", parser.peek().text)
+	}
+	return node, nil
+}
+
+func (parser *queryParser) peek() queryToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *queryParser) take() queryToken {
+	token := parser.tokens[parser.next]
+	if token.kind != queryTokenEOF {
+		parser.next++
+	}
+	return token
+}
+
+func (parser *queryParser) isKeyword(keyword string) bool {
+	token := parser.peek()
+	return token.kind == queryTokenWord && token.text == keyword
+}
+
+func (parser *queryParser) errorf(format string, args ...interface{}) error {
+	return &QuerySyntaxError{Pos: parser.peek().pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (parser *queryParser) parseOr() (queryNode, error) {
+	node, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{node}
+	for parser.isKeyword("OR") {
+		parser.take()
+		if node, err = parser.parseAnd(); err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &queryOr{children: children}, nil
+}
+
+func (parser *queryParser) parseAnd() (queryNode, error) {
+	node, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{node}
+	for {
+		token := parser.peek()
+		if token.kind == queryTokenEOF || token.kind == queryTokenRParen || parser.isKeyword("OR") {
+			break
+		}
+		if parser.isKeyword("AND") {
+			parser.take()
+		}
+		if node, err = parser.parseNot(); err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &queryAnd{children: children}, nil
+}
+
+func (parser *queryParser) parseNot() (queryNode, error) {
+	if parser.isKeyword("NOT") {
+		parser.take()
+		node, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{child: node}, nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *queryParser) parsePrimary() (queryNode, error) {
+	token := parser.peek()
+
+	switch token.kind {
+	case queryTokenLParen:
+		parser.take()
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek().kind != queryTokenRParen {
+			return nil, parser.errorf("expected )")
+		}
+		parser.take()
+		return node, nil
+
+	case queryTokenWord:
+		if token.text == "AND" || token.text == "OR" || token.text == "NOT" {
+			return nil, parser.errorf("unexpected %s", token.text)
+		}
+		return parser.parseComparison()
+
+	case queryTokenEOF:
+		return nil, parser.errorf("unexpected end of query")
+	}
+
+	return nil, parser.errorf("expected a field name, found %q", token.text)
+}
+
+func (parser *queryParser) parseComparison() (queryNode, error) {
+	fieldToken := parser.take()
+	typ, ok := queryFields[fieldToken.text]
+	if !ok {
+		return nil, &QuerySyntaxError{Pos: fieldToken.pos, Message: fmt.Sprintf("unknown field %q", fieldToken.text)}
+	}
+
+	if parser.peek().kind != queryTokenOp {
+		return nil, parser.errorf("expected an operator after %s", fieldToken.text)
+	}
+	op := parser.take().text
+
+	valueToken := parser.peek()
+	if valueToken.kind != queryTokenWord && valueToken.kind != queryTokenString {
+		return nil, parser.errorf("expected a value after %s%s", fieldToken.text, op)
+	}
+	parser.take()
+
+	isRange := op != ":" && op != "="
+	if isRange && typ == queryFieldString {
+		return nil, &QuerySyntaxError{Pos: valueToken.pos,
+			Message: fmt.Sprintf("%s can only be compared with : or =", fieldToken.text)}
+	}
+
+	value, err := parseQueryValue(fieldToken.text, typ, valueToken.text)
+	if err != nil {
+		return nil, &QuerySyntaxError{Pos: valueToken.pos, Message: err.Error()}
+	}
+
+	return &queryComparison{field: fieldToken.text, op: op, value: value}, nil
+}
+
+func parseQueryValue(field string, typ queryFieldType, s string) (interface{}, error) {
+	switch typ {
+	case queryFieldInteger:
+		if field == "severity" {
+			sev, err := parseSeverity(s)
+			if err != nil {
+				return nil, err
+			}
+			return sev.Value(), nil
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs an integer, not %q", field, s)
+		}
+		return i, nil
+
+	case queryFieldDouble:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a number, not %q", field, s)
+		}
+		return f, nil
+
+	case queryFieldDate:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs an RFC 3339 time, not %q", field, s)
+		}
+		return t.UTC().Format(time.RFC3339), nil
+	}
+
+	return s, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+func queryToJSON(assert *assert.Assertions, s string) string {
+	dsl, err := ParseQuery(s)
+	assert.NoError(err)
+	byts, err := json.Marshal(dsl)
+	assert.NoError(err)
+	return string(byts)
+}
+
+func TestParseQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	{
+		actual := queryToJSON(assert,
+			`severity<=3 AND application:pz-workflow AND message:"timeout*" AND NOT hostName:dev-*`)
+		expected := `
+		{"bool":{"must":[
+			{"range":{"severity":{"lte":3}}},
+			{"term":{"application":"pz-workflow"}},
+			{"wildcard":{"message":{"value":"timeout*"}}},
+			{"bool":{"must_not":[{"wildcard":{"hostName":{"value":"dev-*"}}}]}}
+		]}}`
+		assert.JSONEq(expected, actual)
+	}
+
+	// precedence, grouping, implicit AND, and values with colons in them
+	{
+		actual := queryToJSON(assert,
+			`(severity=error OR severity:fatal) timeStamp>=2016-07-26T01:00:00Z OR metricData.value>2.5`)
+		expected := `
+		{"bool":{"minimum_should_match":1,"should":[
+			{"bool":{"must":[
+				{"bool":{"minimum_should_match":1,"should":[
+					{"term":{"severity":3}},
+					{"term":{"severity":2}}
+				]}},
+				{"range":{"timeStamp":{"gte":"2016-07-26T01:00:00Z"}}}
+			]}},
+			{"range":{"metricData.value":{"gt":2.5}}}
+		]}}`
+		assert.JSONEq(expected, actual)
+	}
+
+	{
+		actual := queryToJSON(assert, `message:"say \"hi\""`)
+		assert.JSONEq(`{"term":{"message":"say \"hi\""}}`, actual)
+	}
+
+	errorAt := func(s string, pos int) {
+		_, err := ParseQuery(s)
+		if assert.Error(err, s) {
+			serr, ok := err.(*QuerySyntaxError)
+			if assert.True(ok, s) {
+				assert.Equal(pos, serr.Pos, s)
+			}
+		}
+	}
+	errorAt(``, 1)
+	errorAt(`colour:red`, 1)
+	errorAt(`severity<=3 AND`, 16)
+	errorAt(`hostName<h`, 10)
+	errorAt(`sourceData.line:ten`, 17)
+	errorAt(`(severity:3`, 12)
+	errorAt(`severity:3)`, 11)
+	errorAt(`message:"open`, 9)
+	errorAt(`application pz-workflow`, 13)
+}
+
+func TestQueryParam(t *testing.T) {
+	assert := assert.New(t)
+
+	format := &piazza.JsonPagination{PerPage: 10, SortBy: "timeStamp", Order: piazza.SortOrderDescending}
+
+	request, err := http.NewRequest("GET", "/syslog?service=pz-workflow&q=hostName:h1", nil)
+	assert.NoError(err)
+	actual, err := createQueryDslAsString(format, newQueryParams(request))
+	assert.NoError(err)
+	assert.Contains(actual, `{"match":{"application":"pz-workflow"}},{"term":{"hostName":"h1"}}`)
+
+	params := &piazza.HttpQueryParams{}
+	params.AddString("q", "hostName:")
+	_, err = createQueryDslAsString(format, params)
+	assert.Error(err)
+	assert.Contains(err.Error(), "position 10")
+}
@@ -0,0 +1,677 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+const (
+	// the kinds of rate condition
+	RateThreshold = "threshold"
+	RateSpike     = "spike"
+	RateSilence   = "silence"
+
+	// MaxRateHistory is how far back message rates are kept, and so the
+	// most a rate condition's window and baseline may cover together.
+	MaxRateHistory = 2 * time.Hour
+
+	// DefaultRateCheckInterval is how often the rate conditions are checked.
+	DefaultRateCheckInterval = 10 * time.Second
+
+	// rateLeasePeriod is how long an instance, once it has the lease,
+	// raises the rate events for all of them.
+	rateLeasePeriod = time.Minute
+
+	// MaxRateSeries is how many kinds of message, by tenant, application
+	// and severity, are counted apart. Past it, the messages of new
+	// applications are counted under rateOtherApplication.
+	MaxRateSeries = 1000
+
+	// rates are counted in buckets this long
+	rateBucket  = 10 * time.Second
+	rateBuckets = int(MaxRateHistory / rateBucket)
+
+	// how many kinds of message have their last-seen time kept, for
+	// silence rules, after their counts have run out
+	maxRateLastSeen = 10 * MaxRateSeries
+
+	rateOtherApplication = "(other)"
+
+	// how much of the recent past each sync counts again, for the messages
+	// written since the last
+	rateResync = time.Minute
+)
+
+// rateAggregateInterval is rateBucket, for reading the counts from the index.
+var rateAggregateInterval = &aggregateInterval{name: "10s", fixed: rateBucket}
+
+// RateCondition makes an alert rule about the rate of messages, from the
+// applications and of the severities it names, rather than about each
+// message. It trips when, over the last Window,
+//   - threshold: there are more than Above messages
+//   - spike: there are more than Factor times as many as the average over
+//     the Baseline before the window, and at least Above
+//
+// or when, for silence, there have been none for SilentFor.
+type RateCondition struct {
+	Type string `json:"type"` // RateThreshold, RateSpike or RateSilence
+
+	// which messages count: applications, with * and ? wildcards, all if
+	// empty; and the least severe severity, as for GET /syslog
+	Application string `json:"application,omitempty"`
+	MaxSeverity string `json:"maxSeverity,omitempty"`
+
+	Window    string  `json:"window,omitempty"` // such as "1m"
+	Above     int     `json:"above,omitempty"`
+	Factor    float64 `json:"factor,omitempty"`
+	Baseline  string  `json:"baseline,omitempty"` // such as "1h"
+	SilentFor string  `json:"silentFor,omitempty"`
+}
+
+// RateTrip says why a rate condition tripped.
+type RateTrip struct {
+	Reason string  `json:"reason"`
+	Count  int     `json:"count"` // messages in the window, or none for silence
+	Limit  float64 `json:"limit"` // what they were more than
+}
+
+// rateMatcher is a RateCondition, checked and parsed.
+type rateMatcher struct {
+	cond        RateCondition
+	maxSeverity pzsyslog.Severity
+	window      time.Duration
+	baseline    time.Duration
+	silentFor   time.Duration
+}
+
+func newRateMatcher(cond *RateCondition) (*rateMatcher, error) {
+	matcher := &rateMatcher{cond: *cond, maxSeverity: pzsyslog.Debug}
+
+	duration := func(name string, s string) (time.Duration, error) {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < rateBucket {
+			return 0, &alertRuleError{fmt.Sprintf("rate %s %q is not a duration of at least %s", name, s, rateBucket)}
+		}
+		return d, nil
+	}
+
+	var err error
+	if cond.MaxSeverity != "" {
+		if matcher.maxSeverity, err = parseSeverity(cond.MaxSeverity); err != nil {
+			return nil, &alertRuleError{err.Error()}
+		}
+	}
+
+	switch cond.Type {
+	case RateThreshold, RateSpike:
+		if matcher.window, err = duration("window", cond.Window); err != nil {
+			return nil, err
+		}
+		if cond.Above < 0 {
+			return nil, &alertRuleError{"rate above may not be negative"}
+		}
+		if cond.Type == RateThreshold {
+			break
+		}
+		if cond.Factor <= 1 {
+			return nil, &alertRuleError{"rate factor must be more than 1"}
+		}
+		if matcher.baseline, err = duration("baseline", cond.Baseline); err != nil {
+			return nil, err
+		}
+		if matcher.window+matcher.baseline > MaxRateHistory {
+			return nil, &alertRuleError{fmt.Sprintf("rate window and baseline may cover at most %s", MaxRateHistory)}
+		}
+	case RateSilence:
+		if matcher.silentFor, err = duration("silentFor", cond.SilentFor); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &alertRuleError{fmt.Sprintf("rate type must be %s, %s or %s", RateThreshold, RateSpike, RateSilence)}
+	}
+	if matcher.window > MaxRateHistory {
+		return nil, &alertRuleError{fmt.Sprintf("rate window may be at most %s", MaxRateHistory)}
+	}
+
+	return matcher, nil
+}
+
+// counts says whether messages of the series count towards the condition,
+// of a rule of the given tenant.
+func (matcher *rateMatcher) counts(tenant string, key rateKey) bool {
+	if !sees(tenant, key.tenant) || key.severity > matcher.maxSeverity {
+		return false
+	}
+	return matcher.cond.Application == "" || matchMemoryWildcard(matcher.cond.Application, key.application)
+}
+
+// check returns why the condition trips now, or nil if it doesn't.
+func (matcher *rateMatcher) check(rates *rateTracker, tenant string, now time.Time) *RateTrip {
+	filter := func(key rateKey) bool {
+		return matcher.counts(tenant, key)
+	}
+	what := "messages"
+	if matcher.cond.Application != "" {
+		what += " from " + matcher.cond.Application
+	}
+
+	switch matcher.cond.Type {
+	case RateThreshold:
+		count := rates.count(filter, now.Add(-matcher.window), now)
+		if count > matcher.cond.Above {
+			return &RateTrip{
+				Reason: fmt.Sprintf("%d %s in %s, more than %d", count, what, matcher.window, matcher.cond.Above),
+				Count:  count,
+				Limit:  float64(matcher.cond.Above),
+			}
+		}
+
+	case RateSpike:
+		// not until there is a whole baseline
+		if now.Sub(rates.begun()) < matcher.window+matcher.baseline {
+			return nil
+		}
+		start := now.Add(-matcher.window)
+		count := rates.count(filter, start, now)
+		base := rates.count(filter, start.Add(-matcher.baseline), start)
+		limit := matcher.cond.Factor * float64(base) * float64(matcher.window) / float64(matcher.baseline)
+		if count > 0 && float64(count) > limit && count >= matcher.cond.Above {
+			return &RateTrip{
+				Reason: fmt.Sprintf("%d %s in %s, more than %g times the %d in the %s before", count, what,
+					matcher.window, matcher.cond.Factor, base, matcher.baseline),
+				Count: count,
+				Limit: limit,
+			}
+		}
+
+	case RateSilence:
+		last := rates.seen(filter)
+		if now.Sub(last) >= matcher.silentFor {
+			return &RateTrip{Reason: fmt.Sprintf("no %s for %s", what, matcher.silentFor)}
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+type rateKey struct {
+	tenant      string
+	application string
+	severity    pzsyslog.Severity
+}
+
+// rateSeries is the counts of one kind of message, in a ring of buckets.
+type rateSeries struct {
+	counts [rateBuckets]int
+	latest int64 // the bucket of the newest count
+}
+
+func (series *rateSeries) get(bucket int64) int {
+	if bucket > series.latest || bucket <= series.latest-int64(rateBuckets) {
+		return 0
+	}
+	return series.counts[bucket%int64(rateBuckets)]
+}
+
+func (series *rateSeries) add(bucket int64, n int) {
+	if bucket <= series.latest-int64(rateBuckets) {
+		// too old to keep
+		return
+	}
+	for b := series.latest + 1; b <= bucket && b <= series.latest+int64(rateBuckets); b++ {
+		series.counts[b%int64(rateBuckets)] = 0
+	}
+	if bucket > series.latest {
+		series.latest = bucket
+	}
+	series.counts[bucket%int64(rateBuckets)] += n
+}
+
+// rateTracker keeps the counts of the messages in the index, by tenant,
+// application and severity, over the last MaxRateHistory, so that checking
+// the rate rules costs one small aggregation rather than one query per
+// rule. Messages are counted by their timeStamp: sync reads the whole
+// history the first time, and after that the last rateResync again, to
+// take in the messages written since. Since the counts come from the
+// index, every instance has the same ones.
+//
+// A series is dropped once it has counted nothing for MaxRateHistory, but
+// when its kind of message was last seen is kept apart, up to maxSeen
+// kinds, the oldest being forgotten first.
+type rateTracker struct {
+	sync.Mutex
+	start    time.Time // when the counts begin
+	synced   time.Time // zero until the whole history has been read
+	series   map[rateKey]*rateSeries
+	lastSeen map[rateKey]time.Time
+	pruned   int64 // the bucket of the last pruning
+
+	maxSeries int
+	maxSeen   int
+
+	source aggregator
+	typ    string
+	now    func() time.Time
+}
+
+func newRateTracker(source aggregator, typ string) *rateTracker {
+	return &rateTracker{
+		start:     time.Now(),
+		series:    map[rateKey]*rateSeries{},
+		lastSeen:  map[rateKey]time.Time{},
+		maxSeries: MaxRateSeries,
+		maxSeen:   maxRateLastSeen,
+		source:    source,
+		typ:       typ,
+		now:       time.Now,
+	}
+}
+
+func rateBucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(rateBucket)
+}
+
+func rateBucketStart(bucket int64) time.Time {
+	return time.Unix(0, bucket*int64(rateBucket)).UTC()
+}
+
+// sync reads the counts from the index, in place of those it has for the
+// same buckets.
+func (rt *rateTracker) sync() error {
+	now := rt.now()
+
+	rt.Lock()
+	from := rt.synced.Add(-rateResync)
+	rt.Unlock()
+	if earliest := now.Add(-MaxRateHistory); from.Before(earliest) {
+		from = earliest
+	}
+	first, last := rateBucketOf(from), rateBucketOf(now)
+
+	query := map[string]interface{}{
+		"range": map[string]interface{}{
+			"timeStamp": map[string]interface{}{
+				"gte": rateBucketStart(first).Format(time.RFC3339),
+				"lt":  rateBucketStart(last + 1).Format(time.RFC3339),
+			},
+		},
+	}
+	result, err := rt.source.Aggregate(rt.typ, query, &aggregateSpec{
+		groupBy:  []string{"tenant", "application", "severity"},
+		interval: rateAggregateInterval,
+		missing:  map[string]interface{}{"tenant": ""},
+		// the tracker keeps that many series, whatever their spread
+		termsSize: MaxRateSeries,
+	})
+	if err != nil {
+		return err
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	for _, series := range rt.series {
+		for b := first; b <= last && b <= series.latest; b++ {
+			if b <= series.latest-int64(rateBuckets) {
+				continue
+			}
+			series.counts[b%int64(rateBuckets)] = 0
+		}
+	}
+	for _, bucket := range result.Buckets {
+		if bucket.Time == nil {
+			continue
+		}
+		key := rateKey{}
+		key.tenant, _ = bucket.Key["tenant"].(string)
+		key.application, _ = bucket.Key["application"].(string)
+		severity, err := strconv.Atoi(fmt.Sprint(bucket.Key["severity"]))
+		if err != nil {
+			continue
+		}
+		key.severity = pzsyslog.Severity(severity)
+
+		// seen at the end of the bucket, or now, if it is the latest
+		b := rateBucketOf(*bucket.Time)
+		seen := rateBucketStart(b + 1)
+		if seen.After(now) {
+			seen = now
+		}
+		rt.add(key, b, seen, bucket.Count)
+	}
+	if rt.synced.IsZero() {
+		// the history counts as much as what came after startup
+		rt.start = rateBucketStart(first)
+	}
+	if now.After(rt.synced) {
+		rt.synced = now
+	}
+	return nil
+}
+
+// begun returns when the counts begin.
+func (rt *rateTracker) begun() time.Time {
+	rt.Lock()
+	defer rt.Unlock()
+	return rt.start
+}
+
+// add counts n messages of a kind into a bucket, the last of them seen at
+// the given time. It is called with the lock held.
+func (rt *rateTracker) add(key rateKey, bucket int64, seen time.Time, n int) {
+	if now := rateBucketOf(rt.now()); now > rt.pruned {
+		rt.prune(now)
+	}
+
+	series, ok := rt.series[key]
+	if !ok && len(rt.series) >= rt.maxSeries {
+		key.application = rateOtherApplication
+		series, ok = rt.series[key]
+	}
+	if !ok {
+		series = &rateSeries{latest: bucket}
+		rt.series[key] = series
+	}
+	if seen.After(rt.lastSeen[key]) {
+		rt.lastSeen[key] = seen
+	}
+	series.add(bucket, n)
+}
+
+// prune drops the series that have counted nothing over the last
+// MaxRateHistory, and the oldest last-seen times past maxSeen.
+func (rt *rateTracker) prune(bucket int64) {
+	rt.pruned = bucket
+	for key, series := range rt.series {
+		if series.latest <= bucket-int64(rateBuckets) {
+			delete(rt.series, key)
+		}
+	}
+
+	if len(rt.lastSeen) <= rt.maxSeen {
+		return
+	}
+	keys := make([]rateKey, 0, len(rt.lastSeen))
+	for key := range rt.lastSeen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rt.lastSeen[keys[i]].Before(rt.lastSeen[keys[j]])
+	})
+	for _, key := range keys[:len(keys)-rt.maxSeen] {
+		delete(rt.lastSeen, key)
+	}
+}
+
+// count returns how many of the messages that pass the filter arrived
+// after from, up to and including to, to the nearest bucket.
+func (rt *rateTracker) count(filter func(rateKey) bool, from time.Time, to time.Time) int {
+	rt.Lock()
+	defer rt.Unlock()
+
+	first, last := rateBucketOf(from)+1, rateBucketOf(to)
+	n := 0
+	for key, series := range rt.series {
+		if !filter(key) {
+			continue
+		}
+		for b := first; b <= last; b++ {
+			n += series.get(b)
+		}
+	}
+	return n
+}
+
+// seen returns when the last message that passes the filter arrived, or,
+// if there has been none that is remembered, when the tracker was made.
+func (rt *rateTracker) seen(filter func(rateKey) bool) time.Time {
+	rt.Lock()
+	defer rt.Unlock()
+
+	last := rt.start
+	for key, t := range rt.lastSeen {
+		if filter(key) && t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// MessageRate is the number of messages of one application and severity
+// over a window.
+type MessageRate struct {
+	Application string            `json:"application"`
+	Severity    pzsyslog.Severity `json:"severity"`
+	Tenant      string            `json:"tenant,omitempty"`
+	Count       int               `json:"count"`
+}
+
+// rates returns the count of each kind of message the tenant may see, in
+// the window up to now, busiest first.
+func (rt *rateTracker) rates(tenant string, window time.Duration) []MessageRate {
+	now := rt.now()
+	first, last := rateBucketOf(now.Add(-window))+1, rateBucketOf(now)
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	rates := []MessageRate{}
+	for key, series := range rt.series {
+		if !sees(tenant, key.tenant) {
+			continue
+		}
+		n := 0
+		for b := first; b <= last; b++ {
+			n += series.get(b)
+		}
+		if n > 0 {
+			rates = append(rates, MessageRate{Application: key.application, Severity: key.severity, Tenant: key.tenant, Count: n})
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		a, b := rates[i], rates[j]
+		switch {
+		case a.Count != b.Count:
+			return a.Count > b.Count
+		case a.Application != b.Application:
+			return a.Application < b.Application
+		case a.Severity != b.Severity:
+			return a.Severity < b.Severity
+		}
+		return a.Tenant < b.Tenant
+	})
+	return rates
+}
+
+//---------------------------------------------------------------------------
+
+// CheckRates brings the counts up to date and raises an event for each
+// enabled rate rule that has tripped since it was last checked. A rule that
+// stays tripped raises no more events until it has recovered. Every
+// instance checks the rules, so that they all know which have tripped, but
+// only the one holding the lease on the current minute raises the events.
+func (engine *AlertEngine) CheckRates(rates *rateTracker) ([]*AlertEvent, error) {
+	if err := rates.sync(); err != nil {
+		return nil, err
+	}
+	now := rates.now()
+	raising, err := engine.holdRateLease(now)
+	if err != nil {
+		return nil, err
+	}
+
+	// the checks can take a while, so they are run on a copy, leaving
+	// Match free to go on
+	type trip struct {
+		matcher *alertMatcher
+		rule    AlertRule
+		trip    *RateTrip
+	}
+	checks := []trip{}
+	engine.RLock()
+	for _, matcher := range engine.matchers {
+		if matcher.rate != nil && !matcher.rule.Disabled {
+			checks = append(checks, trip{matcher: matcher, rule: *matcher.rule})
+		}
+	}
+	engine.RUnlock()
+
+	for i := range checks {
+		checks[i].trip = checks[i].matcher.rate.check(rates, checks[i].rule.Tenant, now)
+	}
+
+	trips := []trip{}
+	engine.Lock()
+	for _, t := range checks {
+		if t.trip != nil && !t.matcher.tripped && raising {
+			trips = append(trips, t)
+		}
+		t.matcher.tripped = t.trip != nil
+	}
+	engine.Unlock()
+
+	events := []*AlertEvent{}
+	for _, t := range trips {
+		event := &AlertEvent{
+			ID:        piazza.NewUuid().String(),
+			RuleID:    t.rule.ID,
+			RuleName:  t.rule.Name,
+			Tenant:    t.rule.Tenant,
+			TimeStamp: piazza.TimeStamp(engine.now().UTC()),
+			Rate:      t.trip,
+		}
+		if err := engine.raise(t.rule, event); err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// rateLease is the claim of one instance to raise the rate events for a
+// while.
+type rateLease struct {
+	Holder string           `json:"holder"`
+	Start  piazza.TimeStamp `json:"start"`
+}
+
+func rateLeaseID(slot int64) string {
+	return "rates-" + strconv.FormatInt(slot, 10)
+}
+
+// holdRateLease says whether this engine raises the rate events for the
+// lease period now is in, taking the lease if no other instance has yet.
+func (engine *AlertEngine) holdRateLease(now time.Time) (bool, error) {
+	engine.leaseLock.Lock()
+	defer engine.leaseLock.Unlock()
+
+	slot := now.UnixNano() / int64(rateLeasePeriod)
+	if slot == engine.leaseSlot {
+		return engine.leaseHeld, nil
+	}
+
+	lease := &rateLease{Holder: engine.instance, Start: piazza.TimeStamp(time.Unix(0, slot*int64(rateLeasePeriod)).UTC())}
+	held, err := createDocument(engine.esi, AlertLeaseType, rateLeaseID(slot), lease)
+	if err != nil {
+		return false, err
+	}
+	engine.leaseSlot, engine.leaseHeld = slot, held
+	if held {
+		// the one before last is no use to anyone now; it may never have
+		// been made, so that failing is no matter
+		_, _ = engine.esi.DeleteByID(AlertLeaseType, rateLeaseID(slot-2))
+	}
+	return held, nil
+}
+
+// startRateChecks checks the rate rules every interval until stopRateChecks.
+func (engine *AlertEngine) startRateChecks(rates *rateTracker, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRateCheckInterval
+	}
+
+	engine.Lock()
+	defer engine.Unlock()
+	if engine.stopRates != nil {
+		return
+	}
+	stop := make(chan struct{})
+	engine.stopRates = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := engine.CheckRates(rates); err != nil {
+					log.Printf("Unable to raise rate alerts: %s", err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (engine *AlertEngine) stopRateChecks() {
+	engine.Lock()
+	defer engine.Unlock()
+	if engine.stopRates != nil {
+		close(engine.stopRates)
+		engine.stopRates = nil
+	}
+}
+
+// GetRates returns how many messages of each application and severity the
+// tenant may see are in the index from the last window (1m by default).
+func (service *Service) GetRates(params *piazza.HttpQueryParams, tenant string) *piazza.JsonResponse {
+	s, err := params.GetAsString("window", "1m")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window < rateBucket || window > MaxRateHistory {
+		return service.newBadRequestResponse(
+			fmt.Errorf("window %q is not a duration from %s to %s", s, rateBucket, MaxRateHistory))
+	}
+
+	if err = service.rates.sync(); err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       service.rates.rates(tenant, window),
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
@@ -0,0 +1,327 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// newRateTrackerForTest returns a tracker, and a clock to move it along.
+func newRateTrackerForTest() (*rateTracker, *time.Time) {
+	now := time.Date(2016, time.July, 26, 1, 0, 0, 0, time.UTC)
+	rt := newRateTracker(nil, pzsyslog.LoggerType)
+	rt.start = now
+	rt.now = func() time.Time { return now }
+	return rt, &now
+}
+
+// addRatesForTest counts messages as if sync had found them in the index.
+func addRatesForTest(rt *rateTracker, n int, application string, severity pzsyslog.Severity, tenant string) {
+	rt.Lock()
+	defer rt.Unlock()
+	now := rt.now()
+	rt.add(rateKey{tenant: tenant, application: application, severity: severity}, rateBucketOf(now), now, n)
+}
+
+// postRatesForTest stores messages in the index, stamped with the time.
+func postRatesForTest(assert *assert.Assertions, esi *MemoryIndex, n int, application string,
+	severity pzsyslog.Severity, tenant string, at time.Time) {
+
+	for i := 0; i < n; i++ {
+		mssg := newAlertMessageForTest(application, severity)
+		mssg.TimeStamp = piazza.TimeStamp(at)
+		_, err := esi.PostData(pzsyslog.LoggerType, "", &storedMessage{Message: mssg, Tenant: tenant})
+		assert.NoError(err)
+	}
+}
+
+func TestRateTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	rt, now := newRateTrackerForTest()
+	all := func(rateKey) bool { return true }
+
+	addRatesForTest(rt, 3, "pz-gateway", pzsyslog.Error, "")
+	*now = now.Add(time.Minute)
+	addRatesForTest(rt, 2, "pz-gateway", pzsyslog.Error, "")
+	addRatesForTest(rt, 1, "pz-gateway", pzsyslog.Informational, "acme")
+
+	assert.Equal(6, rt.count(all, now.Add(-time.Hour), *now))
+	assert.Equal(3, rt.count(all, now.Add(-time.Minute), *now))
+	assert.Equal(1, rt.count(func(key rateKey) bool { return key.tenant == "acme" }, now.Add(-time.Hour), *now))
+	assert.Equal(*now, rt.seen(all))
+	assert.Equal(rt.start, rt.seen(func(rateKey) bool { return false }))
+
+	assert.Equal([]MessageRate{
+		{Application: "pz-gateway", Severity: pzsyslog.Error, Count: 2},
+		{Application: "pz-gateway", Severity: pzsyslog.Informational, Tenant: "acme", Count: 1},
+	}, rt.rates("", time.Minute))
+	assert.Equal([]MessageRate{
+		{Application: "pz-gateway", Severity: pzsyslog.Informational, Tenant: "acme", Count: 1},
+	}, rt.rates("acme", time.Minute))
+
+	// old counts fall off the end
+	*now = now.Add(MaxRateHistory - time.Minute/2)
+	assert.Equal(3, rt.count(all, now.Add(-MaxRateHistory), *now))
+	addRatesForTest(rt, 1, "pz-gateway", pzsyslog.Error, "")
+	assert.Equal(4, rt.count(all, now.Add(-MaxRateHistory), *now))
+	*now = now.Add(10 * MaxRateHistory)
+	addRatesForTest(rt, 1, "pz-gateway", pzsyslog.Error, "")
+	assert.Equal(1, rt.count(all, now.Add(-MaxRateHistory), *now))
+}
+
+func TestRateTrackerLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	rt, now := newRateTrackerForTest()
+	rt.maxSeries, rt.maxSeen = 2, 3
+	all := func(rateKey) bool { return true }
+	from := func(application string) func(rateKey) bool {
+		return func(key rateKey) bool { return key.application == application }
+	}
+
+	// past the cap, new applications are counted together
+	start := *now
+	for _, application := range []string{"a", "b", "c", "d"} {
+		addRatesForTest(rt, 1, application, pzsyslog.Error, "")
+		*now = now.Add(time.Second)
+	}
+	assert.Len(rt.series, 3)
+	assert.Equal(4, rt.count(all, now.Add(-time.Hour), *now))
+	assert.Equal(2, rt.count(from(rateOtherApplication), now.Add(-time.Hour), *now))
+	assert.Equal(rt.start, rt.seen(from("c")))
+
+	// idle series are dropped, but not when they were last seen
+	*now = now.Add(MaxRateHistory)
+	addRatesForTest(rt, 1, "e", pzsyslog.Error, "")
+	assert.Len(rt.series, 1)
+	assert.Equal(1, rt.count(all, now.Add(-MaxRateHistory), *now))
+	assert.Equal(start, rt.seen(from("a")))
+	assert.Equal(*now, rt.seen(from("e")))
+
+	// the oldest last-seen times go first
+	*now = now.Add(time.Minute)
+	addRatesForTest(rt, 1, "f", pzsyslog.Error, "")
+	assert.Len(rt.lastSeen, 4)
+	assert.Equal(rt.start, rt.seen(from("a")))
+	assert.Equal(start.Add(time.Second), rt.seen(from("b")))
+	*now = now.Add(time.Minute)
+	addRatesForTest(rt, 1, "f", pzsyslog.Error, "")
+	assert.Len(rt.lastSeen, 3)
+	assert.Equal(rt.start, rt.seen(from("b")))
+	assert.Equal(*now, rt.seen(from("f")))
+}
+
+func TestRateConditions(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, bad := range []RateCondition{
+		{Type: "sometimes"},
+		{Type: RateThreshold},
+		{Type: RateThreshold, Window: "1s"},
+		{Type: RateThreshold, Window: "1m", MaxSeverity: "dire"},
+		{Type: RateSpike, Window: "1m", Factor: 5},
+		{Type: RateSpike, Window: "1m", Baseline: "1h"},
+		{Type: RateSpike, Window: "1h", Baseline: "2h", Factor: 5},
+		{Type: RateSilence},
+	} {
+		_, err := newRateMatcher(&bad)
+		assert.IsType(&alertRuleError{}, err, bad)
+	}
+
+	check := func(cond RateCondition, rt *rateTracker, tenant string) *RateTrip {
+		matcher, err := newRateMatcher(&cond)
+		if !assert.NoError(err) {
+			return nil
+		}
+		return matcher.check(rt, tenant, rt.now())
+	}
+
+	rt, now := newRateTrackerForTest()
+	*now = now.Add(2 * time.Hour)
+
+	// more than 100 errors a minute from pz-gateway
+	errors := RateCondition{Type: RateThreshold, Application: "pz-gateway", MaxSeverity: "error", Window: "1m", Above: 100}
+	addRatesForTest(rt, 100, "pz-gateway", pzsyslog.Error, "")
+	addRatesForTest(rt, 50, "pz-gateway", pzsyslog.Warning, "")
+	addRatesForTest(rt, 50, "pz-workflow", pzsyslog.Error, "")
+	assert.Nil(check(errors, rt, ""))
+	addRatesForTest(rt, 1, "pz-gateway", pzsyslog.Fatal, "acme")
+	trip := check(errors, rt, "")
+	if assert.NotNil(trip) {
+		assert.Equal(101, trip.Count)
+		assert.EqualValues(100, trip.Limit)
+		assert.Equal("101 messages from pz-gateway in 1m0s, more than 100", trip.Reason)
+	}
+	// a tenant's rule sees only its own
+	assert.Nil(check(errors, rt, "acme"))
+
+	// the window moves on
+	*now = now.Add(time.Minute)
+	assert.Nil(check(errors, rt, ""))
+
+	// 5x the trailing hour's baseline: 60 an hour is 1 a minute
+	rt, now = newRateTrackerForTest()
+	spike := RateCondition{Type: RateSpike, Application: "pz-*", Window: "1m", Factor: 5, Baseline: "1h"}
+	addRatesForTest(rt, 10, "pz-jobmanager", pzsyslog.Informational, "")
+	assert.Nil(check(spike, rt, ""), "not until there is a whole baseline")
+
+	rt, now = newRateTrackerForTest()
+	for i := 0; i <= 60; i++ {
+		addRatesForTest(rt, 1, "pz-jobmanager", pzsyslog.Informational, "")
+		*now = now.Add(time.Minute)
+	}
+	addRatesForTest(rt, 5, "pz-jobmanager", pzsyslog.Informational, "")
+	assert.Nil(check(spike, rt, ""))
+	addRatesForTest(rt, 1, "pz-jobmanager", pzsyslog.Informational, "")
+	trip = check(spike, rt, "")
+	if assert.NotNil(trip) {
+		assert.Equal(6, trip.Count)
+		assert.InDelta(5, trip.Limit, 0.01)
+	}
+	spike.Above = 10
+	assert.Nil(check(spike, rt, ""))
+
+	// silent for 15 minutes, counting from startup
+	rt, now = newRateTrackerForTest()
+	silence := RateCondition{Type: RateSilence, Application: "pz-gateway", SilentFor: "15m"}
+	*now = now.Add(10 * time.Minute)
+	assert.Nil(check(silence, rt, ""))
+	addRatesForTest(rt, 1, "pz-gateway", pzsyslog.Debug, "")
+	*now = now.Add(10 * time.Minute)
+	addRatesForTest(rt, 1, "pz-workflow", pzsyslog.Debug, "")
+	assert.Nil(check(silence, rt, ""))
+	*now = now.Add(5 * time.Minute)
+	trip = check(silence, rt, "")
+	if assert.NotNil(trip) {
+		assert.Equal("no messages from pz-gateway for 15m0s", trip.Reason)
+	}
+}
+
+func TestRateTrackerSync(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("ratetest")
+	assert.NoError(esi.Create(""))
+	rt, now := newRateTrackerForTest()
+	rt.source = &searchAggregator{esi: esi}
+	all := func(rateKey) bool { return true }
+
+	// the first sync reads the whole history
+	postRatesForTest(assert, esi, 2, "pz-gateway", pzsyslog.Error, "acme", now.Add(-90*time.Minute))
+	postRatesForTest(assert, esi, 1, "pz-gateway", pzsyslog.Error, "", now.Add(-30*time.Second))
+	postRatesForTest(assert, esi, 1, "pz-gateway", pzsyslog.Error, "", now.Add(-3*time.Hour))
+	postRatesForTest(assert, esi, 1, "pz-gateway", pzsyslog.Error, "", now.Add(time.Hour))
+	assert.NoError(rt.sync())
+	assert.Equal(3, rt.count(all, now.Add(-MaxRateHistory), *now))
+	assert.Equal(2, rt.count(func(key rateKey) bool { return key.tenant == "acme" }, now.Add(-MaxRateHistory), *now))
+	assert.Equal(now.Add(-30*time.Second).Truncate(rateBucket).Add(rateBucket), rt.seen(all))
+
+	// after that, the last rateResync, in place of what was counted
+	*now = now.Add(rateBucket)
+	postRatesForTest(assert, esi, 2, "pz-gateway", pzsyslog.Error, "", now.Add(-30*time.Second))
+	postRatesForTest(assert, esi, 1, "pz-gateway", pzsyslog.Error, "", now.Add(-10*time.Minute))
+	assert.NoError(rt.sync())
+	assert.Equal(5, rt.count(all, now.Add(-MaxRateHistory), *now))
+	assert.Equal(3, rt.count(all, now.Add(-time.Minute), *now))
+}
+
+func TestCheckRates(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := NewMemoryIndex("ratetest")
+	assert.NoError(esi.Create(""))
+
+	// two instances, with the same index and the same clock
+	type instance struct {
+		engine *AlertEngine
+		rates  *rateTracker
+		raised []*AlertEvent
+	}
+	rt, now := newRateTrackerForTest()
+	instances := []*instance{}
+	for i := 0; i < 2; i++ {
+		engine, err := NewAlertEngine(esi, nil)
+		assert.NoError(err)
+		in := &instance{engine: engine, rates: newRateTracker(&searchAggregator{esi: esi}, pzsyslog.LoggerType)}
+		in.rates.start, in.rates.now = rt.start, rt.now
+		engine.now = rt.now
+		engine.onEvent = func(rule AlertRule, event *AlertEvent) {
+			in.raised = append(in.raised, event)
+		}
+		instances = append(instances, in)
+	}
+	one, two := instances[0], instances[1]
+
+	rule := &AlertRule{Name: "busy", Rate: &RateCondition{Type: RateThreshold, Window: "1m", Above: 2}}
+	assert.NoError(one.engine.Put(rule))
+	assert.IsType(&alertRuleError{}, one.engine.Put(&AlertRule{Name: "both", Query: "severity<=3", Rate: rule.Rate}))
+	assert.NoError(two.engine.ReloadRules())
+
+	// rate rules don't match messages
+	events, err := one.engine.Match(newAlertMessageForTest("pz-gateway", pzsyslog.Error), "")
+	assert.NoError(err)
+	assert.Empty(events)
+
+	check := func(in *instance) []*AlertEvent {
+		events, err := in.engine.CheckRates(in.rates)
+		assert.NoError(err)
+		in.engine.flushEvents()
+		return events
+	}
+
+	// the first to check this minute raises the events
+	assert.Empty(check(one))
+	assert.Empty(check(two))
+	postRatesForTest(assert, esi, 3, "pz-gateway", pzsyslog.Error, "", *now)
+	events = check(one)
+	if assert.Len(events, 1) {
+		assert.Equal(rule.ID, events[0].RuleID)
+		assert.Nil(events[0].Message)
+		assert.Equal(3, events[0].Rate.Count)
+	}
+	assert.Equal(events, one.raised)
+	assert.Empty(check(two))
+
+	// once until it recovers, whichever instance raises it next
+	postRatesForTest(assert, esi, 3, "pz-gateway", pzsyslog.Error, "", *now)
+	assert.Empty(check(one))
+	*now = now.Add(2 * time.Minute)
+	assert.Empty(check(two))
+	assert.Empty(check(one))
+	postRatesForTest(assert, esi, 3, "pz-gateway", pzsyslog.Error, "", *now)
+	assert.Empty(check(one))
+	assert.Len(check(two), 1)
+	assert.Len(one.raised, 1)
+	assert.Len(two.raised, 1)
+
+	// the events are stored with the rest
+	service := &Service{esIndex: esi, alerts: one.engine}
+	request, err := http.NewRequest("GET", "/alerts/events?rule="+rule.ID, nil)
+	assert.NoError(err)
+	resp := service.GetAlertEvents(newQueryParams(request), "")
+	if assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+		stored := resp.Data.([]AlertEvent)
+		if assert.Len(stored, 2) {
+			assert.NotNil(stored[0].Rate)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"github.com/venicegeo/pz-logger/schema"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// DefaultRetentionClass is the class of the messages that no retention
+// rule matches.
+const DefaultRetentionClass = "default"
+
+// DefaultRetentionCheckInterval is how often the indices are rolled and
+// the retention rules applied, unless RollingConfig says otherwise.
+const DefaultRetentionCheckInterval = time.Hour
+
+// RetentionAction is what happens to an index once it is too old.
+type RetentionAction string
+
+const (
+	RetentionDelete RetentionAction = "delete"
+
+	// RetentionClose keeps the data on disk but takes the index out of the
+	// read alias, so it is no longer searched.
+	RetentionClose RetentionAction = "close"
+)
+
+// RetentionRule picks out a class of messages, which get their own
+// indices, and says how long those are kept. A message belongs to the
+// first rule it matches. Every condition given must hold: Severity is a
+// list of names or numbers, Application may have * and ? wildcards, and
+// Audit matches messages with auditData.
+//
+// MaxAge counts from the end of the index's period, and is a number
+// followed by d, w or y (365 days), or a Go duration such as 36h. Zero
+// keeps the indices forever.
+type RetentionRule struct {
+	Name        string          `json:"name"`
+	Severity    []string        `json:"severity,omitempty"`
+	Application string          `json:"application,omitempty"`
+	Audit       bool            `json:"audit,omitempty"`
+	MaxAge      string          `json:"maxAge"`
+	Action      RetentionAction `json:"action,omitempty"` // default delete
+
+	severities map[pzsyslog.Severity]bool
+	maxAge     time.Duration
+}
+
+// RollingConfig turns on rolling indices. Instead of the one index, each
+// class of message is written, through its own write alias, to an index
+// per day or week, and the logger index name becomes a read alias over
+// all of them.
+type RollingConfig struct {
+	Period        string // day, the default, or week
+	Rules         []*RetentionRule
+	DefaultMaxAge string          // for messages no rule matches
+	DefaultAction RetentionAction // default delete
+	CheckInterval time.Duration
+
+	// if set, too-old indices are only reported, never removed
+	DryRun bool
+}
+
+var retentionClassRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+var retentionAgeRegexp = regexp.MustCompile(`^([0-9]+)([dwy])$`)
+
+// parseRetentionAge reads a MaxAge; "" is zero.
+func parseRetentionAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if match := retentionAgeRegexp.FindStringSubmatch(s); match != nil {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		days := map[string]int{"d": 1, "w": 7, "y": 365}[match[2]]
+		return time.Duration(n*days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("age must be a number followed by d, w or y, or a duration, not %q", s)
+	}
+	return age, nil
+}
+
+func (rule *RetentionRule) init() error {
+	if !retentionClassRegexp.MatchString(rule.Name) {
+		return fmt.Errorf("retention rule name must be lower case letters, digits and _, not %q", rule.Name)
+	}
+
+	var err error
+	if rule.maxAge, err = parseRetentionAge(rule.MaxAge); err != nil {
+		return fmt.Errorf("retention rule %s: %s", rule.Name, err.Error())
+	}
+
+	switch rule.Action {
+	case "":
+		rule.Action = RetentionDelete
+	case RetentionDelete, RetentionClose:
+	default:
+		return fmt.Errorf("retention rule %s: action must be delete or close, not %q", rule.Name, rule.Action)
+	}
+
+	rule.severities = nil
+	if len(rule.Severity) > 0 {
+		rule.severities = map[pzsyslog.Severity]bool{}
+		for _, s := range rule.Severity {
+			sev, err := parseSeverity(s)
+			if err != nil {
+				return fmt.Errorf("retention rule %s: %s", rule.Name, err.Error())
+			}
+			rule.severities[sev] = true
+		}
+	}
+
+	return nil
+}
+
+func (rule *RetentionRule) matches(mssg *pzsyslog.Message) bool {
+	if rule.severities != nil && !rule.severities[mssg.Severity] {
+		return false
+	}
+	if rule.Application != "" && !matchMemoryWildcard(rule.Application, mssg.Application) {
+		return false
+	}
+	if rule.Audit && mssg.AuditData == nil {
+		return false
+	}
+	return true
+}
+
+//---------------------------------------------------------------------------
+
+// RetentionItem is an index that is past its age, and what is to be done
+// with it.
+type RetentionItem struct {
+	Index  string          `json:"index"`
+	Class  string          `json:"class"`
+	Ended  time.Time       `json:"ended"` // the end of the index's period
+	Action RetentionAction `json:"action"`
+}
+
+// RetentionReport is what GET /admin/retention returns: what the rules
+// would remove if they were applied at At, plus how the last run went.
+type RetentionReport struct {
+	At        time.Time       `json:"at"`
+	DryRun    bool            `json:"dryRun"`
+	Items     []RetentionItem `json:"items"`
+	LastRun   *time.Time      `json:"lastRun,omitempty"`
+	LastError string          `json:"lastError,omitempty"`
+	LastItems []RetentionItem `json:"lastItems,omitempty"` // what the last run did
+}
+
+// indexState is what indexAdmin.listIndices says about an index.
+type indexState struct {
+	Name string `json:"index"`
+	Open bool   `json:"-"`
+}
+
+// indexAdmin is the handful of index management calls the retention
+// manager needs. elasticsearch.IIndex only knows about its own index.
+type indexAdmin interface {
+	putTemplate(name string, body string) error
+	listIndices(pattern string) ([]indexState, error)
+	createIndex(name string) error
+	closeIndex(name string) error
+	deleteIndex(name string) error
+
+	// aliasIndices returns the indices an alias points to.
+	aliasIndices(alias string) ([]string, error)
+
+	// moveAlias takes the alias off the from indices and, unless it is
+	// "", puts it on the to index, all at once.
+	moveAlias(alias string, from []string, to string) error
+}
+
+// RetentionManager rolls the write aliases on to a new index as each
+// period starts, and applies the retention rules to the old indices.
+type RetentionManager struct {
+	sync.Mutex
+
+	admin     indexAdmin
+	readAlias string
+	typ       string
+	period    *aggregateInterval
+	rules     []*RetentionRule // the default rule last
+	interval  time.Duration
+	dryRun    bool
+
+	lastRun   time.Time
+	lastError string
+	lastItems []RetentionItem
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newRetentionManager(config *RollingConfig, admin indexAdmin, readAlias string, typ string) (*RetentionManager, error) {
+	rm := &RetentionManager{
+		admin:     admin,
+		readAlias: readAlias,
+		typ:       typ,
+		interval:  config.CheckInterval,
+		dryRun:    config.DryRun,
+	}
+	if rm.interval <= 0 {
+		rm.interval = DefaultRetentionCheckInterval
+	}
+
+	switch config.Period {
+	case "", "day":
+		rm.period = &aggregateInterval{name: "day", calendar: "day"}
+	case "week":
+		rm.period = &aggregateInterval{name: "week", calendar: "week"}
+	default:
+		return nil, fmt.Errorf("rolling period must be day or week, not %q", config.Period)
+	}
+
+	names := map[string]bool{}
+	for _, rule := range config.Rules {
+		r := *rule
+		if err := r.init(); err != nil {
+			return nil, err
+		}
+		if r.Name == DefaultRetentionClass || names[r.Name] {
+			return nil, fmt.Errorf("retention rule name %q is already taken", r.Name)
+		}
+		names[r.Name] = true
+		rm.rules = append(rm.rules, &r)
+	}
+
+	def := &RetentionRule{Name: DefaultRetentionClass, MaxAge: config.DefaultMaxAge, Action: config.DefaultAction}
+	if err := def.init(); err != nil {
+		return nil, err
+	}
+	rm.rules = append(rm.rules, def)
+
+	return rm, nil
+}
+
+func (rm *RetentionManager) classify(mssg *pzsyslog.Message) string {
+	for _, rule := range rm.rules {
+		if rule.matches(mssg) {
+			return rule.Name
+		}
+	}
+	return DefaultRetentionClass
+}
+
+func (rm *RetentionManager) getRule(class string) *RetentionRule {
+	for _, rule := range rm.rules {
+		if rule.Name == class {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rm *RetentionManager) indexName(class string, t time.Time) string {
+	return fmt.Sprintf("%s-%s-%s", rm.readAlias, class, rm.period.start(t).Format("2006.01.02"))
+}
+
+func (rm *RetentionManager) writeAlias(class string) string {
+	return fmt.Sprintf("%s-%s-write", rm.readAlias, class)
+}
+
+// parseIndexName is the reverse of indexName.
+func (rm *RetentionManager) parseIndexName(name string) (string, time.Time, bool) {
+	prefix := rm.readAlias + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return "", time.Time{}, false
+	}
+	rest := schema.StripVersion(name[len(prefix):])
+	i := strings.LastIndex(rest, "-")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	start, err := time.Parse("2006.01.02", rest[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return rest[:i], start, true
+}
+
+func (rm *RetentionManager) periodEnd(start time.Time) time.Time {
+	if rm.period.calendar == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// route returns the write alias for a document given to the bulk indexer,
+// which is a *pzsyslog.Message, a storedMessage or, from the spool, their
+// JSON.
+func (rm *RetentionManager) route(doc interface{}) (string, error) {
+	var mssg *pzsyslog.Message
+	switch doc := doc.(type) {
+	case *pzsyslog.Message:
+		mssg = doc
+	case *storedMessage:
+		mssg = doc.Message
+	default:
+		byts, err := json.Marshal(doc)
+		if err != nil {
+			return "", err
+		}
+		mssg = &pzsyslog.Message{}
+		if err = json.Unmarshal(byts, mssg); err != nil {
+			return "", err
+		}
+	}
+	return rm.writeAlias(rm.classify(mssg)), nil
+}
+
+// setup installs the template that gives each new index the mapping and
+// the read alias.
+func (rm *RetentionManager) setup() error {
+	mapping, err := schema.LatestMapping()
+	if err != nil {
+		return err
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"template": rm.readAlias + "-*",
+		"aliases":  map[string]interface{}{rm.readAlias: map[string]interface{}{}},
+		"mappings": map[string]interface{}{rm.typ: mapping},
+	})
+	if err != nil {
+		return err
+	}
+	return rm.admin.putTemplate(rm.readAlias, string(byts))
+}
+
+// roll makes sure each class has an index for the period now is in, and
+// that its write alias points there.
+func (rm *RetentionManager) roll(now time.Time) error {
+	indices, err := rm.admin.listIndices(rm.readAlias + "-*")
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, index := range indices {
+		exists[index.Name] = true
+	}
+
+	for _, rule := range rm.rules {
+		name := rm.indexName(rule.Name, now)
+		if !exists[name] {
+			if err = rm.admin.createIndex(name); err != nil {
+				return err
+			}
+		}
+
+		alias := rm.writeAlias(rule.Name)
+		current, err := rm.admin.aliasIndices(alias)
+		if err != nil {
+			return err
+		}
+		if len(current) == 1 && current[0] == name {
+			continue
+		}
+		from := []string{}
+		for _, index := range current {
+			if index != name {
+				from = append(from, index)
+			}
+		}
+		if err = rm.admin.moveAlias(alias, from, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// plan works out which indices are past their age at now. Indices of
+// classes that no longer have a rule are left alone.
+func (rm *RetentionManager) plan(now time.Time) ([]RetentionItem, error) {
+	indices, err := rm.admin.listIndices(rm.readAlias + "-*")
+	if err != nil {
+		return nil, err
+	}
+
+	items := []RetentionItem{}
+	for _, index := range indices {
+		class, start, ok := rm.parseIndexName(index.Name)
+		if !ok {
+			continue
+		}
+		rule := rm.getRule(class)
+		if rule == nil || rule.maxAge == 0 {
+			continue
+		}
+		end := rm.periodEnd(start)
+		if now.Sub(end) <= rule.maxAge {
+			continue
+		}
+		if rule.Action == RetentionClose && !index.Open {
+			continue
+		}
+		items = append(items, RetentionItem{Index: index.Name, Class: class, Ended: end, Action: rule.Action})
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Index < items[j].Index })
+	return items, nil
+}
+
+func (rm *RetentionManager) apply(items []RetentionItem) error {
+	for _, item := range items {
+		var err error
+		switch item.Action {
+		case RetentionDelete:
+			err = rm.admin.deleteIndex(item.Index)
+		case RetentionClose:
+			// a closed index in the alias would break every search
+			if err = rm.admin.moveAlias(rm.readAlias, []string{item.Index}, ""); err == nil {
+				err = rm.admin.closeIndex(item.Index)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", item.Action, item.Index, err.Error())
+		}
+	}
+	return nil
+}
+
+// run rolls the indices and, unless this is a dry run, removes the ones
+// that are too old.
+func (rm *RetentionManager) run(now time.Time) error {
+	err := rm.roll(now)
+
+	var items []RetentionItem
+	if err == nil {
+		items, err = rm.plan(now)
+	}
+	if err == nil && !rm.dryRun {
+		err = rm.apply(items)
+	}
+
+	rm.Lock()
+	rm.lastRun = now
+	rm.lastItems = items
+	rm.lastError = ""
+	if err != nil {
+		rm.lastError = err.Error()
+	}
+	rm.Unlock()
+
+	return err
+}
+
+// Start installs the template and rolls the indices, so that there is
+// somewhere to write to, and then goes on doing so in the background.
+func (rm *RetentionManager) Start() error {
+	if err := rm.setup(); err != nil {
+		return err
+	}
+	if err := rm.run(time.Now()); err != nil {
+		return err
+	}
+
+	rm.stop = make(chan struct{})
+	rm.done = make(chan struct{})
+	go func() {
+		defer close(rm.done)
+		ticker := time.NewTicker(rm.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rm.stop:
+				return
+			case now := <-ticker.C:
+				if err := rm.run(now); err != nil {
+					log.Printf("retention: %s", err.Error())
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (rm *RetentionManager) Stop() {
+	if rm.stop == nil {
+		return
+	}
+	close(rm.stop)
+	<-rm.done
+	rm.stop = nil
+}
+
+// Report says what the rules would remove at the given time.
+func (rm *RetentionManager) Report(at time.Time) (*RetentionReport, error) {
+	items, err := rm.plan(at)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{At: at, DryRun: rm.dryRun, Items: items}
+
+	rm.Lock()
+	if !rm.lastRun.IsZero() {
+		lastRun := rm.lastRun
+		report.LastRun = &lastRun
+		report.LastError = rm.lastError
+		report.LastItems = rm.lastItems
+	}
+	rm.Unlock()
+
+	return report, nil
+}
+
+//---------------------------------------------------------------------------
+
+// GetRetention reports what the retention rules would remove now or, with
+// ?at=, at some other time. Nothing is removed.
+func (service *Service) GetRetention(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	rm := service.getRetentionManager()
+	if rm == nil {
+		return service.newServiceUnavailableResponse(errors.New("rolling indices are not enabled"))
+	}
+
+	at, err := params.GetAsTime("at", time.Now())
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	report, err := rm.Report(at)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       report,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
+
+//---------------------------------------------------------------------------
+
+// elasticIndexAdmin is indexAdmin over the Elasticsearch index APIs.
+type elasticIndexAdmin struct {
+	client *elastic.Client
+}
+
+func (admin *elasticIndexAdmin) putTemplate(name string, body string) error {
+	_, err := admin.client.IndexPutTemplate(name).BodyString(body).Do()
+	return err
+}
+
+func (admin *elasticIndexAdmin) listIndices(pattern string) ([]indexState, error) {
+	params := url.Values{"format": {"json"}, "h": {"index,status"}}
+	resp, err := admin.client.PerformRequest("GET", "/_cat/indices/"+pattern, params, nil, http.StatusNotFound)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var rows []struct {
+		Index  string `json:"index"`
+		Status string `json:"status"`
+	}
+	if err = json.Unmarshal(resp.Body, &rows); err != nil {
+		return nil, err
+	}
+	indices := make([]indexState, len(rows))
+	for i, row := range rows {
+		indices[i] = indexState{Name: row.Index, Open: row.Status != "close"}
+	}
+	return indices, nil
+}
+
+func (admin *elasticIndexAdmin) createIndex(name string) error {
+	_, err := admin.client.CreateIndex(name).Do()
+	return err
+}
+
+func (admin *elasticIndexAdmin) closeIndex(name string) error {
+	_, err := admin.client.CloseIndex(name).Do()
+	return err
+}
+
+func (admin *elasticIndexAdmin) deleteIndex(name string) error {
+	_, err := admin.client.DeleteIndex(name).Do()
+	return err
+}
+
+func (admin *elasticIndexAdmin) aliasIndices(alias string) ([]string, error) {
+	result, err := admin.client.Aliases().Do()
+	if err != nil {
+		return nil, err
+	}
+	return result.IndicesByAlias(alias), nil
+}
+
+func (admin *elasticIndexAdmin) moveAlias(alias string, from []string, to string) error {
+	service := admin.client.Alias()
+	for _, index := range from {
+		service.Remove(index, alias)
+	}
+	if to != "" {
+		service.Add(to, alias)
+	}
+	_, err := service.Do()
+	return err
+}
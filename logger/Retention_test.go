@@ -0,0 +1,314 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// fakeIndexAdmin keeps track of indices and aliases in memory.
+type fakeIndexAdmin struct {
+	template string
+	indices  map[string]bool            // name -> open
+	aliases  map[string]map[string]bool // alias -> indices
+}
+
+func newFakeIndexAdmin() *fakeIndexAdmin {
+	return &fakeIndexAdmin{indices: map[string]bool{}, aliases: map[string]map[string]bool{}}
+}
+
+func (admin *fakeIndexAdmin) putTemplate(name string, body string) error {
+	admin.template = body
+	return nil
+}
+
+func (admin *fakeIndexAdmin) listIndices(pattern string) ([]indexState, error) {
+	list := []indexState{}
+	for name, open := range admin.indices {
+		if matchMemoryWildcard(pattern, name) {
+			list = append(list, indexState{Name: name, Open: open})
+		}
+	}
+	return list, nil
+}
+
+func (admin *fakeIndexAdmin) createIndex(name string) error {
+	admin.indices[name] = true
+	return nil
+}
+
+func (admin *fakeIndexAdmin) closeIndex(name string) error {
+	admin.indices[name] = false
+	return nil
+}
+
+func (admin *fakeIndexAdmin) deleteIndex(name string) error {
+	delete(admin.indices, name)
+	for _, indices := range admin.aliases {
+		delete(indices, name)
+	}
+	return nil
+}
+
+func (admin *fakeIndexAdmin) aliasIndices(alias string) ([]string, error) {
+	list := []string{}
+	for name := range admin.aliases[alias] {
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+func (admin *fakeIndexAdmin) moveAlias(alias string, from []string, to string) error {
+	if admin.aliases[alias] == nil {
+		admin.aliases[alias] = map[string]bool{}
+	}
+	for _, name := range from {
+		delete(admin.aliases[alias], name)
+	}
+	if to != "" {
+		admin.aliases[alias][to] = true
+	}
+	return nil
+}
+
+func (admin *fakeIndexAdmin) names() []string {
+	list := []string{}
+	for name := range admin.indices {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+//---------------------------------------------------------------------------
+
+func newRetentionManagerForTest(assert *assert.Assertions, dryRun bool) (*RetentionManager, *fakeIndexAdmin) {
+	admin := newFakeIndexAdmin()
+	rm, err := newRetentionManager(&RollingConfig{
+		Rules: []*RetentionRule{
+			{Name: "audit", Audit: true, MaxAge: "7y"},
+			{Name: "debug", Severity: []string{"debug"}, MaxAge: "3d"},
+			{Name: "error", Severity: []string{"error", "critical", "alert", "emergency"}, MaxAge: "90d", Action: RetentionClose},
+		},
+		DefaultMaxAge: "30d",
+		DryRun:        dryRun,
+	}, admin, "pzlogger", pzsyslog.LoggerType)
+	assert.NoError(err)
+	return rm, admin
+}
+
+func TestParseRetentionAge(t *testing.T) {
+	assert := assert.New(t)
+
+	day := 24 * time.Hour
+	for s, expected := range map[string]time.Duration{
+		"":    0,
+		"3d":  3 * day,
+		"2w":  14 * day,
+		"7y":  7 * 365 * day,
+		"36h": 36 * time.Hour,
+	} {
+		age, err := parseRetentionAge(s)
+		if assert.NoError(err, s) {
+			assert.Equal(expected, age, s)
+		}
+	}
+
+	for _, s := range []string{"d", "3x", "-1h", "forever"} {
+		_, err := parseRetentionAge(s)
+		assert.Error(err, s)
+	}
+
+	for _, rule := range []*RetentionRule{
+		{Name: "Debug"},
+		{Name: "debug", Severity: []string{"chatty"}},
+		{Name: "debug", Action: "archive"},
+		{Name: "default"},
+	} {
+		_, err := newRetentionManager(&RollingConfig{Rules: []*RetentionRule{rule}}, newFakeIndexAdmin(), "pzlogger", "LogData")
+		assert.Error(err, rule.Name)
+	}
+}
+
+func TestRetentionClassify(t *testing.T) {
+	assert := assert.New(t)
+
+	rm, _ := newRetentionManagerForTest(assert, false)
+
+	mssg := func(sev pzsyslog.Severity, audit bool) *pzsyslog.Message {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = sev
+		if audit {
+			m.AuditData = &pzsyslog.AuditElement{Actor: "me", Action: "read", Actee: "it"}
+		}
+		return m
+	}
+
+	assert.Equal("debug", rm.classify(mssg(pzsyslog.Debug, false)))
+	assert.Equal("error", rm.classify(mssg(pzsyslog.Fatal, false)))
+	assert.Equal("default", rm.classify(mssg(pzsyslog.Informational, false)))
+
+	// the first rule wins
+	assert.Equal("audit", rm.classify(mssg(pzsyslog.Debug, true)))
+
+	// from the spool
+	byts, err := json.Marshal(mssg(pzsyslog.Debug, false))
+	assert.NoError(err)
+	alias, err := rm.route(json.RawMessage(byts))
+	assert.NoError(err)
+	assert.Equal("pzlogger-debug-write", alias)
+}
+
+func TestRetentionManager(t *testing.T) {
+	assert := assert.New(t)
+
+	rm, admin := newRetentionManagerForTest(assert, false)
+
+	assert.NoError(rm.setup())
+	assert.Contains(admin.template, `"template":"pzlogger-*"`)
+	assert.Contains(admin.template, `"LogData":{`)
+
+	day1 := time.Date(2016, time.July, 26, 12, 0, 0, 0, time.UTC)
+	assert.NoError(rm.run(day1))
+	assert.Equal([]string{
+		"pzlogger-audit-2016.07.26",
+		"pzlogger-debug-2016.07.26",
+		"pzlogger-default-2016.07.26",
+		"pzlogger-error-2016.07.26",
+	}, admin.names())
+	alias, _ := admin.aliasIndices("pzlogger-debug-write")
+	assert.Equal([]string{"pzlogger-debug-2016.07.26"}, alias)
+
+	// the next day, the aliases move on
+	assert.NoError(rm.run(day1.AddDate(0, 0, 1)))
+	alias, _ = admin.aliasIndices("pzlogger-debug-write")
+	assert.Equal([]string{"pzlogger-debug-2016.07.27"}, alias)
+	assert.Len(admin.names(), 8)
+
+	// an index the schema has been migrated in is still that period's
+	class, start, ok := rm.parseIndexName("pzlogger-debug-2016.07.26_v2")
+	assert.True(ok)
+	assert.Equal("debug", class)
+	assert.Equal(time.Date(2016, time.July, 26, 0, 0, 0, 0, time.UTC), start)
+
+	// nothing is old enough yet; the 26th's debug index ends on the 27th,
+	// and is kept for 3 days after that
+	report, err := rm.Report(day1.AddDate(0, 0, 3))
+	assert.NoError(err)
+	assert.Empty(report.Items)
+	assert.NotNil(report.LastRun)
+
+	report, err = rm.Report(day1.AddDate(0, 0, 4))
+	assert.NoError(err)
+	assert.Equal([]RetentionItem{{
+		Index:  "pzlogger-debug-2016.07.26",
+		Class:  "debug",
+		Ended:  time.Date(2016, time.July, 27, 0, 0, 0, 0, time.UTC),
+		Action: RetentionDelete,
+	}}, report.Items)
+	assert.Len(admin.names(), 8) // a report removes nothing
+
+	// error indices are closed, and taken out of the read alias
+	admin.aliases["pzlogger"] = map[string]bool{"pzlogger-error-2016.07.26": true}
+	assert.NoError(rm.run(day1.AddDate(0, 0, 92)))
+	assert.False(admin.indices["pzlogger-error-2016.07.26"])
+	assert.Empty(admin.aliases["pzlogger"])
+	_, ok = admin.indices["pzlogger-debug-2016.07.26"]
+	assert.False(ok)
+	_, ok = admin.indices["pzlogger-default-2016.07.27"]
+	assert.False(ok)
+	assert.True(admin.indices["pzlogger-audit-2016.07.26"])
+
+	// closed indices stay closed
+	report, err = rm.Report(day1.AddDate(0, 0, 92))
+	assert.NoError(err)
+	for _, item := range report.Items {
+		assert.NotEqual("pzlogger-error-2016.07.26", item.Index)
+	}
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	rm, admin := newRetentionManagerForTest(assert, true)
+
+	day1 := time.Date(2016, time.July, 26, 12, 0, 0, 0, time.UTC)
+	assert.NoError(rm.run(day1))
+	assert.NoError(rm.run(day1.AddDate(0, 0, 10)))
+	assert.Len(admin.names(), 8)
+
+	report, err := rm.Report(day1.AddDate(0, 0, 10))
+	assert.NoError(err)
+	assert.True(report.DryRun)
+	if assert.Len(report.LastItems, 1) {
+		assert.Equal("pzlogger-debug-2016.07.26", report.LastItems[0].Index)
+	}
+}
+
+func TestRoutedBulkIndexer(t *testing.T) {
+	assert := assert.New(t)
+
+	indices := []string{}
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			_, err := w.Write([]byte(`{}`))
+			assert.NoError(err)
+			return
+		}
+		items := []string{}
+		scanner := bufio.NewScanner(r.Body)
+		for i := 0; scanner.Scan(); i++ {
+			if i%2 == 1 {
+				continue
+			}
+			var action map[string]map[string]interface{}
+			assert.NoError(json.Unmarshal(scanner.Bytes(), &action))
+			indices = append(indices, action["index"]["_index"].(string))
+			items = append(items, `{"index": {"status": 201}}`)
+		}
+		_, err := w.Write([]byte(`{"items": [` + strings.Join(items, ",") + `]}`))
+		assert.NoError(err)
+	}))
+	defer es.Close()
+
+	client, err := elastic.NewClient(elastic.SetURL(es.URL), elastic.SetSniff(false))
+	if !assert.NoError(err) {
+		return
+	}
+
+	rm, _ := newRetentionManagerForTest(assert, false)
+	bi := &elasticBulkIndexer{client: client, index: "pzlogger", route: rm.route}
+
+	debug := pzsyslog.NewMessage("123456")
+	debug.Severity = pzsyslog.Debug
+	info := pzsyslog.NewMessage("123456")
+	info.Severity = pzsyslog.Informational
+
+	errs, err := bi.Bulk(pzsyslog.LoggerType, []interface{}{debug, info})
+	assert.NoError(err)
+	assert.Equal([]error{nil, nil}, errs)
+	assert.Equal([]string{"pzlogger-debug-write", "pzlogger-default-write"}, indices)
+}
@@ -0,0 +1,190 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// RFC3164MessageID is put in the MessageID of every Message converted from
+// an RFC 3164 line, so that converted messages can be told apart from
+// native ones. (BSD syslog has no MSGID of its own.)
+const RFC3164MessageID = "rfc3164"
+
+// rfc3164DefaultPri is what RFC 3164 section 4.3.3 says to assume if a
+// message has no PRI: facility 1 (user), severity 5 (notice).
+const rfc3164DefaultPri = 13
+
+// RFC3164Options controls the parts of an RFC 3164 conversion that can't
+// be read from the message itself.
+type RFC3164Options struct {
+	// Location is the time zone the senders' clocks are in. BSD
+	// timestamps carry no zone. Defaults to UTC.
+	Location *time.Location
+
+	// HostName is used when a message has no HOSTNAME field, e.g. the
+	// address of the sender.
+	HostName string
+}
+
+// ParseRFC3164String converts a BSD syslog line of the form
+// "<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG" into a Message, following
+// the heuristics of RFC 3164 section 4.3 where parts are missing:
+//
+//   - no PRI means user.notice
+//   - an unreadable TIMESTAMP means the receive time, with the rest of
+//     the line treated as content
+//   - the year is taken from receiveTime, unless that would put the
+//     message more than a day in the future, in which case it was sent
+//     last year (e.g. sent Dec 31, received Jan 1)
+//   - the TAG becomes the Application, and the PID the Process; since
+//     Message.Validate requires both, a line with no TAG gets the HOSTNAME
+//     (or "-", if there is none) as its Application, and "-" is used when
+//     there is no PID
+//   - only the severity is kept from the PRI: Message.Validate accepts
+//     nothing but DefaultFacility, so every message is given that
+//
+// The result always has MessageID set to RFC3164MessageID.
+func ParseRFC3164String(s string, receiveTime time.Time, opts *RFC3164Options) (*pzsyslog.Message, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errors.New("rfc3164: empty message")
+	}
+	if opts == nil {
+		opts = &RFC3164Options{}
+	}
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	rest := s
+	pri := rfc3164DefaultPri
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end > 1 && end <= 4 {
+			if n, err := strconv.Atoi(rest[1:end]); err == nil && n >= 0 && n <= 191 {
+				pri = n
+				rest = rest[end+1:]
+			}
+		}
+	}
+
+	timeStamp, rest, ok := parseRFC3164TimeStamp(rest, receiveTime, loc)
+	hostName := opts.HostName
+	if ok {
+		// HOSTNAME may be missing; if the next word looks like a TAG
+		// instead, leave it alone
+		word := rest
+		if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+			word = rest[:sp]
+		}
+		if word != "" && !strings.ContainsAny(word, "[:") {
+			hostName = word
+			rest = strings.TrimPrefix(rest[len(word):], " ")
+		}
+	} else {
+		timeStamp = piazza.TimeStamp(receiveTime.Round(time.Millisecond).UTC())
+	}
+
+	tag, pid, content := splitRFC3164Tag(rest)
+	if tag == "" {
+		tag = hostName
+	}
+	if tag == "" {
+		tag = "-"
+	}
+	if pid == "" {
+		pid = "-"
+	}
+
+	mssg := pzsyslog.NewMessage("")
+	mssg.Facility = pzsyslog.DefaultFacility
+	mssg.Severity = pzsyslog.Severity(pri % 8)
+	mssg.Version = pzsyslog.DefaultVersion
+	mssg.TimeStamp = timeStamp
+	mssg.HostName = hostName
+	mssg.Application = tag
+	mssg.Process = pid
+	mssg.MessageID = RFC3164MessageID
+	mssg.Message = content
+
+	return mssg, nil
+}
+
+// parseRFC3164TimeStamp reads "Mmm dd hh:mm:ss" (dd is space-padded) from
+// the front of s, returning the time and what follows it.
+func parseRFC3164TimeStamp(s string, receiveTime time.Time, loc *time.Location) (piazza.TimeStamp, string, bool) {
+	const layout = "Jan _2 15:04:05"
+	if len(s) < len(layout) {
+		return piazza.TimeStamp{}, s, false
+	}
+
+	received := receiveTime.In(loc)
+	t, err := time.ParseInLocation("2006 "+layout, strconv.Itoa(received.Year())+" "+s[:len(layout)], loc)
+	if err != nil {
+		return piazza.TimeStamp{}, s, false
+	}
+	if t.After(received.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	rest := strings.TrimPrefix(s[len(layout):], " ")
+	return piazza.TimeStamp(t.Round(time.Millisecond).UTC()), rest, true
+}
+
+// splitRFC3164Tag breaks "TAG[PID]: MSG" into its parts. The TAG is at most
+// 32 alphanumeric characters, but in practice senders also use '-', '_',
+// '.' and '/', so we allow anything up to '[', ':' or a space. If there is
+// no ':' where we expect one, there is no TAG and the whole line is MSG.
+func splitRFC3164Tag(s string) (string, string, string) {
+	end := strings.IndexAny(s, "[: ")
+	if end <= 0 || end > 32 {
+		return "", "", s
+	}
+	tag := s[:end]
+	rest := s[end:]
+
+	pid := ""
+	if strings.HasPrefix(rest, "[") {
+		last := strings.IndexByte(rest, ']')
+		if last < 0 {
+			return "", "", s
+		}
+		pid = rest[1:last]
+		rest = rest[last+1:]
+	}
+
+	if !strings.HasPrefix(rest, ":") {
+		return "", "", s
+	}
+	return tag, pid, strings.TrimPrefix(rest[1:], " ")
+}
+
+// ParseSyslogString accepts a message in either RFC 5424 or RFC 3164 form.
+// An RFC 5424 message has a VERSION digit right after the PRI; anything
+// else is assumed to be RFC 3164.
+func ParseSyslogString(s string, receiveTime time.Time, opts *RFC3164Options) (*pzsyslog.Message, error) {
+	if end := strings.IndexByte(s, '>'); strings.HasPrefix(s, "<") && end > 0 && end <= 4 &&
+		end+2 < len(s) && isDigit(s[end+1]) && (s[end+2] == ' ' || isDigit(s[end+2])) {
+		return ParseMessageString(s)
+	}
+	return ParseRFC3164String(s, receiveTime, opts)
+}
@@ -0,0 +1,136 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestParseRFC3164String(t *testing.T) {
+	assert := assert.New(t)
+
+	received := time.Date(2016, time.October, 12, 1, 0, 0, 0, time.UTC)
+
+	// the example from RFC 3164 section 5.4
+	{
+		m, err := ParseRFC3164String("<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8", received, nil)
+		assert.NoError(err)
+		assert.Equal(pzsyslog.DefaultFacility, m.Facility)
+		assert.Equal(pzsyslog.Fatal, m.Severity)
+		assert.Equal(pzsyslog.DefaultVersion, m.Version)
+		assert.Equal("2016-10-11T22:14:15Z", m.TimeStamp.String())
+		assert.Equal("mymachine", m.HostName)
+		assert.Equal("su", m.Application)
+		assert.Equal("-", m.Process)
+		assert.Equal(RFC3164MessageID, m.MessageID)
+		assert.Equal("'su root' failed for lonvick on /dev/pts/8", m.Message)
+		assert.NoError(m.Validate())
+	}
+
+	// local0, which Message.Validate would refuse
+	{
+		m, err := ParseRFC3164String("<134>Oct 11 22:14:15 mymachine pz-gateway[7]: up", received, nil)
+		assert.NoError(err)
+		assert.Equal(pzsyslog.DefaultFacility, m.Facility)
+		assert.Equal(pzsyslog.Informational, m.Severity)
+		assert.NoError(m.Validate())
+	}
+
+	// pid, padded day, and a time zone
+	{
+		loc, err := time.LoadLocation("America/New_York")
+		assert.NoError(err)
+		opts := &RFC3164Options{Location: loc}
+		m, err := ParseRFC3164String("<14>Oct  5 08:00:00 host1 pz-workflow[4321]: started", received, opts)
+		assert.NoError(err)
+		assert.Equal("2016-10-05T12:00:00Z", m.TimeStamp.String())
+		assert.Equal("host1", m.HostName)
+		assert.Equal("pz-workflow", m.Application)
+		assert.Equal("4321", m.Process)
+		assert.Equal("started", m.Message)
+		assert.NoError(m.Validate())
+	}
+
+	// sent at the end of last year
+	{
+		newYear := time.Date(2017, time.January, 1, 0, 0, 5, 0, time.UTC)
+		m, err := ParseRFC3164String("<14>Dec 31 23:59:59 host1 app: late", newYear, nil)
+		assert.NoError(err)
+		assert.Equal("2016-12-31T23:59:59Z", m.TimeStamp.String())
+	}
+
+	// no PRI, no HOSTNAME
+	{
+		opts := &RFC3164Options{HostName: "10.0.0.1"}
+		m, err := ParseRFC3164String("Oct 11 22:14:15 kernel: oops", received, opts)
+		assert.NoError(err)
+		assert.Equal(1, m.Facility)
+		assert.Equal(pzsyslog.Notice, m.Severity)
+		assert.Equal("10.0.0.1", m.HostName)
+		assert.Equal("kernel", m.Application)
+		assert.Equal("oops", m.Message)
+	}
+
+	// no usable TIMESTAMP or TAG: it's all content
+	{
+		m, err := ParseRFC3164String("<13>just some text", received, nil)
+		assert.NoError(err)
+		assert.Equal("2016-10-12T01:00:00Z", m.TimeStamp.String())
+		assert.Equal("-", m.Application)
+		assert.Equal("just some text", m.Message)
+	}
+
+	// no TAG: the HOSTNAME stands in for it
+	{
+		m, err := ParseRFC3164String("<13>Oct 11 22:14:15 mymachine no tag here", received, nil)
+		assert.NoError(err)
+		assert.Equal("mymachine", m.HostName)
+		assert.Equal("mymachine", m.Application)
+		assert.Equal("-", m.Process)
+		assert.Equal("no tag here", m.Message)
+		assert.NoError(m.Validate())
+
+		opts := &RFC3164Options{HostName: "10.0.0.1"}
+		m, err = ParseRFC3164String("<13>Oct 11 22:14:15 some text", received, opts)
+		assert.NoError(err)
+		assert.Equal("some", m.HostName)
+		assert.Equal("some", m.Application)
+
+		m, err = ParseRFC3164String("<13>just some text", received, opts)
+		assert.NoError(err)
+		assert.Equal("10.0.0.1", m.HostName)
+		assert.Equal("10.0.0.1", m.Application)
+		assert.NoError(m.Validate())
+	}
+
+	_, err := ParseRFC3164String("  ", received, nil)
+	assert.Error(err)
+}
+
+func TestParseSyslogString(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := ParseSyslogString("<13>1 2016-10-11T22:14:15Z h a p m - text", time.Now(), nil)
+	assert.NoError(err)
+	assert.Equal("m", m.MessageID)
+
+	m, err = ParseSyslogString("<13>Oct 11 22:14:15 h a: text", time.Now(), nil)
+	assert.NoError(err)
+	assert.Equal(RFC3164MessageID, m.MessageID)
+}
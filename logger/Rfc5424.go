@@ -0,0 +1,451 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// The SD-IDs of our own SDEs, as written by Message.String(). Each is
+// qualified with the PEN, as in "pzaudit@48851".
+const (
+	auditSDName  = "pzaudit"
+	metricSDName = "pzmetric"
+	sourceSDName = "pzsource"
+)
+
+const utf8BOM = "\xef\xbb\xbf"
+
+// ParseError is returned by ParseMessageString. Offset is the byte position
+// in the input at which the problem was found.
+type ParseError struct {
+	Offset int
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("rfc5424: %s at offset %d", e.Reason, e.Offset)
+}
+
+// ParseMessageString is the inverse of Message.String(): it takes the text
+// of an RFC 5424 message and builds a Message from it, rebuilding AuditData,
+// MetricData, and SourceData from their PEN-qualified SD-IDs. Other SDEs
+// are checked for syntax but otherwise ignored.
+//
+// NILVALUE ("-") header fields become empty strings, except for TIMESTAMP,
+// which as the RFC allows is replaced with the time of parsing. A UTF-8 BOM
+// at the start of MSG is dropped. Only the severity is kept from the PRI:
+// Message.Validate accepts nothing but DefaultFacility, so every message is
+// given that.
+func ParseMessageString(s string) (*pzsyslog.Message, error) {
+	p := &rfc5424Parser{input: s}
+	return p.parse()
+}
+
+//---------------------------------------------------------------------------
+
+type rfc5424Parser struct {
+	input string
+	pos   int
+}
+
+func (p *rfc5424Parser) errorf(format string, args ...interface{}) error {
+	return &ParseError{Offset: p.pos, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (p *rfc5424Parser) atEnd() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *rfc5424Parser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *rfc5424Parser) expect(c byte, what string) error {
+	if p.atEnd() {
+		return p.errorf("expected %s, found end of message", what)
+	}
+	if p.input[p.pos] != c {
+		return p.errorf("expected %s, found %q", what, p.input[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+func (p *rfc5424Parser) parse() (*pzsyslog.Message, error) {
+	_, severity, err := p.parsePri()
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := p.parseVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(' ', "SP after VERSION"); err != nil {
+		return nil, err
+	}
+
+	timeStamp, err := p.parseTimeStamp()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect(' ', "SP after TIMESTAMP"); err != nil {
+		return nil, err
+	}
+
+	fields := []struct {
+		name   string
+		maxLen int
+		value  string
+	}{
+		{name: "HOSTNAME", maxLen: 255},
+		{name: "APP-NAME", maxLen: 48},
+		{name: "PROCID", maxLen: 128},
+		{name: "MSGID", maxLen: 32},
+	}
+	for i := range fields {
+		fields[i].value, err = p.parseHeaderField(fields[i].name, fields[i].maxLen)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(' ', "SP after "+fields[i].name); err != nil {
+			return nil, err
+		}
+	}
+
+	sdes, err := p.parseStructuredData()
+	if err != nil {
+		return nil, err
+	}
+
+	text := ""
+	if !p.atEnd() {
+		if err = p.expect(' ', "SP before MSG"); err != nil {
+			return nil, err
+		}
+		text = strings.TrimPrefix(p.input[p.pos:], utf8BOM)
+	}
+
+	pen := ""
+	for _, sde := range sdes {
+		if sde.pen != "" {
+			pen = sde.pen
+			break
+		}
+	}
+
+	mssg := pzsyslog.NewMessage(pen)
+	mssg.Facility = pzsyslog.DefaultFacility
+	mssg.Severity = pzsyslog.Severity(severity)
+	mssg.Version = version
+	mssg.TimeStamp = timeStamp
+	mssg.HostName = fields[0].value
+	mssg.Application = fields[1].value
+	mssg.Process = fields[2].value
+	mssg.MessageID = fields[3].value
+	mssg.Message = text
+
+	for _, sde := range sdes {
+		switch sde.name {
+		case auditSDName:
+			mssg.AuditData = &pzsyslog.AuditElement{
+				Actor:  sde.params["actor"],
+				Action: sde.params["action"],
+				Actee:  sde.params["actee"],
+			}
+		case metricSDName:
+			value := 0.0
+			if s, ok := sde.params["value"]; ok {
+				if value, err = strconv.ParseFloat(s, 64); err != nil {
+					return nil, &ParseError{Offset: sde.offset, Reason: fmt.Sprintf("invalid %s value %q", sde.id, s)}
+				}
+			}
+			mssg.MetricData = &pzsyslog.MetricElement{
+				Name:   sde.params["name"],
+				Value:  value,
+				Object: sde.params["object"],
+			}
+		case sourceSDName:
+			line := 0
+			if s, ok := sde.params["line"]; ok {
+				if line, err = strconv.Atoi(s); err != nil {
+					return nil, &ParseError{Offset: sde.offset, Reason: fmt.Sprintf("invalid %s line %q", sde.id, s)}
+				}
+			}
+			mssg.SourceData = &pzsyslog.SourceElement{
+				File:     sde.params["file"],
+				Function: sde.params["function"],
+				Line:     line,
+			}
+		}
+	}
+
+	return mssg, nil
+}
+
+// PRI = "<" PRIVAL ">", where PRIVAL is 1-3 digits in the range 0..191
+func (p *rfc5424Parser) parsePri() (int, int, error) {
+	if err := p.expect('<', "'<' at start of PRI"); err != nil {
+		return 0, 0, err
+	}
+
+	start := p.pos
+	for !p.atEnd() && isDigit(p.peek()) && p.pos-start < 3 {
+		p.pos++
+	}
+	if p.pos == start {
+		return 0, 0, p.errorf("expected PRIVAL digits")
+	}
+	prival, _ := strconv.Atoi(p.input[start:p.pos])
+	if prival > 191 {
+		p.pos = start
+		return 0, 0, p.errorf("PRIVAL %d out of range", prival)
+	}
+
+	if err := p.expect('>', "'>' at end of PRI"); err != nil {
+		return 0, 0, err
+	}
+
+	return prival / 8, prival % 8, nil
+}
+
+// VERSION = NONZERO-DIGIT 0*2DIGIT
+func (p *rfc5424Parser) parseVersion() (int, error) {
+	start := p.pos
+	if p.atEnd() || !isDigit(p.peek()) || p.peek() == '0' {
+		return 0, p.errorf("expected VERSION")
+	}
+	for !p.atEnd() && isDigit(p.peek()) && p.pos-start < 3 {
+		p.pos++
+	}
+	version, _ := strconv.Atoi(p.input[start:p.pos])
+	return version, nil
+}
+
+func (p *rfc5424Parser) parseTimeStamp() (piazza.TimeStamp, error) {
+	start := p.pos
+	token := p.nextToken()
+	if token == "" {
+		return piazza.TimeStamp{}, p.errorf("expected TIMESTAMP")
+	}
+	if token == "-" {
+		return piazza.NewTimeStamp(), nil
+	}
+
+	timeStamp, err := piazza.ParseTimeStamp(token)
+	if err != nil {
+		p.pos = start
+		return piazza.TimeStamp{}, p.errorf("invalid TIMESTAMP %q", token)
+	}
+	return timeStamp, nil
+}
+
+// parseHeaderField reads HOSTNAME, APP-NAME, PROCID, or MSGID: either
+// NILVALUE or 1..maxLen printable US-ASCII characters.
+func (p *rfc5424Parser) parseHeaderField(name string, maxLen int) (string, error) {
+	start := p.pos
+	token := p.nextToken()
+	if token == "" {
+		return "", p.errorf("expected %s", name)
+	}
+	if len(token) > maxLen {
+		p.pos = start
+		return "", p.errorf("%s longer than %d characters", name, maxLen)
+	}
+	for i := 0; i < len(token); i++ {
+		if !isPrintUSASCII(token[i]) {
+			p.pos = start + i
+			return "", p.errorf("invalid character %q in %s", token[i], name)
+		}
+	}
+	if token == "-" {
+		return "", nil
+	}
+	return token, nil
+}
+
+// nextToken returns everything up to (not including) the next space.
+func (p *rfc5424Parser) nextToken() string {
+	start := p.pos
+	for !p.atEnd() && p.peek() != ' ' {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+//---------------------------------------------------------------------------
+
+type sdElement struct {
+	id     string // the full SD-ID, e.g. "pzaudit@48851"
+	name   string // the part before the '@', or the whole thing if none
+	pen    string // the part after the '@'
+	offset int
+	params map[string]string
+}
+
+// STRUCTURED-DATA = NILVALUE / 1*SD-ELEMENT
+func (p *rfc5424Parser) parseStructuredData() ([]*sdElement, error) {
+	if p.peek() == '-' {
+		p.pos++
+		return nil, nil
+	}
+	if p.peek() != '[' {
+		if p.atEnd() {
+			return nil, p.errorf("expected STRUCTURED-DATA, found end of message")
+		}
+		return nil, p.errorf("expected STRUCTURED-DATA, found %q", p.peek())
+	}
+
+	sdes := []*sdElement{}
+	seen := map[string]bool{}
+	for p.peek() == '[' {
+		start := p.pos
+		sde, err := p.parseSDElement()
+		if err != nil {
+			return nil, err
+		}
+		if seen[sde.id] {
+			p.pos = start
+			return nil, p.errorf("duplicate SD-ID %q", sde.id)
+		}
+		seen[sde.id] = true
+		sdes = append(sdes, sde)
+	}
+
+	return sdes, nil
+}
+
+// SD-ELEMENT = "[" SD-ID *(SP SD-PARAM) "]"
+func (p *rfc5424Parser) parseSDElement() (*sdElement, error) {
+	sde := &sdElement{offset: p.pos, params: map[string]string{}}
+	p.pos++ // the '['
+
+	id, err := p.parseSDName("SD-ID")
+	if err != nil {
+		return nil, err
+	}
+	sde.id = id
+	sde.name = id
+	if at := strings.Index(id, "@"); at >= 0 {
+		sde.name = id[:at]
+		sde.pen = id[at+1:]
+	}
+
+	for {
+		switch p.peek() {
+		case ']':
+			p.pos++
+			return sde, nil
+		case ' ':
+			p.pos++
+			name, value, err := p.parseSDParam()
+			if err != nil {
+				return nil, err
+			}
+			sde.params[name] = value
+		default:
+			if p.atEnd() {
+				return nil, p.errorf("unterminated SD-ELEMENT")
+			}
+			return nil, p.errorf("expected SP or ']' in SD-ELEMENT, found %q", p.peek())
+		}
+	}
+}
+
+// SD-PARAM = PARAM-NAME "=" %d34 PARAM-VALUE %d34
+func (p *rfc5424Parser) parseSDParam() (string, string, error) {
+	name, err := p.parseSDName("PARAM-NAME")
+	if err != nil {
+		return "", "", err
+	}
+	if err = p.expect('=', "'=' after PARAM-NAME"); err != nil {
+		return "", "", err
+	}
+	if err = p.expect('"', "'\"' before PARAM-VALUE"); err != nil {
+		return "", "", err
+	}
+
+	// Inside PARAM-VALUE, '"', '\' and ']' must be escaped with a '\'.
+	// A '\' before any other character is kept as is.
+	value := []byte{}
+	for {
+		if p.atEnd() {
+			return "", "", p.errorf("unterminated PARAM-VALUE")
+		}
+		c := p.input[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return name, string(value), nil
+		case ']':
+			return "", "", p.errorf("unescaped ']' in PARAM-VALUE")
+		case '\\':
+			if p.pos+1 < len(p.input) {
+				next := p.input[p.pos+1]
+				if next == '"' || next == '\\' || next == ']' {
+					value = append(value, next)
+					p.pos += 2
+					continue
+				}
+			}
+			value = append(value, c)
+			p.pos++
+		default:
+			value = append(value, c)
+			p.pos++
+		}
+	}
+}
+
+// SD-NAME = 1*32PRINTUSASCII, except '=', SP, ']', '"'
+func (p *rfc5424Parser) parseSDName(what string) (string, error) {
+	start := p.pos
+	for !p.atEnd() {
+		c := p.peek()
+		if !isPrintUSASCII(c) || c == '=' || c == ']' || c == '"' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		if p.atEnd() {
+			return "", p.errorf("expected %s, found end of message", what)
+		}
+		return "", p.errorf("expected %s, found %q", what, p.peek())
+	}
+	if p.pos-start > 32 {
+		p.pos = start
+		return "", p.errorf("%s longer than 32 characters", what)
+	}
+	return p.input[start:p.pos], nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// PRINTUSASCII = %d33-126; note that this excludes SP
+func isPrintUSASCII(c byte) bool {
+	return c >= 33 && c <= 126
+}
@@ -0,0 +1,186 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestParseMessageString(t *testing.T) {
+	assert := assert.New(t)
+
+	{
+		s := `<12>1 2016-07-26T01:02:03.456Z myhost myapp 1234 ID47 ` +
+			`[pzaudit@48851 actor="alice" action="login" actee="bob"]` +
+			`[pzmetric@48851 name="size" value="3.500000" object="queue"]` +
+			`[pzsource@48851 file="main.go" function="main.main" line="17"] hello world`
+		m, err := ParseMessageString(s)
+		assert.NoError(err)
+		assert.NoError(m.Validate())
+		assert.Equal(1, m.Facility)
+		assert.Equal(pzsyslog.Warning, m.Severity)
+		assert.Equal(1, m.Version)
+		assert.Equal("2016-07-26T01:02:03Z", m.TimeStamp.String())
+		assert.Equal("myhost", m.HostName)
+		assert.Equal("myapp", m.Application)
+		assert.Equal("1234", m.Process)
+		assert.Equal("ID47", m.MessageID)
+		assert.Equal("hello world", m.Message)
+		assert.Equal(&pzsyslog.AuditElement{Actor: "alice", Action: "login", Actee: "bob"}, m.AuditData)
+		assert.Equal(&pzsyslog.MetricElement{Name: "size", Value: 3.5, Object: "queue"}, m.MetricData)
+		assert.Equal(&pzsyslog.SourceElement{File: "main.go", Function: "main.main", Line: 17}, m.SourceData)
+	}
+
+	// NILVALUEs, a BOM, and no MSG at all
+	{
+		before := time.Now().Add(-time.Second)
+		m, err := ParseMessageString(`<165>1 - - - - - -`)
+		assert.NoError(err)
+		assert.Equal(pzsyslog.DefaultFacility, m.Facility)
+		assert.Equal(pzsyslog.Notice, m.Severity)
+		assert.True(time.Time(m.TimeStamp).After(before))
+		assert.Equal("", m.HostName)
+		assert.Equal("", m.Application)
+		assert.Equal("", m.Process)
+		assert.Equal("", m.MessageID)
+		assert.Equal("", m.Message)
+		assert.Nil(m.AuditData)
+
+		m, err = ParseMessageString("<14>1 2016-07-26T01:02:03+02:00 h a p - - \xef\xbb\xbfunicode \xe2\x98\x83")
+		assert.NoError(err)
+		assert.Equal("2016-07-25T23:02:03Z", m.TimeStamp.String())
+		assert.Equal("unicode \xe2\x98\x83", m.Message)
+	}
+
+	// escapes in PARAM-VALUE, and SDEs we don't know about
+	{
+		s := `<14>1 2016-07-26T01:02:03Z h a p - [exampleSDID@32473 iut="3" eventSource="App\]"]` +
+			`[pzaudit@48851 actor="a \"quoted\" name" action="back\\slash" actee="odd\q"] msg`
+		m, err := ParseMessageString(s)
+		assert.NoError(err)
+		assert.Equal(`a "quoted" name`, m.AuditData.Actor)
+		assert.Equal(`back\slash`, m.AuditData.Action)
+		assert.Equal(`odd\q`, m.AuditData.Actee)
+		assert.Nil(m.MetricData)
+		assert.Equal("msg", m.Message)
+	}
+}
+
+func TestParseMessageStringErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []struct {
+		input  string
+		offset int
+		reason string
+	}{
+		{"", 0, "expected '<' at start of PRI"},
+		{"<>1", 1, "expected PRIVAL digits"},
+		{"<192>1", 1, "PRIVAL 192 out of range"},
+		{"<13 1", 3, "expected '>' at end of PRI"},
+		{"<13>0 -", 4, "expected VERSION"},
+		{"<13>1", 5, "expected SP after VERSION"},
+		{"<13>1 yesterday h a p m -", 6, "invalid TIMESTAMP"},
+		{"<13>1 - h a p", 13, "expected SP after PROCID"},
+		{"<13>1 - " + strings.Repeat("x", 256) + " a p m -", 8, "HOSTNAME longer than 255"},
+		{"<13>1 - h a p m msg", 16, "expected STRUCTURED-DATA"},
+		{"<13>1 - h a p m [id", 19, "unterminated SD-ELEMENT"},
+		{"<13>1 - h a p m [id k=v]", 22, "expected '\"' before PARAM-VALUE"},
+		{`<13>1 - h a p m [id k="v`, 24, "unterminated PARAM-VALUE"},
+		{`<13>1 - h a p m [id k="]"]`, 23, "unescaped ']'"},
+		{`<13>1 - h a p m [id][id]`, 20, "duplicate SD-ID"},
+		{`<13>1 - h a p m [pzmetric@1 value="x"]`, 16, "invalid pzmetric@1 value"},
+		{`<13>1 - h a p m -msg`, 17, "expected SP before MSG"},
+	}
+
+	for _, d := range data {
+		_, err := ParseMessageString(d.input)
+		if !assert.Error(err, d.input) {
+			continue
+		}
+		perr, ok := err.(*ParseError)
+		if !assert.True(ok, d.input) {
+			continue
+		}
+		assert.Equal(d.offset, perr.Offset, d.input)
+		assert.Contains(perr.Reason, d.reason, d.input)
+	}
+}
+
+// isRoundTrippable returns false for strings that Message.String() would
+// write out ambiguously. Header fields must be printable ASCII without
+// spaces, and SD-PARAM values must not contain the characters that the RFC
+// requires to be escaped, because Message.String() does not escape them.
+func isRoundTrippable(header []string, params []string) bool {
+	for _, h := range header {
+		for i := 0; i < len(h); i++ {
+			if !isPrintUSASCII(h[i]) {
+				return false
+			}
+		}
+	}
+	for _, p := range params {
+		if strings.ContainsAny(p, "\"\\]") {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzParseMessageString(f *testing.F) {
+	f.Add(3, "host", "app", "proc", "id", "actor", "action", "actee", "name", 1.5, "object", "file.go", "fn", 12, "text")
+	f.Add(7, "-", "-", "-", "-", "", "", "", "", 0.0, "", "", "", 0, "")
+	f.Add(0, "h", "a", "p", "m", "x y", "", "z", "n", -2.25, "o", "f", "g", 10000, "a longer message, with ] and \" in it")
+
+	f.Fuzz(func(t *testing.T, severity int, host, app, proc, msgID, actor, action, actee,
+		name string, value float64, object, file, function string, line int, text string) {
+
+		if severity < 0 || severity > 7 || len(host) > 255 || len(app) > 48 || len(proc) > 128 || len(msgID) > 32 {
+			t.Skip()
+		}
+		if strings.HasPrefix(text, utf8BOM) {
+			t.Skip()
+		}
+		if !isRoundTrippable([]string{host, app, proc, msgID},
+			[]string{actor, action, actee, name, object, file, function}) {
+			t.Skip()
+		}
+
+		m := pzsyslog.NewMessage("48851")
+		m.Severity = pzsyslog.Severity(severity)
+		m.HostName = host
+		m.Application = app
+		m.Process = proc
+		m.MessageID = msgID
+		m.AuditData = &pzsyslog.AuditElement{Actor: actor, Action: action, Actee: actee}
+		m.MetricData = &pzsyslog.MetricElement{Name: name, Value: value, Object: object}
+		m.SourceData = &pzsyslog.SourceElement{File: file, Function: function, Line: line}
+		m.Message = text
+
+		s := m.String()
+		parsed, err := ParseMessageString(s)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", s, err.Error())
+		}
+		if parsed.String() != s {
+			t.Fatalf("round trip failed:\n%q\n%q", s, parsed.String())
+		}
+	})
+}
@@ -15,7 +15,15 @@
 package logger
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"encoding/json"
 
@@ -35,14 +43,46 @@ func (server *Server) Init(service *Service) error {
 	server.service = service
 
 	server.Routes = []piazza.RouteData{
-		{Verb: "GET", Path: "/", Handler: server.handleGetRoot},
-		{Verb: "GET", Path: "/version", Handler: server.handleGetVersion},
-		{Verb: "GET", Path: "/admin/stats", Handler: server.handleGetStats},
+		{Verb: "GET", Path: "/", Handler: server.authorize(accessPublic, server.handleGetRoot)},
+		{Verb: "GET", Path: "/version", Handler: server.authorize(accessPublic, server.handleGetVersion)},
+		{Verb: "GET", Path: "/admin/stats", Handler: server.authorize(accessAdmin, server.handleGetStats)},
+		{Verb: "GET", Path: "/admin/retention", Handler: server.authorize(accessAdmin, server.handleGetRetention)},
+		{Verb: "GET", Path: "/metrics", Handler: server.authorize(accessAdmin, server.handleGetMetrics)},
+		{Verb: "GET", Path: "/health/live", Handler: server.authorize(accessPublic, server.handleGetHealthLive)},
+		{Verb: "GET", Path: "/health/ready", Handler: server.authorize(accessPublic, server.handleGetHealthReady)},
 
-		{Verb: "GET", Path: "/syslog", Handler: server.handleGetSyslog},
-		{Verb: "POST", Path: "/syslog", Handler: server.handlePostSyslog},
+		{Verb: "GET", Path: "/syslog", Handler: server.authorize(accessRead, server.handleGetSyslog)},
+		{Verb: "GET", Path: "/syslog/stream", Handler: server.authorize(accessRead, server.handleGetSyslogStream)},
+		{Verb: "GET", Path: "/syslog/export", Handler: server.authorize(accessRead, server.handleGetSyslogExport)},
+		{Verb: "GET", Path: "/syslog/aggregate", Handler: server.authorize(accessRead, server.handleGetSyslogAggregate)},
+		{Verb: "GET", Path: "/syslog/rates", Handler: server.authorize(accessRead, server.handleGetSyslogRates)},
+		{Verb: "POST", Path: "/syslog", Handler: server.authorize(accessWrite, server.handlePostSyslog)},
+		{Verb: "POST", Path: "/syslog/bulk", Handler: server.authorize(accessWrite, server.handlePostSyslogBulk)},
+		{Verb: "POST", Path: "/syslog/text", Handler: server.authorize(accessWrite, server.handlePostSyslogText)},
 
-		{Verb: "POST", Path: "/query", Handler: server.handlePostQuery},
+		{Verb: "POST", Path: "/query", Handler: server.authorize(accessQuery, server.handlePostQuery)},
+
+		{Verb: "GET", Path: "/metrics/query", Handler: server.authorize(accessRead, server.handleGetMetricsQuery)},
+
+		{Verb: "GET", Path: "/audit", Handler: server.authorize(accessAudit, server.handleGetAudit)},
+		{Verb: "GET", Path: "/audit/actor/:id", Handler: server.authorize(accessAudit, server.handleGetAuditByActor)},
+		{Verb: "GET", Path: "/audit/actee/:id", Handler: server.authorize(accessAudit, server.handleGetAuditByActee)},
+		{Verb: "GET", Path: "/audit/verify", Handler: server.authorize(accessAudit, server.handleGetAuditVerify)},
+
+		{Verb: "GET", Path: "/alerts/rules", Handler: server.authorize(accessRead, server.handleGetAlertRules)},
+		{Verb: "GET", Path: "/alerts/rules/:id", Handler: server.authorize(accessRead, server.handleGetAlertRule)},
+		{Verb: "POST", Path: "/alerts/rules", Handler: server.authorize(accessAlerts, server.handlePostAlertRule)},
+		{Verb: "PUT", Path: "/alerts/rules/:id", Handler: server.authorize(accessAlerts, server.handlePutAlertRule)},
+		{Verb: "DELETE", Path: "/alerts/rules/:id", Handler: server.authorize(accessAlerts, server.handleDeleteAlertRule)},
+		{Verb: "GET", Path: "/alerts/events", Handler: server.authorize(accessRead, server.handleGetAlertEvents)},
+
+		// channels may hold webhook secrets, so only those who may change them see them
+		{Verb: "GET", Path: "/alerts/channels", Handler: server.authorize(accessAlerts, server.handleGetNotificationChannels)},
+		{Verb: "GET", Path: "/alerts/channels/:id", Handler: server.authorize(accessAlerts, server.handleGetNotificationChannel)},
+		{Verb: "POST", Path: "/alerts/channels", Handler: server.authorize(accessAlerts, server.handlePostNotificationChannel)},
+		{Verb: "PUT", Path: "/alerts/channels/:id", Handler: server.authorize(accessAlerts, server.handlePutNotificationChannel)},
+		{Verb: "DELETE", Path: "/alerts/channels/:id", Handler: server.authorize(accessAlerts, server.handleDeleteNotificationChannel)},
+		{Verb: "GET", Path: "/alerts/deliveries", Handler: server.authorize(accessRead, server.handleGetNotificationDeliveries)},
 	}
 
 	return nil
@@ -64,30 +104,204 @@ func (server *Server) handleGetStats(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetRetention(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetRetention(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetHealthLive(c *gin.Context) {
+	resp := server.service.GetLive()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetHealthReady(c *gin.Context) {
+	resp := server.service.GetReady()
+	piazza.GinReturnJson(c, resp)
+}
+
+// handleGetMetrics serves the Prometheus text format, not JSON.
+func (server *Server) handleGetMetrics(c *gin.Context) {
+	var buf bytes.Buffer
+	if err := server.service.WritePrometheus(&buf); err != nil {
+		piazza.GinReturnJson(c, server.service.newInternalErrorResponse(err))
+		return
+	}
+	c.Data(http.StatusOK, PrometheusContentType, buf.Bytes())
+}
+
 func (server *Server) handleGetSyslog(c *gin.Context) {
-	params := piazza.NewQueryParams(c.Request)
+	defer server.service.telemetry.observeRequest("GetSyslog", time.Now())
+
+	params := newTenantQueryParams(c)
 	resp := server.service.GetSyslog(params)
 
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetSyslogAggregate(c *gin.Context) {
+	params := newTenantQueryParams(c)
+	resp := server.service.Aggregate(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetSyslogRates(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetRates(params, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetMetricsQuery(c *gin.Context) {
+	params := newTenantQueryParams(c)
+	resp := server.service.QueryMetric(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAudit(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetAudit(params, "", "")
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAuditByActor(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetAudit(params, c.Param("id"), "")
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAuditByActee(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetAudit(params, "", c.Param("id"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAuditVerify(c *gin.Context) {
+	resp := server.service.VerifyAudit()
+	piazza.GinReturnJson(c, resp)
+}
+
+// handleGetSyslogStream serves a WebSocket if the client asks to upgrade,
+// and Server-Sent Events otherwise.
+func (server *Server) handleGetSyslogStream(c *gin.Context) {
+	params := newTenantQueryParams(c)
+	stream, resp := server.service.OpenStream(params)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	defer stream.Close()
+
+	if isWebSocketRequest(c.Request) {
+		serveStreamWebSocket(c, stream)
+	} else {
+		serveStreamSSE(c, stream)
+	}
+}
+
+// handleGetSyslogExport streams its output, compressed if the client
+// accepts gzip. Errors after the first byte end the output early, with the
+// ExportStatusTrailer saying what happened.
+func (server *Server) handleGetSyslogExport(c *gin.Context) {
+	params := newTenantQueryParams(c)
+	export, resp := server.service.NewExport(params)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", export.contentType())
+	header.Set("Content-Disposition", "attachment; filename=\""+export.fileName()+"\"")
+	header.Set("Trailer", ExportStatusTrailer)
+
+	var w io.Writer = c.Writer
+	flush := c.Writer.Flush
+	if strings.Contains(c.Request.Header.Get("Accept-Encoding"), "gzip") {
+		header.Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(c.Writer)
+		defer func() {
+			if err := gz.Close(); err != nil {
+				log.Printf("handleGetSyslogExport: %s", err.Error())
+			}
+		}()
+		w = gz
+		flush = func() {
+			if err := gz.Flush(); err == nil {
+				c.Writer.Flush()
+			}
+		}
+	}
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+
+	if _, err := export.WriteTo(w, flush); err != nil {
+		log.Printf("handleGetSyslogExport: %s", err.Error())
+		header.Set(ExportStatusTrailer, "error: "+err.Error())
+		return
+	}
+	header.Set(ExportStatusTrailer, "complete")
+}
+
 func (server *Server) handlePostSyslog(c *gin.Context) {
+	defer server.service.telemetry.observeRequest("PostSyslog", time.Now())
+
 	sysM := syslogger.NewMessage(server.service.pen)
 
 	err := c.BindJSON(&sysM)
+	if err != nil {
+		server.service.telemetry.messageRejected(nil)
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostSyslog(sysM, getAPIKey(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+// readBody reads the request body, of at most limit bytes. If it can't, it
+// returns the response to give instead: a 413 if the body is too large.
+func readBody(c *gin.Context, limit int64) ([]byte, *piazza.JsonResponse) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
 	if err != nil {
 		resp := &piazza.JsonResponse{
 			StatusCode: http.StatusBadRequest,
 			Message:    err.Error(),
 		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			resp.StatusCode = http.StatusRequestEntityTooLarge
+		}
+		return nil, resp
+	}
+	return body, nil
+}
+
+func (server *Server) handlePostSyslogBulk(c *gin.Context) {
+	body, resp := readBody(c, MaxBulkBodySize)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp = server.service.PostSyslogBulk(body, getAPIKey(c))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostSyslogText(c *gin.Context) {
+	body, resp := readBody(c, MaxBulkBodySize)
+	if resp != nil {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
-	resp := server.service.PostSyslog(sysM)
+	resp = server.service.PostSyslogText(body, time.Now(), c.ClientIP(), getAPIKey(c))
 	piazza.GinReturnJson(c, resp)
 }
 
 func (server *Server) handlePostQuery(c *gin.Context) {
+	defer server.service.telemetry.observeRequest("PostQuery", time.Now())
+
 	params := piazza.NewQueryParams(c.Request)
 
 	// We have been given a string (containing JSON) and we want to
@@ -117,6 +331,88 @@ func (server *Server) handlePostQuery(c *gin.Context) {
 		return
 	}
 
-	resp := server.service.PostQuery(params, string(byts))
+	resp := server.service.PostQuery(params, string(byts), getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlertRules(c *gin.Context) {
+	resp := server.service.GetAlertRules(getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlertRule(c *gin.Context) {
+	resp := server.service.GetAlertRule(c.Param("id"), getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostAlertRule(c *gin.Context) {
+	rule := &AlertRule{}
+	if err := c.BindJSON(rule); err != nil {
+		piazza.GinReturnJson(c, server.service.newBadRequestResponse(err))
+		return
+	}
+	resp := server.service.PostAlertRule(rule, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutAlertRule(c *gin.Context) {
+	rule := &AlertRule{}
+	if err := c.BindJSON(rule); err != nil {
+		piazza.GinReturnJson(c, server.service.newBadRequestResponse(err))
+		return
+	}
+	resp := server.service.PutAlertRule(c.Param("id"), rule, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteAlertRule(c *gin.Context) {
+	resp := server.service.DeleteAlertRule(c.Param("id"), getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlertEvents(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetAlertEvents(params, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetNotificationChannels(c *gin.Context) {
+	resp := server.service.GetNotificationChannels(getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetNotificationChannel(c *gin.Context) {
+	resp := server.service.GetNotificationChannel(c.Param("id"), getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostNotificationChannel(c *gin.Context) {
+	channel := &NotificationChannel{}
+	if err := c.BindJSON(channel); err != nil {
+		piazza.GinReturnJson(c, server.service.newBadRequestResponse(err))
+		return
+	}
+	resp := server.service.PostNotificationChannel(channel, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutNotificationChannel(c *gin.Context) {
+	channel := &NotificationChannel{}
+	if err := c.BindJSON(channel); err != nil {
+		piazza.GinReturnJson(c, server.service.newBadRequestResponse(err))
+		return
+	}
+	resp := server.service.PutNotificationChannel(c.Param("id"), channel, getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteNotificationChannel(c *gin.Context) {
+	resp := server.service.DeleteNotificationChannel(c.Param("id"), getAPIKey(c).tenant())
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetNotificationDeliveries(c *gin.Context) {
+	params := newQueryParams(c.Request)
+	resp := server.service.GetNotificationDeliveries(params, getAPIKey(c).tenant())
 	piazza.GinReturnJson(c, resp)
 }
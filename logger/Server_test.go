@@ -15,10 +15,26 @@
 package logger
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +45,7 @@ import (
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"golang.org/x/net/websocket"
 )
 
 //---------------------------------------------------------------------
@@ -95,7 +112,7 @@ func setupES(sys *piazza.SystemConfig) (elasticsearch.IIndex, pzsyslog.Writer, e
 		log.Fatal(err)
 	}
 
-	idx := elasticsearch.NewMockIndex(loggerIndex)
+	idx := NewMemoryIndex(loggerIndex)
 
 	logESWriter := pzsyslog.NewElasticWriter(idx, pzsyslog.LoggerType)
 	if _, err = logESWriter.CreateIndex(); err != nil {
@@ -155,6 +172,23 @@ func sleep() {
 	time.Sleep(1 * time.Second)
 }
 
+// waitForStats polls the stats until done says they are what is wanted,
+// for up to 5 seconds, returning whether they got there. Messages are
+// counted after they are written, so once done, reading them is safe.
+func (suite *LoggerTester) waitForStats(done func(*Stats) bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		output := &Stats{}
+		if err := suite.getStats(output); err == nil && done(output) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (suite *LoggerTester) getLastMessage() string {
 	t := suite.T()
 	assert := assert.New(t)
@@ -204,6 +238,7 @@ func (suite *LoggerTester) Test02Admin() {
 	err := suite.getStats(output)
 	assert.NoError(err, "GetFromAdminStats")
 	assert.NotNil(output)
+	assert.Contains(*output, "writer")
 
 	_, _, _, err = piazza.HTTP(piazza.GET, fmt.Sprintf("http://localhost:%s/admin/stats", piazza.LocalPortNumbers[piazza.PzLogger]), piazza.NewHeaderBuilder().AddJsonContentType().GetHeader(), nil)
 	assert.NoError(err)
@@ -255,48 +290,66 @@ func (suite *LoggerTester) Test03Pagination() {
 	assert.EqualValues(pzsyslog.Fatal, ms[4].Severity)
 }
 
-// this test uses an ES query that is not supported under mocking
-/*
 func (suite *LoggerTester) Test04OtherParams() {
-
 	t := suite.T()
 	assert := assert.New(t)
 
 	suite.setupFixture()
 	defer suite.teardownFixture()
 
-	//client.SetService("myservice", "1.2.3.4")
-
-	sysloggerD := syslog.NewLogger(&syslog.MessageWriter{}, "Dispatcher")
-	sysloggerJ := syslog.NewLogger(&syslog.MessageWriter{}, "JobManager")
-	sysloggerU := syslog.NewLogger(&syslog.MessageWriter{}, "pz-uuidgen")
+	writer, err := pzsyslog.NewHttpWriter(suite.kit.Url, "")
+	assert.NoError(err)
+	loggerD := pzsyslog.NewLogger(writer, writer, "Dispatcher", "123456")
+	loggerJ := pzsyslog.NewLogger(writer, writer, "JobManager", "123456")
+	loggerU := pzsyslog.NewLogger(writer, writer, "pz-uuidgen", "123456")
 
-	sysloggerD.Info("Received Message to Relay on topic Request-Job with key f3b63085-b482-4ae8-8297-3c7d1fcfff7d")
-	sysloggerJ.Info("Processed Update Status for Job 6d0ea538-4382-4ea5-9669-56519b8c8f58 with Status Success")
-	sysloggerU.Info("generated 1: 09d4ec60-ea61-4066-8697-5568a47f84bf")
-	sysloggerJ.Info("Handling Job with Topic Create-Job for Job ID 09d4ec60-ea61-4066-8697-5568a47f84b")
-	sysloggerJ.Info("Handling Job with Topic Update-Job for Job ID be4ce034-1187-4a4f-95a9-a9c31826248b")
+	assert.NoError(loggerD.Info("Received Message to Relay on topic Request-Job with key f3b63085-b482-4ae8-8297-3c7d1fcfff7d"))
+	assert.NoError(loggerJ.Info("Processed Update Status for Job 6d0ea538-4382-4ea5-9669-56519b8c8f58 with Status Success"))
+	assert.NoError(loggerU.Info("generated 1: 09d4ec60-ea61-4066-8697-5568a47f84bf"))
+	assert.NoError(loggerJ.Info("Handling Job with Topic Create-Job for Job ID 09d4ec60-ea61-4066-8697-5568a47f84b"))
+	assert.NoError(loggerJ.Error("Handling Job with Topic Update-Job for Job ID be4ce034-1187-4a4f-95a9-a9c31826248b"))
 
 	sleep()
 
-	format := piazza.JsonPagination{
+	format := &piazza.JsonPagination{
 		PerPage: 100,
 		Page:    0,
-		Order:   "",
-		SortBy:  "",
+		Order:   piazza.SortOrderAscending,
+		SortBy:  "timeStamp",
+	}
+
+	get := func(params *piazza.HttpQueryParams) ([]pzsyslog.Message, int) {
+		msgs, count, err := writer.GetMessages(format, params)
+		assert.NoError(err)
+		return msgs, count
 	}
 
-	params := piazza.HttpQueryParams{}
+	params := &piazza.HttpQueryParams{}
 	params.AddString("service", "JobManager")
 	params.AddString("contains", "Success")
+	msgs, count := get(params)
+	assert.Len(msgs, 1)
+	assert.Equal(1, count)
 
-	msgs, count, err := suite.client.GetMessages(&format, &params)
-	assert.NoError(err)
+	params = &piazza.HttpQueryParams{}
+	params.AddString("service", "JobManager")
+	msgs, count = get(params)
+	assert.Len(msgs, 3)
+	assert.Equal(3, count)
+	assert.Contains(msgs[0].Message, "Processed Update Status")
+	assert.Contains(msgs[2].Message, "Update-Job")
+
+	params = &piazza.HttpQueryParams{}
+	params.AddString("maxSeverity", "error")
+	msgs, _ = get(params)
 	assert.Len(msgs, 1)
-	assert.Equal(5, count)
+	assert.Equal("JobManager", msgs[0].Application)
 
+	params = &piazza.HttpQueryParams{}
+	params.AddString("q", url.QueryEscape("application:pz-* OR (application:Dispatcher AND NOT severity:error)"))
+	msgs, _ = get(params)
+	assert.Len(msgs, 2)
 }
-*/
 
 func (suite *LoggerTester) Test05ConstructDsl() {
 	t := suite.T()
@@ -451,6 +504,10 @@ func (suite *LoggerTester) Test08PostQuery() {
 	suite.setupFixture()
 	defer suite.teardownFixture()
 
+	err := suite.logger.Info("in the index")
+	assert.NoError(err)
+	sleep()
+
 	h := &piazza.Http{BaseUrl: suite.kit.Url}
 
 	jsn := `
@@ -466,10 +523,988 @@ func (suite *LoggerTester) Test08PostQuery() {
 }`
 
 	input := map[string]interface{}{}
-	err := json.Unmarshal([]byte(jsn), &input)
+	err = json.Unmarshal([]byte(jsn), &input)
 	assert.NoError(err)
 	resp := h.PzPost("/query", input)
-	assert.True(resp.IsError())
-	assert.Error(resp.ToError())
-	assert.Contains(resp.ToError().Error(), "not supported under mocking")
+	assert.False(resp.IsError())
+	assert.Equal(1, resp.Pagination.Count)
+
+	var lines []pzsyslog.Message
+	assert.NoError(resp.ExtractData(&lines))
+	assert.Len(lines, 1)
+	assert.Equal("in the index", lines[0].Message)
+}
+
+func (suite *LoggerTester) Test09PostSyslogBulk() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	newMessage := func(text string) *pzsyslog.Message {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = pzsyslog.Informational
+		m.HostName = "localhost"
+		m.Application = "bulktest"
+		m.Process = "1"
+		m.Message = text
+		return m
+	}
+
+	url := suite.kit.Url + "/syslog/bulk"
+	header := piazza.NewHeaderBuilder().AddJsonContentType().GetHeader()
+
+	// array form, with one bad message
+	{
+		bad := newMessage("bad")
+		bad.HostName = ""
+		byts, err := json.Marshal([]*pzsyslog.Message{newMessage("one"), bad, newMessage("two")})
+		assert.NoError(err)
+
+		code, body, _, err := piazza.HTTP(piazza.POST, url, header, bytes.NewReader(byts))
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, code)
+
+		var jresp piazza.JsonResponse
+		assert.NoError(json.Unmarshal(body, &jresp))
+		var result BulkResult
+		assert.NoError(jresp.ExtractData(&result))
+		assert.Equal(2, result.NumAccepted)
+		assert.Equal(1, result.NumRejected)
+		assert.Len(result.Items, 3)
+		assert.True(result.Items[0].Accepted)
+		assert.False(result.Items[1].Accepted)
+		assert.Contains(result.Items[1].Message, "HostName")
+		assert.True(result.Items[2].Accepted)
+	}
+
+	// newline-delimited form, with one undecodable line
+	{
+		one, err := json.Marshal(newMessage("three"))
+		assert.NoError(err)
+		two, err := json.Marshal(newMessage("four"))
+		assert.NoError(err)
+		ndjson := string(one) + "\n\n{not json\n" + string(two) + "\n"
+
+		code, body, _, err := piazza.HTTP(piazza.POST, url, header, bytes.NewReader([]byte(ndjson)))
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, code)
+
+		var jresp piazza.JsonResponse
+		assert.NoError(json.Unmarshal(body, &jresp))
+		var result BulkResult
+		assert.NoError(jresp.ExtractData(&result))
+		assert.Equal(2, result.NumAccepted)
+		assert.Equal(1, result.NumRejected)
+		assert.False(result.Items[1].Accepted)
+	}
+
+	// empty body
+	{
+		code, _, _, err := piazza.HTTP(piazza.POST, url, header, bytes.NewReader([]byte(" ")))
+		assert.NoError(err)
+		assert.Equal(http.StatusBadRequest, code)
+	}
+
+	// a body too large to read
+	{
+		code, _, _, err := piazza.HTTP(piazza.POST, url, header, bytes.NewReader(make([]byte, MaxBulkBodySize+1)))
+		assert.NoError(err)
+		assert.Equal(http.StatusRequestEntityTooLarge, code)
+	}
+
+	{
+		output := &Stats{}
+		err := suite.getStats(output)
+		assert.NoError(err)
+		assert.Equal(4, output.NumMessages)
+		assert.Equal(4, output.NumMessagesByApplication["bulktest"])
+	}
+
+	{
+		format := &piazza.JsonPagination{PerPage: 100, SortBy: "timeStamp", Order: piazza.SortOrderAscending}
+		result, err := suite.kit.esi.FilterByMatchAll(pzsyslog.LoggerType, format)
+		assert.NoError(err)
+		assert.EqualValues(4, result.TotalHits())
+	}
+}
+
+func newTestTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (suite *LoggerTester) Test10SyslogListener() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	tlsConfig, err := newTestTLSConfig()
+	assert.NoError(err)
+
+	listener, err := NewSyslogListener(suite.kit.Service, &SyslogListenerConfig{
+		UDPAddr:   "127.0.0.1:0",
+		TCPAddr:   "127.0.0.1:0",
+		TLSAddr:   "127.0.0.1:0",
+		TLSConfig: tlsConfig,
+	})
+	assert.NoError(err)
+	assert.NoError(listener.Start())
+	defer func() {
+		assert.NoError(listener.Stop())
+	}()
+
+	newMessage := func(text string) *pzsyslog.Message {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = pzsyslog.Warning
+		m.HostName = "localhost"
+		m.Application = "listenertest"
+		m.Process = "99"
+		m.MessageID = "msgid"
+		m.Message = text
+		return m
+	}
+
+	{
+		m := newMessage("over udp")
+		m.MetricData = &pzsyslog.MetricElement{Name: "size", Value: 3.5, Object: "queue"}
+		conn, err := net.Dial("udp", listener.UDPAddr().String())
+		assert.NoError(err)
+		_, err = conn.Write([]byte(m.String()))
+		assert.NoError(err)
+		assert.NoError(conn.Close())
+	}
+	// each in turn, so that they are stored in order
+	assert.True(suite.waitForStats(func(stats *Stats) bool { return stats.NumMessages >= 1 }))
+
+	{
+		m := newMessage("over tcp")
+		conn, err := net.Dial("tcp", listener.TCPAddr().String())
+		assert.NoError(err)
+		s := m.String()
+		_, err = fmt.Fprintf(conn, "%d %s", len(s), s)
+		assert.NoError(err)
+		assert.NoError(conn.Close())
+	}
+	assert.True(suite.waitForStats(func(stats *Stats) bool { return stats.NumMessages >= 2 }))
+
+	{
+		m := newMessage("over tls")
+		m.AuditData = &pzsyslog.AuditElement{Actor: "me", Action: "login", Actee: "you"}
+		conn, err := tls.Dial("tcp", listener.TLSAddr().String(), &tls.Config{InsecureSkipVerify: true})
+		assert.NoError(err)
+		s := m.String()
+		_, err = fmt.Fprintf(conn, "%d %s", len(s), s)
+		assert.NoError(err)
+		assert.NoError(conn.Close())
+	}
+	assert.True(suite.waitForStats(func(stats *Stats) bool { return stats.NumMessages >= 3 }))
+
+	ms, err := suite.logReader.Read(3)
+	assert.NoError(err)
+	assert.Len(ms, 3)
+
+	assert.Equal("over udp", ms[0].Message)
+	assert.Equal("listenertest", ms[0].Application)
+	assert.Equal(pzsyslog.Warning, ms[0].Severity)
+	assert.NotNil(ms[0].MetricData)
+	assert.EqualValues(3.5, ms[0].MetricData.Value)
+
+	assert.Equal("over tcp", ms[1].Message)
+	assert.Equal("msgid", ms[1].MessageID)
+
+	assert.Equal("over tls", ms[2].Message)
+	assert.NotNil(ms[2].AuditData)
+	assert.Equal("login", ms[2].AuditData.Action)
+
+	output := &Stats{}
+	assert.NoError(suite.getStats(output))
+	assert.Equal(3, output.NumMessagesByApplication["listenertest"])
+
+	// lines from facilities other than user
+	for _, line := range []string{
+		"<34>Oct 11 22:14:15 mymachine listenertest: from auth",
+		"<134>Oct 11 22:14:15 mymachine listenertest[7]: from local0",
+		"<34>1 2016-10-11T22:14:15Z mymachine listenertest 7 - - native from auth",
+		"<134>1 2016-10-11T22:14:15Z mymachine listenertest 7 - - native from local0",
+	} {
+		conn, err := net.Dial("udp", listener.UDPAddr().String())
+		assert.NoError(err)
+		_, err = conn.Write([]byte(line))
+		assert.NoError(err)
+		assert.NoError(conn.Close())
+	}
+	assert.True(suite.waitForStats(func(stats *Stats) bool { return stats.NumMessages >= 7 }))
+
+	assert.NoError(suite.getStats(output))
+	assert.Equal(7, output.NumMessagesByApplication["listenertest"])
+}
+
+func (suite *LoggerTester) Test11PostSyslogText() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	body := "<14>Oct 11 22:14:15 mymachine texttest[12]: from bsd\n" +
+		"<13>1 2016-10-11T22:14:15Z h texttest 1 - - native\n" +
+		"\n" +
+		"<13>Oct 11 22:14:15 mymachine no tag here\n" +
+		"<34>Oct 11 22:14:15 mymachine texttest: from auth\n" +
+		"<134>Oct 11 22:14:15 mymachine texttest[7]: from local0\n" +
+		"<34>1 2016-10-11T22:14:15Z h texttest 1 - - native from auth\n" +
+		"<134>1 2016-10-11T22:14:15Z h texttest 1 - - native from local0\n" +
+		"<13>1 yesterday h texttest 1 - - bad time\n"
+
+	url := suite.kit.Url + "/syslog/text"
+	header := piazza.NewHeaderBuilder().AddHeader("Content-Type", "text/plain").GetHeader()
+
+	code, respBody, _, err := piazza.HTTP(piazza.POST, url, header, bytes.NewReader([]byte(body)))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, code)
+
+	var jresp piazza.JsonResponse
+	assert.NoError(json.Unmarshal(respBody, &jresp))
+	var result BulkResult
+	assert.NoError(jresp.ExtractData(&result))
+	assert.Equal(7, result.NumAccepted)
+	assert.Equal(1, result.NumRejected)
+	assert.True(result.Items[2].Accepted)
+	assert.False(result.Items[7].Accepted)
+
+	output := &Stats{}
+	assert.NoError(suite.getStats(output))
+	assert.Equal(6, output.NumMessagesByApplication["texttest"])
+	// the line with no tag is the host's
+	assert.Equal(1, output.NumMessagesByApplication["mymachine"])
+
+	code, _, _, err = piazza.HTTP(piazza.POST, url, header, bytes.NewReader(make([]byte, MaxBulkBodySize+1)))
+	assert.NoError(err)
+	assert.Equal(http.StatusRequestEntityTooLarge, code)
+}
+
+func (suite *LoggerTester) Test12Spool() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	dir, err := ioutil.TempDir("", "pzspool")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	spool, err := newSpool(&SpoolConfig{Dir: dir}, suite.kit.Service.bulkIndexer, pzsyslog.LoggerType)
+	assert.NoError(err)
+	spool.Start()
+	suite.kit.Service.setSpool(spool)
+	defer func() {
+		assert.NoError(spool.Close())
+	}()
+
+	err = suite.logger.Info("spooled")
+	assert.NoError(err)
+	sleep()
+
+	output := &Stats{}
+	assert.NoError(suite.getStats(output))
+	assert.NotNil(output.Spool)
+	assert.Equal(0, output.Spool.Depth)
+	assert.Equal(1, output.Spool.NumDrained)
+}
+
+func (suite *LoggerTester) Test13Shutdown() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	err := suite.logger.Info("before shutdown")
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := suite.kit.Shutdown(ctx)
+	assert.NoError(err)
+	assert.Equal(0, report.NumAbandoned)
+	assert.NoError(suite.kit.Wait())
+
+	err = suite.logger.Info("after shutdown")
+	assert.Error(err)
+
+	assert.Contains(suite.getLastMessage(), "before shutdown")
+}
+
+func (suite *LoggerTester) Test14Stream() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	err := suite.logger.Info("before streaming")
+	assert.NoError(err)
+	since := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	// SSE, replaying from a minute ago and then going live
+	{
+		resp, err := http.Get(suite.kit.Url + "/syslog/stream?service=pz-logger/unittest&since=" + since)
+		assert.NoError(err)
+		defer func() {
+			assert.NoError(resp.Body.Close())
+		}()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Contains(resp.Header.Get("Content-Type"), "text/event-stream")
+
+		reader := bufio.NewReader(resp.Body)
+		nextData := func() string {
+			for {
+				line, err := reader.ReadString('\n')
+				if !assert.NoError(err) {
+					return ""
+				}
+				if strings.HasPrefix(line, "data:") {
+					return line
+				}
+			}
+		}
+
+		assert.Contains(nextData(), "before streaming")
+
+		err = suite.logger.Info("while streaming")
+		assert.NoError(err)
+		assert.Contains(nextData(), "while streaming")
+	}
+
+	// WebSocket, with a filter that skips the first message
+	{
+		wsURL := strings.Replace(suite.kit.Url, "http://", "ws://", 1) + "/syslog/stream?q=" +
+			url.QueryEscape(`message:"*second*"`)
+		ws, err := websocket.Dial(wsURL, "", suite.kit.Url)
+		if !assert.NoError(err) {
+			return
+		}
+		defer func() {
+			assert.NoError(ws.Close())
+		}()
+
+		err = suite.logger.Info("first over websocket")
+		assert.NoError(err)
+		err = suite.logger.Info("second over websocket")
+		assert.NoError(err)
+
+		event := &StreamEvent{}
+		assert.NoError(websocket.JSON.Receive(ws, event))
+		assert.Equal("message", event.Type)
+		if assert.NotNil(event.Message) {
+			assert.Equal("second over websocket", event.Message.Message)
+		}
+	}
+
+	// a bad filter is refused before anything is streamed
+	{
+		resp, err := http.Get(suite.kit.Url + "/syslog/stream?buffer=0")
+		assert.NoError(err)
+		assert.NoError(resp.Body.Close())
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func (suite *LoggerTester) Test15Cursor() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	for _, s := range []string{"one", "two", "three"} {
+		err := suite.logger.Info("%s", s)
+		assert.NoError(err)
+	}
+	sleep()
+
+	h := &piazza.Http{BaseUrl: suite.kit.Url}
+
+	getPage := func(cursor string) ([]pzsyslog.Message, string) {
+		params := &piazza.HttpQueryParams{}
+		params.AddString("perPage", "2")
+		params.AddString("sortBy", "timeStamp")
+		params.AddString("order", "asc")
+		params.AddString("cursor", cursor)
+		resp := h.PzGet("/syslog?" + params.String())
+		if !assert.False(resp.IsError(), resp.Message) {
+			return nil, ""
+		}
+		var lines []pzsyslog.Message
+		assert.NoError(resp.ExtractData(&lines))
+		metadata := &CursorMetadata{}
+		if resp.Metadata != nil {
+			byts, err := json.Marshal(resp.Metadata)
+			assert.NoError(err)
+			assert.NoError(json.Unmarshal(byts, metadata))
+		}
+		return lines, metadata.NextCursor
+	}
+
+	lines, cursor := getPage("")
+	assert.Len(lines, 2)
+	assert.NotEmpty(cursor)
+	assert.Equal("one", lines[0].Message)
+
+	lines, cursor = getPage(cursor)
+	assert.Len(lines, 1)
+	assert.Empty(cursor)
+	assert.Equal("three", lines[0].Message)
+
+	resp := h.PzGet("/syslog?cursor=nonsense")
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (suite *LoggerTester) Test16Export() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	err := suite.logger.Info("exported")
+	assert.NoError(err)
+	sleep()
+
+	request, err := http.NewRequest("GET", suite.kit.Url+"/syslog/export?format=rfc5424", nil)
+	assert.NoError(err)
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(request)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() {
+		assert.NoError(resp.Body.Close())
+	}()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("gzip", resp.Header.Get("Content-Encoding"))
+	assert.Contains(resp.Header.Get("Content-Disposition"), "syslog.log")
+
+	gz, err := gzip.NewReader(resp.Body)
+	if !assert.NoError(err) {
+		return
+	}
+	byts, err := ioutil.ReadAll(gz)
+	assert.NoError(err)
+	assert.Contains(string(byts), "pz-logger/unittest")
+	assert.Contains(string(byts), "exported\n")
+	assert.Equal("complete", resp.Trailer.Get(ExportStatusTrailer))
+}
+
+func (suite *LoggerTester) Test17Audit() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	// the suite's logger sends audit messages through both its writers, so
+	// they would be recorded twice
+	writer, err := pzsyslog.NewHttpWriter(suite.kit.Url, "")
+	assert.NoError(err)
+	logger := pzsyslog.NewLogger(writer, &pzsyslog.NilWriter{}, "pz-logger/unittest", "123456")
+
+	err = logger.Audit("alice", "create", "job1", "made a job")
+	assert.NoError(err)
+	err = logger.Audit("bob", "read", "job1", "read a job")
+	assert.NoError(err)
+	err = logger.Info("not audited")
+	assert.NoError(err)
+	sleep()
+
+	h := &piazza.Http{BaseUrl: suite.kit.Url}
+
+	getRecords := func(path string) []AuditRecord {
+		resp := h.PzGet(path)
+		if !assert.False(resp.IsError(), resp.Message) {
+			return nil
+		}
+		var records []AuditRecord
+		assert.NoError(resp.ExtractData(&records))
+		return records
+	}
+
+	records := getRecords("/audit?order=asc")
+	if assert.Len(records, 2) {
+		assert.Equal("alice", records[0].Actor)
+		assert.Equal(records[0].Hash, records[1].PrevHash)
+	}
+
+	records = getRecords("/audit/actor/bob")
+	if assert.Len(records, 1) {
+		assert.Equal("read", records[0].Action)
+	}
+	assert.Len(getRecords("/audit/actee/job1"), 2)
+
+	resp := h.PzGet("/audit/verify")
+	if assert.False(resp.IsError(), resp.Message) {
+		result := &AuditVerifyResult{}
+		assert.NoError(resp.ExtractData(result))
+		assert.True(result.Verified)
+		assert.Equal(2, result.NumRecords)
+	}
+}
+
+func (suite *LoggerTester) Test18Metrics() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	err := suite.logger.Info("counted")
+	assert.NoError(err)
+	err = suite.logger.Error("counted too")
+	assert.NoError(err)
+	sleep()
+
+	resp, err := http.Post(suite.kit.Url+"/syslog", "application/json", strings.NewReader("{"))
+	if assert.NoError(err) {
+		assert.NoError(resp.Body.Close())
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	h := &piazza.Http{BaseUrl: suite.kit.Url}
+	jresp := h.PzGet("/syslog")
+	assert.False(jresp.IsError(), jresp.Message)
+
+	resp, err = http.Get(suite.kit.Url + "/metrics")
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() {
+		assert.NoError(resp.Body.Close())
+	}()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(PrometheusContentType, resp.Header.Get("Content-Type"))
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	text := string(byts)
+	assert.Contains(text, `pzlogger_messages_accepted_total{application="pz-logger/unittest",severity="6"} 1`)
+	assert.Contains(text, `pzlogger_messages_accepted_total{application="pz-logger/unittest",severity="3"} 1`)
+	assert.Contains(text, `pzlogger_messages_rejected_total{application="",severity=""} 1`)
+	assert.Contains(text, `pzlogger_request_duration_seconds_count{handler="PostSyslog"} 3`)
+	assert.Contains(text, `pzlogger_request_duration_seconds_count{handler="GetSyslog"} 1`)
+	assert.Contains(text, `pzlogger_queue_capacity{writer="log"}`)
+	assert.Contains(text, `pzlogger_async_write_failures_total{writer="log"} 0`)
+}
+
+func (suite *LoggerTester) Test19Health() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	h := &piazza.Http{BaseUrl: suite.kit.Url}
+
+	for _, path := range []string{"/health/live", "/health/ready"} {
+		resp := h.PzGet(path)
+		if assert.False(resp.IsError(), resp.Message) {
+			report := &HealthReport{}
+			assert.NoError(resp.ExtractData(report))
+			assert.Equal(HealthOK, report.Status, path)
+		}
+	}
+}
+
+func (suite *LoggerTester) Test20Auth() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	authorizer := &stubAuthorizer{keys: map[string]*APIKey{
+		"writer":  {Name: "writer", Applications: []string{"pz-logger/*"}},
+		"reader":  {Name: "reader", Read: true},
+		"querier": {Name: "querier", Query: true},
+		"admin":   {Name: "admin", Admin: true},
+	}}
+	suite.kit.Service.setAuthorizer(authorizer)
+	defer suite.kit.Service.setAuthorizer(nil)
+
+	as := func(apiKey string) *piazza.Http {
+		return &piazza.Http{BaseUrl: suite.kit.Url, ApiKey: apiKey}
+	}
+	newMessage := func(application string) *pzsyslog.Message {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = pzsyslog.Informational
+		m.HostName = "localhost"
+		m.Application = application
+		m.Process = "1"
+		m.Message = "hello"
+		return m
+	}
+
+	// public
+	assert.Equal(http.StatusOK, as("").PzGet("/version").StatusCode)
+	assert.Equal(http.StatusOK, as("").PzGet("/health/live").StatusCode)
+
+	// no key, or a bad one
+	assert.Equal(http.StatusUnauthorized, as("").PzGet("/syslog").StatusCode)
+	assert.Equal(http.StatusUnauthorized, as("bogus").PzGet("/syslog").StatusCode)
+
+	// the wrong key
+	assert.Equal(http.StatusForbidden, as("writer").PzGet("/syslog").StatusCode)
+	assert.Equal(http.StatusForbidden, as("reader").PzPost("/syslog", newMessage("pz-logger/unittest")).StatusCode)
+	assert.Equal(http.StatusForbidden, as("reader").PzPost("/query", map[string]interface{}{}).StatusCode)
+	assert.Equal(http.StatusForbidden, as("querier").PzGet("/admin/stats").StatusCode)
+
+	// the right one
+	assert.Equal(http.StatusOK, as("reader").PzGet("/syslog").StatusCode)
+	assert.Equal(http.StatusOK, as("reader").PzGet("/audit").StatusCode)
+	assert.Equal(http.StatusOK, as("admin").PzGet("/admin/stats").StatusCode)
+	assert.Equal(http.StatusOK, as("querier").PzPost("/query",
+		map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}}).StatusCode)
+
+	// writes only as the applications granted
+	assert.Equal(http.StatusOK, as("writer").PzPost("/syslog", newMessage("pz-logger/unittest")).StatusCode)
+	assert.Equal(http.StatusForbidden, as("writer").PzPost("/syslog", newMessage("pz-gateway")).StatusCode)
+
+	resp := as("writer").PzPost("/syslog/bulk",
+		[]*pzsyslog.Message{newMessage("pz-logger/bulk"), newMessage("pz-gateway")})
+	if assert.Equal(http.StatusOK, resp.StatusCode, resp.Message) {
+		var result BulkResult
+		assert.NoError(resp.ExtractData(&result))
+		assert.Equal(1, result.NumAccepted)
+		assert.Equal(1, result.NumRejected)
+		assert.True(result.Items[0].Accepted)
+		assert.Contains(result.Items[1].Message, "pz-gateway")
+	}
+
+	// the keys can't be checked
+	authorizer.err = errors.New("authz is down")
+	assert.Equal(http.StatusServiceUnavailable, as("reader").PzGet("/syslog").StatusCode)
+}
+
+func (suite *LoggerTester) Test21Tenants() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	suite.kit.Service.setAuthorizer(&stubAuthorizer{keys: map[string]*APIKey{
+		"acme":   {Name: "acme", Tenant: "acme", Applications: []string{"*"}, Read: true, Query: true, Admin: true},
+		"globex": {Name: "globex", Tenant: "globex", Applications: []string{"*"}, Read: true},
+		"ops":    {Name: "ops", Read: true, Query: true, Admin: true},
+	}})
+	defer suite.kit.Service.setAuthorizer(nil)
+	suite.kit.Service.tenants.setQuotas(map[string]*TenantQuota{"globex": {MessagesPerDay: 2}})
+
+	as := func(apiKey string) *piazza.Http {
+		return &piazza.Http{BaseUrl: suite.kit.Url, ApiKey: apiKey}
+	}
+	post := func(apiKey string, text string) int {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = pzsyslog.Informational
+		m.HostName = "localhost"
+		m.Application = "pz-logger/unittest"
+		m.Process = "1"
+		m.Message = text
+		return as(apiKey).PzPost("/syslog", m).StatusCode
+	}
+	count := func(apiKey string, path string) int {
+		resp := as(apiKey).PzGet(path)
+		if !assert.False(resp.IsError(), resp.Message) {
+			return -1
+		}
+		return resp.Pagination.Count
+	}
+
+	assert.Equal(http.StatusOK, post("acme", "one"))
+	assert.Equal(http.StatusOK, post("globex", "two"))
+	assert.Equal(http.StatusOK, post("globex", "three"))
+	assert.Equal(http.StatusTooManyRequests, post("globex", "four"))
+
+	// each tenant sees only its own, whatever it asks for
+	assert.Equal(1, count("acme", "/syslog"))
+	assert.Equal(1, count("acme", "/syslog?tenant=globex"))
+	assert.Equal(0, count("acme", "/syslog?q=tenant:globex"))
+	assert.Equal(2, count("globex", "/syslog"))
+
+	resp := as("acme").PzPost("/query", map[string]interface{}{"query": map[string]interface{}{"match_all": map[string]interface{}{}}})
+	if assert.False(resp.IsError(), resp.Message) {
+		assert.Equal(1, resp.Pagination.Count)
+	}
+
+	// those without a tenant see everything, and can pick one
+	assert.Equal(3, count("ops", "/syslog"))
+	assert.Equal(2, count("ops", "/syslog?tenant=globex"))
+
+	// the audit trail and the admin routes are for everyone's messages
+	assert.Equal(http.StatusForbidden, as("acme").PzGet("/audit").StatusCode)
+	assert.Equal(http.StatusForbidden, as("acme").PzGet("/admin/stats").StatusCode)
+
+	resp = as("ops").PzGet("/admin/stats")
+	if assert.False(resp.IsError(), resp.Message) {
+		stats := &Stats{}
+		assert.NoError(resp.ExtractData(stats))
+		assert.Equal(&TenantStats{NumMessages: 1, NumToday: 1}, stats.Tenants["acme"])
+		assert.Equal(&TenantStats{NumMessages: 2, NumToday: 2, NumOverQuota: 1,
+			Quota: &TenantQuota{MessagesPerDay: 2}}, stats.Tenants["globex"])
+	}
+}
+
+func (suite *LoggerTester) Test22Alerts() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	suite.kit.Service.setAuthorizer(&stubAuthorizer{keys: map[string]*APIKey{
+		"acme":   {Name: "acme", Tenant: "acme", Applications: []string{"*"}, Read: true, Alerts: true},
+		"ops":    {Name: "ops", Applications: []string{"*"}, Read: true, Alerts: true},
+		"reader": {Name: "reader", Read: true},
+	}})
+	defer suite.kit.Service.setAuthorizer(nil)
+
+	as := func(apiKey string) *piazza.Http {
+		return &piazza.Http{BaseUrl: suite.kit.Url, ApiKey: apiKey}
+	}
+	post := func(apiKey string, application string, severity pzsyslog.Severity) {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = severity
+		m.HostName = "localhost"
+		m.Application = application
+		m.Process = "1"
+		m.Message = "alerting"
+		resp := as(apiKey).PzPost("/syslog", m)
+		assert.False(resp.IsError(), resp.Message)
+	}
+	newRule := func(apiKey string, name string, query string) *AlertRule {
+		resp := as(apiKey).PzPost("/alerts/rules", &AlertRule{Name: name, Query: query})
+		if !assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message) {
+			return nil
+		}
+		rule := &AlertRule{}
+		assert.NoError(resp.ExtractData(rule))
+		return rule
+	}
+	events := func(apiKey string, path string) []AlertEvent {
+		suite.kit.AlertEngine.flushEvents()
+		resp := as(apiKey).PzGet(path)
+		if !assert.False(resp.IsError(), resp.Message) {
+			return nil
+		}
+		events := []AlertEvent{}
+		assert.NoError(resp.ExtractData(&events))
+		return events
+	}
+
+	jobs := newRule("ops", "jobs", "severity<=2 AND application:pz-jobmanager")
+	mine := newRule("acme", "mine", "severity<=3")
+	if jobs == nil || mine == nil {
+		return
+	}
+	assert.Equal("acme", mine.Tenant)
+
+	assert.Equal(http.StatusBadRequest, as("ops").PzPost("/alerts/rules", &AlertRule{Name: "bad", Query: "severity<="}).StatusCode)
+	assert.Equal(http.StatusForbidden, as("reader").PzPost("/alerts/rules", &AlertRule{Name: "x", Query: "x"}).StatusCode)
+
+	// each tenant sees only its own rules
+	resp := as("acme").PzGet("/alerts/rules")
+	if assert.False(resp.IsError(), resp.Message) {
+		rules := []AlertRule{}
+		assert.NoError(resp.ExtractData(&rules))
+		assert.Equal([]AlertRule{*mine}, rules)
+	}
+	assert.Equal(http.StatusNotFound, as("acme").PzGet("/alerts/rules/"+jobs.ID).StatusCode)
+	assert.Equal(http.StatusNotFound, as("acme").PzDelete("/alerts/rules/"+jobs.ID).StatusCode)
+	assert.Equal(http.StatusOK, as("reader").PzGet("/alerts/rules/"+jobs.ID).StatusCode)
+
+	post("ops", "pz-jobmanager", pzsyslog.Fatal)
+	post("ops", "pz-jobmanager", pzsyslog.Informational)
+	post("acme", "pz-jobmanager", pzsyslog.Error)
+
+	all := events("reader", "/alerts/events")
+	assert.Len(all, 2)
+	acme := events("acme", "/alerts/events")
+	if assert.Len(acme, 1) {
+		assert.Equal(mine.ID, acme[0].RuleID)
+		assert.Equal("mine", acme[0].RuleName)
+		assert.Equal(pzsyslog.Error, acme[0].Message.Severity)
+	}
+	assert.Len(events("reader", "/alerts/events?rule="+jobs.ID), 1)
+
+	// disabled, then deleted
+	jobs.Disabled = true
+	resp = as("ops").PzPut("/alerts/rules/"+jobs.ID, jobs)
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	post("ops", "pz-jobmanager", pzsyslog.Fatal)
+	assert.Len(events("reader", "/alerts/events?rule="+jobs.ID), 1)
+
+	assert.Equal(http.StatusOK, as("ops").PzDelete("/alerts/rules/"+jobs.ID).StatusCode)
+	assert.Equal(http.StatusNotFound, as("ops").PzGet("/alerts/rules/"+jobs.ID).StatusCode)
+	assert.Len(events("reader", "/alerts/events"), 2)
+}
+
+func (suite *LoggerTester) Test23Notifications() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	webhook := newWebhookStandIn()
+	defer webhook.Close()
+
+	suite.kit.Service.setAuthorizer(&stubAuthorizer{keys: map[string]*APIKey{
+		"acme":   {Name: "acme", Tenant: "acme", Applications: []string{"*"}, Read: true, Alerts: true},
+		"ops":    {Name: "ops", Applications: []string{"*"}, Read: true, Alerts: true},
+		"reader": {Name: "reader", Read: true},
+	}})
+	defer suite.kit.Service.setAuthorizer(nil)
+
+	as := func(apiKey string) *piazza.Http {
+		return &piazza.Http{BaseUrl: suite.kit.Url, ApiKey: apiKey}
+	}
+
+	resp := as("ops").PzPost("/alerts/channels", &NotificationChannel{Name: "hook", Type: ChannelWebhook,
+		URL: webhook.URL, Template: `{"text": {{json .RuleName}}}`})
+	if !assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message) {
+		return
+	}
+	channel := &NotificationChannel{}
+	assert.NoError(resp.ExtractData(channel))
+
+	assert.Equal(http.StatusBadRequest, as("ops").PzPost("/alerts/channels",
+		&NotificationChannel{Name: "bad", Type: ChannelWebhook, URL: webhook.URL, Template: "{"}).StatusCode)
+
+	// nor may a tenant's webhook be on a private address
+	assert.Equal(http.StatusBadRequest, as("acme").PzPost("/alerts/channels",
+		&NotificationChannel{Name: "mine", Type: ChannelWebhook, URL: webhook.URL}).StatusCode)
+
+	// webhook urls may be secret
+	assert.Equal(http.StatusForbidden, as("reader").PzGet("/alerts/channels").StatusCode)
+
+	// a tenant can't see the channel, nor use it
+	assert.Equal(http.StatusNotFound, as("acme").PzGet("/alerts/channels/"+channel.ID).StatusCode)
+	assert.Equal(http.StatusBadRequest, as("acme").PzPost("/alerts/rules",
+		&AlertRule{Name: "mine", Query: "severity<=3", Channels: []string{channel.ID}}).StatusCode)
+
+	assert.Equal(http.StatusBadRequest, as("ops").PzPost("/alerts/rules",
+		&AlertRule{Name: "jobs", Query: "severity<=3", Throttle: "often"}).StatusCode)
+	resp = as("ops").PzPost("/alerts/rules",
+		&AlertRule{Name: "jobs", Query: "severity<=3", Channels: []string{channel.ID}, Throttle: "10m"})
+	if !assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message) {
+		return
+	}
+	rule := &AlertRule{}
+	assert.NoError(resp.ExtractData(rule))
+
+	// a channel in use can't be removed
+	assert.Equal(http.StatusBadRequest, as("ops").PzDelete("/alerts/channels/"+channel.ID).StatusCode)
+
+	m := pzsyslog.NewMessage("123456")
+	m.Severity = pzsyslog.Error
+	m.HostName = "localhost"
+	m.Application = "pz-jobmanager"
+	m.Process = "1"
+	m.Message = "failed"
+	resp = as("ops").PzPost("/syslog", m)
+	assert.False(resp.IsError(), resp.Message)
+
+	assert.Equal("jobs", webhook.next(t)["text"])
+
+	var deliveries []NotificationDelivery
+	for i := 0; i < 100 && len(deliveries) == 0; i++ {
+		resp = as("reader").PzGet("/alerts/deliveries?rule=" + rule.ID)
+		if !assert.False(resp.IsError(), resp.Message) {
+			return
+		}
+		assert.NoError(resp.ExtractData(&deliveries))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.Len(deliveries, 1) {
+		assert.Equal(DeliveryDelivered, deliveries[0].Status)
+		assert.Equal(channel.ID, deliveries[0].ChannelID)
+	}
+	assert.Equal(0, as("acme").PzGet("/alerts/deliveries").Pagination.Count)
+}
+
+func (suite *LoggerTester) Test24Rates() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := &piazza.Http{BaseUrl: suite.kit.Url}
+
+	resp := client.PzPost("/alerts/rules", &AlertRule{Name: "gateway errors",
+		Rate: &RateCondition{Type: RateThreshold, Application: "pz-gateway", MaxSeverity: "error", Window: "1m", Above: 2}})
+	if !assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message) {
+		return
+	}
+	rule := &AlertRule{}
+	assert.NoError(resp.ExtractData(rule))
+
+	assert.Equal(http.StatusBadRequest, client.PzPost("/alerts/rules", &AlertRule{Name: "bad",
+		Rate: &RateCondition{Type: RateSpike, Window: "1m"}}).StatusCode)
+
+	for i, severity := range []pzsyslog.Severity{pzsyslog.Error, pzsyslog.Warning, pzsyslog.Error, pzsyslog.Fatal} {
+		m := pzsyslog.NewMessage("123456")
+		m.Severity = severity
+		m.HostName = "localhost"
+		m.Application = "pz-gateway"
+		m.Process = "1"
+		m.Message = fmt.Sprintf("error %d", i)
+		resp = client.PzPost("/syslog", m)
+		assert.False(resp.IsError(), resp.Message)
+	}
+
+	resp = client.PzGet("/syslog/rates?window=5m")
+	if assert.False(resp.IsError(), resp.Message) {
+		rates := []MessageRate{}
+		assert.NoError(resp.ExtractData(&rates))
+		assert.Contains(rates, MessageRate{Application: "pz-gateway", Severity: pzsyslog.Error, Count: 2})
+		assert.Contains(rates, MessageRate{Application: "pz-gateway", Severity: pzsyslog.Warning, Count: 1})
+	}
+	assert.Equal(http.StatusBadRequest, client.PzGet("/syslog/rates?window=1d").StatusCode)
+
+	events, err := suite.kit.AlertEngine.CheckRates(suite.kit.Service.rates)
+	assert.NoError(err)
+	assert.Len(events, 1)
+	suite.kit.AlertEngine.flushEvents()
+
+	resp = client.PzGet("/alerts/events?rule=" + rule.ID)
+	if assert.False(resp.IsError(), resp.Message) {
+		stored := []AlertEvent{}
+		assert.NoError(resp.ExtractData(&stored))
+		if assert.Len(stored, 1) && assert.NotNil(stored[0].Rate) {
+			assert.Equal(3, stored[0].Rate.Count)
+			assert.Equal("3 messages from pz-gateway in 1m0s, more than 2", stored[0].Rate.Reason)
+		}
+	}
 }
@@ -16,9 +16,11 @@ package logger
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,9 +39,46 @@ type Service struct {
 	logWriter   pzsyslog.Writer
 	auditWriter pzsyslog.Writer
 
-	esIndex elasticsearch.IIndex
+	esIndex     elasticsearch.IIndex
+	bulkIndexer bulkIndexer
+	aggregator  aggregator
+
+	// if set, log messages go through here rather than the logWriter
+	spool *Spool
+
+	// subscribers to GET /syslog/stream
+	stream *streamHub
+
+	// if set, audit messages are also appended to the audit trail
+	auditTrail *AuditTrail
+
+	// if set, the indices are rolled and old ones removed
+	retention *RetentionManager
+
+	// for GET /metrics
+	telemetry *Telemetry
+
+	// for GET /health/ready
+	health *healthChecker
+
+	// if set, the HTTP API needs an API key
+	authorizer Authorizer
+
+	// each tenant's counts and quota
+	tenants *tenantTracker
+
+	// the recent rate of messages, for GET /syslog/rates and rate alerts
+	rates *rateTracker
+
+	// if set, accepted messages are matched against the alert rules
+	alerts *AlertEngine
+
+	// if set, tells the alert rules' channels of their matches
+	notifier *Notifier
 
 	pen string
+
+	rfc3164 RFC3164Options
 }
 
 func (service *Service) Init(sys *piazza.SystemConfig, logWriter pzsyslog.Writer, auditWriter pzsyslog.Writer, esi elasticsearch.IIndex, asyncLogging bool, pen string) error {
@@ -51,15 +90,109 @@ func (service *Service) Init(sys *piazza.SystemConfig, logWriter pzsyslog.Writer
 
 	service.esIndex = esi
 
+	service.telemetry = newTelemetry()
+
+	bulkIndexer, err := newBulkIndexer(sys, esi)
+	if err != nil {
+		return err
+	}
+	service.bulkIndexer = service.telemetry.countBulk(bulkIndexer)
+
+	aggregator, err := newAggregator(sys, esi)
+	if err != nil {
+		return err
+	}
+	service.aggregator = service.telemetry.countAggregate(aggregator)
+
 	service.origin = string(sys.Name)
 
 	service.async = asyncLogging
 
 	service.pen = pen
 
+	service.stream = newStreamHub()
+
+	service.tenants = newTenantTracker()
+
+	service.rates = newRateTracker(service.aggregator, pzsyslog.LoggerType)
+
 	return nil
 }
 
+// SetRFC3164Options sets how BSD syslog lines are converted, both by the
+// network listeners and by POST /syslog/text.
+func (service *Service) SetRFC3164Options(opts *RFC3164Options) {
+	service.Lock()
+	service.rfc3164 = *opts
+	service.Unlock()
+}
+
+func (service *Service) getRFC3164Options() RFC3164Options {
+	service.Lock()
+	defer service.Unlock()
+	return service.rfc3164
+}
+
+func (service *Service) setLogWriter(logWriter pzsyslog.Writer) {
+	service.Lock()
+	service.logWriter = logWriter
+	service.Unlock()
+}
+
+func (service *Service) getLogWriter() pzsyslog.Writer {
+	service.Lock()
+	defer service.Unlock()
+	return service.logWriter
+}
+
+func (service *Service) setAuditWriter(auditWriter pzsyslog.Writer) {
+	service.Lock()
+	service.auditWriter = auditWriter
+	service.Unlock()
+}
+
+func (service *Service) getAuditWriter() pzsyslog.Writer {
+	service.Lock()
+	defer service.Unlock()
+	return service.auditWriter
+}
+
+func (service *Service) setSpool(spool *Spool) {
+	service.Lock()
+	service.spool = spool
+	service.Unlock()
+}
+
+func (service *Service) getSpool() *Spool {
+	service.Lock()
+	defer service.Unlock()
+	return service.spool
+}
+
+func (service *Service) setAuditTrail(auditTrail *AuditTrail) {
+	service.Lock()
+	service.auditTrail = auditTrail
+	service.Unlock()
+}
+
+func (service *Service) getAuditTrail() *AuditTrail {
+	service.Lock()
+	defer service.Unlock()
+	return service.auditTrail
+}
+
+func (service *Service) setRetentionManager(retention *RetentionManager) {
+	service.Lock()
+	service.retention = retention
+	service.Unlock()
+}
+
+func (service *Service) getRetentionManager() *RetentionManager {
+	service.Lock()
+	defer service.Unlock()
+	return service.retention
+}
+
 func (service *Service) newInternalErrorResponse(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusInternalServerError,
@@ -68,6 +201,30 @@ func (service *Service) newInternalErrorResponse(err error) *piazza.JsonResponse
 	}
 }
 
+func (service *Service) newServiceUnavailableResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+func (service *Service) newTooManyRequestsResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+func (service *Service) newNotFoundResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusNotFound,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 func (service *Service) newBadRequestResponse(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusBadRequest,
@@ -100,8 +257,20 @@ func (service *Service) GetRoot() *piazza.JsonResponse {
 func (service *Service) GetStats() *piazza.JsonResponse {
 	service.Lock()
 	t := service.stats
+	t.Tenants = service.tenants.snapshot()
+	spool := service.spool
+	logWriter := service.logWriter
 	service.Unlock()
 
+	if spool != nil {
+		spoolStats := spool.Stats()
+		t.Spool = &spoolStats
+	}
+	if bw, ok := logWriter.(*BatchWriter); ok {
+		writerStats := bw.Stats()
+		t.Writer = &writerStats
+	}
+
 	resp := &piazza.JsonResponse{
 		StatusCode: http.StatusOK,
 		Data:       t,
@@ -213,6 +382,24 @@ func createQueryDslAsString(
 		})
 	}
 
+	filters, err := createFilterClauses(params)
+	if err != nil {
+		return "", err
+	}
+	must = append(must, filters...)
+
+	q, err := params.GetAsString("q", "")
+	if err != nil {
+		return "", err
+	}
+	if q != "" {
+		clause, err := ParseQuery(q)
+		if err != nil {
+			return "", err
+		}
+		must = append(must, clause)
+	}
+
 	if !after.IsZero() || !before.IsZero() {
 		rangeParams := map[string]time.Time{}
 
@@ -261,18 +448,46 @@ func createQueryDslAsString(
 	return string(output), nil
 }
 
-func (service *Service) PostSyslog(mNew *pzsyslog.Message) *piazza.JsonResponse {
+// PostSyslog stores a message, as the key's tenant if it has one. A nil
+// key, as when authentication is off, may write anything.
+func (service *Service) PostSyslog(mNew *pzsyslog.Message, key *APIKey) *piazza.JsonResponse {
 	err := mNew.Validate()
 	if err != nil {
+		service.telemetry.messageRejected(mNew)
 		return service.newBadRequestResponse(err)
 	}
 
-	err = service.postSyslog(mNew)
+	if !key.mayWrite(mNew.Application) {
+		service.telemetry.messageRejected(mNew)
+		return service.newForbiddenResponse(errNotAllowedToWrite(mNew.Application))
+	}
+
+	tenant := key.tenant()
+	if err = service.tenants.take(tenant); err != nil {
+		service.telemetry.messageRejected(mNew)
+		return service.newTooManyRequestsResponse(err)
+	}
+
+	err = service.postSyslog(&storedMessage{Message: mNew, Tenant: tenant})
+	if err != nil {
+		service.tenants.giveBack(tenant)
+		service.telemetry.messageRejected(mNew)
+	}
+	if err == ErrSpoolFull {
+		return service.newServiceUnavailableResponse(err)
+	}
+	if err == ErrQueueFull {
+		return service.newTooManyRequestsResponse(err)
+	}
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
 
 	service.incrementStats(mNew.Application)
+	service.tenants.accepted(tenant)
+	service.telemetry.messageAccepted(mNew)
+	service.stream.publish(mNew, tenant)
+	service.matchAlerts(mNew, tenant)
 
 	resp := &piazza.JsonResponse{
 		StatusCode: http.StatusOK,
@@ -280,52 +495,306 @@ func (service *Service) PostSyslog(mNew *pzsyslog.Message) *piazza.JsonResponse
 	return resp
 }
 
-func (service *Service) postSyslog(mssg *pzsyslog.Message) error {
+// PostSyslogBulk accepts a JSON array or newline-delimited JSON list of
+// messages. Each message is validated on its own and the valid ones are
+// stored with a single bulk request; the response says which were rejected.
+// Messages from applications the key may not write as, or past the quota
+// of its tenant, are rejected too.
+func (service *Service) PostSyslogBulk(body []byte, key *APIKey) *piazza.JsonResponse {
+	raws, err := splitBulkBody(body)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if len(raws) > MaxBulkMessages {
+		return service.newBadRequestResponse(
+			fmt.Errorf("too many messages in bulk request: %d (max is %d)", len(raws), MaxBulkMessages))
+	}
+
+	result := &BulkResult{Items: make([]BulkItemResult, len(raws))}
+	mssgs := make([]*pzsyslog.Message, len(raws))
+
+	for i, raw := range raws {
+		mssg := pzsyslog.NewMessage(service.pen)
+		if err = json.Unmarshal(raw, mssg); err != nil {
+			result.reject(i, err)
+			continue
+		}
+		mssgs[i] = mssg
+	}
+
+	return service.postSyslogBulk(result, mssgs, key)
+}
+
+// PostSyslogText accepts one syslog message per line, each in either
+// RFC 5424 or RFC 3164 form. It otherwise behaves like PostSyslogBulk.
+// remoteHost is used for RFC 3164 lines that have no HOSTNAME, unless the
+// RFC3164Options say otherwise.
+func (service *Service) PostSyslogText(body []byte, receiveTime time.Time, remoteHost string, key *APIKey) *piazza.JsonResponse {
+	lines := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return service.newBadRequestResponse(errors.New("request body is empty"))
+	}
+	if len(lines) > MaxBulkMessages {
+		return service.newBadRequestResponse(
+			fmt.Errorf("too many messages in request: %d (max is %d)", len(lines), MaxBulkMessages))
+	}
+
+	opts := service.getRFC3164Options()
+	if opts.HostName == "" {
+		opts.HostName = remoteHost
+	}
+
+	result := &BulkResult{Items: make([]BulkItemResult, len(lines))}
+	mssgs := make([]*pzsyslog.Message, len(lines))
+
+	for i, line := range lines {
+		mssg, err := ParseSyslogString(line, receiveTime, &opts)
+		if err != nil {
+			result.reject(i, err)
+			continue
+		}
+		mssgs[i] = mssg
+	}
+
+	return service.postSyslogBulk(result, mssgs, key)
+}
+
+// postSyslogBulk validates and stores the non-nil messages the key may
+// write, recording the outcome of each in result. A nil entry has already
+// been rejected.
+func (service *Service) postSyslogBulk(result *BulkResult, mssgs []*pzsyslog.Message, key *APIKey) *piazza.JsonResponse {
 	var err error
-	isAudit := mssg.AuditData != nil
 
-	if service.logWriter != nil {
-		err = service.logWriter.Write(mssg, service.async)
+	tenant := key.tenant()
+	valid := []*pzsyslog.Message{}
+	indexes := []int{}
+	for i, mssg := range mssgs {
+		if mssg == nil {
+			continue
+		}
+		if err = mssg.Validate(); err != nil {
+			result.reject(i, err)
+			continue
+		}
+		if !key.mayWrite(mssg.Application) {
+			result.reject(i, errNotAllowedToWrite(mssg.Application))
+			continue
+		}
+		if err = service.tenants.take(tenant); err != nil {
+			result.reject(i, err)
+			continue
+		}
+		valid = append(valid, mssg)
+		indexes = append(indexes, i)
+	}
+
+	if len(valid) > 0 {
+		errs, err := service.storeBulk(valid, tenant)
 		if err != nil {
-			return fmt.Errorf("syslog.Service.postSyslog: %s", err.Error())
+			for range valid {
+				service.tenants.giveBack(tenant)
+			}
+			for _, mssg := range mssgs {
+				service.telemetry.messageRejected(mssg)
+			}
+			return service.newInternalErrorResponse(
+				fmt.Errorf("syslog.Service.postSyslogBulk: %s", err.Error()))
 		}
+
+		for i, mssg := range valid {
+			if errs[i] != nil {
+				service.tenants.giveBack(tenant)
+				result.reject(indexes[i], errs[i])
+				continue
+			}
+			if err = service.writeAudit(mssg, tenant); err != nil {
+				result.reject(indexes[i], fmt.Errorf("syslog.Service.postSyslogBulk (audit): %s", err.Error()))
+				continue
+			}
+			result.accept(indexes[i])
+			service.incrementStats(mssg.Application)
+			service.tenants.accepted(tenant)
+			service.stream.publish(mssg, tenant)
+			service.matchAlerts(mssg, tenant)
+		}
+	}
+
+	for i, item := range result.Items {
+		if item.Accepted {
+			service.telemetry.messageAccepted(mssgs[i])
+		} else {
+			service.telemetry.messageRejected(mssgs[i])
+		}
+	}
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       result,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
 	}
 
-	if isAudit && service.auditWriter != nil {
-		err = service.auditWriter.Write(mssg, service.async)
+	return resp
+}
+
+// storeBulk stores the messages, as the tenant's, in a single bulk request
+// or, if there is a spool, appends them to it one by one. The returns are
+// as for bulkIndexer.Bulk.
+func (service *Service) storeBulk(mssgs []*pzsyslog.Message, tenant string) ([]error, error) {
+	if spool := service.getSpool(); spool != nil {
+		errs := make([]error, len(mssgs))
+		for i, mssg := range mssgs {
+			errs[i] = spool.Append(&storedMessage{Message: mssg, Tenant: tenant})
+		}
+		return errs, nil
+	}
+
+	docs := make([]interface{}, len(mssgs))
+	for i, mssg := range mssgs {
+		docs[i] = &storedMessage{Message: mssg, Tenant: tenant}
+	}
+	return service.bulkIndexer.Bulk(pzsyslog.LoggerType, docs)
+}
+
+func (service *Service) postSyslog(doc *storedMessage) error {
+	var err error
+
+	if spool := service.getSpool(); spool != nil {
+		err = spool.Append(doc)
+		if err == ErrSpoolFull {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("syslog.Service.postSyslog (spool): %s", err.Error())
+		}
+	} else if logWriter := service.getLogWriter(); logWriter != nil {
+		err = service.writeLog(logWriter, doc)
+		if err == ErrQueueFull {
+			return err
+		}
 		if err != nil {
-			return fmt.Errorf("syslog.Service.postSyslog (audit): %s", err.Error())
+			return fmt.Errorf("syslog.Service.postSyslog: %s", err.Error())
 		}
 	}
 
+	if err = service.writeAudit(doc.Message, doc.Tenant); err != nil {
+		return fmt.Errorf("syslog.Service.postSyslog (audit): %s", err.Error())
+	}
+
 	return nil
 }
 
-func (service *Service) getMessageCommon(params *piazza.HttpQueryParams) (*elasticsearch.SearchResult, *piazza.JsonPagination, *piazza.JsonResponse) {
+// writeLog writes a message to the log writer. A tenant's message goes in
+// a bulk request, queued if the writer is a BatchWriter that makes them,
+// since the vendored writers have nowhere to put the tenant.
+func (service *Service) writeLog(logWriter pzsyslog.Writer, doc *storedMessage) error {
+	if doc.Tenant == "" {
+		return logWriter.Write(doc.Message, service.async)
+	}
+	if bw, ok := logWriter.(*BatchWriter); ok && bw.indexer != nil {
+		return bw.writeDoc(doc, service.async)
+	}
+	errs, err := service.bulkIndexer.Bulk(pzsyslog.LoggerType, []interface{}{doc})
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// writeAudit appends an audit message, as the tenant's, to the audit trail
+// and writes it to the audit writer, if there are such things. Other
+// messages are ignored.
+func (service *Service) writeAudit(mssg *pzsyslog.Message, tenant string) error {
+	if mssg.AuditData == nil {
+		return nil
+	}
+
+	if auditTrail := service.getAuditTrail(); auditTrail != nil {
+		if _, err := auditTrail.Append(mssg, tenant); err != nil {
+			return err
+		}
+	}
+
+	if auditWriter := service.getAuditWriter(); auditWriter != nil {
+		return auditWriter.Write(mssg, service.async)
+	}
+
+	return nil
+}
+
+// closeStreams ends every GET /syslog/stream, which would otherwise keep
+// the server from stopping, and refuses new ones.
+func (service *Service) closeStreams() {
+	service.stream.close()
+}
+
+// getMessageCommon runs the search for GET /syslog. The search is always
+// sorted with the cursor tiebreaker, so that the returned cursor, if any,
+// picks up exactly where this page leaves off.
+func (service *Service) getMessageCommon(params *piazza.HttpQueryParams) (*elasticsearch.SearchResult, *piazza.JsonPagination, string, *piazza.JsonResponse) {
 	pagination, err := piazza.NewJsonPagination(params)
 	if err != nil {
-		return nil, nil, service.newBadRequestResponse(err)
+		return nil, nil, "", service.newBadRequestResponse(err)
 	}
 
 	paginationCreatedOnToTimeStamp(pagination)
 
+	cursor, err := params.GetAsString("cursor", "")
+	if err != nil {
+		return nil, pagination, "", service.newBadRequestResponse(err)
+	}
+
 	dsl, err := createQueryDslAsString(pagination, params)
 	if err != nil {
-		return nil, pagination, service.newBadRequestResponse(err)
+		return nil, pagination, "", service.newBadRequestResponse(err)
+	}
+	if dsl == "" {
+		dsl, err = createMatchAllDslAsString(pagination)
+		if err != nil {
+			return nil, pagination, "", service.newInternalErrorResponse(err)
+		}
 	}
 
-	var searchResult *elasticsearch.SearchResult
+	dsl, err = applyCursor(dsl, cursor)
+	if err != nil {
+		return nil, pagination, "", service.newBadRequestResponse(err)
+	}
 
-	if dsl == "" {
-		searchResult, err = service.esIndex.FilterByMatchAll(pzsyslog.LoggerType, pagination)
-	} else {
-		searchResult, err = service.esIndex.SearchByJSON(pzsyslog.LoggerType, dsl)
+	searchResult, nextCursor, err := service.searchPage(pzsyslog.LoggerType, dsl)
+	if err != nil {
+		return nil, pagination, "", service.newInternalErrorResponse(err)
+	}
+
+	return searchResult, pagination, nextCursor, nil
+}
+
+func createMatchAllDslAsString(pagination *piazza.JsonPagination) (string, error) {
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"size": pagination.PerPage,
+		"from": pagination.PerPage * pagination.Page,
+		"sort": map[string]string{
+			pagination.SortBy: string(pagination.Order),
+		},
 	}
+
+	output, err := json.Marshal(dsl)
 	if err != nil {
-		return nil, pagination, service.newInternalErrorResponse(err)
+		return "", err
 	}
 
-	return searchResult, pagination, nil
+	return string(output), nil
 }
 
 func (service *Service) GetSyslog(params *piazza.HttpQueryParams) *piazza.JsonResponse {
@@ -336,7 +805,7 @@ func (service *Service) GetSyslog(params *piazza.HttpQueryParams) *piazza.JsonRe
 		return service.newInternalErrorResponse(err)
 	}
 
-	searchResult, pagination, jErr := service.getMessageCommon(params)
+	searchResult, pagination, nextCursor, jErr := service.getMessageCommon(params)
 	if jErr != nil {
 		return jErr
 	}
@@ -362,6 +831,9 @@ func (service *Service) GetSyslog(params *piazza.HttpQueryParams) *piazza.JsonRe
 		Data:       data,
 		Pagination: pagination,
 	}
+	if nextCursor != "" {
+		resp.Metadata = &CursorMetadata{NextCursor: nextCursor}
+	}
 
 	err = resp.SetType()
 	if err != nil {
@@ -405,18 +877,31 @@ func extractFromSearchResult(searchResult *elasticsearch.SearchResult) ([]pzsysl
 	return lines, nil
 }
 
-func (service *Service) PostQuery(params *piazza.HttpQueryParams, jsnQuery string) *piazza.JsonResponse {
+// PostQuery runs a search given in the Elasticsearch DSL. If tenant is
+// set, only that tenant's messages are searched.
+func (service *Service) PostQuery(params *piazza.HttpQueryParams, jsnQuery string, tenant string) *piazza.JsonResponse {
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
 		return service.newBadRequestResponse(err)
 	}
 	paginationCreatedOnToTimeStamp(format)
 
+	cursor, err := params.GetAsString("cursor", "")
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	if jsnQuery, err = restrictQueryToTenant(jsnQuery, tenant); err != nil {
+		return service.newBadRequestResponse(err)
+	}
 	if jsnQuery, err = format.SyncPagination(jsnQuery); err != nil {
 		return service.newBadRequestResponse(err)
 	}
+	if jsnQuery, err = applyCursor(jsnQuery, cursor); err != nil {
+		return service.newBadRequestResponse(err)
+	}
 
-	searchResult, err := service.esIndex.SearchByJSON(pzsyslog.LoggerType, jsnQuery)
+	searchResult, nextCursor, err := service.searchPage(pzsyslog.LoggerType, jsnQuery)
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
@@ -432,6 +917,9 @@ func (service *Service) PostQuery(params *piazza.HttpQueryParams, jsnQuery strin
 		Data:       lines,
 		Pagination: format,
 	}
+	if nextCursor != "" {
+		resp.Metadata = &CursorMetadata{NextCursor: nextCursor}
+	}
 
 	err = resp.SetType()
 	if err != nil {
@@ -0,0 +1,706 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSpoolFull is returned by Spool.Append when the spool has reached its
+// maximum size.
+var ErrSpoolFull = errors.New("spool is full")
+
+// errSpoolRetryStopped leaves a batch, part of which is not stored yet, to
+// be sent again after a restart.
+var errSpoolRetryStopped = errors.New("spool closed while retrying")
+
+// SpoolSyncPolicy says when the spool calls fsync on the segment being
+// written.
+type SpoolSyncPolicy string
+
+const (
+	// SpoolSyncAlways syncs after every message. This is the only policy
+	// under which an accepted message is sure to survive a machine crash.
+	SpoolSyncAlways SpoolSyncPolicy = "always"
+
+	// SpoolSyncInterval syncs every SyncInterval.
+	SpoolSyncInterval SpoolSyncPolicy = "interval"
+
+	// SpoolSyncNever leaves it up to the OS. Messages still survive a
+	// crash of pz-logger itself.
+	SpoolSyncNever SpoolSyncPolicy = "never"
+)
+
+const (
+	spoolSegmentSuffix = ".seg"
+	spoolCursorName    = "cursor"
+)
+
+// SpoolConfig configures a Spool. Only Dir is required.
+type SpoolConfig struct {
+	Dir          string
+	SegmentSize  int64 // bytes; a new segment file is started after this
+	MaxSize      int64 // bytes; total across all segments
+	SyncPolicy   SpoolSyncPolicy
+	SyncInterval time.Duration
+	BatchSize    int // max messages per bulk request when draining
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+func (config *SpoolConfig) setDefaults() {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = 16 * 1024 * 1024
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1024 * 1024 * 1024
+	}
+	if config.SyncPolicy == "" {
+		config.SyncPolicy = SpoolSyncAlways
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = 30 * time.Second
+	}
+}
+
+// SpoolStats is reported in /admin/stats.
+type SpoolStats struct {
+	Depth            int     `json:"depth"`
+	Bytes            int64   `json:"bytes"`
+	Segments         int     `json:"segments"`
+	OldestAgeSeconds float64 `json:"oldestAgeSeconds"`
+	NumDrained       int     `json:"numDrained"`
+	NumDropped       int     `json:"numDropped"`
+	NumRetries       int     `json:"numRetries"`
+}
+
+// spoolRecord is one line of a segment file.
+type spoolRecord struct {
+	Time    int64           `json:"t"` // when it was appended, in Unix nanoseconds
+	Message json.RawMessage `json:"m"`
+}
+
+type spoolCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Spool is a durable, append-only queue of messages on local disk. Messages
+// are appended to numbered segment files, one JSON record per line, and a
+// background goroutine drains them to Elasticsearch in bulk, retrying with
+// backoff for as long as Elasticsearch is unavailable. The drain position
+// is kept in a cursor file, so anything not yet drained is replayed when
+// the spool is reopened. Delivery is at-least-once.
+//
+// Messages that Elasticsearch rejects individually (as opposed to failures
+// of the whole request) are logged and dropped, since retrying them would
+// block the queue forever.
+type Spool struct {
+	sync.Mutex
+
+	config  SpoolConfig
+	indexer bulkIndexer
+	typ     string
+
+	// write side
+	writeSeg    int64
+	writeFile   *os.File
+	writeOffset int64
+	dirty       bool
+
+	// read side; only the drain goroutine moves these
+	cursor spoolCursor
+
+	segSizes map[int64]int64
+	depth    int
+	headTime int64
+	stats    SpoolStats
+
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSpool(config *SpoolConfig, indexer bulkIndexer, typ string) (*Spool, error) {
+	if config == nil || config.Dir == "" {
+		return nil, errors.New("spool directory not set")
+	}
+	if indexer == nil {
+		return nil, errors.New("spool indexer not set")
+	}
+	switch config.SyncPolicy {
+	case "", SpoolSyncAlways, SpoolSyncInterval, SpoolSyncNever:
+	default:
+		return nil, fmt.Errorf("unknown spool sync policy: %s", config.SyncPolicy)
+	}
+
+	spool := &Spool{
+		config:   *config,
+		indexer:  indexer,
+		typ:      typ,
+		segSizes: map[int64]int64{},
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	spool.config.setDefaults()
+
+	if err := os.MkdirAll(spool.config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := spool.open(); err != nil {
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+// open finds the existing segments and cursor, repairs a torn write at the
+// end of the last segment, and counts what is left to drain.
+func (spool *Spool) open() error {
+	segs, err := spool.listSegments()
+	if err != nil {
+		return err
+	}
+
+	if err = spool.readCursor(); err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		if seg < spool.cursor.Segment {
+			// fully drained, but we died before deleting it
+			if err = os.Remove(spool.segmentPath(seg)); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := os.Stat(spool.segmentPath(seg))
+		if err != nil {
+			return err
+		}
+		spool.segSizes[seg] = info.Size()
+	}
+
+	spool.writeSeg = spool.cursor.Segment
+	if len(segs) > 0 && segs[len(segs)-1] > spool.writeSeg {
+		spool.writeSeg = segs[len(segs)-1]
+	}
+
+	if err = spool.openWriteSegment(); err != nil {
+		return err
+	}
+
+	if spool.cursor.Offset > spool.segSizes[spool.cursor.Segment] {
+		spool.cursor.Offset = spool.segSizes[spool.cursor.Segment]
+	}
+
+	return spool.countDepth()
+}
+
+func (spool *Spool) listSegments() ([]int64, error) {
+	infos, err := ioutil.ReadDir(spool.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segs := []int64{}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+func (spool *Spool) segmentPath(seg int64) string {
+	return filepath.Join(spool.config.Dir, fmt.Sprintf("%016d%s", seg, spoolSegmentSuffix))
+}
+
+func (spool *Spool) readCursor() error {
+	byts, err := ioutil.ReadFile(filepath.Join(spool.config.Dir, spoolCursorName))
+	if os.IsNotExist(err) {
+		spool.cursor = spoolCursor{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, &spool.cursor)
+}
+
+func (spool *Spool) writeCursor(cursor spoolCursor) error {
+	byts, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(spool.config.Dir, spoolCursorName)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(byts); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if spool.config.SyncPolicy == SpoolSyncAlways {
+		if err = file.Sync(); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openWriteSegment opens the current write segment for appending, cutting
+// off any partial record left by a crash in the middle of a write.
+func (spool *Spool) openWriteSegment() error {
+	path := spool.segmentPath(spool.writeSeg)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	byts, err := ioutil.ReadAll(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	size := int64(bytes.LastIndexByte(byts, '\n') + 1)
+	if size != int64(len(byts)) {
+		log.Printf("spool: truncating partial record at end of %s", path)
+		if err = file.Truncate(size); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if _, err = file.Seek(size, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	spool.writeFile = file
+	spool.writeOffset = size
+	spool.segSizes[spool.writeSeg] = size
+	return nil
+}
+
+func (spool *Spool) countDepth() error {
+	depth := 0
+	for seg := range spool.segSizes {
+		if seg < spool.cursor.Segment {
+			continue
+		}
+		byts, err := ioutil.ReadFile(spool.segmentPath(seg))
+		if err != nil {
+			return err
+		}
+		if seg == spool.cursor.Segment {
+			byts = byts[spool.cursor.Offset:]
+		}
+		depth += bytes.Count(byts, []byte{'\n'})
+	}
+	spool.depth = depth
+	return nil
+}
+
+//---------------------------------------------------------------------------
+
+// Start begins draining the spool, starting with anything left over from
+// a previous run.
+func (spool *Spool) Start() {
+	spool.wg.Add(1)
+	go spool.drainLoop()
+
+	if spool.config.SyncPolicy == SpoolSyncInterval {
+		spool.wg.Add(1)
+		go spool.syncLoop()
+	}
+
+	spool.signal()
+}
+
+// Close stops draining and closes the spool. Anything not yet drained
+// stays on disk for next time.
+func (spool *Spool) Close() error {
+	close(spool.quit)
+	spool.wg.Wait()
+
+	spool.Lock()
+	defer spool.Unlock()
+
+	if spool.writeFile == nil {
+		return nil
+	}
+	err := spool.writeFile.Sync()
+	if e := spool.writeFile.Close(); err == nil {
+		err = e
+	}
+	spool.writeFile = nil
+	return err
+}
+
+func (spool *Spool) signal() {
+	select {
+	case spool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Append adds a message, a *pzsyslog.Message or anything else that is
+// stored as one, to the spool. When it returns nil the message is on disk,
+// and synced if the policy says so.
+func (spool *Spool) Append(mssg interface{}) error {
+	raw, err := json.Marshal(mssg)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	line, err := json.Marshal(&spoolRecord{Time: now, Message: raw})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	spool.Lock()
+	defer spool.Unlock()
+
+	if spool.writeFile == nil {
+		return errors.New("spool is closed")
+	}
+	if spool.totalBytes()+int64(len(line)) > spool.config.MaxSize {
+		return ErrSpoolFull
+	}
+
+	if spool.writeOffset > 0 && spool.writeOffset+int64(len(line)) > spool.config.SegmentSize {
+		if err = spool.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = spool.writeFile.Write(line); err != nil {
+		return err
+	}
+	if spool.config.SyncPolicy == SpoolSyncAlways {
+		if err = spool.writeFile.Sync(); err != nil {
+			return err
+		}
+	} else {
+		spool.dirty = true
+	}
+
+	spool.writeOffset += int64(len(line))
+	spool.segSizes[spool.writeSeg] = spool.writeOffset
+	if spool.depth == 0 {
+		spool.headTime = now
+	}
+	spool.depth++
+
+	spool.signal()
+	return nil
+}
+
+// rollSegment is called with the lock held.
+func (spool *Spool) rollSegment() error {
+	if err := spool.writeFile.Sync(); err != nil {
+		return err
+	}
+	if err := spool.writeFile.Close(); err != nil {
+		return err
+	}
+	spool.writeSeg++
+	return spool.openWriteSegment()
+}
+
+// totalBytes is called with the lock held.
+func (spool *Spool) totalBytes() int64 {
+	total := int64(0)
+	for _, size := range spool.segSizes {
+		total += size
+	}
+	return total
+}
+
+// Stats returns the current queue depth, size, and the age of the oldest
+// message not yet drained.
+func (spool *Spool) Stats() SpoolStats {
+	spool.Lock()
+	defer spool.Unlock()
+
+	stats := spool.stats
+	stats.Depth = spool.depth
+	stats.Bytes = spool.totalBytes()
+	stats.Segments = len(spool.segSizes)
+	if spool.depth > 0 && spool.headTime > 0 {
+		stats.OldestAgeSeconds = time.Since(time.Unix(0, spool.headTime)).Seconds()
+	}
+	return stats
+}
+
+func (spool *Spool) syncLoop() {
+	defer spool.wg.Done()
+
+	ticker := time.NewTicker(spool.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-spool.quit:
+			return
+		case <-ticker.C:
+			spool.Lock()
+			if spool.dirty && spool.writeFile != nil {
+				if err := spool.writeFile.Sync(); err != nil {
+					log.Printf("spool: sync failed: %s", err.Error())
+				} else {
+					spool.dirty = false
+				}
+			}
+			spool.Unlock()
+		}
+	}
+}
+
+//---------------------------------------------------------------------------
+
+func (spool *Spool) drainLoop() {
+	defer spool.wg.Done()
+
+	backoff := spool.config.MinBackoff
+
+	for {
+		records, next, err := spool.readBatch()
+		if err != nil {
+			log.Printf("spool: unable to read: %s", err.Error())
+		}
+
+		if len(records) == 0 && err == nil {
+			if next != spool.cursor {
+				// nothing left in this segment, and the writer has moved on
+				spool.advance(next, 0)
+				continue
+			}
+			select {
+			case <-spool.quit:
+				return
+			case <-spool.wake:
+			}
+			continue
+		}
+
+		if err == nil {
+			spool.Lock()
+			spool.headTime = records[0].Time
+			spool.Unlock()
+			err = spool.deliver(records)
+		}
+
+		if err != nil {
+			spool.Lock()
+			spool.stats.NumRetries++
+			spool.Unlock()
+
+			select {
+			case <-spool.quit:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > spool.config.MaxBackoff {
+				backoff = spool.config.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = spool.config.MinBackoff
+		spool.advance(next, len(records))
+	}
+}
+
+// readBatch reads up to BatchSize records starting at the cursor, without
+// going past what the writer has finished writing. It returns the records
+// and the cursor position just after them.
+func (spool *Spool) readBatch() ([]*spoolRecord, spoolCursor, error) {
+	cursor := spool.cursor
+
+	spool.Lock()
+	writeSeg := spool.writeSeg
+	end := spool.segSizes[cursor.Segment]
+	spool.Unlock()
+
+	if cursor.Offset >= end {
+		if cursor.Segment < writeSeg {
+			return nil, spoolCursor{Segment: cursor.Segment + 1}, nil
+		}
+		return nil, cursor, nil
+	}
+
+	file, err := os.Open(spool.segmentPath(cursor.Segment))
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// read only as far as the batch goes, not the whole rest of the segment
+	reader := bufio.NewReader(io.NewSectionReader(file, cursor.Offset, end-cursor.Offset))
+
+	records := []*spoolRecord{}
+	next := cursor
+	for len(records) < spool.config.BatchSize {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, cursor, err
+		}
+		next.Offset += int64(len(line))
+
+		record := &spoolRecord{}
+		if err = json.Unmarshal(line[:len(line)-1], record); err != nil {
+			log.Printf("spool: skipping unreadable record in segment %d: %s", cursor.Segment, err.Error())
+			spool.Lock()
+			spool.depth--
+			spool.stats.NumDropped++
+			spool.Unlock()
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, next, nil
+}
+
+// deliver sends a batch to Elasticsearch. Documents that Elasticsearch
+// turns away for now, as when it is too busy, are sent again with backoff
+// until they are stored, so that the cursor never moves past them; only
+// those it will never take are dropped. An error means the whole batch
+// should be retried.
+func (spool *Spool) deliver(records []*spoolRecord) error {
+	pending := records
+	backoff := spool.config.MinBackoff
+
+	for {
+		docs := make([]interface{}, len(pending))
+		for i, record := range pending {
+			docs[i] = record.Message
+		}
+
+		errs, err := spool.indexer.Bulk(spool.typ, docs)
+		if err != nil {
+			log.Printf("spool: unable to drain %d messages, will retry: %s", len(docs), err.Error())
+			return err
+		}
+
+		retry := []*spoolRecord{}
+		dropped := 0
+		for i, e := range errs {
+			switch {
+			case e == nil:
+			case isTemporaryBulkError(e):
+				retry = append(retry, pending[i])
+			default:
+				log.Printf("spool: dropping message rejected by Elasticsearch [%s]: %s", string(pending[i].Message), e.Error())
+				dropped++
+			}
+		}
+
+		spool.Lock()
+		spool.stats.NumDrained += len(pending) - len(retry) - dropped
+		spool.stats.NumDropped += dropped
+		if len(retry) > 0 {
+			spool.stats.NumRetries++
+		}
+		spool.Unlock()
+
+		if len(retry) == 0 {
+			return nil
+		}
+		log.Printf("spool: Elasticsearch turned away %d messages for now, will retry", len(retry))
+		pending = retry
+
+		select {
+		case <-spool.quit:
+			return errSpoolRetryStopped
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > spool.config.MaxBackoff {
+			backoff = spool.config.MaxBackoff
+		}
+	}
+}
+
+// advance moves the cursor past n delivered records, persists it, and
+// deletes segments that have been fully drained.
+func (spool *Spool) advance(next spoolCursor, n int) {
+	if err := spool.writeCursor(next); err != nil {
+		// the records will be sent again after a restart; that's all
+		log.Printf("spool: unable to save cursor: %s", err.Error())
+	}
+
+	spool.Lock()
+	for seg := range spool.segSizes {
+		if seg < next.Segment {
+			delete(spool.segSizes, seg)
+			if err := os.Remove(spool.segmentPath(seg)); err != nil {
+				log.Printf("spool: unable to remove drained segment: %s", err.Error())
+			}
+		}
+	}
+	spool.depth -= n
+	if spool.depth < 0 {
+		spool.depth = 0
+	}
+	spool.Unlock()
+
+	spool.cursor = next
+}
@@ -0,0 +1,273 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// fakeBulkIndexer records what it is sent, and fails whole requests while
+// down is set. A message whose text is in rejects is turned away with each
+// of its errors in turn, and then stored.
+type fakeBulkIndexer struct {
+	sync.Mutex
+	down    bool
+	texts   []string
+	rejects map[string][]error
+}
+
+func (bi *fakeBulkIndexer) Bulk(typ string, docs []interface{}) ([]error, error) {
+	bi.Lock()
+	defer bi.Unlock()
+
+	if bi.down {
+		return nil, errors.New("elasticsearch is down")
+	}
+	errs := make([]error, len(docs))
+	for i, doc := range docs {
+		byts, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		mssg := &pzsyslog.Message{}
+		if err = json.Unmarshal(byts, mssg); err != nil {
+			return nil, err
+		}
+		if rejects := bi.rejects[mssg.Message]; len(rejects) > 0 {
+			errs[i], bi.rejects[mssg.Message] = rejects[0], rejects[1:]
+			continue
+		}
+		bi.texts = append(bi.texts, mssg.Message)
+	}
+	return errs, nil
+}
+
+func (bi *fakeBulkIndexer) setDown(down bool) {
+	bi.Lock()
+	bi.down = down
+	bi.Unlock()
+}
+
+func (bi *fakeBulkIndexer) getTexts() []string {
+	bi.Lock()
+	defer bi.Unlock()
+	return append([]string{}, bi.texts...)
+}
+
+func newSpoolTestMessage(text string) *pzsyslog.Message {
+	m := pzsyslog.NewMessage("123456")
+	m.Application = "spooltest"
+	m.Message = text
+	return m
+}
+
+func waitForSpool(spool *Spool, depth int) {
+	for i := 0; i < 100 && spool.Stats().Depth != depth; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzspool")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	config := &SpoolConfig{
+		Dir:         dir,
+		SegmentSize: 512,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  20 * time.Millisecond,
+	}
+	indexer := &fakeBulkIndexer{down: true}
+
+	// accepted while Elasticsearch is down
+	{
+		spool, err := newSpool(config, indexer, pzsyslog.LoggerType)
+		assert.NoError(err)
+		spool.Start()
+
+		for _, text := range []string{"one", "two", "three", "four", "five"} {
+			assert.NoError(spool.Append(newSpoolTestMessage(text)))
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		stats := spool.Stats()
+		assert.Equal(5, stats.Depth)
+		assert.True(stats.Segments > 1)
+		assert.True(stats.NumRetries > 0)
+		assert.True(stats.OldestAgeSeconds > 0)
+
+		assert.NoError(spool.Close())
+	}
+
+	// replayed after a restart, once Elasticsearch is back
+	{
+		spool, err := newSpool(config, indexer, pzsyslog.LoggerType)
+		assert.NoError(err)
+		assert.Equal(5, spool.Stats().Depth)
+
+		indexer.setDown(false)
+		spool.Start()
+		waitForSpool(spool, 0)
+
+		stats := spool.Stats()
+		assert.Equal(0, stats.Depth)
+		assert.Equal(5, stats.NumDrained)
+		assert.Equal(1, stats.Segments)
+		assert.Equal([]string{"one", "two", "three", "four", "five"}, indexer.getTexts())
+
+		assert.NoError(spool.Close())
+	}
+
+	// nothing is sent twice
+	{
+		spool, err := newSpool(config, indexer, pzsyslog.LoggerType)
+		assert.NoError(err)
+		assert.Equal(0, spool.Stats().Depth)
+		spool.Start()
+		assert.NoError(spool.Append(newSpoolTestMessage("six")))
+		waitForSpool(spool, 0)
+		assert.NoError(spool.Close())
+		assert.Equal([]string{"one", "two", "three", "four", "five", "six"}, indexer.getTexts())
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzspool")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	_, err = newSpool(&SpoolConfig{Dir: dir, SyncPolicy: "sometimes"}, &fakeBulkIndexer{}, pzsyslog.LoggerType)
+	assert.Error(err)
+
+	spool, err := newSpool(&SpoolConfig{Dir: dir, MaxSize: 300, SyncPolicy: SpoolSyncNever},
+		&fakeBulkIndexer{}, pzsyslog.LoggerType)
+	assert.NoError(err)
+
+	assert.NoError(spool.Append(newSpoolTestMessage("fits")))
+	err = spool.Append(newSpoolTestMessage("does not fit"))
+	assert.Equal(ErrSpoolFull, err)
+
+	// a torn write at the end is cut off on reopen
+	assert.NoError(spool.Close())
+	file, err := os.OpenFile(spool.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(err)
+	_, err = file.Write([]byte(`{"t":1,"m":{"app`))
+	assert.NoError(err)
+	assert.NoError(file.Close())
+
+	spool, err = newSpool(&SpoolConfig{Dir: dir}, &fakeBulkIndexer{}, pzsyslog.LoggerType)
+	assert.NoError(err)
+	assert.Equal(1, spool.Stats().Depth)
+	assert.NoError(spool.Close())
+}
+
+func TestSpoolRejections(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzspool")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	busy := &bulkItemError{Status: http.StatusTooManyRequests, Type: "es_rejected_execution_exception", Reason: "queue full"}
+	indexer := &fakeBulkIndexer{rejects: map[string][]error{
+		"two": {busy, busy},
+		"bad": {&bulkItemError{Status: http.StatusBadRequest, Type: "mapper_parsing_exception", Reason: "failed to parse"}},
+	}}
+	config := &SpoolConfig{Dir: dir, MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	spool, err := newSpool(config, indexer, pzsyslog.LoggerType)
+	assert.NoError(err)
+	spool.Start()
+	defer func() {
+		assert.NoError(spool.Close())
+	}()
+
+	for _, text := range []string{"one", "two", "bad", "three"} {
+		assert.NoError(spool.Append(newSpoolTestMessage(text)))
+	}
+	waitForSpool(spool, 0)
+
+	// a busy cluster's 429 is retried until stored; a parse error is dropped
+	texts := indexer.getTexts()
+	sort.Strings(texts)
+	assert.Equal([]string{"one", "three", "two"}, texts)
+	stats := spool.Stats()
+	assert.Equal(3, stats.NumDrained)
+	assert.Equal(1, stats.NumDropped)
+	assert.True(stats.NumRetries >= 2)
+}
+
+func TestSpoolBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "pzspool")
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(os.RemoveAll(dir))
+	}()
+
+	spool, err := newSpool(&SpoolConfig{Dir: dir, BatchSize: 2}, &fakeBulkIndexer{}, pzsyslog.LoggerType)
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(spool.Close())
+	}()
+
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		assert.NoError(spool.Append(newSpoolTestMessage(text)))
+	}
+
+	// each batch reads on from where the last stopped, in one segment
+	texts := [][]string{}
+	for {
+		records, next, err := spool.readBatch()
+		assert.NoError(err)
+		if len(records) == 0 {
+			assert.Equal(spool.cursor, next)
+			break
+		}
+		batch := []string{}
+		for _, record := range records {
+			mssg := &pzsyslog.Message{}
+			assert.NoError(json.Unmarshal(record.Message, mssg))
+			batch = append(batch, mssg.Message)
+		}
+		texts = append(texts, batch)
+		assert.True(next.Offset > spool.cursor.Offset)
+		assert.Equal(spool.cursor.Segment, next.Segment)
+		spool.cursor = next
+	}
+	assert.Equal([][]string{{"one", "two"}, {"three", "four"}, {"five"}}, texts)
+}
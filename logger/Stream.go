@@ -0,0 +1,337 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// DefaultStreamBuffer is how many messages a subscriber to
+	// GET /syslog/stream may fall behind before messages are dropped,
+	// unless it asks for something else with ?buffer=.
+	DefaultStreamBuffer = 1000
+
+	// MaxStreamBuffer is the most a subscriber may ask for.
+	MaxStreamBuffer = 10000
+
+	// MaxStreamReplay is the most messages sent when a subscriber asks to
+	// start from a time in the past with ?since=. Past that, a "dropped"
+	// event after them says how many more there were.
+	MaxStreamReplay = 10000
+)
+
+// StreamEvent is what subscribers to GET /syslog/stream receive. Over
+// WebSocket each event is one JSON frame; over SSE the Type is the event
+// name and the rest is the data.
+type StreamEvent struct {
+	Type       string            `json:"type"` // "message" or "dropped"
+	Message    *pzsyslog.Message `json:"message,omitempty"`
+	NumDropped int               `json:"numDropped,omitempty"`
+}
+
+//---------------------------------------------------------------------------
+
+type streamItem struct {
+	seq  int
+	mssg *pzsyslog.Message
+}
+
+type streamSubscriber struct {
+	query interface{} // as in a search; nil matches everything
+	items chan streamItem
+
+	// the sequence number of the next message, dropped or not; only
+	// touched by the hub, under its lock
+	seq int
+}
+
+// streamHub hands each accepted message to every subscriber whose filter
+// it matches. A subscriber that falls behind by more than its buffer
+// loses messages rather than holding anything up.
+type streamHub struct {
+	sync.Mutex
+	subs   map[*streamSubscriber]bool
+	closed bool
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subs: map[*streamSubscriber]bool{}}
+}
+
+func (hub *streamHub) subscribe(query interface{}, buffer int) (*streamSubscriber, error) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if hub.closed {
+		return nil, errors.New("the service is shutting down")
+	}
+
+	sub := &streamSubscriber{query: query, items: make(chan streamItem, buffer)}
+	hub.subs[sub] = true
+	return sub, nil
+}
+
+func (hub *streamHub) unsubscribe(sub *streamSubscriber) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if hub.subs[sub] {
+		delete(hub.subs, sub)
+		close(sub.items)
+	}
+}
+
+// publish hands out a message that has been accepted, as the tenant's if
+// there is one; subscribers filter on the tenant like any other field.
+func (hub *streamHub) publish(mssg *pzsyslog.Message, tenant string) {
+	hub.Lock()
+	defer hub.Unlock()
+
+	if len(hub.subs) == 0 {
+		return
+	}
+
+	var fields map[string]interface{}
+
+	for sub := range hub.subs {
+		if sub.query != nil {
+			if fields == nil {
+				byts, err := json.Marshal(&storedMessage{Message: mssg, Tenant: tenant})
+				if err != nil {
+					return
+				}
+				if err = json.Unmarshal(byts, &fields); err != nil {
+					return
+				}
+			}
+			if ok, err := evalMemoryQuery(sub.query, fields); err != nil || !ok {
+				continue
+			}
+		}
+
+		select {
+		case sub.items <- streamItem{seq: sub.seq, mssg: mssg}:
+		default:
+		}
+		sub.seq++
+	}
+}
+
+// close ends every stream, and refuses new ones.
+func (hub *streamHub) close() {
+	hub.Lock()
+	defer hub.Unlock()
+
+	hub.closed = true
+	for sub := range hub.subs {
+		delete(hub.subs, sub)
+		close(sub.items)
+	}
+}
+
+//---------------------------------------------------------------------------
+
+// syslogStream is one subscriber's view: first the replayed messages, if
+// any, and then the live ones.
+type syslogStream struct {
+	hub     *streamHub
+	sub     *streamSubscriber
+	replay  []pzsyslog.Message
+	nextSeq int
+
+	// how many stored messages were left out of the replay
+	truncated int
+}
+
+// OpenStream subscribes to the messages accepted from now on that match
+// the same filters GET /syslog takes. If the params include since, the
+// stored messages from that time on are sent first. Messages accepted
+// while those are being fetched may be sent twice.
+func (service *Service) OpenStream(params *piazza.HttpQueryParams) (*syslogStream, *piazza.JsonResponse) {
+	buffer, err := params.GetAsInt("buffer", DefaultStreamBuffer)
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+	if buffer < 1 || buffer > MaxStreamBuffer {
+		return nil, service.newBadRequestResponse(
+			fmt.Errorf("buffer must be between 1 and %d", MaxStreamBuffer))
+	}
+
+	since, err := params.GetAsTime("since", time.Time{})
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+
+	pagination := &piazza.JsonPagination{
+		PerPage: MaxStreamReplay,
+		SortBy:  "timeStamp",
+		Order:   piazza.SortOrderAscending,
+	}
+
+	var query interface{}
+	dsl, err := createQueryDslAsString(pagination, params)
+	if err != nil {
+		return nil, service.newBadRequestResponse(err)
+	}
+	if dsl != "" {
+		obj := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(dsl), &obj); err != nil {
+			return nil, service.newInternalErrorResponse(err)
+		}
+		query = obj["query"]
+	}
+
+	sub, err := service.stream.subscribe(query, buffer)
+	if err != nil {
+		return nil, service.newServiceUnavailableResponse(err)
+	}
+	stream := &syslogStream{hub: service.stream, sub: sub}
+
+	if !since.IsZero() {
+		// subscribed first, so that nothing falls between the two
+		params.AddTime("after", since)
+		dsl, err = createQueryDslAsString(pagination, params)
+		if err != nil {
+			stream.Close()
+			return nil, service.newBadRequestResponse(err)
+		}
+		searchResult, err := service.search(pzsyslog.LoggerType, dsl)
+		if err != nil {
+			stream.Close()
+			return nil, service.newInternalErrorResponse(err)
+		}
+		if stream.replay, err = extractFromSearchResult(searchResult); err != nil {
+			stream.Close()
+			return nil, service.newInternalErrorResponse(err)
+		}
+		stream.truncated = int(searchResult.TotalHits()) - len(stream.replay)
+	}
+
+	return stream, nil
+}
+
+func (stream *syslogStream) Close() {
+	stream.hub.unsubscribe(stream.sub)
+}
+
+// next blocks until there is something to send, returning nil once the
+// stream has been closed or gone is. A gap in the live messages is
+// reported before the message that follows it, as are the messages left
+// out of the replay.
+func (stream *syslogStream) next(gone <-chan struct{}) *StreamEvent {
+	if len(stream.replay) > 0 {
+		mssg := stream.replay[0]
+		stream.replay = stream.replay[1:]
+		return &StreamEvent{Type: "message", Message: &mssg}
+	}
+	if stream.truncated > 0 {
+		dropped := stream.truncated
+		stream.truncated = 0
+		return &StreamEvent{Type: "dropped", NumDropped: dropped}
+	}
+
+	select {
+	case <-gone:
+		return nil
+	case item, ok := <-stream.sub.items:
+		if !ok {
+			return nil
+		}
+		if item.seq > stream.nextSeq {
+			// hold on to the message until the notice has been sent
+			dropped := item.seq - stream.nextSeq
+			stream.replay = []pzsyslog.Message{*item.mssg}
+			stream.nextSeq = item.seq + 1
+			return &StreamEvent{Type: "dropped", NumDropped: dropped}
+		}
+		stream.nextSeq = item.seq + 1
+		return &StreamEvent{Type: "message", Message: item.mssg}
+	}
+}
+
+//---------------------------------------------------------------------------
+
+func isWebSocketRequest(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "websocket")
+}
+
+func serveStreamSSE(c *gin.Context, stream *syslogStream) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	gone := make(chan struct{})
+	go func() {
+		<-c.Writer.CloseNotify()
+		close(gone)
+	}()
+
+	for {
+		event := stream.next(gone)
+		if event == nil {
+			return
+		}
+		if event.Type == "message" {
+			c.SSEvent(event.Type, event.Message)
+		} else {
+			c.SSEvent(event.Type, event)
+		}
+		c.Writer.Flush()
+	}
+}
+
+func serveStreamWebSocket(c *gin.Context, stream *syslogStream) {
+	handler := func(ws *websocket.Conn) {
+		// we don't expect the client to say anything, but reading is
+		// how we find out it has gone
+		gone := make(chan struct{})
+		go func() {
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(gone)
+		}()
+
+		for {
+			event := stream.next(gone)
+			if event == nil {
+				return
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		}
+	}
+
+	// browsers send an Origin, other clients may not; either is fine
+	server := websocket.Server{Handler: handler}
+	server.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,107 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestStreamHub(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := newStreamHub()
+
+	query, err := ParseQuery("application:keep")
+	assert.NoError(err)
+
+	sub, err := hub.subscribe(query, 2)
+	assert.NoError(err)
+	stream := &syslogStream{hub: hub, sub: sub}
+
+	newMessage := func(application string, text string) *pzsyslog.Message {
+		mssg := pzsyslog.NewMessage("123456")
+		mssg.Application = application
+		mssg.Message = text
+		return mssg
+	}
+
+	// the buffer holds two, so the third and fourth are dropped
+	hub.publish(newMessage("keep", "1"), "")
+	hub.publish(newMessage("skip", "x"), "")
+	hub.publish(newMessage("keep", "2"), "")
+	hub.publish(newMessage("keep", "3"), "")
+	hub.publish(newMessage("keep", "4"), "")
+
+	gone := make(chan struct{})
+
+	event := stream.next(gone)
+	assert.Equal("message", event.Type)
+	assert.Equal("1", event.Message.Message)
+	event = stream.next(gone)
+	assert.Equal("2", event.Message.Message)
+
+	hub.publish(newMessage("keep", "5"), "")
+	event = stream.next(gone)
+	assert.Equal("dropped", event.Type)
+	assert.Equal(2, event.NumDropped)
+	event = stream.next(gone)
+	assert.Equal("message", event.Type)
+	assert.Equal("5", event.Message.Message)
+
+	close(gone)
+	assert.Nil(stream.next(gone))
+
+	// closing the hub ends the stream and refuses new ones
+	hub.close()
+	assert.Nil(stream.next(make(chan struct{})))
+	stream.Close()
+	_, err = hub.subscribe(nil, 1)
+	assert.Error(err)
+}
+
+func TestStreamReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := newStreamHub()
+	sub, err := hub.subscribe(nil, 2)
+	assert.NoError(err)
+
+	mssg := pzsyslog.NewMessage("123456")
+	mssg.Message = "live"
+	hub.publish(mssg, "")
+
+	// the replay was cut short by 3
+	stream := &syslogStream{hub: hub, sub: sub, truncated: 3,
+		replay: []pzsyslog.Message{{Message: "1"}, {Message: "2"}}}
+	gone := make(chan struct{})
+
+	for _, expected := range []string{"1", "2"} {
+		event := stream.next(gone)
+		assert.Equal("message", event.Type)
+		assert.Equal(expected, event.Message.Message)
+	}
+	event := stream.next(gone)
+	assert.Equal("dropped", event.Type)
+	assert.Equal(3, event.NumDropped)
+	event = stream.next(gone)
+	assert.Equal("message", event.Type)
+	assert.Equal("live", event.Message.Message)
+
+	stream.Close()
+	hub.close()
+}
@@ -0,0 +1,229 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+// DefaultTenantQuota is the key, in the quotas given to the service, of
+// the quota of tenants not listed.
+const DefaultTenantQuota = "*"
+
+// ErrQuotaExceeded is returned when a tenant has written all the messages
+// its quota allows for the day.
+var ErrQuotaExceeded = errors.New("tenant's message quota for the day is used up")
+
+// storedMessage is a message as it is kept in the index: the message,
+// and the tenant it belongs to, if any. The vendored writers know only
+// the message, so anything with a tenant has to go in a bulk request.
+type storedMessage struct {
+	*pzsyslog.Message
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// tenant returns the tenant of the key's holder, which is none if
+// authentication is off.
+func (key *APIKey) tenant() string {
+	if key == nil {
+		return ""
+	}
+	return key.Tenant
+}
+
+// newTenantQueryParams is newQueryParams, restricted to the caller's
+// tenant if it has one. Callers without a tenant may filter on tenant like
+// any other field.
+func newTenantQueryParams(c *gin.Context) *piazza.HttpQueryParams {
+	params := newQueryParams(c.Request)
+	if tenant := getAPIKey(c).tenant(); tenant != "" {
+		params.AddString("tenant", tenant)
+	}
+	return params
+}
+
+// restrictQueryToTenant puts the query of a search in a bool filter that
+// keeps only the messages of the tenant.
+func restrictQueryToTenant(jsn string, tenant string) (string, error) {
+	if tenant == "" {
+		return jsn, nil
+	}
+
+	dsl := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &dsl); err != nil {
+		return "", err
+	}
+
+	query := dsl["query"]
+	if query == nil {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	dsl["query"] = map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{query},
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"tenant": tenant}},
+			},
+		},
+	}
+
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
+
+//---------------------------------------------------------------------------
+
+// TenantQuota limits what a tenant may write.
+type TenantQuota struct {
+	// how many messages may be accepted each day, starting at midnight
+	// UTC; 0 is no limit
+	MessagesPerDay int `json:"messagesPerDay"`
+}
+
+// TenantStats are what GET /admin/stats reports for each tenant. The
+// counts are since the service was started.
+type TenantStats struct {
+	NumMessages  int          `json:"numMessages"`
+	NumToday     int          `json:"numToday"`
+	NumOverQuota int          `json:"numOverQuota"`
+	Quota        *TenantQuota `json:"quota,omitempty"`
+}
+
+// tenantTracker counts each tenant's messages and holds them to their
+// quotas. Messages without a tenant are neither counted nor limited.
+type tenantTracker struct {
+	sync.Mutex
+	quotas map[string]*TenantQuota
+	stats  map[string]*TenantStats
+	day    time.Time
+
+	now func() time.Time
+}
+
+func newTenantTracker() *tenantTracker {
+	return &tenantTracker{
+		quotas: map[string]*TenantQuota{},
+		stats:  map[string]*TenantStats{},
+		now:    time.Now,
+	}
+}
+
+func (tt *tenantTracker) setQuotas(quotas map[string]*TenantQuota) {
+	tt.Lock()
+	defer tt.Unlock()
+
+	tt.quotas = map[string]*TenantQuota{}
+	for tenant, quota := range quotas {
+		tt.quotas[tenant] = quota
+	}
+	for tenant, stats := range tt.stats {
+		stats.Quota = tt.quota(tenant)
+	}
+}
+
+// quota is called with the lock held.
+func (tt *tenantTracker) quota(tenant string) *TenantQuota {
+	if quota, ok := tt.quotas[tenant]; ok {
+		return quota
+	}
+	return tt.quotas[DefaultTenantQuota]
+}
+
+// get is called with the lock held. It starts a new day's counts if the
+// day has changed.
+func (tt *tenantTracker) get(tenant string) *TenantStats {
+	today := tt.now().UTC().Truncate(24 * time.Hour)
+	if !today.Equal(tt.day) {
+		tt.day = today
+		for _, stats := range tt.stats {
+			stats.NumToday = 0
+		}
+	}
+
+	stats, ok := tt.stats[tenant]
+	if !ok {
+		stats = &TenantStats{Quota: tt.quota(tenant)}
+		tt.stats[tenant] = stats
+	}
+	return stats
+}
+
+// take counts a message against the tenant's quota for the day, or
+// returns ErrQuotaExceeded if there is no room for it.
+func (tt *tenantTracker) take(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+
+	tt.Lock()
+	defer tt.Unlock()
+
+	stats := tt.get(tenant)
+	if stats.Quota != nil && stats.Quota.MessagesPerDay > 0 && stats.NumToday >= stats.Quota.MessagesPerDay {
+		stats.NumOverQuota++
+		return ErrQuotaExceeded
+	}
+	stats.NumToday++
+	return nil
+}
+
+// giveBack undoes take, for a message that was not accepted after all.
+func (tt *tenantTracker) giveBack(tenant string) {
+	if tenant == "" {
+		return
+	}
+
+	tt.Lock()
+	defer tt.Unlock()
+
+	if stats := tt.get(tenant); stats.NumToday > 0 {
+		stats.NumToday--
+	}
+}
+
+// accepted counts a message that was stored.
+func (tt *tenantTracker) accepted(tenant string) {
+	if tenant == "" {
+		return
+	}
+
+	tt.Lock()
+	defer tt.Unlock()
+
+	tt.get(tenant).NumMessages++
+}
+
+// snapshot returns a copy of the stats of every tenant seen so far.
+func (tt *tenantTracker) snapshot() map[string]*TenantStats {
+	tt.Lock()
+	defer tt.Unlock()
+
+	stats := map[string]*TenantStats{}
+	for tenant := range tt.stats {
+		s := *tt.get(tenant)
+		stats[tenant] = &s
+	}
+	return stats
+}
@@ -0,0 +1,153 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
+)
+
+func TestStoredMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	mssg := pzsyslog.NewMessage("123456")
+	mssg.Application = "app"
+
+	// no tenant, no change
+	plain, err := json.Marshal(mssg)
+	assert.NoError(err)
+	stored, err := json.Marshal(&storedMessage{Message: mssg})
+	assert.NoError(err)
+	assert.JSONEq(string(plain), string(stored))
+
+	stored, err = json.Marshal(&storedMessage{Message: mssg, Tenant: "acme"})
+	assert.NoError(err)
+	fields := map[string]interface{}{}
+	assert.NoError(json.Unmarshal(stored, &fields))
+	assert.Equal("acme", fields["tenant"])
+	assert.Equal("app", fields["application"])
+}
+
+func TestRestrictQueryToTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	jsn := `{"query": {"term": {"application": "app"}}, "size": 10}`
+
+	same, err := restrictQueryToTenant(jsn, "")
+	assert.NoError(err)
+	assert.Equal(jsn, same)
+
+	restricted, err := restrictQueryToTenant(jsn, "acme")
+	assert.NoError(err)
+	dsl := map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(restricted), &dsl))
+	assert.EqualValues(10, dsl["size"])
+
+	matches := func(fields map[string]interface{}) bool {
+		ok, err := evalMemoryQuery(dsl["query"], fields)
+		assert.NoError(err)
+		return ok
+	}
+	assert.True(matches(map[string]interface{}{"application": "app", "tenant": "acme"}))
+	assert.False(matches(map[string]interface{}{"application": "app", "tenant": "other"}))
+	assert.False(matches(map[string]interface{}{"application": "app"}))
+	assert.False(matches(map[string]interface{}{"application": "else", "tenant": "acme"}))
+
+	// no query at all
+	restricted, err = restrictQueryToTenant(`{}`, "acme")
+	assert.NoError(err)
+	dsl = map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(restricted), &dsl))
+	assert.True(matches(map[string]interface{}{"tenant": "acme"}))
+	assert.False(matches(map[string]interface{}{"tenant": "other"}))
+
+	_, err = restrictQueryToTenant(`{`, "acme")
+	assert.Error(err)
+}
+
+func TestTenantTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 7, 26, 23, 0, 0, 0, time.UTC)
+	tt := newTenantTracker()
+	tt.now = func() time.Time { return now }
+	tt.setQuotas(map[string]*TenantQuota{
+		"small":            {MessagesPerDay: 2},
+		DefaultTenantQuota: {MessagesPerDay: 100},
+	})
+
+	// no tenant, no limit
+	for i := 0; i < 10; i++ {
+		assert.NoError(tt.take(""))
+	}
+
+	assert.NoError(tt.take("small"))
+	tt.accepted("small")
+	assert.NoError(tt.take("small"))
+	tt.giveBack("small")
+	assert.NoError(tt.take("small"))
+	tt.accepted("small")
+	assert.Equal(ErrQuotaExceeded, tt.take("small"))
+
+	assert.NoError(tt.take("big"))
+	tt.accepted("big")
+
+	stats := tt.snapshot()
+	assert.Len(stats, 2)
+	assert.Equal(&TenantStats{NumMessages: 2, NumToday: 2, NumOverQuota: 1,
+		Quota: &TenantQuota{MessagesPerDay: 2}}, stats["small"])
+	assert.Equal(&TenantStats{NumMessages: 1, NumToday: 1,
+		Quota: &TenantQuota{MessagesPerDay: 100}}, stats["big"])
+
+	// a new day
+	now = now.Add(2 * time.Hour)
+	assert.NoError(tt.take("small"))
+	stats = tt.snapshot()
+	assert.Equal(1, stats["small"].NumToday)
+	assert.Equal(0, stats["big"].NumToday)
+	assert.Equal(2, stats["small"].NumMessages)
+}
+
+func TestStreamTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := newStreamHub()
+
+	query, err := ParseQuery("tenant:acme")
+	assert.NoError(err)
+	sub, err := hub.subscribe(query, 10)
+	assert.NoError(err)
+	stream := &syslogStream{hub: hub, sub: sub}
+
+	newMessage := func(text string) *pzsyslog.Message {
+		mssg := pzsyslog.NewMessage("123456")
+		mssg.Message = text
+		return mssg
+	}
+
+	hub.publish(newMessage("none"), "")
+	hub.publish(newMessage("other"), "other")
+	hub.publish(newMessage("mine"), "acme")
+
+	gone := make(chan struct{})
+	event := stream.next(gone)
+	assert.Equal("mine", event.Message.Message)
+
+	hub.close()
+}
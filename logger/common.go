@@ -30,6 +30,15 @@ type Stats struct {
 	NumMessages int `json:"numMessages"`
 
 	NumMessagesByApplication map[string]int `json:"numMessagesByApplication"`
+
+	// only present when messages are being spooled to disk
+	Spool *SpoolStats `json:"spool,omitempty"`
+
+	// only present when async writes are being batched
+	Writer *BatchWriterStats `json:"writer,omitempty"`
+
+	// only present once messages with a tenant have been written
+	Tenants map[string]*TenantStats `json:"tenants,omitempty"`
 }
 
 //---------------------------------------------------------------------------
@@ -38,6 +47,20 @@ func init() {
 	piazza.JsonResponseDataTypes["[]syslog.Message"] = "syslogMessage-list"
 	piazza.JsonResponseDataTypes["logger.Stats"] = "logstats"
 	piazza.JsonResponseDataTypes["*logger.Stats"] = "logstats"
+	piazza.JsonResponseDataTypes["*logger.BulkResult"] = "logbulkresult"
+	piazza.JsonResponseDataTypes["*logger.AggregateResult"] = "logaggregate"
+	piazza.JsonResponseDataTypes["*logger.MetricQueryResult"] = "logmetricquery"
+	piazza.JsonResponseDataTypes["[]logger.AuditRecord"] = "auditrecord-list"
+	piazza.JsonResponseDataTypes["*logger.AuditVerifyResult"] = "auditverify"
+	piazza.JsonResponseDataTypes["*logger.RetentionReport"] = "logretention"
+	piazza.JsonResponseDataTypes["*logger.HealthReport"] = "health"
+	piazza.JsonResponseDataTypes["*logger.AlertRule"] = "alertrule"
+	piazza.JsonResponseDataTypes["[]logger.AlertRule"] = "alertrule-list"
+	piazza.JsonResponseDataTypes["[]logger.AlertEvent"] = "alertevent-list"
+	piazza.JsonResponseDataTypes["*logger.NotificationChannel"] = "notificationchannel"
+	piazza.JsonResponseDataTypes["[]logger.NotificationChannel"] = "notificationchannel-list"
+	piazza.JsonResponseDataTypes["[]logger.NotificationDelivery"] = "notificationdelivery-list"
+	piazza.JsonResponseDataTypes["[]logger.MessageRate"] = "messagerate-list"
 }
 
 func paginationCreatedOnToTimeStamp(pagination *piazza.JsonPagination) {
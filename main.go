@@ -15,18 +15,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"reflect"
-	"regexp"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
 	pzlogger "github.com/venicegeo/pz-logger/logger"
+	"github.com/venicegeo/pz-logger/schema"
+	"gopkg.in/olivere/elastic.v3"
 )
 
 func main() {
@@ -38,7 +47,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	idx, logESWriter, auditWriter, err := setupES(sys)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrate(sys, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	idx, logESWriter, schemaManager, err := setupES(sys)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -48,108 +64,448 @@ func main() {
 		log.Fatal("Environment Variable PZ_PEN not found")
 	}
 
-	kit, err := pzlogger.NewKit(sys, logESWriter, auditWriter, idx, true, pen)
+	// audit messages go to the audit trail, in the index
+	kit, err := pzlogger.NewKit(sys, logESWriter, nil, idx, true, pen)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kit.Start()
+	kit.ListenerConfig, err = getSyslogListenerConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = kit.Wait()
+	kit.SpoolConfig, err = getSpoolConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = closeES(idx, logESWriter)
+	kit.BatchWriterConfig, err = getBatchWriterConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kit.HealthConfig, err = getHealthConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	kit.HealthConfig.SchemaCheck = schemaManager.Check
+
+	kit.Authorizer, err = getAuthorizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kit.TenantQuotas, err = getTenantQuotas()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kit.NotifierConfig, err = getNotifierConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func closeES(idx elasticsearch.IIndex, logWriter pzsyslog.Writer) error {
-	err := logWriter.Close()
+	kit.RollingConfig, err = getRollingConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return idx.Close()
+	kit.AuditConfig, err = getAuditConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if tz := os.Getenv("SYSLOG_RFC3164_TZ"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kit.Service.SetRFC3164Options(&pzlogger.RFC3164Options{Location: loc})
+	}
+
+	err = kit.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timeout, err := getShutdownTimeout()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- kit.Wait()
+	}()
+
+	select {
+	case sig := <-sigs:
+		log.Printf("Received %s, shutting down", sig)
+	case err = <-waited:
+		if err != nil {
+			log.Printf("Server stopped: %s", err.Error())
+		}
+	}
+
+	// either way, write out what is queued, and stop everything else
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	report, shutdownErr := kit.Shutdown(ctx)
+	log.Printf("Shutdown: %d messages flushed, %d abandoned, %d left in the spool",
+		report.NumFlushed, report.NumAbandoned, report.NumSpooled)
+	if shutdownErr != nil {
+		log.Fatal(shutdownErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func setupES(sys *piazza.SystemConfig) (elasticsearch.IIndex, pzsyslog.Writer, pzsyslog.Writer, error) {
-	var idx *elasticsearch.Index
-	loggerIndex, err := pzsyslog.GetRequiredEnvVars()
+// getShutdownTimeout reads how long to spend flushing queued messages on
+// SIGTERM or SIGINT. Cloud Foundry kills the process 10 seconds after
+// SIGTERM, so the default leaves a little room.
+func getShutdownTimeout() (time.Duration, error) {
+	s := os.Getenv("SHUTDOWN_TIMEOUT")
+	if s == "" {
+		return 8 * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(s)
 	if err != nil {
-		log.Fatalln(err)
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT: %s", err.Error())
 	}
-	{
-		pwd, err := os.Getwd()
+	return timeout, nil
+}
+
+// getSyslogListenerConfig reads the addresses of the native syslog
+// listeners from the environment. Each transport is off unless its
+// variable is set; TLS also needs a certificate and key.
+func getSyslogListenerConfig() (*pzlogger.SyslogListenerConfig, error) {
+	config := &pzlogger.SyslogListenerConfig{
+		UDPAddr: os.Getenv("SYSLOG_UDP_ADDR"),
+		TCPAddr: os.Getenv("SYSLOG_TCP_ADDR"),
+		TLSAddr: os.Getenv("SYSLOG_TLS_ADDR"),
+	}
+
+	if config.TLSAddr != "" {
+		certFile := os.Getenv("SYSLOG_TLS_CERT")
+		keyFile := os.Getenv("SYSLOG_TLS_KEY")
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("SYSLOG_TLS_ADDR requires SYSLOG_TLS_CERT and SYSLOG_TLS_KEY")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
-		esURL, err := sys.GetURL(piazza.PzElasticSearch)
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return config, nil
+}
+
+// getSpoolConfig reads the spool settings from the environment. The spool
+// is off unless SPOOL_DIR is set.
+func getSpoolConfig() (*pzlogger.SpoolConfig, error) {
+	dir := os.Getenv("SPOOL_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	config := &pzlogger.SpoolConfig{
+		Dir:        dir,
+		SyncPolicy: pzlogger.SpoolSyncPolicy(os.Getenv("SPOOL_SYNC")),
+	}
+
+	if s := os.Getenv("SPOOL_MAX_SIZE"); s != "" {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("SPOOL_MAX_SIZE: %s", err.Error())
+		}
+		config.MaxSize = size
+	}
+
+	return config, nil
+}
+
+// getRollingConfig reads the rolling index and retention settings from the
+// environment. Rolling is off unless ROLLING_PERIOD is set, to day or
+// week. RETENTION_RULES is a JSON list of rules.
+func getRollingConfig() (*pzlogger.RollingConfig, error) {
+	period := os.Getenv("ROLLING_PERIOD")
+	if period == "" {
+		return nil, nil
+	}
+
+	config := &pzlogger.RollingConfig{
+		Period:        period,
+		DefaultMaxAge: os.Getenv("RETENTION_DEFAULT_MAX_AGE"),
+		DefaultAction: pzlogger.RetentionAction(os.Getenv("RETENTION_DEFAULT_ACTION")),
+		DryRun:        os.Getenv("RETENTION_DRY_RUN") == "true",
+	}
+
+	if s := os.Getenv("RETENTION_RULES"); s != "" {
+		if err := json.Unmarshal([]byte(s), &config.Rules); err != nil {
+			return nil, fmt.Errorf("RETENTION_RULES: %s", err.Error())
+		}
+	}
+
+	if s := os.Getenv("RETENTION_CHECK_INTERVAL"); s != "" {
+		interval, err := time.ParseDuration(s)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, fmt.Errorf("RETENTION_CHECK_INTERVAL: %s", err.Error())
 		}
+		config.CheckInterval = interval
+	}
 
-		type ScriptRes struct {
-			Status  string `json:"status"`
-			Message string `json:"message"`
-			Mapping string `json:"mapping"`
+	return config, nil
+}
+
+// getHealthConfig reads when GET /health/ready is to fail from the
+// environment.
+func getHealthConfig() (*pzlogger.HealthConfig, error) {
+	config := &pzlogger.HealthConfig{}
+
+	if s := os.Getenv("READY_MAX_BACKLOG"); s != "" {
+		backlog, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("READY_MAX_BACKLOG: %s", err.Error())
 		}
+		config.MaxBacklog = backlog
+	}
 
-		format := func(dat []byte) []byte {
-			re := regexp.MustCompile(`\r?\n?\t`)
-			return bytes.TrimPrefix([]byte(re.ReplaceAllString(string(dat), "")), []byte("\xef\xbb\xbf"))
+	return config, nil
+}
+
+// getAuthorizer returns what checks the API keys, from a local file or
+// another service, or nil if anyone may use the API.
+func getAuthorizer() (pzlogger.Authorizer, error) {
+	keyFile := os.Getenv("API_KEY_FILE")
+	authURL := os.Getenv("AUTH_URL")
+
+	switch {
+	case keyFile != "" && authURL != "":
+		return nil, errors.New("API_KEY_FILE and AUTH_URL may not both be set")
+	case keyFile != "":
+		authorizer, err := pzlogger.LoadKeyFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("API_KEY_FILE: %s", err.Error())
 		}
+		return authorizer, nil
+	case authURL != "":
+		return pzlogger.NewHTTPAuthorizer(authURL), nil
+	}
 
-		log.Println("Running init script...")
-		outDat, err := exec.Command("bash", pwd+"/db/000-CreateLoggerIndex.sh", "piazzalogger", esURL).Output()
+	log.Printf("API_KEY_FILE and AUTH_URL not set: the API is open to all")
+	return nil, nil
+}
+
+// getAuditConfig reads the key the audit trail is hashed with, from a file
+// or the environment, and where its checkpoint is kept.
+func getAuditConfig() (*pzlogger.AuditConfig, error) {
+	config := &pzlogger.AuditConfig{CheckpointFile: os.Getenv("AUDIT_CHECKPOINT_FILE")}
+
+	keyFile := os.Getenv("AUDIT_KEY_FILE")
+	key := os.Getenv("AUDIT_KEY")
+	switch {
+	case keyFile != "" && key != "":
+		return nil, errors.New("AUDIT_KEY_FILE and AUDIT_KEY may not both be set")
+	case keyFile != "":
+		byts, err := ioutil.ReadFile(keyFile)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, fmt.Errorf("AUDIT_KEY_FILE: %s", err.Error())
 		}
-		outDat = format(outDat)
-		scriptRes := ScriptRes{}
-		if err = json.Unmarshal(outDat, &scriptRes); err != nil {
-			log.Fatalln(err)
+		key = strings.TrimSpace(string(byts))
+		if key == "" {
+			return nil, errors.New("AUDIT_KEY_FILE: the file is empty")
 		}
-		if scriptRes.Status != "success" {
-			log.Fatalf("Script failed: [%s]\n", scriptRes.Message)
+	}
+	if key != "" {
+		config.Key = []byte(key)
+	} else {
+		log.Printf("AUDIT_KEY_FILE and AUDIT_KEY not set: the audit trail is hashed without a key")
+	}
+	if config.CheckpointFile == "" {
+		log.Printf("AUDIT_CHECKPOINT_FILE not set: removing the latest audit records can go unseen")
+	}
+
+	return config, nil
+}
+
+// getTenantQuotas reads the quota of each tenant, a JSON object keyed by
+// tenant, from the environment.
+func getTenantQuotas() (map[string]*pzlogger.TenantQuota, error) {
+	s := os.Getenv("TENANT_QUOTAS")
+	if s == "" {
+		return nil, nil
+	}
+
+	quotas := map[string]*pzlogger.TenantQuota{}
+	if err := json.Unmarshal([]byte(s), &quotas); err != nil {
+		return nil, fmt.Errorf("TENANT_QUOTAS: %s", err.Error())
+	}
+	for tenant, quota := range quotas {
+		if quota == nil || quota.MessagesPerDay < 0 {
+			return nil, fmt.Errorf("TENANT_QUOTAS: bad quota for %s", tenant)
 		}
-		if scriptRes.Message != "" {
-			log.Println(" ", scriptRes.Message)
+	}
+	return quotas, nil
+}
+
+// getNotifierConfig says how alert notifications are sent. Email channels
+// need SMTP_SERVER (host:port) and SMTP_FROM.
+func getNotifierConfig() (*pzlogger.NotifierConfig, error) {
+	config := &pzlogger.NotifierConfig{}
+
+	var err error
+	if s := os.Getenv("NOTIFY_MAX_ATTEMPTS"); s != "" {
+		if config.MaxAttempts, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("NOTIFY_MAX_ATTEMPTS: %s", err.Error())
 		}
-		if idx, err = elasticsearch.NewIndex(sys, loggerIndex, ""); err != nil {
-			log.Fatalln(err)
+	}
+	if s := os.Getenv("NOTIFY_BACKOFF"); s != "" {
+		if config.InitialBackoff, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("NOTIFY_BACKOFF: %s", err.Error())
 		}
-		if scriptRes.Mapping != "" {
-			inter, err := piazza.StructStringToInterface(scriptRes.Mapping)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			var scriptMap, esMap map[string]interface{}
-			var ok bool
-			if scriptMap, ok = inter.(map[string]interface{}); !ok {
-				log.Fatalf("Schema [LogData] on alias [%s] in script is not type map[string]interface{}\n", loggerIndex)
-			}
-			if inter, err = idx.GetMapping("LogData"); err != nil {
-				log.Fatalln(err)
-			}
-			if esMap, ok = inter.(map[string]interface{}); !ok {
-				log.Fatalf("Schema [LogData] on alias [%s] on elasticsearch is not type map[string]interface{}\n", loggerIndex)
-			}
-			if !reflect.DeepEqual(scriptMap, esMap) {
-				log.Fatalf("Schema [LogData] on alias [%s] on elasticsearch does not match the mapping provided\n", loggerIndex)
+	}
+	if s := os.Getenv("NOTIFY_WEBHOOK_HOSTS"); s != "" {
+		for _, host := range strings.Split(s, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				config.WebhookHosts = append(config.WebhookHosts, host)
 			}
 		}
 	}
 
+	if addr := os.Getenv("SMTP_SERVER"); addr != "" {
+		config.SMTP = &pzlogger.SMTPConfig{
+			Addr:     addr,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if config.SMTP.From == "" {
+			return nil, errors.New("SMTP_SERVER needs SMTP_FROM")
+		}
+	}
+
+	return config, nil
+}
+
+// getBatchWriterConfig reads the async write queue settings from the
+// environment. Anything not set is left at its default.
+func getBatchWriterConfig() (*pzlogger.BatchWriterConfig, error) {
+	config := &pzlogger.BatchWriterConfig{
+		FullPolicy: pzlogger.QueueFullPolicy(os.Getenv("LOG_QUEUE_FULL_POLICY")),
+	}
+
+	var err error
+	if s := os.Getenv("LOG_QUEUE_SIZE"); s != "" {
+		if config.QueueSize, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("LOG_QUEUE_SIZE: %s", err.Error())
+		}
+	}
+	if s := os.Getenv("LOG_QUEUE_WORKERS"); s != "" {
+		if config.Workers, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("LOG_QUEUE_WORKERS: %s", err.Error())
+		}
+	}
+
+	return config, nil
+}
+
+func setupES(sys *piazza.SystemConfig) (elasticsearch.IIndex, pzsyslog.Writer, *schema.Manager, error) {
+	loggerIndex, err := pzsyslog.GetRequiredEnvVars()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	manager, err := newSchemaManager(sys, loggerIndex)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	results, err := manager.Ensure(os.Getenv("SCHEMA_AUTO_MIGRATE") != "false")
+	for _, result := range results {
+		log.Printf("Schema: %s", result)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	idx, err := elasticsearch.NewIndex(sys, loggerIndex, "")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	logEsWriter := pzsyslog.NewElasticWriter(idx, pzsyslog.LoggerType)
 	if _, err = logEsWriter.CreateIndex(); err != nil {
 		return idx, nil, nil, err
 	}
 
-	return idx, logEsWriter, &pzsyslog.StdoutWriter{}, nil
+	return idx, logEsWriter, manager, nil
+}
+
+// migrate is the migrate subcommand: it brings the indices behind
+// LOGGER_INDEX up to the latest schema, or with -status just shows them.
+func migrate(sys *piazza.SystemConfig, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "only show the schema version of each index")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	loggerIndex, err := pzsyslog.GetRequiredEnvVars()
+	if err != nil {
+		return err
+	}
+	manager, err := newSchemaManager(sys, loggerIndex)
+	if err != nil {
+		return err
+	}
+
+	if *status {
+		statuses, err := manager.Status()
+		if err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			fmt.Printf("%s: no indices\n", loggerIndex)
+		}
+		for _, status := range statuses {
+			fmt.Printf("%s: version %d of %d, aliases %s\n",
+				status.Index, status.Version, schema.Latest().Version, strings.Join(status.Aliases, ", "))
+		}
+		return nil
+	}
+
+	results, err := manager.Ensure(true)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if err == nil && len(results) == 0 {
+		fmt.Printf("%s is at version %d\n", loggerIndex, schema.Latest().Version)
+	}
+	return err
+}
+
+// newSchemaManager returns a schema manager for the indices behind alias,
+// which logs how far each copy has got.
+func newSchemaManager(sys *piazza.SystemConfig, alias string) (*schema.Manager, error) {
+	esURL, err := sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		return nil, err
+	}
+	client, err := elastic.NewClient(elastic.SetURL(esURL), elastic.SetSniff(false))
+	if err != nil {
+		return nil, err
+	}
+
+	manager := schema.NewManager(client, alias, pzsyslog.LoggerType)
+	manager.Progress = func(p *schema.Progress) {
+		if p.Done == p.Total || p.Done%10000 == 0 {
+			log.Printf("Schema: copying %s to %s, pass %d: %d of %d", p.Index, p.Target, p.Pass, p.Done, p.Total)
+		}
+	}
+	return manager, nil
 }
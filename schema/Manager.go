@@ -0,0 +1,370 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// IndexStatus is an index behind the alias, and the version of its mapping.
+type IndexStatus struct {
+	Index   string   `json:"index"`
+	Version int      `json:"version"`
+	Aliases []string `json:"aliases"`
+}
+
+// Progress is how far the copying of an index has got. Each index is
+// copied twice: once before its aliases are moved to the new index, and
+// again after, for anything written in between.
+type Progress struct {
+	Index  string
+	Target string
+	Pass   int // 1 or 2
+	Done   int64
+	Total  int64
+}
+
+// Result is what the Manager did to an index. A new index has no Index.
+type Result struct {
+	Index       string `json:"index,omitempty"`
+	FromVersion int    `json:"fromVersion,omitempty"`
+	Target      string `json:"target"`
+	ToVersion   int    `json:"toVersion"`
+	Copied      int64  `json:"copied"`
+}
+
+func (result *Result) String() string {
+	if result.Index == "" {
+		return fmt.Sprintf("created %s at version %d", result.Target, result.ToVersion)
+	}
+	return fmt.Sprintf("migrated %s from version %d to %s at version %d, %d documents copied",
+		result.Index, result.FromVersion, result.Target, result.ToVersion, result.Copied)
+}
+
+// Manager keeps the indices behind an alias at the latest version of the
+// mapping of a type. A new install gets the index <alias>_v<version>; an
+// index at an older version is copied into one named for the latest
+// version, its aliases are moved over, and it is left in place, to be
+// deleted by hand once the new one has been checked.
+type Manager struct {
+	Alias string
+	Type  string
+
+	// Migrations defaults to the package's Migrations
+	Migrations []*Migration
+
+	// if set, called every so often while documents are copied
+	Progress func(*Progress)
+
+	store store
+}
+
+// NewManager returns a Manager for the indices behind alias.
+func NewManager(client *elastic.Client, alias string, typ string) *Manager {
+	return &Manager{
+		Alias:      alias,
+		Type:       typ,
+		Migrations: Migrations,
+		store:      &elasticStore{client: client},
+	}
+}
+
+func (m *Manager) latest() *Migration {
+	return m.Migrations[len(m.Migrations)-1]
+}
+
+// Status returns the indices behind the alias, by name. If the alias is
+// really an index, that index is returned.
+func (m *Manager) Status() ([]*IndexStatus, error) {
+	indices, err := m.store.aliasIndices(m.Alias)
+	if err != nil {
+		return nil, err
+	}
+	if len(indices) == 0 {
+		exists, err := m.store.indexExists(m.Alias)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			indices = []string{m.Alias}
+		}
+	}
+	sort.Strings(indices)
+
+	statuses := []*IndexStatus{}
+	for _, index := range indices {
+		status := &IndexStatus{Index: index}
+		if status.Version, err = m.version(index); err != nil {
+			return nil, err
+		}
+		if status.Aliases, err = m.store.indexAliases(index); err != nil {
+			return nil, err
+		}
+		sort.Strings(status.Aliases)
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Ensure creates the first index if there is none. If any index is at an
+// older version, it is migrated or, unless migrate is set, an error is
+// returned.
+func (m *Manager) Ensure(migrate bool) ([]*Result, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(statuses) == 0 {
+		result, err := m.create()
+		if err != nil {
+			return nil, err
+		}
+		return []*Result{result}, nil
+	}
+
+	outdated := m.outdated(statuses)
+	if len(outdated) == 0 || migrate {
+		return m.migrate(outdated)
+	}
+	return nil, m.outdatedError(outdated)
+}
+
+// Check returns an error unless there are indices behind the alias and
+// all of them are at the latest version.
+func (m *Manager) Check() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if len(statuses) == 0 {
+		return fmt.Errorf("there are no indices behind %s", m.Alias)
+	}
+	if outdated := m.outdated(statuses); len(outdated) > 0 {
+		return m.outdatedError(outdated)
+	}
+	return nil
+}
+
+// Migrate brings each index behind the alias up to the latest version.
+func (m *Manager) Migrate() ([]*Result, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	return m.migrate(m.outdated(statuses))
+}
+
+func (m *Manager) outdated(statuses []*IndexStatus) []*IndexStatus {
+	outdated := []*IndexStatus{}
+	for _, status := range statuses {
+		if status.Version < m.latest().Version {
+			outdated = append(outdated, status)
+		}
+	}
+	return outdated
+}
+
+func (m *Manager) outdatedError(outdated []*IndexStatus) error {
+	names := []string{}
+	for _, status := range outdated {
+		names = append(names, status.Index)
+	}
+	return fmt.Errorf("schema of %s is older than version %d; run pz-logger migrate",
+		strings.Join(names, ", "), m.latest().Version)
+}
+
+func (m *Manager) create() (*Result, error) {
+	latest := m.latest()
+	mapping, err := latest.mapping(true)
+	if err != nil {
+		return nil, err
+	}
+	name := targetName(m.Alias, latest.Version)
+	err = m.store.createIndex(name, map[string]interface{}{
+		"mappings": map[string]interface{}{m.Type: mapping},
+		"aliases":  map[string]interface{}{m.Alias: map[string]interface{}{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Target: name, ToVersion: latest.Version}, nil
+}
+
+func (m *Manager) migrate(outdated []*IndexStatus) ([]*Result, error) {
+	results := []*Result{}
+	for _, status := range outdated {
+		result, err := m.migrateIndex(status)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (m *Manager) migrateIndex(status *IndexStatus) (*Result, error) {
+	if status.Index == m.Alias {
+		return nil, fmt.Errorf("%s is an index, not an alias, so it can't be migrated", m.Alias)
+	}
+
+	latest := m.latest()
+	result := &Result{
+		Index:       status.Index,
+		FromVersion: status.Version,
+		Target:      targetName(status.Index, latest.Version),
+		ToVersion:   latest.Version,
+	}
+
+	// the target may be left over from a migration that didn't finish
+	exists, err := m.store.indexExists(result.Target)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		version, err := m.version(result.Target)
+		if err != nil {
+			return nil, err
+		}
+		if version != latest.Version {
+			return nil, fmt.Errorf("%s already exists, at version %d", result.Target, version)
+		}
+	} else {
+		mapping, err := latest.mapping(true)
+		if err != nil {
+			return nil, err
+		}
+		err = m.store.createIndex(result.Target, map[string]interface{}{
+			"mappings": map[string]interface{}{m.Type: mapping},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transform := m.transform(status.Version)
+
+	if _, err = m.store.copyIndex(status.Index, result.Target, transform, m.progress(result, 1)); err != nil {
+		return nil, err
+	}
+	if len(status.Aliases) > 0 {
+		if err = m.store.moveAliases(status.Aliases, status.Index, result.Target); err != nil {
+			return nil, err
+		}
+	}
+	if result.Copied, err = m.store.copyIndex(status.Index, result.Target, transform, m.progress(result, 2)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// transform returns the Transforms of the versions after the given one,
+// run in order, or nil if none of them has one.
+func (m *Manager) transform(version int) func(map[string]interface{}) error {
+	transforms := []func(map[string]interface{}) error{}
+	for _, migration := range m.Migrations {
+		if migration.Version > version && migration.Transform != nil {
+			transforms = append(transforms, migration.Transform)
+		}
+	}
+	if len(transforms) == 0 {
+		return nil
+	}
+	return func(doc map[string]interface{}) error {
+		for _, transform := range transforms {
+			if err := transform(doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (m *Manager) progress(result *Result, pass int) func(int64, int64) {
+	if m.Progress == nil {
+		return nil
+	}
+	return func(done int64, total int64) {
+		m.Progress(&Progress{Index: result.Index, Target: result.Target, Pass: pass, Done: done, Total: total})
+	}
+}
+
+// version works out the version of an index's mapping: from its _meta if
+// it has one, or else by finding a version with the same mapping, as for
+// the indices made by the old db script.
+func (m *Manager) version(index string) (int, error) {
+	mapping, err := m.store.getMapping(index, m.Type)
+	if err != nil {
+		return 0, err
+	}
+	if mapping == nil {
+		return 0, fmt.Errorf("%s has no %s mapping", index, m.Type)
+	}
+
+	version := 0
+	if meta, ok := mapping["_meta"].(map[string]interface{}); ok {
+		if v, ok := meta[MetaVersionKey].(float64); ok {
+			version = int(v)
+		}
+	}
+
+	if version == 0 {
+		bare := map[string]interface{}{}
+		for key, value := range mapping {
+			if key != "_meta" {
+				bare[key] = value
+			}
+		}
+		for i := len(m.Migrations) - 1; i >= 0; i-- {
+			known, err := m.Migrations[i].mapping(false)
+			if err != nil {
+				return 0, err
+			}
+			if reflect.DeepEqual(known, bare) {
+				version = m.Migrations[i].Version
+				break
+			}
+		}
+		if version == 0 {
+			return 0, fmt.Errorf("%s mapping of %s is not one of the known versions", m.Type, index)
+		}
+	}
+
+	if version > m.latest().Version {
+		return 0, fmt.Errorf("%s is at version %d, newer than this pz-logger knows", index, version)
+	}
+	return version, nil
+}
+
+var versionSuffixRegexp = regexp.MustCompile(`_v[0-9]+$`)
+
+// targetName names the index an index is migrated to: its name, less any
+// version it already has, plus _v<version>.
+func targetName(index string, version int) string {
+	return fmt.Sprintf("%s_v%d", StripVersion(index), version)
+}
+
+// StripVersion returns an index name without the _v<version> that
+// migration gives it.
+func StripVersion(index string) string {
+	return versionSuffixRegexp.ReplaceAllString(index, "")
+}
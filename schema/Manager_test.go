@@ -0,0 +1,311 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeIndex struct {
+	mappings map[string]interface{} // type -> mapping
+	aliases  map[string]bool
+	docs     map[string]map[string]interface{}
+}
+
+// fakeStore keeps indices in memory.
+type fakeStore struct {
+	indices map[string]*fakeIndex
+	copies  int
+
+	// if set, called between the copies of a migration
+	onMove func()
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{indices: map[string]*fakeIndex{}}
+}
+
+func (fs *fakeStore) indexExists(name string) (bool, error) {
+	_, ok := fs.indices[name]
+	return ok, nil
+}
+
+func (fs *fakeStore) aliasIndices(alias string) ([]string, error) {
+	list := []string{}
+	for name, index := range fs.indices {
+		if index.aliases[alias] {
+			list = append(list, name)
+		}
+	}
+	return list, nil
+}
+
+func (fs *fakeStore) indexAliases(name string) ([]string, error) {
+	list := []string{}
+	for alias := range fs.indices[name].aliases {
+		list = append(list, alias)
+	}
+	return list, nil
+}
+
+func (fs *fakeStore) getMapping(name string, typ string) (map[string]interface{}, error) {
+	index, ok := fs.indices[name]
+	if !ok {
+		return nil, errors.New("no such index")
+	}
+	mapping, _ := index.mappings[typ].(map[string]interface{})
+	return mapping, nil
+}
+
+func (fs *fakeStore) createIndex(name string, body map[string]interface{}) error {
+	if _, ok := fs.indices[name]; ok {
+		return errors.New("index already exists")
+	}
+
+	// as Elasticsearch would keep it
+	byts, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var parsed struct {
+		Mappings map[string]interface{} `json:"mappings"`
+		Aliases  map[string]interface{} `json:"aliases"`
+	}
+	if err = json.Unmarshal(byts, &parsed); err != nil {
+		return err
+	}
+
+	index := &fakeIndex{mappings: parsed.Mappings, aliases: map[string]bool{}, docs: map[string]map[string]interface{}{}}
+	for alias := range parsed.Aliases {
+		index.aliases[alias] = true
+	}
+	fs.indices[name] = index
+	return nil
+}
+
+func (fs *fakeStore) moveAliases(aliases []string, from string, to string) error {
+	for _, alias := range aliases {
+		delete(fs.indices[from].aliases, alias)
+		fs.indices[to].aliases[alias] = true
+	}
+	if fs.onMove != nil {
+		fs.onMove()
+	}
+	return nil
+}
+
+func (fs *fakeStore) copyIndex(from string, to string, transform func(map[string]interface{}) error,
+	progress func(done int64, total int64)) (int64, error) {
+
+	fs.copies++
+	ids := []string{}
+	for id := range fs.indices[from].docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		doc := map[string]interface{}{}
+		for key, value := range fs.indices[from].docs[id] {
+			doc[key] = value
+		}
+		if transform != nil {
+			if err := transform(doc); err != nil {
+				return int64(i), err
+			}
+		}
+		fs.indices[to].docs[id] = doc
+		if progress != nil {
+			progress(int64(i+1), int64(len(ids)))
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+//---------------------------------------------------------------------------
+
+// newLegacyStore has the index the old db script made.
+func newLegacyStore(assert *assert.Assertions) *fakeStore {
+	fs := newFakeStore()
+	mapping, err := Migrations[0].mapping(false)
+	assert.NoError(err)
+	assert.NoError(fs.createIndex("pzlogger5", map[string]interface{}{
+		"mappings": map[string]interface{}{"LogData": mapping},
+		"aliases":  map[string]interface{}{"piazzalogger": map[string]interface{}{}},
+	}))
+	fs.indices["pzlogger5"].docs["1"] = map[string]interface{}{"severity": 3, "message": "one"}
+	fs.indices["pzlogger5"].docs["2"] = map[string]interface{}{"severity": 7, "message": "two"}
+	return fs
+}
+
+// withNext adds a version that renames message to text.
+func withNext() []*Migration {
+	return append(Migrations, &Migration{
+		Version:     Latest().Version + 1,
+		Description: "message is now text",
+		Mapping:     `{"dynamic": "strict", "properties": {"severity": {"type": "integer"}, "text": {"type": "string"}}}`,
+		Transform: func(doc map[string]interface{}) error {
+			doc["text"] = doc["message"]
+			delete(doc, "message")
+			return nil
+		},
+	})
+}
+
+func TestLatestMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping, err := LatestMapping()
+	assert.NoError(err)
+	assert.Equal("strict", mapping["dynamic"])
+	assert.Equal(map[string]interface{}{MetaVersionKey: Latest().Version}, mapping["_meta"])
+
+	assert.Equal("pzlogger-debug-2016.07.26", StripVersion("pzlogger-debug-2016.07.26_v2"))
+	assert.Equal("pzlogger5_v2", targetName("pzlogger5", 2))
+	assert.Equal("pzlogger5_v3", targetName("pzlogger5_v2", 3))
+}
+
+func TestManagerCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := newFakeStore()
+	m := &Manager{Alias: "pzlogger", Type: "LogData", Migrations: Migrations, store: fs}
+	assert.Error(m.Check())
+
+	results, err := m.Ensure(false)
+	assert.NoError(err)
+	if assert.Len(results, 1) {
+		assert.Equal("created pzlogger_v2 at version 2", results[0].String())
+	}
+
+	statuses, err := m.Status()
+	assert.NoError(err)
+	assert.Equal([]*IndexStatus{{Index: "pzlogger_v2", Version: 2, Aliases: []string{"pzlogger"}}}, statuses)
+
+	// nothing more to do
+	results, err = m.Ensure(false)
+	assert.NoError(err)
+	assert.Empty(results)
+}
+
+func TestManagerVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := newLegacyStore(assert)
+	m := &Manager{Alias: "piazzalogger", Type: "LogData", Migrations: Migrations, store: fs}
+
+	// no _meta, but the mapping is that of version 1
+	statuses, err := m.Status()
+	assert.NoError(err)
+	assert.Equal([]*IndexStatus{{Index: "pzlogger5", Version: 1, Aliases: []string{"piazzalogger"}}}, statuses)
+
+	// a mapping changed by hand
+	fs.indices["pzlogger5"].mappings["LogData"].(map[string]interface{})["dynamic"] = "true"
+	_, err = m.Status()
+	assert.Error(err)
+
+	// a mapping from a newer pz-logger
+	fs.indices["pzlogger5"].mappings["LogData"] = map[string]interface{}{
+		"_meta": map[string]interface{}{MetaVersionKey: 9.0},
+	}
+	_, err = m.Status()
+	assert.Error(err)
+
+	// the alias is an index
+	fs = newFakeStore()
+	assert.NoError(fs.createIndex("piazzalogger", map[string]interface{}{}))
+	m.store = fs
+	_, err = m.Status()
+	assert.Error(err)
+}
+
+func TestManagerMigrate(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := newLegacyStore(assert)
+	m := &Manager{Alias: "piazzalogger", Type: "LogData", Migrations: withNext(), store: fs}
+
+	// not unless asked
+	_, err := m.Ensure(false)
+	assert.Error(err)
+	assert.Len(fs.indices, 1)
+	assert.Error(m.Check())
+
+	progress := []Progress{}
+	m.Progress = func(p *Progress) {
+		progress = append(progress, *p)
+	}
+
+	// a message written while the first copy is going on
+	fs.onMove = func() {
+		fs.indices["pzlogger5"].docs["3"] = map[string]interface{}{"severity": 6, "message": "three"}
+	}
+
+	results, err := m.Ensure(true)
+	assert.NoError(err)
+	if assert.Len(results, 1) {
+		assert.Equal("migrated pzlogger5 from version 1 to pzlogger5_v3 at version 3, 3 documents copied",
+			results[0].String())
+	}
+	assert.Equal(2, fs.copies)
+	assert.Equal(Progress{Index: "pzlogger5", Target: "pzlogger5_v3", Pass: 1, Done: 2, Total: 2}, progress[1])
+	assert.Equal(Progress{Index: "pzlogger5", Target: "pzlogger5_v3", Pass: 2, Done: 3, Total: 3}, progress[4])
+
+	// the old index is kept, out of the alias
+	assert.Empty(fs.indices["pzlogger5"].aliases)
+	assert.Len(fs.indices["pzlogger5"].docs, 3)
+
+	statuses, err := m.Status()
+	assert.NoError(err)
+	assert.Equal([]*IndexStatus{{Index: "pzlogger5_v3", Version: 3, Aliases: []string{"piazzalogger"}}}, statuses)
+	assert.Equal(map[string]interface{}{"severity": 3, "text": "one"}, fs.indices["pzlogger5_v3"].docs["1"])
+	assert.Equal(map[string]interface{}{"severity": 6, "text": "three"}, fs.indices["pzlogger5_v3"].docs["3"])
+
+	// done
+	assert.NoError(m.Check())
+	results, err = m.Migrate()
+	assert.NoError(err)
+	assert.Empty(results)
+}
+
+func TestManagerMigrateFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := newLegacyStore(assert)
+	migrations := withNext()
+	migrations[2].Transform = func(doc map[string]interface{}) error {
+		return errors.New("no")
+	}
+	m := &Manager{Alias: "piazzalogger", Type: "LogData", Migrations: migrations, store: fs}
+
+	_, err := m.Migrate()
+	assert.Error(err)
+
+	// the alias stays where it was
+	assert.True(fs.indices["pzlogger5"].aliases["piazzalogger"])
+	assert.Empty(fs.indices["pzlogger5_v3"].aliases)
+
+	// and a second try picks up the index made by the first
+	migrations[2].Transform = nil
+	results, err := m.Migrate()
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.True(fs.indices["pzlogger5_v3"].aliases["piazzalogger"])
+}
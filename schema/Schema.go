@@ -0,0 +1,163 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema owns the mapping of the LogData type. Each change to the
+// mapping is a Migration, and the Manager brings the indices behind the
+// logger's alias up to the latest one, copying the documents of older
+// indices into new ones.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MetaVersionKey is where, in the _meta of the mapping, the version of
+// the schema is kept.
+const MetaVersionKey = "schemaVersion"
+
+// Migration is one version of the LogData mapping. Transform, if set,
+// rewrites each document of the version before so that it fits Mapping;
+// without one, documents are copied as they are.
+type Migration struct {
+	Version     int
+	Description string
+	Mapping     string // the type's mapping, less the _meta
+	Transform   func(doc map[string]interface{}) error
+}
+
+// Migrations are the versions of the mapping, oldest first. A new
+// version goes on the end; the old ones are never changed, since indices
+// made with them are told apart by their mappings.
+var Migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "the mapping the db scripts used to create",
+		Mapping:     logDataMappingV1,
+	},
+	{
+		Version:     2,
+		Description: "adds the tenant a message belongs to",
+		Mapping:     logDataMappingV2,
+	},
+}
+
+// Latest returns the newest of the Migrations.
+func Latest() *Migration {
+	return Migrations[len(Migrations)-1]
+}
+
+// LatestMapping returns the mapping of the newest version, with its _meta,
+// for the LogData type of a new index.
+func LatestMapping() (map[string]interface{}, error) {
+	return Latest().mapping(true)
+}
+
+// mapping parses the Migration's mapping, with or without the _meta
+// giving its version.
+func (migration *Migration) mapping(withMeta bool) (map[string]interface{}, error) {
+	mapping := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(migration.Mapping), &mapping); err != nil {
+		return nil, fmt.Errorf("schema version %d: %s", migration.Version, err.Error())
+	}
+	if withMeta {
+		mapping["_meta"] = map[string]interface{}{MetaVersionKey: migration.Version}
+	}
+	return mapping, nil
+}
+
+const logDataMappingV1 = `{
+	"dynamic": "strict",
+	"properties": {
+		"facility": {"type": "integer"},
+		"severity": {"type": "integer"},
+		"version": {"type": "integer"},
+		"timeStamp": {
+			"type": "date",
+			"format": "yyyy-MM-dd'T'HH:mm:ssZZ||yyyy-MM-dd'T'HH:mm:ss.SZZ||yyyy-MM-dd'T'HH:mm:ss.SSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSSZZ"
+		},
+		"hostName": {"index": "not_analyzed", "type": "string"},
+		"application": {"index": "not_analyzed", "type": "string"},
+		"process": {"index": "not_analyzed", "type": "string"},
+		"messageId": {"index": "not_analyzed", "type": "string"},
+		"auditData": {
+			"dynamic": "strict",
+			"properties": {
+				"actor": {"index": "not_analyzed", "type": "string"},
+				"actee": {"index": "not_analyzed", "type": "string"},
+				"action": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"metricData": {
+			"dynamic": "strict",
+			"properties": {
+				"name": {"index": "not_analyzed", "type": "string"},
+				"value": {"type": "double"},
+				"object": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"sourceData": {
+			"dynamic": "strict",
+			"properties": {
+				"file": {"index": "not_analyzed", "type": "string"},
+				"line": {"type": "integer"},
+				"function": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"message": {"index": "not_analyzed", "type": "string"}
+	}
+}`
+
+const logDataMappingV2 = `{
+	"dynamic": "strict",
+	"properties": {
+		"facility": {"type": "integer"},
+		"severity": {"type": "integer"},
+		"version": {"type": "integer"},
+		"timeStamp": {
+			"type": "date",
+			"format": "yyyy-MM-dd'T'HH:mm:ssZZ||yyyy-MM-dd'T'HH:mm:ss.SZZ||yyyy-MM-dd'T'HH:mm:ss.SSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSSZZ"
+		},
+		"hostName": {"index": "not_analyzed", "type": "string"},
+		"application": {"index": "not_analyzed", "type": "string"},
+		"process": {"index": "not_analyzed", "type": "string"},
+		"messageId": {"index": "not_analyzed", "type": "string"},
+		"auditData": {
+			"dynamic": "strict",
+			"properties": {
+				"actor": {"index": "not_analyzed", "type": "string"},
+				"actee": {"index": "not_analyzed", "type": "string"},
+				"action": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"metricData": {
+			"dynamic": "strict",
+			"properties": {
+				"name": {"index": "not_analyzed", "type": "string"},
+				"value": {"type": "double"},
+				"object": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"sourceData": {
+			"dynamic": "strict",
+			"properties": {
+				"file": {"index": "not_analyzed", "type": "string"},
+				"line": {"type": "integer"},
+				"function": {"index": "not_analyzed", "type": "string"}
+			}
+		},
+		"message": {"index": "not_analyzed", "type": "string"},
+		"tenant": {"index": "not_analyzed", "type": "string"}
+	}
+}`
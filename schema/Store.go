@@ -0,0 +1,148 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// store is what the Manager needs of Elasticsearch.
+type store interface {
+	indexExists(name string) (bool, error)
+
+	// aliasIndices returns the indices an alias points to, or none if
+	// there is no such alias
+	aliasIndices(alias string) ([]string, error)
+
+	// indexAliases returns the aliases of an index
+	indexAliases(index string) ([]string, error)
+
+	// getMapping returns the mapping of a type in an index, or nil if the
+	// index has no such type
+	getMapping(index string, typ string) (map[string]interface{}, error)
+
+	createIndex(name string, body map[string]interface{}) error
+
+	// moveAliases moves aliases from one index to another, all at once
+	moveAliases(aliases []string, from string, to string) error
+
+	// copyIndex copies each document of an index into another, keeping
+	// its type and ID, and returns the number copied
+	copyIndex(from string, to string, transform func(map[string]interface{}) error,
+		progress func(done int64, total int64)) (int64, error)
+}
+
+// elasticStore is store over the Elasticsearch index APIs.
+type elasticStore struct {
+	client *elastic.Client
+}
+
+func (es *elasticStore) indexExists(name string) (bool, error) {
+	return es.client.IndexExists(name).Do()
+}
+
+func (es *elasticStore) aliasIndices(alias string) ([]string, error) {
+	result, err := es.client.Aliases().Do()
+	if err != nil {
+		return nil, err
+	}
+	return result.IndicesByAlias(alias), nil
+}
+
+func (es *elasticStore) indexAliases(index string) ([]string, error) {
+	result, err := es.client.Aliases().Index(index).Do()
+	if err != nil {
+		return nil, err
+	}
+	aliases := []string{}
+	for _, alias := range result.Indices[index].Aliases {
+		aliases = append(aliases, alias.AliasName)
+	}
+	return aliases, nil
+}
+
+func (es *elasticStore) getMapping(index string, typ string) (map[string]interface{}, error) {
+	result, err := es.client.GetMapping().Index(index).Type(typ).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	// {index: {"mappings": {typ: mapping}}}
+	indexMap, ok := result[index].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	mappings, ok := indexMap["mappings"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	mapping, ok := mappings[typ].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	return mapping, nil
+}
+
+func (es *elasticStore) createIndex(name string, body map[string]interface{}) error {
+	_, err := es.client.CreateIndex(name).BodyJson(body).Do()
+	return err
+}
+
+func (es *elasticStore) moveAliases(aliases []string, from string, to string) error {
+	service := es.client.Alias()
+	for _, alias := range aliases {
+		service.Remove(from, alias)
+		service.Add(to, alias)
+	}
+	_, err := service.Do()
+	return err
+}
+
+func (es *elasticStore) copyIndex(from string, to string, transform func(map[string]interface{}) error,
+	progress func(done int64, total int64)) (int64, error) {
+
+	copyHit := func(hit *elastic.SearchHit, bulk *elastic.BulkService) error {
+		if hit.Source == nil {
+			return fmt.Errorf("document %s has no source", hit.Id)
+		}
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+			return err
+		}
+		if transform != nil {
+			if err := transform(doc); err != nil {
+				return fmt.Errorf("document %s: %s", hit.Id, err.Error())
+			}
+		}
+		bulk.Add(elastic.NewBulkIndexRequest().Index(to).Type(hit.Type).Id(hit.Id).Doc(doc))
+		return nil
+	}
+
+	reindexer := elastic.NewReindexer(es.client, from, copyHit)
+	if progress != nil {
+		reindexer.Progress(progress)
+	}
+	resp, err := reindexer.Do()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Failed > 0 {
+		return resp.Success, fmt.Errorf("%d documents could not be copied from %s to %s", resp.Failed, from, to)
+	}
+	return resp.Success, nil
+}